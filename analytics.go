@@ -1,13 +1,20 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/csv"
 	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/vmihailenco/msgpack.v2"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,21 +24,33 @@ type AnalyticsRecord struct {
 	Path          string
 	ContentLength int64
 	UserAgent     string
+	IPAddress     string
+	TLSVersion    string
+	TLSCipher     string
+	RequestID     string
 	Day           int
 	Month         time.Month
 	Year          int
 	Hour          int
 	ResponseCode  int
+	IsError       bool
+	GRPCStatus    string
+	Mocked        bool
 	APIKey        string
+	Alias         string
 	TimeStamp     time.Time
 	APIVersion    string
+	VersionSource string
+	NotVersioned  bool
 	APIName       string
 	APIID         string
 	OrgID         string
 	OauthID       string
 	RequestTime   int64
+	QueueTime     int64
 	RawRequest    string
 	RawResponse   string
+	CaptureError  string
 	Tags          []string
 	ExpireAt      time.Time `bson:"expireAt" json:"expireAt"`
 }
@@ -40,6 +59,112 @@ const (
 	ANALYTICS_KEYNAME string = "tyk-system-analytics"
 )
 
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+}
+
+var tlsCipherNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+}
+
+// requestTLSDetails returns the TLS version and cipher suite the client connected with, both are
+// empty for plain HTTP and values we have no name for are recorded in hex
+func requestTLSDetails(r *http.Request) (string, string) {
+	if r.TLS == nil {
+		return "", ""
+	}
+
+	version, found := tlsVersionNames[r.TLS.Version]
+	if !found {
+		version = fmt.Sprintf("0x%04X", r.TLS.Version)
+	}
+	cipher, found := tlsCipherNames[r.TLS.CipherSuite]
+	if !found {
+		cipher = fmt.Sprintf("0x%04X", r.TLS.CipherSuite)
+	}
+	return version, cipher
+}
+
+// versionResolution tells how the API version of a request was found, the source is the version
+// location of the API definition ("header", "url-param" or "url"). A request to an API that isn't
+// versioned gets its only version, this is returned as notVersioned with an empty source. Both are
+// empty if the version wasn't resolved, e.g. the request was refused before the version check.
+func versionResolution(r *http.Request) (source string, notVersioned bool) {
+	value, found := context.GetOk(r, VersionSourceData)
+	if !found {
+		return "", false
+	}
+
+	source = value.(string)
+	return source, source == ""
+}
+
+// queueTime is how many milliseconds a request waited for an upstream connection slot, it is 0 if
+// it didn't have to wait or never got as far as the upstream
+func queueTime(r *http.Request) int64 {
+	waited, ok := context.Get(r, QueueTimeData).(time.Duration)
+	if !ok {
+		return 0
+	}
+	return int64(waited / time.Millisecond)
+}
+
+var defaultErrorStatusCodes = []string{"5xx"}
+
+// IsErrorStatusCode tells if a response code counts as an error for analytics and health checks.
+// The codes are set with error_status_codes as classes ("4xx", "5xx") or exact codes ("404"), the
+// default is 5xx.
+func IsErrorStatusCode(code int) bool {
+	errorCodes := config.ErrorStatusCodes
+	if len(errorCodes) == 0 {
+		errorCodes = defaultErrorStatusCodes
+	}
+
+	return statusCodeInList(code, errorCodes)
+}
+
+// IsBreakerFailureCode tells if a response code counts as a failure for a circuit breaker, only
+// the codes set in error_status_codes do. Without them a breaker keeps counting just 500s.
+func IsBreakerFailureCode(code int) bool {
+	if len(config.ErrorStatusCodes) == 0 {
+		return code == 500
+	}
+
+	return statusCodeInList(code, config.ErrorStatusCodes)
+}
+
+func statusCodeInList(code int, errorCodes []string) bool {
+	codeStr := strconv.Itoa(code)
+	for _, errorCode := range errorCodes {
+		errorCode = strings.ToLower(strings.TrimSpace(errorCode))
+		if errorCode == codeStr {
+			return true
+		}
+		if len(errorCode) == 3 && len(codeStr) == 3 && strings.HasSuffix(errorCode, "xx") && errorCode[0] == codeStr[0] {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (a *AnalyticsRecord) SetExpiry(expiresInSeconds int64) {
 	var expiry time.Duration
 
@@ -77,8 +202,9 @@ type Purger interface {
 // RedisAnalyticsHandler implements AnalyticsHandler and will record analytics
 // data to a redis back end as defined in the Config object
 type RedisAnalyticsHandler struct {
-	Store *RedisClusterStorageManager
-	Clean Purger
+	Store      *RedisClusterStorageManager
+	Clean      Purger
+	SetKeyName string
 }
 
 // RecordHit will store an AnalyticsRecord in Redis
@@ -104,11 +230,273 @@ func (r RedisAnalyticsHandler) RecordHit(thisRecord AnalyticsRecord) error {
 		return AnalyticsError{}
 	}
 
-	r.Store.AppendToSet(ANALYTICS_KEYNAME, string(encoded))
+	analyticsKeyName := ANALYTICS_KEYNAME
+	if r.SetKeyName != "" {
+		analyticsKeyName = r.SetKeyName
+	}
+	if err := r.Store.AppendToSet(analyticsKeyName, string(encoded)); err != nil {
+		return AnalyticsError{}
+	}
 
 	return nil
 }
 
+// analyticsDropLogSampleRate means only every nth dropped record is logged so that a store
+// outage doesn't flood the logs
+const analyticsDropLogSampleRate = 100
+
+var analyticsRecordsDropped int64
+
+// AnalyticsRecordsDropped is the number of analytics records that could not be stored since startup
+func AnalyticsRecordsDropped() int64 {
+	return atomic.LoadInt64(&analyticsRecordsDropped)
+}
+
+// debugRecordingMinSecretLength stops a trivial (or empty) debug recording secret from being used
+const debugRecordingMinSecretLength = 32
+
+// debugRecordingEnabled is only true if a debug recording header and a long enough secret have
+// been configured
+func debugRecordingEnabled() bool {
+	if config.AnalyticsConfig.DebugRecordingHeader == "" {
+		return false
+	}
+
+	return len(config.AnalyticsConfig.DebugRecordingSecret) >= debugRecordingMinSecretLength
+}
+
+// checkDebugRecordingHeader is true if the request has the debug recording header with the right
+// secret. The header is always removed so that the secret is neither recorded nor proxied.
+func checkDebugRecordingHeader(r *http.Request) bool {
+	headerName := config.AnalyticsConfig.DebugRecordingHeader
+	if headerName == "" {
+		return false
+	}
+
+	provided := r.Header.Get(headerName)
+	if provided == "" {
+		return false
+	}
+	r.Header.Del(headerName)
+
+	if !debugRecordingEnabled() {
+		log.Warning("Debug recording requested, but debug_recording_secret is too short to be used")
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(config.AnalyticsConfig.DebugRecordingSecret)) != 1 {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+		}).Warning("Debug recording requested with an invalid secret")
+		return false
+	}
+
+	return true
+}
+
+// DetailedRecording is true if the request and response should be recorded in full, either because
+// enable_detailed_recording is on or because the request asked for it with the debug recording
+// header. The header is checked once per request.
+func DetailedRecording(r *http.Request) bool {
+	debugRecord, found := context.GetOk(r, DebugRecordData)
+	if !found {
+		debugRecord = checkDebugRecordingHeader(r)
+		context.Set(r, DebugRecordData, debugRecord)
+	}
+
+	return config.AnalyticsConfig.EnableDetailedRecording || debugRecord.(bool)
+}
+
+const defaultMaxRecordedBodySize = 1 << 20
+
+// MaxRecordedBodySize is how much of a response body detailed recording keeps, set with
+// analytics_config.max_recorded_body_size
+func MaxRecordedBodySize() int {
+	if config.AnalyticsConfig.MaxRecordedBodySize > 0 {
+		return config.AnalyticsConfig.MaxRecordedBodySize
+	}
+	return defaultMaxRecordedBodySize
+}
+
+// analyticsTagsTruncated holds the APIs that have already been warned about truncated tags
+var analyticsTagsTruncated = make(map[string]bool)
+var analyticsTagsTruncatedLock sync.Mutex
+
+// limitAnalyticsTags truncates the tags of a record to analytics_config.max_tags tags and
+// max_tags_size bytes in total, so a misconfigured policy can't bloat every record. A limit of 0
+// means no limit. The first truncation for an API is logged as a warning, later ones at debug level.
+func limitAnalyticsTags(spec *APISpec, tags []string) []string {
+	maxTags := config.AnalyticsConfig.MaxTags
+	maxSize := config.AnalyticsConfig.MaxTagsSize
+
+	limit := len(tags)
+	if maxTags > 0 && limit > maxTags {
+		limit = maxTags
+	}
+	if maxSize > 0 {
+		size := 0
+		for i := 0; i < limit; i++ {
+			size += len(tags[i])
+			if size > maxSize {
+				limit = i
+				break
+			}
+		}
+	}
+
+	if limit == len(tags) {
+		return tags
+	}
+
+	analyticsTagsTruncatedLock.Lock()
+	warned := analyticsTagsTruncated[spec.APIID]
+	analyticsTagsTruncated[spec.APIID] = true
+	analyticsTagsTruncatedLock.Unlock()
+
+	fields := logrus.Fields{
+		"api_id":    spec.APIID,
+		"tags":      len(tags),
+		"tags_kept": limit,
+	}
+	if warned {
+		log.WithFields(fields).Debug("Analytics record has too many tags, truncating")
+	} else {
+		log.WithFields(fields).Warning("Analytics record has too many tags, truncating, further truncation for this API is logged at debug level")
+	}
+
+	return tags[:limit]
+}
+
+// recordAnalytics sends the record to the API's sink and counts it as dropped if that fails
+func recordAnalytics(spec *APISpec, thisRecord AnalyticsRecord) {
+	thisRecord.Tags = limitAnalyticsTags(spec, thisRecord.Tags)
+
+	err := GetAnalyticsSink(spec).RecordHit(thisRecord)
+	if err == nil {
+		return
+	}
+
+	dropped := atomic.AddInt64(&analyticsRecordsDropped, 1)
+	if dropped == 1 || dropped%analyticsDropLogSampleRate == 0 {
+		log.WithFields(logrus.Fields{
+			"api_id":        spec.APIID,
+			"total_dropped": dropped,
+		}).Error("Failed to record analytics, record dropped: ", err)
+	}
+}
+
+var analyticsRecordsPending int64
+
+// queueAnalyticsRecord stores a record off the request goroutine, records that haven't been
+// stored yet are counted so they can be flushed on shutdown
+func queueAnalyticsRecord(spec *APISpec, thisRecord AnalyticsRecord) {
+	atomic.AddInt64(&analyticsRecordsPending, 1)
+	go func() {
+		defer atomic.AddInt64(&analyticsRecordsPending, -1)
+		recordAnalytics(spec, thisRecord)
+	}()
+}
+
+const defaultShutdownFlushTimeout = 5
+
+// FlushAnalytics waits up to timeout for queued records to be stored and then purges the analytics
+// handlers one last time, it returns how many queued records were flushed and how many were dropped
+func FlushAnalytics(timeout time.Duration) (int64, int64) {
+	deadline := time.Now().Add(timeout)
+	pending := atomic.LoadInt64(&analyticsRecordsPending)
+	for atomic.LoadInt64(&analyticsRecordsPending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dropped := atomic.LoadInt64(&analyticsRecordsPending)
+	flushed := pending - dropped
+	if flushed < 0 {
+		flushed = 0
+	}
+
+	if config.AnalyticsConfig.PurgeDelay >= 0 {
+		purged := make(chan struct{})
+		go func() {
+			purgeAnalyticsHandlers()
+			close(purged)
+		}()
+		select {
+		case <-purged:
+		case <-time.After(deadline.Sub(time.Now())):
+			log.Warning("Timed out purging analytics on shutdown")
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"flushed": flushed,
+		"dropped": dropped,
+	}).Info("Flushed analytics before shutdown")
+
+	return flushed, dropped
+}
+
+// purgeAnalyticsHandlers runs the purger of the default handler and of every sink that has one
+func purgeAnalyticsHandlers() {
+	if analytics.Clean != nil {
+		analytics.Clean.PurgeCache()
+	}
+	for _, thisSink := range AnalyticsSinks {
+		if redisSink, ok := thisSink.(RedisAnalyticsHandler); ok && redisSink.Clean != nil {
+			redisSink.Clean.PurgeCache()
+		}
+	}
+}
+
+// AnalyticsSinks are the named analytics handlers that an API can route its records to
+var AnalyticsSinks = make(map[string]AnalyticsHandler)
+
+// RegisterAnalyticsSink makes an AnalyticsHandler available to APIs under name, this is
+// how custom sinks are plugged in
+func RegisterAnalyticsSink(name string, handler AnalyticsHandler) {
+	AnalyticsSinks[name] = handler
+}
+
+// GetAnalyticsSink returns the handler an API's records should be sent to, this is the
+// default handler unless the API Definition names a registered sink
+func GetAnalyticsSink(spec *APISpec) AnalyticsHandler {
+	if spec.Options.AnalyticsSink != "" {
+		thisSink, found := AnalyticsSinks[spec.Options.AnalyticsSink]
+		if found {
+			return thisSink
+		}
+		log.Warning("Analytics sink not found, using default: ", spec.Options.AnalyticsSink)
+	}
+
+	return analytics
+}
+
+// setupAnalyticsSinks creates a Redis-backed handler with a Mongo purger for every sink in the config,
+// sinks are only set up with the mongo analytics type
+func setupAnalyticsSinks(AnalyticsStore *RedisClusterStorageManager) {
+	if config.AnalyticsConfig.Type != "mongo" {
+		if len(config.AnalyticsConfig.Sinks) > 0 {
+			log.Warning("Analytics sinks are purged to MongoDB and need the mongo analytics type, they will not be used")
+		}
+		return
+	}
+
+	for sinkName, sinkConf := range config.AnalyticsConfig.Sinks {
+		log.Info("Setting up analytics sink: ", sinkName)
+		setKeyName := ANALYTICS_KEYNAME + "-" + sinkName
+		thisSink := RedisAnalyticsHandler{
+			Store:      AnalyticsStore,
+			SetKeyName: setKeyName,
+			Clean:      &MongoPurger{AnalyticsStore, nil, sinkConf.MongoCollection, setKeyName, sinkConf.MongoURL},
+		}
+		RegisterAnalyticsSink(sinkName, thisSink)
+
+		if config.AnalyticsConfig.PurgeDelay >= 0 {
+			go thisSink.Clean.StartPurgeLoop(config.AnalyticsConfig.PurgeDelay)
+		}
+	}
+}
+
 // CSVPurger purges the in-memory analytics store to a CSV file as defined in the Config object
 type CSVPurger struct {
 	Store *RedisClusterStorageManager
@@ -185,12 +573,18 @@ type MongoPurger struct {
 	dbSession      *mgo.Session
 	CollectionName string
 	SetKeyName     string
+	MongoURL       string
 }
 
 // Connect Connects to Mongo
 func (m *MongoPurger) Connect() {
+	mongoURL := config.AnalyticsConfig.MongoURL
+	if m.MongoURL != "" {
+		mongoURL = m.MongoURL
+	}
+
 	var err error
-	m.dbSession, err = mgo.Dial(config.AnalyticsConfig.MongoURL)
+	m.dbSession, err = mgo.Dial(mongoURL)
 	if err != nil {
 		log.Error("Mongo connection failed:", err)
 		time.Sleep(5)
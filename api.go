@@ -74,7 +74,7 @@ func GetSpecForOrg(APIID string) *APISpec {
 func checkAndApplyTrialPeriod(keyName string, apiId string, newSession *SessionState) {
 	// Check the policy to see if we are forcing an expiry on the key
 	if newSession.ApplyPolicyID != "" {
-		thisPolicy, foundPolicy := Policies[newSession.ApplyPolicyID]
+		thisPolicy, foundPolicy := GetPolicy(newSession.ApplyPolicyID)
 		if foundPolicy {
 			// Are we foring an expiry?
 			if thisPolicy.KeyExpiresIn > 0 {
@@ -90,6 +90,29 @@ func checkAndApplyTrialPeriod(keyName string, apiId string, newSession *SessionS
 	}
 }
 
+// resetQuotaGroup clears the quota shared by the group of a key (or of its policy) on the APIs the
+// key has access to, the quota of every key in the group is reset
+func resetQuotaGroup(newSession SessionState) {
+	if policy, found := GetPolicy(newSession.ApplyPolicyID); found {
+		newSession.SharedQuotaGroup = policy.SharedQuotaGroup
+	}
+	if newSession.SharedQuotaGroup == "" {
+		return
+	}
+
+	if len(newSession.AccessRights) == 0 {
+		for _, spec := range *ApiSpecRegister {
+			spec.SessionManager.ResetQuotaGroup(&newSession)
+		}
+		return
+	}
+	for apiId := range newSession.AccessRights {
+		if thisAPISpec := GetSpecForApi(apiId); thisAPISpec != nil {
+			thisAPISpec.SessionManager.ResetQuotaGroup(&newSession)
+		}
+	}
+}
+
 func doAddOrUpdate(keyName string, newSession SessionState, dontReset bool) error {
 	if len(newSession.AccessRights) > 0 {
 		// We have a specific list of access rules, only add / update those
@@ -103,7 +126,7 @@ func doAddOrUpdate(keyName string, newSession SessionState, dontReset bool) erro
 				if !thisAPISpec.DontSetQuotasOnCreate {
 					// Reset quote by default
 					if !dontReset {
-						thisAPISpec.SessionManager.ResetQuota(keyName, newSession)
+						thisAPISpec.SessionManager.ResetQuota(keyName, &newSession)
 						newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
 					}
 
@@ -126,7 +149,7 @@ func doAddOrUpdate(keyName string, newSession SessionState, dontReset bool) erro
 			log.Warning("No API Access Rights set, adding key to ALL.")
 			for _, spec := range *ApiSpecRegister {
 				if !dontReset {
-					spec.SessionManager.ResetQuota(keyName, newSession)
+					spec.SessionManager.ResetQuota(keyName, &newSession)
 					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
 				}
 				checkAndApplyTrialPeriod(keyName, spec.APIID, &newSession)
@@ -231,10 +254,17 @@ func handleAddOrUpdate(keyName string, r *http.Request) ([]byte, int) {
 		if dont_reset == "1" {
 			suppress_reset = true
 		}
+		if _, _, found, overrideErr := rateOverride(&newSession); found && overrideErr != nil {
+			log.Error("Invalid session meta data: ", overrideErr)
+			return createError(overrideErr.Error()), 400
+		}
+
 		addUpdateErr := doAddOrUpdate(keyName, newSession, suppress_reset)
 		if addUpdateErr != nil {
 			success = false
 			responseMessage = createError("Failed to create key, ensure security settings are correct.")
+		} else if r.FormValue("reset_quota_group") == "1" {
+			resetQuotaGroup(newSession)
 		}
 	}
 
@@ -894,7 +924,7 @@ func handleOrgAddOrUpdate(keyName string, r *http.Request) ([]byte, int) {
 
 		do_reset := r.FormValue("reset_quota")
 		if do_reset == "1" {
-			thisSessionManager.ResetQuota(keyName, newSession)
+			thisSessionManager.ResetQuota(keyName, &newSession)
 			newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
 			rawKey := QuotaKeyPrefix + publicHash(keyName)
 
@@ -1126,7 +1156,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 						// If we have enabled HMAC checking for keys, we need to generate a secret for the client to use
 						if !thisAPISpec.DontSetQuotasOnCreate {
 							// Reset quota by default
-							thisAPISpec.SessionManager.ResetQuota(newKey, newSession)
+							thisAPISpec.SessionManager.ResetQuota(newKey, &newSession)
 							newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
 						}
 						err := thisAPISpec.SessionManager.UpdateSession(newKey, newSession, thisAPISpec.SessionLifetime)
@@ -1152,7 +1182,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 						checkAndApplyTrialPeriod(newKey, spec.APIID, &newSession)
 						if !spec.DontSetQuotasOnCreate {
 							// Reset quote by default
-							spec.SessionManager.ResetQuota(newKey, newSession)
+							spec.SessionManager.ResetQuota(newKey, &newSession)
 							newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
 						}
 						err := spec.SessionManager.UpdateSession(newKey, newSession, spec.SessionLifetime)
@@ -1197,6 +1227,227 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 	DoJSONWrite(w, code, responseMessage)
 }
 
+// JWTSessionRequest asks for the virtual session of a centralised JWT identity to be created
+// before the identity makes its first request
+type JWTSessionRequest struct {
+	APIID    string `json:"api_id"`
+	Identity string `json:"identity"`
+	PolicyID string `json:"policy_id"`
+}
+
+func createJWTSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	var sessionRequest JWTSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&sessionRequest); err != nil {
+		log.Error("Couldn't decode body: ", err)
+		DoJSONWrite(w, 400, createError("Request malformed"))
+		return
+	}
+
+	if sessionRequest.Identity == "" {
+		DoJSONWrite(w, 400, createError("An identity is required"))
+		return
+	}
+
+	thisAPISpec := GetSpecForApi(sessionRequest.APIID)
+	if thisAPISpec == nil {
+		DoJSONWrite(w, 404, createError("API doesn't exist"))
+		return
+	}
+
+	sessionID := JWTSessionID(thisAPISpec.OrgID, sessionRequest.Identity)
+	action := "added"
+	if _, found := thisAPISpec.SessionManager.GetSessionDetail(sessionID); found {
+		action = "modified"
+	}
+
+	if _, err := CreateJWTVirtualSession(thisAPISpec, sessionID, sessionRequest.PolicyID); err != nil {
+		log.WithFields(logrus.Fields{
+			"apiID":  sessionRequest.APIID,
+			"policy": sessionRequest.PolicyID,
+		}).Error("Failed to create JWT session: ", err)
+		DoJSONWrite(w, 400, createError("Failed to create session - "+err.Error()))
+		return
+	}
+
+	responseMessage, err := json.Marshal(&APIModifyKeySuccess{Key: sessionID, Status: "ok", Action: action})
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
+
+// JWTRevocationRequest revokes the tokens that have a jti or sub claim with Value, on every API of
+// the organisation that owns APIID. The revocation is removed after TTL seconds, set it to the
+// time the token has left so that it expires with the token, 0 keeps it until it is deleted.
+type JWTRevocationRequest struct {
+	APIID string `json:"api_id"`
+	Claim string `json:"claim"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl"`
+}
+
+// jwtRevocationHandler adds (POST with a JWTRevocationRequest) and removes (DELETE with api_id,
+// claim and value parameters) token revocations
+func jwtRevocationHandler(w http.ResponseWriter, r *http.Request) {
+	var revocation JWTRevocationRequest
+	switch r.Method {
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&revocation); err != nil {
+			log.Error("Couldn't decode body: ", err)
+			DoJSONWrite(w, 400, createError("Request malformed"))
+			return
+		}
+	case "DELETE":
+		revocation.APIID = r.FormValue("api_id")
+		revocation.Claim = r.FormValue("claim")
+		revocation.Value = r.FormValue("value")
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	validClaim := false
+	for _, claim := range JWTRevocableClaims {
+		validClaim = validClaim || revocation.Claim == claim
+	}
+	if !validClaim || revocation.Value == "" {
+		DoJSONWrite(w, 400, createError("A claim (jti or sub) and value are required"))
+		return
+	}
+
+	thisAPISpec := GetSpecForApi(revocation.APIID)
+	if thisAPISpec == nil {
+		DoJSONWrite(w, 404, createError("API doesn't exist"))
+		return
+	}
+
+	store := thisAPISpec.SessionManager.GetStore()
+	revocationKey := JWTRevocationKey(thisAPISpec.OrgID, revocation.Claim, revocation.Value)
+	action := "revoked"
+	if r.Method == "DELETE" {
+		store.DeleteRawKey(revocationKey)
+		action = "unrevoked"
+	} else if err := store.SetRawKey(revocationKey, "1", revocation.TTL); err != nil {
+		log.Error("Failed to store token revocation: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"org_id": thisAPISpec.OrgID,
+		"claim":  revocation.Claim,
+		"value":  revocation.Value,
+	}).Info("Token ", action)
+
+	responseMessage, err := json.Marshal(&APIStatusMessage{Status: "ok", Message: "Token " + action})
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
+
+// JWTValidationRequest is a token to check against an API with validateJWTHandler
+type JWTValidationRequest struct {
+	APIID string `json:"api_id"`
+	Token string `json:"token"`
+}
+
+// JWTValidationResult is the outcome of checking a token, it never includes the session itself
+type JWTValidationResult struct {
+	Valid    bool   `json:"valid"`
+	Code     int    `json:"code"`
+	Identity string `json:"identity,omitempty"`
+	PolicyID string `json:"policy_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// validateJWTHandler runs a token through the JWT middleware of an API without proxying the
+// request, so developers can find out why a token is rejected
+func validateJWTHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	var validationRequest JWTValidationRequest
+	if err := json.NewDecoder(r.Body).Decode(&validationRequest); err != nil {
+		log.Error("Couldn't decode body: ", err)
+		DoJSONWrite(w, 400, createError("Request malformed"))
+		return
+	}
+
+	thisAPISpec := GetSpecForApi(validationRequest.APIID)
+	if thisAPISpec == nil {
+		DoJSONWrite(w, 404, createError("API doesn't exist"))
+		return
+	}
+	if !thisAPISpec.EnableJWT {
+		DoJSONWrite(w, 400, createError("API doesn't use JWT authentication"))
+		return
+	}
+
+	result := validateJWTForAPI(r, thisAPISpec, validationRequest.Token)
+
+	responseMessage, err := json.Marshal(&result)
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
+
+// validateJWTForAPI checks a token the same way the API's JWT middleware does for a live request,
+// without firing events, reporting to the health check or creating and caching sessions
+func validateJWTForAPI(r *http.Request, spec *APISpec, token string) JWTValidationResult {
+	jwtMiddleware := &JWTMiddleware{&TykMiddleware{spec, nil}}
+	configuration, confErr := jwtMiddleware.GetConfig()
+	if confErr != nil {
+		return JWTValidationResult{Code: 500, Error: "JWT configuration is invalid"}
+	}
+	thisModuleConfig := configuration.(JWTMiddlewareConfig)
+	thisModuleConfig.validateOnly = true
+
+	check := jwtMiddleware.checkJWT(thisModuleConfig, r, stripAuthScheme(token, thisModuleConfig.JWTAuthSchemes))
+	policyIDs := sessionPolicies(check.session)
+	detail := check.tokenErr
+	if check.err == nil && check.needsVirtualSession {
+		// The middleware would create the session from the token's policies
+		policyIDs = tokenPolicies(thisModuleConfig, check.token)
+		if sessionErr := checkVirtualSession(spec, policyIDs); sessionErr != nil {
+			check.err, check.code = errors.New("Key not authorised"), 403
+			detail = sessionErr
+		}
+	}
+
+	if check.err != nil {
+		result := JWTValidationResult{Code: check.code, Error: check.err.Error()}
+		if detail != nil {
+			result.Detail = detail.Error()
+		}
+		return result
+	}
+
+	result := JWTValidationResult{Valid: true, Code: 200, Identity: check.tykId}
+	if len(policyIDs) == 1 {
+		result.PolicyID = policyIDs[0]
+	}
+	return result
+}
+
 // NewClientRequest is an outward facing JSON object translated from osin OAuthClients
 type NewClientRequest struct {
 	ClientRedirectURI string `json:"redirect_uri"`
@@ -1542,6 +1793,8 @@ func healthCheckhandler(w http.ResponseWriter, r *http.Request) {
 				thisAPISpec := GetSpecForApi(APIID)
 				if thisAPISpec != nil {
 					health, _ := thisAPISpec.Health.GetApiHealthValues()
+					// In-flight upstream requests are only known to this node
+					health.UpstreamInFlight = thisAPISpec.UpstreamLimiter.InFlight()
 					var jsonErr error
 					responseMessage, jsonErr = json.Marshal(health)
 					if jsonErr != nil {
@@ -1567,6 +1820,27 @@ func healthCheckhandler(w http.ResponseWriter, r *http.Request) {
 	DoJSONWrite(w, code, responseMessage)
 }
 
+// policyValidationHandler lists the policy_per_api entries that were skipped when the policies
+// were loaded
+func policyValidationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	policiesMu.RLock()
+	issues := PolicyPerAPIIssues
+	policiesMu.RUnlock()
+
+	responseMessage, err := json.Marshal(issues)
+	if err != nil {
+		DoJSONWrite(w, 500, createError("Failed to encode data"))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
+
 func UserRatesCheck() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		code := 200
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	b64 "encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/context"
 	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
 	"github.com/rubyist/circuitbreaker"
+	"golang.org/x/net/http2"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"io/ioutil"
@@ -46,6 +49,8 @@ const (
 	URLRewrite             URLStatus = 11
 	VirtualPath            URLStatus = 12
 	RequestSizeLimit       URLStatus = 13
+	ValidateJSONRequest    URLStatus = 14
+	MockResponse           URLStatus = 15
 )
 
 // RequestStatus is a custom type to avoid collisions
@@ -104,22 +109,45 @@ type ExtendedCircuitBreakerMeta struct {
 	CB *circuit.Breaker
 }
 
+// ExtendedAPIOptions are gateway options for an API that are read from the raw API Definition
+type ExtendedAPIOptions struct {
+	AnalyticsSink          string                   `mapstructure:"analytics_sink" bson:"analytics_sink" json:"analytics_sink"`
+	MaxUpstreamConnections int                      `mapstructure:"max_upstream_connections" bson:"max_upstream_connections" json:"max_upstream_connections"`
+	UpstreamQueueTimeout   int                      `mapstructure:"upstream_queue_timeout" bson:"upstream_queue_timeout" json:"upstream_queue_timeout"`
+	UpstreamHTTP2          bool                     `mapstructure:"upstream_http2" bson:"upstream_http2" json:"upstream_http2"`
+	UpstreamTLS            UpstreamTLSOptions       `mapstructure:"upstream_tls" bson:"upstream_tls" json:"upstream_tls"`
+	RequestTimeout         int                      `mapstructure:"request_timeout" bson:"request_timeout" json:"request_timeout"`
+	ResponseHeaders        []ResponseHeaderOptions  `mapstructure:"response_headers" bson:"response_headers" json:"response_headers"`
+	MaxRequestHeaders      int                      `mapstructure:"max_request_headers" bson:"max_request_headers" json:"max_request_headers"`
+	MaxRequestHeaderSize   int                      `mapstructure:"max_request_header_size" bson:"max_request_header_size" json:"max_request_header_size"`
+	StrictPolicies         bool                     `mapstructure:"strict_policies" bson:"strict_policies" json:"strict_policies"`
+	UpstreamRewrites       []UpstreamRewriteOptions `mapstructure:"upstream_rewrites" bson:"upstream_rewrites" json:"upstream_rewrites"`
+	PathNormalization      PathNormalizationOptions `mapstructure:"path_normalization" bson:"path_normalization" json:"path_normalization"`
+	MaxSessionLifetime     int64                    `mapstructure:"max_session_lifetime" bson:"max_session_lifetime" json:"max_session_lifetime"`
+}
+
 // APISpec represents a path specification for an API, to avoid enumerating multiple nested lists, a single
 // flattened URL list is checked for matching paths and then it's status evaluated if found.
 type APISpec struct {
 	tykcommon.APIDefinition
-	RxPaths           map[string][]URLSpec
-	WhiteListEnabled  map[string]bool
-	target            *url.URL
-	AuthManager       AuthorisationHandler
-	SessionManager    SessionHandler
-	OAuthManager      *OAuthManager
-	OrgSessionManager SessionHandler
-	EventPaths        map[tykcommon.TykEvent][]TykEventHandler
-	Health            HealthChecker
-	JSVM              *JSVM
-	ResponseChain     *[]TykResponseHandler
-	RoundRobin        *RoundRobin
+	RxPaths                map[string][]URLSpec
+	WhiteListEnabled       map[string]bool
+	target                 *url.URL
+	AuthManager            AuthorisationHandler
+	SessionManager         SessionHandler
+	OAuthManager           *OAuthManager
+	OrgSessionManager      SessionHandler
+	EventPaths             map[tykcommon.TykEvent][]TykEventHandler
+	Health                 HealthChecker
+	JSVM                   *JSVM
+	ResponseChain          *[]TykResponseHandler
+	RoundRobin             *RoundRobin
+	Options                ExtendedAPIOptions
+	UpstreamLimiter        *UpstreamLimiter
+	UpstreamTLSConfig      *tls.Config
+	UpstreamTLSError       error
+	UpstreamTransport      http.RoundTripper
+	UpstreamHTTP2Transport http.RoundTripper
 }
 
 // APIDefinitionLoader will load an Api definition from a storage system. It has two methods LoadDefinitionsFromMongo()
@@ -152,6 +180,26 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 	newAppSpec := APISpec{}
 	newAppSpec.APIDefinition = thisAppConfig
 
+	// Options that aren't part of the common definition are read from the raw data
+	if decodeErr := mapstructure.Decode(thisAppConfig.RawData, &newAppSpec.Options); decodeErr != nil {
+		log.Error("Failed to decode extended API options: ", decodeErr)
+	}
+	newAppSpec.UpstreamLimiter = NewUpstreamLimiter(newAppSpec.Options.MaxUpstreamConnections, newAppSpec.Options.UpstreamQueueTimeout)
+	newAppSpec.Options.UpstreamRewrites = compileUpstreamRewrites(newAppSpec.Name, newAppSpec.Options.UpstreamRewrites)
+
+	if newAppSpec.Options.UpstreamTLS.InsecureSkipVerify {
+		log.Warning("Upstream certificate verification is DISABLED for API ", newAppSpec.Name, ", connections to it can be intercepted!")
+	}
+	if tlsConfig, tlsErr := NewUpstreamTLSConfig(newAppSpec.Options.UpstreamTLS); tlsErr != nil {
+		// Falling back to the default transport would drop the client certificate or trust other CAs
+		log.Error("Failed to load upstream TLS settings for API ", newAppSpec.Name, ", requests to it will be refused: ", tlsErr)
+		newAppSpec.UpstreamTLSError = tlsErr
+	} else if tlsConfig != nil {
+		newAppSpec.UpstreamTLSConfig = tlsConfig
+		newAppSpec.UpstreamTransport = NewUpstreamTransport(tlsConfig)
+		newAppSpec.UpstreamHTTP2Transport = &http2.Transport{TLSClientConfig: tlsConfig}
+	}
+
 	// We'll push the default HealthChecker:
 	newAppSpec.Health = &DefaultHealthChecker{
 		APIID: newAppSpec.APIID,
@@ -172,14 +220,14 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 	if newAppSpec.APIDefinition.SessionProvider.Name != "" {
 		switch newAppSpec.APIDefinition.SessionProvider.Name {
 		case DefaultSessionProvider:
-			newAppSpec.SessionManager = &DefaultSessionManager{}
+			newAppSpec.SessionManager = &DefaultSessionManager{MaxLifetime: newAppSpec.Options.MaxSessionLifetime}
 			newAppSpec.OrgSessionManager = &DefaultSessionManager{}
 		default:
-			newAppSpec.SessionManager = &DefaultSessionManager{}
+			newAppSpec.SessionManager = &DefaultSessionManager{MaxLifetime: newAppSpec.Options.MaxSessionLifetime}
 			newAppSpec.OrgSessionManager = &DefaultSessionManager{}
 		}
 	} else {
-		newAppSpec.SessionManager = &DefaultSessionManager{}
+		newAppSpec.SessionManager = &DefaultSessionManager{MaxLifetime: newAppSpec.Options.MaxSessionLifetime}
 		newAppSpec.OrgSessionManager = &DefaultSessionManager{}
 	}
 
@@ -191,22 +239,7 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 
 	// Set up Event Handlers
 	log.Debug("INITIALISING EVENT HANDLERS")
-	newAppSpec.EventPaths = make(map[tykcommon.TykEvent][]TykEventHandler)
-	for eventName, eventHandlerConfs := range thisAppConfig.EventHandlers.Events {
-		log.Debug("FOUND EVENTS TO INIT")
-		for _, handlerConf := range eventHandlerConfs {
-			log.Debug("CREATING EVENT HANDLERS")
-			thisEventHandlerInstance, getHandlerErr := GetEventHandlerByName(handlerConf, &newAppSpec)
-
-			if getHandlerErr != nil {
-				log.Error("Failed to init event handler: ", getHandlerErr)
-			} else {
-				log.Debug("Init Event Handler: ", eventName)
-				newAppSpec.EventPaths[eventName] = append(newAppSpec.EventPaths[eventName], thisEventHandlerInstance)
-			}
-
-		}
-	}
+	newAppSpec.EventPaths = InitEventHandlers(thisAppConfig.EventHandlers, &newAppSpec)
 
 	newAppSpec.RxPaths = make(map[string][]URLSpec)
 	newAppSpec.WhiteListEnabled = make(map[string]bool)
@@ -1030,6 +1063,11 @@ func (a *APISpec) GetVersionData(r *http.Request) (*tykcommon.VersionInfo, *[]UR
 		// Lets save this for the future
 		context.Set(r, VersionData, thisVersion)
 		context.Set(r, VersionKeyContext, versionKey)
+		if a.APIDefinition.VersionData.NotVersioned {
+			context.Set(r, VersionSourceData, "")
+		} else {
+			context.Set(r, VersionSourceData, a.APIDefinition.VersionDefinition.Location)
+		}
 	}
 
 	// Load path data and whitelist data for version
@@ -14,6 +14,8 @@ const (
 	KeyFailure        HealthPrefix = "KeyFailure"
 	RequestLog        HealthPrefix = "Request"
 	BlockedRequestLog HealthPrefix = "BlockedRequest"
+	UpstreamError     HealthPrefix = "UpstreamError"
+	JWKCacheEviction  HealthPrefix = "JWKCacheEviction"
 
 	HealthCheckRedisPrefix string = "apihealth"
 )
@@ -30,6 +32,9 @@ type HealthCheckValues struct {
 	KeyFailuresPS       float64 `bson:"key_failures_per_second,omitempty" json:"key_failures_per_second"`
 	AvgUpstreamLatency  float64 `bson:"average_upstream_latency,omitempty" json:"average_upstream_latency"`
 	AvgRequestsPS       float64 `bson:"average_requests_per_second,omitempty" json:"average_requests_per_second"`
+	UpstreamErrorsPS    float64 `bson:"upstream_errors_per_second,omitempty" json:"upstream_errors_per_second"`
+	UpstreamInFlight    int64   `bson:"upstream_connections_in_flight,omitempty" json:"upstream_connections_in_flight"`
+	JWKCacheEvictionsPS float64 `bson:"jwk_cache_evictions_per_second,omitempty" json:"jwk_cache_evictions_per_second"`
 }
 
 type DefaultHealthChecker struct {
@@ -115,6 +120,8 @@ func (h *DefaultHealthChecker) GetApiHealthValues() (HealthCheckValues, error) {
 	values.QuotaViolationsPS = h.getAvgCount(QuotaViolation)
 	values.KeyFailuresPS = h.getAvgCount(KeyFailure)
 	values.AvgRequestsPS = h.getAvgCount(RequestLog)
+	values.UpstreamErrorsPS = h.getAvgCount(UpstreamError)
+	values.JWKCacheEvictionsPS = h.getAvgCount(JWKCacheEviction)
 
 	// Get the micro latency graph, an average upstream latency
 	searchStr := strings.Join([]string{h.APIID, string(RequestLog)}, ".")
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/lonelycode/tykcommon"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 var apiTestDef string = `
@@ -255,6 +257,24 @@ func TestKeyHandlerUpdateKey(t *testing.T) {
 	}
 }
 
+func TestKeyHandlerInvalidRateOverride(t *testing.T) {
+	sampleKey := createSampleSession()
+	sampleKey.MetaData = map[string]interface{}{RateOverrideMetaKey: map[string]interface{}{"rate": 100}}
+	body, _ := json.Marshal(&sampleKey)
+
+	recorder := httptest.NewRecorder()
+	param := make(url.Values)
+	MakeSampleAPI()
+	param.Set("api_id", "1")
+	req, _ := http.NewRequest("POST", "/tyk/keys/1234"+param.Encode(), strings.NewReader(string(body)))
+
+	keyHandler(recorder, req)
+
+	if recorder.Code != 400 {
+		t.Error("A rate override without per should be refused, got: ", recorder.Code, recorder.Body.String())
+	}
+}
+
 func createKey() {
 	uri := "/tyk/keys/1234"
 	method := "POST"
@@ -380,3 +400,167 @@ func TestAPIAuthOk(t *testing.T) {
 		t.Error("Access to API should have been blocked, but response code was: ", recorder.Code)
 	}
 }
+
+func TestCreateJWTSessionHandler(t *testing.T) {
+	spec := MakeSampleAPI()
+	Policies["jwt-preseed-policy"] = Policy{ID: "jwt-preseed-policy", OrgID: spec.OrgID, Rate: 50, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-preseed-policy")
+
+	identity := randSeq(10)
+	for _, tc := range []struct {
+		policyID string
+		code     int
+		action   string
+	}{
+		{"jwt-preseed-policy", 200, "added"},
+		{"jwt-preseed-policy", 200, "modified"},
+		{"missing-policy", 400, ""},
+	} {
+		body := `{"api_id": "1", "identity": "` + identity + `", "policy_id": "` + tc.policyID + `"}`
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/tyk/jwt/sessions", strings.NewReader(body))
+		createJWTSessionHandler(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("Policy %v: expected %v, got %v", tc.policyID, tc.code, recorder.Code)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+
+		newSuccess := Success{}
+		json.Unmarshal(recorder.Body.Bytes(), &newSuccess)
+		if newSuccess.Key != JWTSessionID(spec.OrgID, identity) || newSuccess.Action != tc.action {
+			t.Error("Unexpected response: ", recorder.Body.String())
+		}
+	}
+
+	thisSession, found := spec.SessionManager.GetSessionDetail(JWTSessionID(spec.OrgID, identity))
+	if !found || thisSession.Rate != 50 {
+		t.Error("Session was not preseeded from the policy: ", thisSession, found)
+	}
+}
+
+func TestValidateJWTHandler(t *testing.T) {
+	spec := createDefinitionFromString(jwtDef)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+
+	oldRegister := ApiSpecRegister
+	ApiSpecRegister = &map[string]*APISpec{spec.APIID: &spec}
+	defer func() { ApiSpecRegister = oldRegister }()
+
+	Policies["jwt-validate-policy"] = Policy{ID: "jwt-validate-policy", OrgID: spec.OrgID, Rate: 50, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-validate-policy")
+
+	keyId := randSeq(10)
+	thisSession := createJWTSession()
+	thisSession.ApplyPolicyID = "jwt-validate-policy"
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	signed := func(secret string) string {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = keyId
+		token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, _ := token.SignedString([]byte(secret))
+		return tokenString
+	}
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		code     int
+		valid    bool
+		identity string
+		policyID string
+	}{
+		{"valid token", `{"api_id": "` + spec.APIID + `", "token": "` + signed(JWTSECRET) + `"}`, 200, true, keyId, "jwt-validate-policy"},
+		{"wrong secret", `{"api_id": "` + spec.APIID + `", "token": "` + signed("not-the-secret") + `"}`, 200, false, "", ""},
+		{"unknown API", `{"api_id": "does-not-exist", "token": "abc"}`, 404, false, "", ""},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/tyk/jwt/validate", strings.NewReader(tc.body))
+		validateJWTHandler(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+			continue
+		}
+		if strings.Contains(recorder.Body.String(), JWTSECRET) {
+			t.Errorf("%v: response must not include the secret", tc.name)
+		}
+		if tc.code != 200 {
+			continue
+		}
+
+		var result JWTValidationResult
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		if result.Valid != tc.valid || result.Identity != tc.identity || result.PolicyID != tc.policyID {
+			t.Errorf("%v: unexpected result %+v", tc.name, result)
+		}
+		if !tc.valid && (result.Error == "" || result.Detail == "") {
+			t.Errorf("%v: a rejected token should say why, got %+v", tc.name, result)
+		}
+	}
+}
+
+func TestValidateJWTHasNoSideEffects(t *testing.T) {
+	server, _ := createJWKSource(t, "validate-kid")
+	defer server.Close()
+
+	Policies["jwt-validate-virtual"] = Policy{ID: "jwt-validate-virtual", OrgID: "default", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-validate-virtual")
+
+	defer func() { config.LocalSessionCache.NegativeCacheTimeout = 0 }()
+	config.LocalSessionCache.NegativeCacheTimeout = 60
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol"`)
+	spec.JWTSigningMethod = "rsa"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	reasons := make(chan AuthFailureReason, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_AuthFailure: {authFailureRecorder{reasons}}}
+
+	identity := randSeq(10) + "@example.com"
+	sessionID := JWTSessionID("default", identity)
+	req, _ := http.NewRequest("POST", "/tyk/jwt/validate", nil)
+
+	valid := validateJWTForAPI(req, &spec, createJWKSourcedTokenWithClaims(t, "validate-kid", map[string]interface{}{"email": identity, "pol": "jwt-validate-virtual"}))
+	if !valid.Valid || valid.Identity != sessionID || valid.PolicyID != "jwt-validate-virtual" {
+		t.Error("Unexpected result for a valid token: ", valid)
+	}
+
+	missingPolicy := validateJWTForAPI(req, &spec, createJWKSourcedTokenWithClaims(t, "validate-kid", map[string]interface{}{"email": identity, "pol": "missing-policy"}))
+	if missingPolicy.Valid || missingPolicy.Code != 403 || missingPolicy.Detail == "" {
+		t.Error("Expected a token with an unknown policy to be refused with the reason: ", missingPolicy)
+	}
+
+	badKid := validateJWTForAPI(req, &spec, createJWKSourcedTokenWithClaims(t, "no-such-kid", map[string]interface{}{"email": identity}))
+	if badKid.Valid || badKid.Code != 403 {
+		t.Error("Expected a token with an unknown kid to be refused: ", badKid)
+	}
+
+	if _, found := spec.SessionManager.GetSessionDetail(sessionID); found {
+		t.Error("Validating a token must not create a session")
+	}
+	if _, found := SessionCache.Get(sessionID); found {
+		t.Error("Validating a token must not cache a session")
+	}
+	if _, found := NegativeAuthCache.Get(sessionID); found {
+		t.Error("Validating a token must not add to the negative cache")
+	}
+	if _, unknown := jwkUnknownKIDs.Get(jwkCacheKey(server.URL) + "#no-such-kid"); unknown {
+		t.Error("Validating a token must not remember unknown kids")
+	}
+	select {
+	case reason := <-reasons:
+		t.Error("Validating a token must not fire events, got: ", reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
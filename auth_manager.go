@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"github.com/Sirupsen/logrus"
 	"github.com/nu7hatch/gouuid"
 	"strings"
 	"time"
@@ -27,7 +28,8 @@ type SessionHandler interface {
 	GetSessionDetail(keyName string) (SessionState, bool)
 	GetSessions(filter string) []string
 	GetStore() StorageHandler
-	ResetQuota(string, SessionState)
+	ResetQuota(string, *SessionState)
+	ResetQuotaGroup(*SessionState)
 }
 
 type KeyGenerator interface {
@@ -43,6 +45,9 @@ type DefaultAuthorisationManager struct {
 
 type DefaultSessionManager struct {
 	Store StorageHandler
+	// MaxLifetime caps how long a session lives after it was first saved, whatever the API or policy
+	// asks for, 0 disables the cap
+	MaxLifetime int64
 }
 
 func (b *DefaultAuthorisationManager) Init(store StorageHandler) {
@@ -65,6 +70,11 @@ func (b DefaultAuthorisationManager) IsKeyAuthorised(keyName string) (SessionSta
 		return newSession, false
 	}
 
+	if decryptErr := decryptSessionSecrets(&newSession); decryptErr != nil {
+		log.Error("Couldn't decrypt session secrets: ", decryptErr)
+		return SessionState{}, false
+	}
+
 	return newSession, true
 }
 
@@ -89,8 +99,12 @@ func (b *DefaultSessionManager) GetStore() StorageHandler {
 	return b.Store
 }
 
-func (b *DefaultSessionManager) ResetQuota(keyName string, session SessionState) {
+// ResetQuota clears the quota counters of a key. The count on the session is cleared as well,
+// otherwise quota reconciliation would take the new counter for one that lost writes. The counter
+// of a shared quota group is left alone, it is reset with ResetQuotaGroup.
+func (b *DefaultSessionManager) ResetQuota(keyName string, session *SessionState) {
 	log.Warning("Tracked quota reset for key: ", keyName)
+	session.QuotaUsed = 0
 	rawKey := QuotaKeyPrefix + publicHash(keyName)
 	log.Info("Setting key quota: ", rawKey)
 
@@ -99,23 +113,98 @@ func (b *DefaultSessionManager) ResetQuota(keyName string, session SessionState)
 	go b.Store.DeleteRawKey(rateLimiterSentinelKey)
 	// Fix the raw key
 	go b.Store.DeleteRawKey(rawKey)
+	go b.Store.DeleteRawKey(QuotaRollingPrefix + rawKey)
 	//go b.Store.SetKey(rawKey, "0", session.QuotaRenewalRate)
 }
 
+// ResetQuotaGroup clears the quota counters shared by the quota group of a session, so every key
+// in the group starts again from nothing
+func (b *DefaultSessionManager) ResetQuotaGroup(session *SessionState) {
+	if session.SharedQuotaGroup == "" {
+		return
+	}
+
+	rawKey := quotaKeyForSession("", session)
+	log.Warning("Tracked quota reset for quota group: ", rawKey)
+	session.QuotaUsed = 0
+	go b.Store.DeleteRawKey(rawKey)
+	go b.Store.DeleteRawKey(QuotaRollingPrefix + rawKey)
+}
+
 // UpdateSession updates the session state in the storage engine
 func (b DefaultSessionManager) UpdateSession(keyName string, session SessionState, resetTTLTo int64) error {
+	// Secrets are only ever stored encrypted, the session passed in keeps the plaintext
+	if encryptErr := encryptSessionSecrets(&session); encryptErr != nil {
+		log.Error("Couldn't encrypt session secrets, session not saved: ", encryptErr)
+		return encryptErr
+	}
+
+	if session.DateCreated == 0 {
+		session.DateCreated = time.Now().Unix()
+	}
+	// The expiry goes with the session, so the cap holds on APIs that share it but don't set one
+	if b.MaxLifetime > 0 {
+		if capEnd := session.DateCreated + b.MaxLifetime; session.Expires <= 0 || session.Expires > capEnd {
+			session.Expires = capEnd
+		}
+	}
+
 	v, _ := json.Marshal(session)
 
-	// Keep the TTL
+	resetTTLTo, alive := b.cappedTTL(keyName, session, resetTTLTo)
+	if !alive {
+		log.WithFields(logrus.Fields{
+			"key":          keyName,
+			"max_lifetime": b.MaxLifetime,
+		}).Info("Session has reached max_session_lifetime, removing it")
+		b.Store.DeleteKey(keyName)
+		return nil
+	}
+
+	// Keep the TTL. A new key must not be blocked by an earlier miss, which is only forgotten once
+	// the key is in the store so a request in between can't cache the miss again.
 	if config.UseAsyncSessionWrite {
-		go b.Store.SetKey(keyName, string(v), int64(resetTTLTo))
+		go func() {
+			if err := b.Store.SetKey(keyName, string(v), int64(resetTTLTo)); err == nil {
+				invalidateNegativeAuthResult(keyName)
+			}
+		}()
 		return nil
 	}
 	err := b.Store.SetKey(keyName, string(v), int64(resetTTLTo))
+	if err == nil {
+		invalidateNegativeAuthResult(keyName)
+	}
 	return err
 
 }
 
+// cappedTTL returns the TTL a session can be saved with under MaxLifetime, which counts from when
+// the session was first saved. It is false once the session has outlived the cap.
+func (b DefaultSessionManager) cappedTTL(keyName string, session SessionState, resetTTLTo int64) (int64, bool) {
+	if b.MaxLifetime <= 0 {
+		return resetTTLTo, true
+	}
+
+	remaining := session.DateCreated + b.MaxLifetime - time.Now().Unix()
+	if remaining <= 0 {
+		return 0, false
+	}
+	if resetTTLTo > 0 && resetTTLTo <= remaining {
+		return resetTTLTo, true
+	}
+
+	// Sessions that would never expire get the cap without a log, it applies to every one of them
+	if resetTTLTo > 0 {
+		log.WithFields(logrus.Fields{
+			"key":          keyName,
+			"ttl":          resetTTLTo,
+			"max_lifetime": b.MaxLifetime,
+		}).Info("Session lifetime capped by max_session_lifetime")
+	}
+	return remaining, true
+}
+
 func (b DefaultSessionManager) RemoveSession(keyName string) {
 	b.Store.DeleteKey(keyName)
 }
@@ -134,6 +223,11 @@ func (b DefaultSessionManager) GetSessionDetail(keyName string) (SessionState, b
 		return thisSession, false
 	}
 
+	if decryptErr := decryptSessionSecrets(&thisSession); decryptErr != nil {
+		log.Error("Couldn't decrypt session secrets: ", decryptErr)
+		return SessionState{}, false
+	}
+
 	return thisSession, true
 }
 
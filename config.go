@@ -6,7 +6,6 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"strings"
 )
 
 // Config is the configuration object used by tyk to set up various parameters.
@@ -19,6 +18,12 @@ type Config struct {
 	Policies       struct {
 		PolicySource     string `json:"policy_source"`
 		PolicyRecordName string `json:"policy_record_name"`
+		ReloadRetryAfter int    `json:"reload_retry_after"`
+		LazyLoad         bool   `json:"lazy_load"`
+		LazyCacheTTL     int    `json:"lazy_cache_ttl"`
+		// EmptyAccessRights is how a policy without access rights is read when it doesn't say
+		// itself, "allow" (the default) gives access to every API and "deny" to none
+		EmptyAccessRights string `json:"empty_access_rights"`
 	} `json:"policies"`
 	UseDBAppConfigs  bool `json:"use_db_app_configs"`
 	DBAppConfOptions struct {
@@ -40,23 +45,43 @@ type Config struct {
 	} `json:"storage"`
 	EnableAnalytics bool `json:"enable_analytics"`
 	AnalyticsConfig struct {
-		Type                    string   `json:"type"`
-		CSVDir                  string   `json:"csv_dir"`
-		MongoURL                string   `json:"mongo_url"`
-		MongoDbName             string   `json:"mongo_db_name"`
-		MongoCollection         string   `json:"mongo_collection"`
-		PurgeDelay              int      `json:"purge_delay"`
-		IgnoredIPs              []string `json:"ignored_ips"`
-		EnableDetailedRecording bool     `json:"enable_detailed_recording"`
+		Type                    string                         `json:"type"`
+		CSVDir                  string                         `json:"csv_dir"`
+		MongoURL                string                         `json:"mongo_url"`
+		MongoDbName             string                         `json:"mongo_db_name"`
+		MongoCollection         string                         `json:"mongo_collection"`
+		PurgeDelay              int                            `json:"purge_delay"`
+		IgnoredIPs              []string                       `json:"ignored_ips"`
+		EnableDetailedRecording bool                           `json:"enable_detailed_recording"`
+		Sinks                   map[string]AnalyticsSinkConfig `json:"sinks"`
+		MaxTags                 int                            `json:"max_tags"`
+		MaxTagsSize             int                            `json:"max_tags_size"`
+		MaxRecordedBodySize     int                            `json:"max_recorded_body_size"`
+		DebugRecordingHeader    string                         `json:"debug_recording_header"`
+		DebugRecordingSecret    string                         `json:"debug_recording_secret"`
+		ShutdownFlushTimeout    int                            `json:"shutdown_flush_timeout"`
 		ignoredIPsCompiled      map[string]bool
 	} `json:"analytics_config"`
 	HealthCheck struct {
 		EnableHealthChecks      bool  `json:"enable_health_checks"`
 		HealthCheckValueTimeout int64 `json:"health_check_value_timeouts"`
 	} `json:"health_check"`
-	UseAsyncSessionWrite            bool   `json:"optimisations_use_async_session_write"`
+	UseAsyncSessionWrite bool     `json:"optimisations_use_async_session_write"`
+	TrustedProxies       []string `json:"trusted_proxies"`
+	trustedProxyNets     []*net.IPNet
+	ErrorStatusCodes     []string `json:"error_status_codes"`
+	RequestIDHeader      string   `json:"request_id_header"`
+	SessionWriteRetry    struct {
+		MaxRetries   int  `json:"max_retries"`
+		BackoffMs    int  `json:"backoff_ms"`
+		MaxBackoffMs int  `json:"max_backoff_ms"`
+		FailClosed   bool `json:"fail_closed"`
+	} `json:"session_write_retry"`
+	QuotaReconciliation             string `json:"quota_reconciliation"`
 	AllowMasterKeys                 bool   `json:"allow_master_keys"`
 	HashKeys                        bool   `json:"hash_keys"`
+	JWTSecretEncryptionKey          string `json:"jwt_secret_encryption_key"`
+	StrictAuthHeaders               bool   `json:"strict_auth_headers"`
 	SuppressRedisSignalReload       bool   `json:"suppress_redis_signal_reload"`
 	SupressDefaultOrgStore          bool   `json:"suppress_default_org_store"`
 	SentryCode                      string `json:"sentry_code"`
@@ -79,12 +104,15 @@ type Config struct {
 		RPCKey           string `json:"rpc_key"`
 		APIKey           string `json:"api_key"`
 		EnableRPCCache   bool   `json:"enable_rpc_cache"`
+		PolicyCacheFile  string `json:"policy_cache_file"`
 	} `json:"slave_options"`
 	DisableVirtualPathBlobs bool `json:"disable_virtual_path_blobs"`
 	LocalSessionCache       struct {
 		DisableCacheSessionState bool `json:"disable_cached_session_state"`
 		CachedSessionTimeout     int  `json:"cached_session_timeout"`
 		CacheSessionEviction     int  `json:"cached_session_eviction"`
+		NegativeCacheTimeout     int  `json:"negative_cache_timeout"`
+		NegativeCacheMaxEntries  int  `json:"negative_cache_max_entries"`
 	} `json:"local_session_cache"`
 
 	HttpServerOptions struct {
@@ -96,6 +124,7 @@ type Config struct {
 		ServerName       string     `json:"server_name"`
 		MinVersion       uint16     `json:"min_version"`
 		FlushInterval    int        `json:"flush_interval"`
+		EnableHTTP2      bool       `json:"enable_http2"`
 	} `json:"http_server_options"`
 	ServiceDiscovery struct {
 		DefaultCacheTimeout int `json:"default_cache_timeout"`
@@ -121,6 +150,24 @@ type Config struct {
 	ControlAPIHostname   string `json:"control_api_hostname"`
 	EnableCustomDomains  bool   `json:"enable_custom_domains"`
 	EnableJSVM           bool   `json:"enable_jsvm"`
+	DevMode              bool   `json:"dev_mode"`
+	DevModeOptions       struct {
+		JWTBypassHeader string `json:"jwt_bypass_header"`
+		JWTBypassSecret string `json:"jwt_bypass_secret"`
+	} `json:"dev_mode_options"`
+	JWTAllowDefaultSigningMethod bool                             `json:"jwt_allow_default_signing_method"`
+	JWKFetchConcurrency          int                              `json:"jwk_fetch_concurrency"`
+	JWKCacheMaxSources           int                              `json:"jwk_cache_max_sources"`
+	JWKCacheTTL                  int                              `json:"jwk_cache_ttl"`
+	JWKCachePurgeInterval        int                              `json:"jwk_cache_purge_interval"`
+	EventHandlers                tykcommon.EventHandlerMetaConfig `json:"event_handlers"`
+}
+
+// AnalyticsSinkConfig configures a dedicated analytics store that APIs can opt in to
+// with `analytics_sink` in their definition, records are purged to their own Mongo collection
+type AnalyticsSinkConfig struct {
+	MongoURL        string `json:"mongo_url"`
+	MongoCollection string `json:"mongo_collection"`
 }
 
 type CertData struct {
@@ -190,6 +237,10 @@ func (c *Config) loadIgnoredIPs() {
 	}
 }
 
+func (c *Config) loadTrustedProxies() {
+	c.trustedProxyNets = ParseIPNets(c.TrustedProxies)
+}
+
 func (c *Config) TestShowIPs() {
 	log.Warning(c.AnalyticsConfig.ignoredIPsCompiled)
 }
@@ -199,15 +250,7 @@ func (c Config) StoreAnalytics(r *http.Request) bool {
 		return false
 	}
 
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-
-	forwarded := r.Header.Get("X-FORWARDED-FOR")
-	if forwarded != "" {
-		ips := strings.Split(forwarded, ", ")
-		ip = ips[0]
-	}
-
-	_, ignore := c.AnalyticsConfig.ignoredIPsCompiled[ip]
+	_, ignore := c.AnalyticsConfig.ignoredIPsCompiled[GetClientIP(r)]
 
 	return !ignore
 }
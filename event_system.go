@@ -20,16 +20,22 @@ const (
 
 // Register new event types here, the string is the code used to hook at the Api Deifnititon JSON/BSON level
 const (
-	EVENT_QuotaExceeded     tykcommon.TykEvent = "QuotaExceeded"
-	EVENT_RateLimitExceeded tykcommon.TykEvent = "RatelimitExceeded"
-	EVENT_AuthFailure       tykcommon.TykEvent = "AuthFailure"
-	EVENT_KeyExpired        tykcommon.TykEvent = "KeyExpired"
-	EVENT_VersionFailure    tykcommon.TykEvent = "VersionFailure"
-	EVENT_OrgQuotaExceeded  tykcommon.TykEvent = "OrgQuotaExceeded"
-	EVENT_TriggerExceeded   tykcommon.TykEvent = "TriggerExceeded"
-	EVENT_BreakerTriggered  tykcommon.TykEvent = "BreakerTriggered"
-	EVENT_HOSTDOWN          tykcommon.TykEvent = "HostDown"
-	EVENT_HOSTUP            tykcommon.TykEvent = "HostUp"
+	EVENT_QuotaExceeded          tykcommon.TykEvent = "QuotaExceeded"
+	EVENT_QuotaGraceUsed         tykcommon.TykEvent = "QuotaGraceUsed"
+	EVENT_RateLimitExceeded      tykcommon.TykEvent = "RatelimitExceeded"
+	EVENT_AuthFailure            tykcommon.TykEvent = "AuthFailure"
+	EVENT_KeyExpired             tykcommon.TykEvent = "KeyExpired"
+	EVENT_VersionFailure         tykcommon.TykEvent = "VersionFailure"
+	EVENT_OrgRateLimitExceeded   tykcommon.TykEvent = "OrgRateLimitExceeded"
+	EVENT_OrgQuotaExceeded       tykcommon.TykEvent = "OrgQuotaExceeded"
+	EVENT_TriggerExceeded        tykcommon.TykEvent = "TriggerExceeded"
+	EVENT_BreakerTriggered       tykcommon.TykEvent = "BreakerTriggered"
+	EVENT_HOSTDOWN               tykcommon.TykEvent = "HostDown"
+	EVENT_HOSTUP                 tykcommon.TykEvent = "HostUp"
+	EVENT_IPAccessDenied         tykcommon.TykEvent = "IPAccessDenied"
+	EVENT_SessionWriteFailed     tykcommon.TykEvent = "SessionWriteFailed"
+	EVENT_RequestHeadersTooLarge tykcommon.TykEvent = "RequestHeadersTooLarge"
+	EVENT_JWKSourceFailing       tykcommon.TykEvent = "JWKSourceFailing"
 )
 
 // EventMetaDefault is a standard embedded struct to be used with custom event metadata types, gives an interface for
@@ -52,6 +58,14 @@ type EVENT_QuotaExceededMeta struct {
 	Key    string
 }
 
+// EVENT_QuotaGraceUsedMeta is the metadata structure for a request let through by quota grace (EVENT_QuotaGraceUsed)
+type EVENT_QuotaGraceUsedMeta struct {
+	EventMetaDefault
+	Path   string
+	Origin string
+	Key    string
+}
+
 // EVENT_RateLimitExceededMeta is the metadata structure for a rate limit exceeded event (EVENT_RateLimitExceeded)
 type EVENT_RateLimitExceededMeta struct {
 	EventMetaDefault
@@ -60,12 +74,65 @@ type EVENT_RateLimitExceededMeta struct {
 	Key    string
 }
 
+// AuthFailureReason is a code for why a request failed authentication, it lets alerting tell
+// likely attacks (bad signatures) apart from legitimate clients with expired tokens
+type AuthFailureReason string
+
+const (
+	AuthFailureMissingCredentials AuthFailureReason = "missing_credentials"
+	AuthFailureMalformedToken     AuthFailureReason = "malformed_token"
+	AuthFailureUnverifiable       AuthFailureReason = "unverifiable_token"
+	AuthFailureBadSignature       AuthFailureReason = "bad_signature"
+	AuthFailureExpired            AuthFailureReason = "expired"
+	AuthFailureInvalidClaims      AuthFailureReason = "invalid_claims"
+	AuthFailureKeyNotFound        AuthFailureReason = "key_not_found"
+	AuthFailureBadPassword        AuthFailureReason = "bad_password"
+	AuthFailureIPNotAllowed       AuthFailureReason = "ip_not_allowed"
+	AuthFailureRevoked            AuthFailureReason = "revoked"
+	AuthFailureTokenConflict      AuthFailureReason = "token_conflict"
+)
+
 // EVENT_AuthFailureMeta is the metadata structure for an auth failure (EVENT_AuthFailure)
 type EVENT_AuthFailureMeta struct {
 	EventMetaDefault
 	Path   string
 	Origin string
 	Key    string
+	Reason AuthFailureReason
+}
+
+// EVENT_IPAccessDeniedMeta is the metadata structure for a client IP rejected by an API access list (EVENT_IPAccessDenied)
+type EVENT_IPAccessDeniedMeta struct {
+	EventMetaDefault
+	Path   string
+	Origin string
+}
+
+// EVENT_RequestHeadersTooLargeMeta is the metadata structure for a request over the header limits (EVENT_RequestHeadersTooLarge)
+type EVENT_RequestHeadersTooLargeMeta struct {
+	EventMetaDefault
+	Path        string
+	Origin      string
+	HeaderCount int
+	HeaderSize  int
+}
+
+// EVENT_SessionWriteFailedMeta is the metadata structure for a session that could not be saved (EVENT_SessionWriteFailed)
+type EVENT_SessionWriteFailedMeta struct {
+	EventMetaDefault
+	Path   string
+	Origin string
+	Key    string
+	Error  string
+}
+
+// EVENT_JWKSourceFailingMeta is the metadata structure for a JWT source that keeps failing to fetch (EVENT_JWKSourceFailing)
+type EVENT_JWKSourceFailingMeta struct {
+	EventMetaDefault
+	APIID    string
+	Source   string
+	Failures int64
+	Error    string
 }
 
 // EVENT_CurcuitBreakerMeta is the event status for a circuit breaker tripping
@@ -158,11 +225,47 @@ func GetEventHandlerByName(handlerConf tykcommon.EventHandlerTriggerConfig, Spec
 	return nil, errors.New("Handler not found")
 }
 
+// GlobalEventPaths are the event handlers set in the gateway config, they handle the events of
+// APIs that don't have handlers of their own for that event
+var GlobalEventPaths = make(map[tykcommon.TykEvent][]TykEventHandler)
+
+// InitEventHandlers creates the handler instances of an event handler config
+func InitEventHandlers(eventHandlers tykcommon.EventHandlerMetaConfig, Spec *APISpec) map[tykcommon.TykEvent][]TykEventHandler {
+	eventPaths := make(map[tykcommon.TykEvent][]TykEventHandler)
+	for eventName, eventHandlerConfs := range eventHandlers.Events {
+		log.Debug("FOUND EVENTS TO INIT")
+		for _, handlerConf := range eventHandlerConfs {
+			log.Debug("CREATING EVENT HANDLERS")
+			thisEventHandlerInstance, getHandlerErr := GetEventHandlerByName(handlerConf, Spec)
+
+			if getHandlerErr != nil {
+				log.Error("Failed to init event handler: ", getHandlerErr)
+			} else {
+				log.Debug("Init Event Handler: ", eventName)
+				eventPaths[eventName] = append(eventPaths[eventName], thisEventHandlerInstance)
+			}
+
+		}
+	}
+
+	return eventPaths
+}
+
+// eventHandlersFor returns the handlers of an API for an event, falling back to the global handlers
+func eventHandlersFor(eventPaths map[tykcommon.TykEvent][]TykEventHandler, eventName tykcommon.TykEvent) ([]TykEventHandler, bool) {
+	if handlers, handlerExists := eventPaths[eventName]; handlerExists {
+		return handlers, true
+	}
+
+	handlers, handlerExists := GlobalEventPaths[eventName]
+	return handlers, handlerExists
+}
+
 // FireEvent is added to the tykMiddleware object so it is available across the entire stack
 func (t TykMiddleware) FireEvent(eventName tykcommon.TykEvent, eventMetaData interface{}) {
 
 	log.Debug("EVENT FIRED")
-	handlers, handlerExists := t.Spec.EventPaths[eventName]
+	handlers, handlerExists := eventHandlersFor(t.Spec.EventPaths, eventName)
 
 	if handlerExists {
 		log.Debug("FOUND EVENT HANDLERS")
@@ -181,7 +284,7 @@ func (t TykMiddleware) FireEvent(eventName tykcommon.TykEvent, eventMetaData int
 func (s APISpec) FireEvent(eventName tykcommon.TykEvent, eventMetaData interface{}) {
 
 	log.Debug("EVENT FIRED: ", eventName)
-	handlers, handlerExists := s.EventPaths[eventName]
+	handlers, handlerExists := eventHandlersFor(s.EventPaths, eventName)
 
 	if handlerExists {
 		log.Debug("FOUND EVENT HANDLERS")
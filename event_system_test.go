@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"testing"
+	"time"
+)
+
+type recordingEventHandler struct {
+	name   string
+	events chan string
+}
+
+func (r recordingEventHandler) New(interface{}) (TykEventHandler, error) {
+	return r, nil
+}
+
+func (r recordingEventHandler) HandleEvent(em EventMessage) {
+	r.events <- r.name + ":" + string(em.EventType)
+}
+
+func TestPerAPIEventHandlers(t *testing.T) {
+	events := make(chan string, 10)
+	slack := recordingEventHandler{"slack", events}
+	webhook := recordingEventHandler{"webhook", events}
+	global := recordingEventHandler{"global", events}
+
+	GlobalEventPaths = map[tykcommon.TykEvent][]TykEventHandler{
+		EVENT_RateLimitExceeded: {global},
+		EVENT_QuotaExceeded:     {global},
+	}
+	defer func() { GlobalEventPaths = make(map[tykcommon.TykEvent][]TykEventHandler) }()
+
+	rateLimitedAPI := createNonVersionedDefinition()
+	rateLimitedAPI.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_RateLimitExceeded: {slack}}
+	quotaAPI := createNonVersionedDefinition()
+	quotaAPI.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_QuotaExceeded: {webhook}}
+
+	for _, tc := range []struct {
+		spec     APISpec
+		event    tykcommon.TykEvent
+		expected string
+	}{
+		{rateLimitedAPI, EVENT_RateLimitExceeded, "slack:" + string(EVENT_RateLimitExceeded)},
+		{rateLimitedAPI, EVENT_QuotaExceeded, "global:" + string(EVENT_QuotaExceeded)},
+		{quotaAPI, EVENT_QuotaExceeded, "webhook:" + string(EVENT_QuotaExceeded)},
+		{quotaAPI, EVENT_RateLimitExceeded, "global:" + string(EVENT_RateLimitExceeded)},
+	} {
+		spec := tc.spec
+		TykMiddleware{Spec: &spec}.FireEvent(tc.event, nil)
+
+		select {
+		case handled := <-events:
+			if handled != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, handled)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Event was not handled: ", tc.expected)
+		}
+	}
+
+	select {
+	case handled := <-events:
+		t.Error("Event handled more than once: ", handled)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInitGlobalEventHandlers(t *testing.T) {
+	eventHandlers := tykcommon.EventHandlerMetaConfig{
+		Events: map[tykcommon.TykEvent][]tykcommon.EventHandlerTriggerConfig{
+			EVENT_RateLimitExceeded: {
+				{Handler: EH_LogHandler, HandlerMeta: map[string]interface{}{"prefix": "global"}},
+				{Handler: "unknown_handler"},
+			},
+		},
+	}
+
+	eventPaths := InitEventHandlers(eventHandlers, &APISpec{})
+	if len(eventPaths[EVENT_RateLimitExceeded]) != 1 {
+		t.Error("Expected only the known handler to be created, got: ", eventPaths)
+	}
+}
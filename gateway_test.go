@@ -1,14 +1,24 @@
 package main
 
 import (
+	"crypto/tls"
+	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/context"
 	"github.com/justinas/alice"
+	"github.com/pmylund/go-cache"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -128,10 +138,13 @@ func getChain(spec APISpec) http.Handler {
 	remote, _ := url.Parse(spec.Proxy.TargetURL)
 	//remote, _ := url.Parse("http://example.com/")
 	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	proxy.New(nil, &spec)
 	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, &spec))
 	tykMiddleware := &TykMiddleware{&spec, proxy}
 	chain := alice.New(
+		CreateMiddleware(&NormalizePathMiddleware{tykMiddleware}, tykMiddleware),
 		CreateMiddleware(&IPWhiteListMiddleware{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&IPAccessListMiddleware{tykMiddleware}, tykMiddleware),
 		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
 		CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
 		CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
@@ -876,3 +889,2645 @@ func TestWithAnalyticsErrorResponse(t *testing.T) {
 	}
 
 }
+
+func TestPolicyMissingDuringReload(t *testing.T) {
+	defer func() {
+		config.Policies.ReloadRetryAfter = 0
+		atomic.StoreInt32(&policyReloadInProgress, 0)
+	}()
+	config.Policies.ReloadRetryAfter = 2
+
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	thisSession := createStandardSession()
+	thisSession.ApplyPolicyID = "not-loaded-yet"
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+	chain := getChain(spec)
+
+	atomic.StoreInt32(&policyReloadInProgress, 1)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 503 {
+		t.Error("Request during reload should return 503, got: \n", recorder.Code)
+	}
+	if recorder.HeaderMap.Get("Retry-After") != "2" {
+		t.Error("Retry-After header not set, got: ", recorder.HeaderMap.Get("Retry-After"))
+	}
+
+	atomic.StoreInt32(&policyReloadInProgress, 0)
+	secondRecorder := httptest.NewRecorder()
+	chain.ServeHTTP(secondRecorder, req)
+
+	if secondRecorder.Code != 200 {
+		t.Error("Request outside of a reload should go through, got: \n", secondRecorder.Code)
+	}
+
+	// Fetching the policies isn't part of the reload window, only swapping them in is
+	loadedPolicies := Policies
+	defer func() {
+		GetPoliciesFromRPC = getPoliciesFromRPCStore
+		config.Policies.PolicySource = ""
+		config.Policies.PolicyRecordName = ""
+		swapPolicies(loadedPolicies, []PolicyPerAPIIssue{})
+	}()
+	config.Policies.PolicySource = "rpc"
+	config.Policies.PolicyRecordName = "policies"
+	GetPoliciesFromRPC = func(orgId string) string {
+		if PolicyReloadInProgress() {
+			t.Error("The reload flag should not be set while the policies are fetched")
+		}
+		return `[]`
+	}
+	getPolicies()
+	if PolicyReloadInProgress() {
+		t.Error("The reload flag should be cleared once the policies are swapped")
+	}
+}
+
+func TestLazyPolicyLoad(t *testing.T) {
+	fetches := map[string]int{}
+	LoadPolicyFromSource = func(id string) (Policy, bool, error) {
+		fetches[id]++
+		switch id {
+		case "lazy-policy":
+			return Policy{ID: id, OrgID: "default", QuotaMax: 42}, true, nil
+		case "broken-policy":
+			return Policy{}, false, errors.New("source unavailable")
+		}
+		return Policy{}, false, nil
+	}
+	defer func() {
+		LoadPolicyFromSource = loadPolicyFromConfiguredSource
+		config.Policies.LazyLoad = false
+	}()
+	config.Policies.LazyLoad = true
+	resetLazyPolicyCache()
+
+	for i := 0; i < 2; i++ {
+		policy, found := GetPolicy("lazy-policy")
+		if !found || policy.QuotaMax != 42 {
+			t.Fatal("Lazy policy should be loaded, got: ", policy, found)
+		}
+		if _, found := GetPolicy("missing-policy"); found {
+			t.Error("Unknown policy should not be found")
+		}
+		if _, found := GetPolicy("broken-policy"); found {
+			t.Error("Policy should not be found when the source fails")
+		}
+	}
+
+	if fetches["lazy-policy"] != 1 {
+		t.Error("Policy should be fetched once and then cached, fetched: ", fetches["lazy-policy"])
+	}
+	if fetches["missing-policy"] != 1 {
+		t.Error("Missing policy should be cached as not found, fetched: ", fetches["missing-policy"])
+	}
+	if fetches["broken-policy"] != 2 {
+		t.Error("Source errors should not be cached, fetched: ", fetches["broken-policy"])
+	}
+
+	config.Policies.LazyLoad = false
+	if _, found := GetPolicy("lazy-policy"); found {
+		t.Error("Eager mode should only use the preloaded policies")
+	}
+}
+
+func TestLazyPolicyLoadFromListing(t *testing.T) {
+	cacheFile, _ := ioutil.TempFile("", "rpc-policies")
+	os.Remove(cacheFile.Name())
+	defer os.Remove(cacheFile.Name())
+
+	listings := 0
+	GetPoliciesFromRPC = func(orgId string) string {
+		listings++
+		return `[{"_id": "525d4c8f1ef3bd4c95000001", "org_id": "default", "rate": 100, "per": 60}, {"_id": "525d4c8f1ef3bd4c95000002", "org_id": "default", "rate": 5, "per": 1}]`
+	}
+	defer func() {
+		GetPoliciesFromRPC = getPoliciesFromRPCStore
+		config.Policies.LazyLoad = false
+		config.Policies.PolicySource = ""
+		config.SlaveOptions.PolicyCacheFile = ""
+	}()
+	config.Policies.LazyLoad = true
+	config.Policies.PolicySource = "rpc"
+	config.SlaveOptions.PolicyCacheFile = cacheFile.Name()
+	resetLazyPolicyCache()
+
+	if policy, found := GetPolicy("525d4c8f1ef3bd4c95000001"); !found || policy.Rate != 100 {
+		t.Fatal("Lazy policy should be loaded, got: ", policy, found)
+	}
+	if policy, found := GetPolicy("525d4c8f1ef3bd4c95000002"); !found || policy.Rate != 5 {
+		t.Fatal("Lazy policy should be loaded, got: ", policy, found)
+	}
+	if _, found := GetPolicy("525d4c8f1ef3bd4c95000003"); found {
+		t.Error("Unknown policy should not be found")
+	}
+
+	if listings != 1 {
+		t.Error("Misses should share one listing of the source, listed: ", listings)
+	}
+	if _, err := os.Stat(cacheFile.Name()); !os.IsNotExist(err) {
+		t.Error("Lazy loads should not write the RPC policy cache file")
+	}
+}
+
+func TestMalformedPolicyReloadKeepsPolicies(t *testing.T) {
+	policyFile, _ := ioutil.TempFile("", "policies")
+	defer os.Remove(policyFile.Name())
+	defer func() {
+		config.Policies.PolicyRecordName = ""
+		Policies = make(map[string]Policy)
+	}()
+	config.Policies.PolicyRecordName = policyFile.Name()
+
+	ioutil.WriteFile(policyFile.Name(), []byte(`{"reload-policy": {"org_id": "default", "rate": 10, "per": 1}}`), 0644)
+	getPolicies()
+	if _, found := Policies["reload-policy"]; !found {
+		t.Fatal("Policy should have been loaded")
+	}
+
+	ioutil.WriteFile(policyFile.Name(), []byte(`{"reload-policy": {"org_id": `), 0644)
+	if _, err := LoadPoliciesFromFile(policyFile.Name()); err == nil {
+		t.Error("Malformed policy file should be an error")
+	}
+	getPolicies()
+	if policy, found := Policies["reload-policy"]; !found || policy.Rate != 10 {
+		t.Error("Malformed reload should keep the loaded policies, got: ", Policies)
+	}
+}
+
+func TestPolicyPerAPI(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	Policies["per-api-policy"] = Policy{ID: "per-api-policy", OrgID: spec.OrgID, Rate: 2, Per: 60, QuotaMax: -1}
+	defer delete(Policies, "per-api-policy")
+
+	chain := getChain(spec)
+	thisSession := createStandardSession()
+	thisSession.PolicyPerAPI = map[string]string{spec.APIID: "per-api-policy"}
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	// The base rate is 10000, only the per-API rate of 2 can refuse the third request
+	apiSessionKey := PerAPISessionKey(keyId, spec.APIID)
+	passed := 0
+	for i, expected := range []int{200, 200, 429} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != expected {
+			t.Errorf("Request %v: expected %v, got %v", i, expected, recorder.Code)
+		}
+		if recorder.Code == 200 {
+			passed++
+		}
+		waitForRateWindow(t, spec.SessionManager.GetStore().(*RedisClusterStorageManager), apiSessionKey, passed, passed >= 2)
+	}
+
+	apiSession, found := spec.SessionManager.GetSessionDetail(apiSessionKey)
+	if !found {
+		t.Fatal("Per-API session should have been created")
+	}
+	if apiSession.Rate != 2 || apiSession.ApplyPolicyID != "per-api-policy" {
+		t.Error("Per-API policy should be applied to the per-API session, got: ", apiSession)
+	}
+
+	baseSession, _ := spec.SessionManager.GetSessionDetail(keyId)
+	if baseSession.Rate != 10000 {
+		t.Error("Base session should keep its own rate, got: ", baseSession.Rate)
+	}
+}
+
+func TestPolicyPerAPILazySession(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	Policies["lazy-per-api-policy"] = Policy{ID: "lazy-per-api-policy", OrgID: spec.OrgID, Rate: 2, Per: 60, QuotaMax: -1}
+	defer delete(Policies, "lazy-per-api-policy")
+
+	chain := getChain(spec)
+	thisSession := createStandardSession()
+	thisSession.PolicyPerAPI = map[string]string{spec.APIID: "lazy-per-api-policy"}
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+	// The per-API session is created by the rate limiter, wherever the base session came from
+	SessionCache.Set(keyId, thisSession, cache.DefaultExpiration)
+	defer SessionCache.Delete(keyId)
+
+	doRequest := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := doRequest()
+	if recorder.Code != 200 {
+		t.Fatal("Expected 200 for the first request, got: ", recorder.Code)
+	}
+	if limit := recorder.HeaderMap.Get("X-RateLimit-Limit"); limit != "2" {
+		t.Error("The first request should be limited on the per-API policy, got a limit of: ", limit)
+	}
+	apiSessionKey := PerAPISessionKey(keyId, spec.APIID)
+	apiSession, found := spec.SessionManager.GetSessionDetail(apiSessionKey)
+	if !found || apiSession.ApplyPolicyID != "lazy-per-api-policy" {
+		t.Fatal("The per-API session should be created on the first request, got: ", apiSession)
+	}
+
+	// Later requests are limited on the same per-API session
+	apiSession.Alias = "existing per-API session"
+	spec.SessionManager.UpdateSession(apiSessionKey, apiSession, 60)
+	if recorder := doRequest(); recorder.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Error("The second request should count against the per-API rate limit, remaining: ", recorder.Header().Get("X-RateLimit-Remaining"))
+	}
+	if apiSession, _ := spec.SessionManager.GetSessionDetail(apiSessionKey); apiSession.Alias != "existing per-API session" {
+		t.Error("The existing per-API session should be reused, got: ", apiSession)
+	}
+}
+
+func TestPolicyPerAPIValidation(t *testing.T) {
+	policyFile, _ := ioutil.TempFile("", "policies")
+	defer os.Remove(policyFile.Name())
+	defer func() {
+		config.Policies.PolicyRecordName = ""
+		Policies = make(map[string]Policy)
+		PolicyPerAPIIssues = []PolicyPerAPIIssue{}
+	}()
+	config.Policies.PolicyRecordName = policyFile.Name()
+
+	ioutil.WriteFile(policyFile.Name(), []byte(`{
+		"base": {"org_id": "default", "policy_per_api": {"api-a": "valid", "api-b": "vaild", "api-c": "other-org", "api-d": ""}},
+		"valid": {"org_id": "default"},
+		"other-org": {"org_id": "other"}
+	}`), 0644)
+	getPolicies()
+
+	if perAPI := Policies["base"].PolicyPerAPI; len(perAPI) != 4 {
+		t.Error("Validation should leave the loaded policies as they are, got: ", perAPI)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/policies/validation", nil)
+	policyValidationHandler(recorder, req)
+
+	var issues []PolicyPerAPIIssue
+	json.Unmarshal(recorder.Body.Bytes(), &issues)
+	reasons := map[string]string{}
+	for _, issue := range issues {
+		if issue.PolicyID != "base" {
+			t.Error("Unexpected policy in issues: ", issue.PolicyID)
+		}
+		reasons[issue.APIID] = issue.Reason
+	}
+	expected := map[string]string{
+		"api-b": "per-API policy vaild not found",
+		"api-c": "per-API policy other-org belongs to a different organisation",
+		"api-d": "per-API policy ID is empty",
+	}
+	if len(reasons) != len(expected) {
+		t.Error("Expected 3 issues, got: ", issues)
+	}
+	for apiID, reason := range expected {
+		if reasons[apiID] != reason {
+			t.Errorf("%v: expected %q, got %q", apiID, reason, reasons[apiID])
+		}
+	}
+
+	// Maps set on keys directly are checked when they are applied
+	spec := createNonVersionedDefinition()
+	chain := getChain(spec)
+	thisSession := createStandardSession()
+	thisSession.PolicyPerAPI = map[string]string{spec.APIID: "other-org"}
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	if _, found := spec.SessionManager.GetSessionDetail(PerAPISessionKey(keyId, spec.APIID)); found {
+		t.Error("A per-API session should not be created from a policy of another organisation")
+	}
+}
+
+type recordingAnalyticsSink struct {
+	records chan AnalyticsRecord
+}
+
+func (r recordingAnalyticsSink) RecordHit(thisRecord AnalyticsRecord) error {
+	r.records <- thisRecord
+	return nil
+}
+
+func TestAnalyticsSinkPerAPI(t *testing.T) {
+	config.EnableAnalytics = true
+	AnalyticsStore := RedisClusterStorageManager{KeyPrefix: "analytics-"}
+	analytics = RedisAnalyticsHandler{
+		Store: &AnalyticsStore,
+	}
+	analytics.Store.Connect()
+	analytics.Clean = &MockPurger{&AnalyticsStore}
+	analytics.Clean.PurgeCache()
+
+	regulatedSink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("regulated", regulatedSink)
+	defer delete(AnalyticsSinks, "regulated")
+
+	regulatedSpec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "regulated",`, 1))
+	sharedSpec := createNonVersionedDefinition()
+
+	for _, spec := range []APISpec{regulatedSpec, sharedSpec} {
+		redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		getChain(spec).ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Error("Request failed with non-200 code: \n", recorder.Code)
+		}
+	}
+
+	select {
+	case thisRecord := <-regulatedSink.records:
+		if thisRecord.APIID != "1" {
+			t.Error("Unexpected record in dedicated sink: ", thisRecord.APIID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Record was not sent to the dedicated sink")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if len(regulatedSink.records) != 0 {
+		t.Error("Record for API without a sink was sent to the dedicated sink")
+	}
+
+	results := analytics.Store.GetKeysAndValues()
+	if len(results) < 1 {
+		t.Error("Record for API without a sink was not sent to the default sink")
+	}
+}
+
+func TestAnalyticsSinksNeedMongo(t *testing.T) {
+	analyticsType, purgeDelay := config.AnalyticsConfig.Type, config.AnalyticsConfig.PurgeDelay
+	defer func() {
+		config.AnalyticsConfig.Type, config.AnalyticsConfig.PurgeDelay = analyticsType, purgeDelay
+		config.AnalyticsConfig.Sinks = nil
+		delete(AnalyticsSinks, "archive")
+	}()
+	config.AnalyticsConfig.Sinks = map[string]AnalyticsSinkConfig{"archive": {MongoCollection: "archive_analytics"}}
+	config.AnalyticsConfig.PurgeDelay = -1
+	store := &RedisClusterStorageManager{KeyPrefix: "analytics-"}
+
+	config.AnalyticsConfig.Type = "csv"
+	setupAnalyticsSinks(store)
+	if _, found := AnalyticsSinks["archive"]; found {
+		t.Error("Sinks should not be set up without the mongo analytics type")
+	}
+
+	config.AnalyticsConfig.Type = "mongo"
+	setupAnalyticsSinks(store)
+	if _, found := AnalyticsSinks["archive"]; !found {
+		t.Error("Sinks should be set up with the mongo analytics type")
+	}
+}
+
+type failingAnalyticsSink struct{}
+
+func (f failingAnalyticsSink) RecordHit(thisRecord AnalyticsRecord) error {
+	return AnalyticsError{}
+}
+
+func TestAnalyticsDroppedRecordsCounted(t *testing.T) {
+	RegisterAnalyticsSink("failing", failingAnalyticsSink{})
+	defer delete(AnalyticsSinks, "failing")
+
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "failing",`, 1))
+	before := AnalyticsRecordsDropped()
+	recordAnalytics(&spec, AnalyticsRecord{APIID: spec.APIID})
+	recordAnalytics(&spec, AnalyticsRecord{APIID: spec.APIID})
+
+	if dropped := AnalyticsRecordsDropped() - before; dropped != 2 {
+		t.Error("Expected 2 dropped records, got: ", dropped)
+	}
+}
+
+func TestSharedQuotaGroup(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+
+	// Two keys sharing a quota of 2
+	quotaGroup := randSeq(10)
+	keys := []string{randSeq(10), randSeq(10)}
+	for _, keyId := range keys {
+		thisSession := createQuotaSession()
+		thisSession.SharedQuotaGroup = quotaGroup
+		spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+	}
+	chain := getChain(spec)
+
+	for i, keyId := range []string{keys[0], keys[1], keys[0], keys[1]} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		expected := 200
+		if i >= 2 {
+			expected = 403
+		}
+		if recorder.Code != expected {
+			t.Errorf("Request %v: expected %v, got %v", i, expected, recorder.Code)
+		}
+	}
+
+	// Resetting one key leaves the group alone
+	store := spec.SessionManager.GetStore()
+	thisSession, _ := spec.SessionManager.GetSessionDetail(keys[0])
+	ownKey := QuotaKeyPrefix + publicHash(keys[0])
+	groupKey := quotaKeyForSession(keys[0], &thisSession)
+	store.SetRawKey(ownKey, "1", 60)
+	spec.SessionManager.ResetQuota(keys[0], &thisSession)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := store.GetRawKey(ownKey); err != nil {
+			break
+		}
+	}
+	if _, err := store.GetRawKey(ownKey); err == nil {
+		t.Error("The quota counter of the key should have been reset")
+	}
+	if used, _ := store.GetRawKey(groupKey); used != "2" {
+		t.Error("Resetting a key should not reset its quota group, got: ", used)
+	}
+
+	spec.SessionManager.ResetQuotaGroup(&thisSession)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := store.GetRawKey(groupKey); err != nil {
+			break
+		}
+	}
+	if _, err := store.GetRawKey(groupKey); err == nil {
+		t.Error("The quota group counter should have been reset")
+	}
+}
+
+func TestQuotaGrace(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	absoluteGrace := createQuotaSession()
+	absoluteGrace.QuotaGrace = 1
+	percentGrace := createQuotaSession()
+	percentGrace.QuotaGracePercent = 50
+
+	for _, thisSession := range []SessionState{absoluteGrace, percentGrace} {
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+		// Quota of 2 plus a grace of 1
+		for i, expected := range []int{200, 200, 200, 403} {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Add("authorization", keyId)
+			chain.ServeHTTP(recorder, req)
+
+			if recorder.Code != expected {
+				t.Errorf("Request %v: expected %v, got %v", i, expected, recorder.Code)
+			}
+		}
+	}
+}
+
+func TestQuotaReconciliation(t *testing.T) {
+	defer func() { config.QuotaReconciliation = "" }()
+
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	store := spec.SessionManager.GetStore()
+
+	for _, tc := range []struct {
+		mode      string
+		remaining int64
+		exceeded  bool
+	}{
+		// The store is trusted, the key gets the lost requests back
+		{"", 4, false},
+		{QuotaReconcileRead, 4, false},
+		// Counting goes on from the session
+		{QuotaReconcileStrict, 1, false},
+	} {
+		config.QuotaReconciliation = tc.mode
+
+		thisSession := createQuotaSession()
+		thisSession.QuotaMax, thisSession.QuotaRemaining = 5, 5
+		keyId := randSeq(10)
+		for i := 0; i < 3; i++ {
+			sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store)
+		}
+
+		// The store loses the counter, e.g. after a failover
+		store.DeleteRawKey(quotaKeyForSession(keyId, &thisSession))
+
+		exceeded, _ := sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store)
+		if exceeded != tc.exceeded || thisSession.QuotaRemaining != tc.remaining {
+			t.Errorf("Mode %q: expected remaining %v, got %v (exceeded: %v)", tc.mode, tc.remaining, thisSession.QuotaRemaining, exceeded)
+		}
+	}
+
+	// With strict reconciliation the quota runs out at the count the session had
+	config.QuotaReconciliation = QuotaReconcileStrict
+	thisSession := createQuotaSession()
+	thisSession.QuotaMax, thisSession.QuotaRemaining = 3, 3
+	keyId := randSeq(10)
+	sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store)
+	sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store)
+	store.DeleteRawKey(quotaKeyForSession(keyId, &thisSession))
+
+	if exceeded, _ := sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store); exceeded {
+		t.Error("The third request is within the quota")
+	}
+	if exceeded, _ := sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store); !exceeded {
+		t.Error("The fourth request should be refused, the store count was reconciled")
+	}
+
+	// A reset quota starts again from nothing, it isn't a counter that lost writes
+	thisSession.QuotaRenews = time.Now().Unix() + thisSession.QuotaRenewalRate
+	spec.SessionManager.ResetQuota(keyId, &thisSession)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := store.GetRawKey(quotaKeyForSession(keyId, &thisSession)); err != nil {
+			break
+		}
+	}
+	if exceeded, _ := sessionLimiter.IsRedisQuotaExceeded(&thisSession, keyId, store); exceeded || thisSession.QuotaRemaining != 2 {
+		t.Error("The first request after a reset should leave 2 requests, got: ", thisSession.QuotaRemaining)
+	}
+}
+
+func TestRollingQuota(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	// 2 requests in any 2 seconds
+	Policies["rolling-quota"] = Policy{
+		ID:               "rolling-quota",
+		OrgID:            spec.OrgID,
+		Rate:             100,
+		Per:              1,
+		QuotaMax:         2,
+		QuotaRenewalRate: 2,
+		QuotaRolling:     true,
+		AccessRights:     createQuotaSession().AccessRights,
+	}
+	defer delete(Policies, "rolling-quota")
+
+	keyId := randSeq(10)
+	thisSession := createQuotaSession()
+	thisSession.ApplyPolicyID = "rolling-quota"
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	send := func() int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := send(); code != 200 {
+		t.Fatal("First request should pass, got ", code)
+	}
+	time.Sleep(time.Second)
+	if code := send(); code != 200 {
+		t.Fatal("Second request should pass, got ", code)
+	}
+
+	// The first request has left the window but the second hasn't, a quota period anchored at the
+	// first request would have renewed completely by now
+	time.Sleep(1100 * time.Millisecond)
+	if code := send(); code != 200 {
+		t.Error("Request after the first one left the window should pass, got ", code)
+	}
+	if code := send(); code != 403 {
+		t.Error("Request over the quota of the trailing window should be refused, got ", code)
+	}
+}
+
+func TestRollingQuotaRefusedRequestsAndReset(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	thisSession := createQuotaSession()
+	thisSession.QuotaMax = 2
+	thisSession.QuotaRenewalRate = 60
+	thisSession.QuotaRolling = true
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	send := func() int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	rawKey := QuotaRollingPrefix + quotaKeyForSession(keyId, &thisSession)
+	windowSize := func() int {
+		size, _ := redis.Int(redisStore.db.Do("ZCARD", rawKey))
+		return size
+	}
+
+	for i, expected := range []int{200, 200, 403, 403, 403} {
+		if code := send(); code != expected {
+			t.Errorf("Request %v: expected %v, got %v", i, expected, code)
+		}
+	}
+	if size := windowSize(); size != 2 {
+		t.Error("Only the allowed requests should be in the window, got: ", size)
+	}
+
+	spec.SessionManager.ResetQuota(keyId, &thisSession)
+	for deadline := time.Now().Add(time.Second); windowSize() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := send(); code != 200 {
+		t.Error("A request after the quota was reset should pass, got ", code)
+	}
+}
+
+func TestRateLimiterKeepsSessionTTL(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	spec.SessionLifetime = 120
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	// The first request loads the session with the API session lifetime, the ones after it are
+	// served from the session cache and only written by the limiter
+	for i := 0; i < 3; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Expected 200, got ", recorder.Code)
+		}
+
+		ttl, err := spec.SessionManager.GetStore().GetExp(keyId)
+		if err != nil || ttl <= 0 || ttl > spec.SessionLifetime {
+			t.Errorf("Request %v: TTL should stay within the session lifetime after limiter writes, got %v (%v)", i+1, ttl, err)
+		}
+	}
+}
+
+func TestPolicyWriteKeepsSessionExpiry(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	Policies["ttl-policy"] = Policy{ID: "ttl-policy", OrgID: spec.OrgID, Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "ttl-policy")
+
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	// The API has no session lifetime, the key expires in 90 seconds
+	thisSession := createNonThrottledSession()
+	thisSession.ApplyPolicyID = "ttl-policy"
+	thisSession.Expires = time.Now().Unix() + 90
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 90)
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Expected 200, got ", recorder.Code)
+		}
+
+		ttl, err := spec.SessionManager.GetStore().GetExp(keyId)
+		if err != nil || ttl <= 0 || ttl > 90 {
+			t.Errorf("Request %v: policy and limiter writes should keep the key expiry, got TTL %v (%v)", i+1, ttl, err)
+		}
+	}
+}
+
+func TestInjectQuotaHeaders(t *testing.T) {
+	upstreamHeaders := []http.Header{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = append(upstreamHeaders, r.Header)
+	}))
+	defer upstream.Close()
+
+	spec := createNonVersionedDefinition()
+	spec.APIDefinition.RawData["inject_quota_headers"] = true
+	spec.Proxy.TargetURL = upstream.URL
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	// Quota of 10 and a rate of 100
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Fatalf("Request %v: expected 200, got %v", i, recorder.Code)
+		}
+	}
+
+	if len(upstreamHeaders) != 2 {
+		t.Fatal("Expected 2 upstream requests, got: ", len(upstreamHeaders))
+	}
+	for i, expected := range []string{"9", "8"} {
+		if got := upstreamHeaders[i].Get("X-Quota-Remaining"); got != expected {
+			t.Errorf("Request %v: expected X-Quota-Remaining %v, got %v", i, expected, got)
+		}
+	}
+	for i, expected := range []string{"99", "98"} {
+		if got := upstreamHeaders[i].Get("X-Rate-Remaining"); got != expected {
+			t.Errorf("Request %v: expected X-Rate-Remaining %v, got %v", i, expected, got)
+		}
+	}
+}
+
+func TestInjectQuotaHeadersDisabled(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	}))
+	defer upstream.Close()
+
+	spec := createNonVersionedDefinition()
+	spec.Proxy.TargetURL = upstream.URL
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatal("Expected 200, got: ", recorder.Code)
+	}
+	if upstreamHeader.Get("X-Quota-Remaining") != "" || upstreamHeader.Get("X-Rate-Remaining") != "" {
+		t.Error("Quota headers should not be injected unless enabled")
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	Policies["rate-header-policy"] = Policy{ID: "rate-header-policy", OrgID: spec.OrgID, Rate: 2, Per: 30, QuotaMax: -1}
+	defer delete(Policies, "rate-header-policy")
+	chain := getChain(spec)
+
+	doRequest := func(keyId string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// A rate of 3 per 60 seconds, the window resets when the first request leaves it
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createThrottledSession(), 60)
+	firstRequest := time.Now().Unix()
+	for i, expected := range []struct {
+		code      int
+		remaining string
+		limited   bool
+	}{
+		{200, "2", false},
+		{200, "1", false},
+		{200, "0", false},
+		{429, "0", true},
+	} {
+		recorder := doRequest(keyId)
+		now := time.Now().Unix()
+		if recorder.Code != expected.code {
+			t.Errorf("Request %v: expected %v, got %v", i, expected.code, recorder.Code)
+		}
+		if limit := recorder.HeaderMap[http.CanonicalHeaderKey("X-RateLimit-Limit")]; len(limit) != 1 || limit[0] != "3" {
+			t.Errorf("Request %v: expected a single X-RateLimit-Limit of 3, got %v", i, limit)
+		}
+		if got := recorder.HeaderMap.Get("X-RateLimit-Remaining"); got != expected.remaining {
+			t.Errorf("Request %v: expected X-RateLimit-Remaining %v, got %v", i, expected.remaining, got)
+		}
+		resets, _ := strconv.ParseInt(recorder.HeaderMap.Get("X-RateLimit-Reset"), 10, 64)
+		if resets < firstRequest+60 || resets > firstRequest+61 {
+			t.Errorf("Request %v: expected X-RateLimit-Reset to be 60 seconds after the first request at %v, got %v", i, firstRequest, resets)
+		}
+		retryAfter := recorder.HeaderMap.Get("Retry-After")
+		if !expected.limited {
+			if retryAfter != "" {
+				t.Errorf("Request %v: expected no Retry-After, got %v", i, retryAfter)
+			}
+		} else if seconds, err := strconv.ParseInt(retryAfter, 10, 64); err != nil || seconds != resets-now && seconds != resets-now+1 {
+			t.Errorf("Request %v: expected Retry-After to be the seconds until %v, got %v", i, resets, retryAfter)
+		}
+	}
+
+	// The headers come from the per-API session the request was limited on, not the base session
+	perAPISession := createStandardSession()
+	perAPISession.PolicyPerAPI = map[string]string{spec.APIID: "rate-header-policy"}
+	perAPIKeyId := randSeq(10)
+	spec.SessionManager.UpdateSession(perAPIKeyId, perAPISession, 60)
+	recorder := doRequest(perAPIKeyId)
+	if recorder.Code != 200 {
+		t.Fatal("Expected 200 for the per-API session, got: ", recorder.Code)
+	}
+	limit := recorder.HeaderMap.Get("X-RateLimit-Limit")
+	resets, _ := strconv.ParseInt(recorder.HeaderMap.Get("X-RateLimit-Reset"), 10, 64)
+	if now := time.Now().Unix(); limit != "2" || resets < now+29 || resets > now+31 {
+		t.Errorf("Expected the rate limit of the per-API policy, got a limit of %v reset at %v", limit, resets)
+	}
+}
+
+func TestQuotaRetryAfter(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	chain := getChain(spec)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createQuotaSession(), 60)
+
+	// A quota of 2 that renews every 300 seconds, the third request is refused
+	var recorder *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		recorder = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+	}
+
+	if recorder.Code != 403 {
+		t.Fatal("Expected 403 once the quota is used up, got: ", recorder.Code)
+	}
+	retryAfter := recorder.HeaderMap.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err != nil || seconds <= 0 || seconds > 300 {
+		t.Error("Expected Retry-After to be the seconds until the quota renews, got: ", retryAfter)
+	}
+
+	now := time.Now().Unix()
+	for _, tc := range []struct {
+		renewalRate int64
+		renews      int64
+		expected    int64
+	}{
+		{300, now + 120, 120},
+		// A quota that doesn't renew gets no Retry-After
+		{0, now + 120, 0},
+		// A renewal time that has passed or is too far away is stale
+		{300, now - 10, 300},
+		{300, now + 3600, 300},
+	} {
+		thisSession := SessionState{QuotaRenewalRate: tc.renewalRate, QuotaRenews: tc.renews}
+		if got := quotaRetryAfter(&thisSession); got != tc.expected && got != tc.expected-1 {
+			t.Errorf("Renewal rate %v renewing in %v seconds: expected %v, got %v", tc.renewalRate, tc.renews-now, tc.expected, got)
+		}
+	}
+}
+
+// inFlightCount reads the number of requests a key has in flight from the store
+func inFlightCount(spec APISpec, keyId string) int {
+	store := spec.SessionManager.GetStore().(*RedisClusterStorageManager)
+	count, _ := redis.Int(store.db.Do("ZCARD", InFlightKeyPrefix+publicHash(keyId)))
+	return count
+}
+
+// waitForRateWindow waits for the off-thread rolling window write of the last request to land: the
+// window of key holds at least count requests and, if it should be set by now, so is its sentinel
+func waitForRateWindow(t *testing.T, store *RedisClusterStorageManager, key string, count int, sentinel bool) {
+	windowKey := RateLimitKeyPrefix + publicHash(key)
+	deadline := time.Now().Add(time.Second)
+	for {
+		windowCount, _ := redis.Int(store.db.Do("ZCARD", windowKey))
+		_, sentinelErr := store.GetRawKey(windowKey + ".BLOCKED")
+		if windowCount >= count && (!sentinel || sentinelErr == nil) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Rate window of %v has %v requests (sentinel set: %v), expected %v (sentinel set: %v)",
+				key, windowCount, sentinelErr == nil, count, sentinel)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrentRequestLimit(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer upstream.Close()
+
+	spec := createNonVersionedDefinition()
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getChain(spec)
+	thisSession := createNonThrottledSession()
+	thisSession.MaxConcurrentRequests = 2
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	doRequest := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	inFlight := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			inFlight <- doRequest().Code
+		}()
+		<-started
+	}
+
+	// Every acquire keeps the in-flight window alive for inFlightTTL
+	store := spec.SessionManager.GetStore().(*RedisClusterStorageManager)
+	if ttl, _ := redis.Int64(store.db.Do("TTL", InFlightKeyPrefix+publicHash(keyId))); ttl <= inFlightTTL-5 {
+		t.Error("Expected the in-flight TTL to be refreshed, got: ", ttl)
+	}
+
+	recorder := doRequest()
+	if recorder.Code != 429 {
+		t.Error("Expected 429 with two requests in flight, got: ", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "Too many concurrent requests") {
+		t.Error("Expected the concurrent request limit to be named in the error, got: ", recorder.Body.String())
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-inFlight; code != 200 {
+			t.Error("Expected the requests in flight to complete, got: ", code)
+		}
+	}
+
+	go func() { <-started }()
+	if code := doRequest().Code; code != 200 {
+		t.Error("Expected 200 once the requests in flight completed, got: ", code)
+	}
+	if count := inFlightCount(spec, keyId); count != 0 {
+		t.Error("Expected no requests in flight, got: ", count)
+	}
+}
+
+// rpcLikeStore is a store like the RPC one, it adds times to rolling windows whatever the entry
+// and can't take entries out of them again
+type rpcLikeStore struct {
+	*RedisClusterStorageManager
+}
+
+func (s *rpcLikeStore) SetRollingWindow(keyName string, per int64, value string) (int, []interface{}) {
+	count, _ := s.RedisClusterStorageManager.SetRollingWindow(keyName, per, "-1")
+	return count, []interface{}{}
+}
+
+func (s *rpcLikeStore) RemoveFromRollingWindow(keyName string, values ...string) {}
+
+func (s *rpcLikeStore) removesRollingWindowEntries() bool {
+	return false
+}
+
+func TestConcurrentRequestLimitWithoutWindowRemoval(t *testing.T) {
+	store := &rpcLikeStore{&RedisClusterStorageManager{KeyPrefix: "apikey-"}}
+	store.Connect()
+	thisSession := createNonThrottledSession()
+	thisSession.MaxConcurrentRequests = 2
+	keyId := randSeq(10)
+
+	// Slots given back are free again, however many requests the key has made
+	for round := 0; round < 3; round++ {
+		var entries []string
+		for i := 0; i < 2; i++ {
+			entry, acquired := sessionLimiter.AcquireInFlight(&thisSession, keyId, store)
+			if !acquired {
+				t.Fatalf("Round %v: expected request %v to get a slot", round, i)
+			}
+			entries = append(entries, entry)
+		}
+		if _, acquired := sessionLimiter.AcquireInFlight(&thisSession, keyId, store); acquired {
+			t.Fatalf("Round %v: expected the third request to be refused", round)
+		}
+		for _, entry := range entries {
+			sessionLimiter.ReleaseInFlight(keyId, entry, store)
+		}
+	}
+
+	count, _ := store.GetRawKey(inFlightCounterKey(InFlightKeyPrefix + publicHash(keyId)))
+	if count != "0" {
+		t.Error("Expected no requests in flight, got: ", count)
+	}
+}
+
+func TestConcurrentRequestReleasedOnFailure(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Close()
+
+	spec := createNonVersionedDefinition()
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getChain(spec)
+	thisSession := createNonThrottledSession()
+	thisSession.MaxConcurrentRequests = 1
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	// The upstream is down
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code == 429 {
+			t.Fatal("The slot of a request that failed upstream wasn't released")
+		}
+	}
+	if count := inFlightCount(spec, keyId); count != 0 {
+		t.Error("Expected no requests in flight after an upstream error, got: ", count)
+	}
+
+	// The handler after the limiter panics
+	tykMiddleware := &TykMiddleware{&spec, nil}
+	panicChain := alice.New(CreateMiddleware(&RateLimitAndQuotaCheck{tykMiddleware}, tykMiddleware)).Then(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("upstream panicked")
+		}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the handler to panic")
+			}
+		}()
+		req, _ := http.NewRequest("GET", "/", nil)
+		context.Set(req, SessionData, thisSession)
+		context.Set(req, AuthHeaderValue, keyId)
+		panicChain.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if count := inFlightCount(spec, keyId); count != 0 {
+		t.Error("Expected no requests in flight after a panic, got: ", count)
+	}
+
+	// Releasing a request that isn't counted can't leave the key with spare slots
+	sessionLimiter.ReleaseInFlight(keyId, rollingWindowEntry(), spec.SessionManager.GetStore())
+	if count := inFlightCount(spec, keyId); count != 0 {
+		t.Error("Expected no requests in flight after a stray release, got: ", count)
+	}
+	if _, acquired := sessionLimiter.AcquireInFlight(&thisSession, keyId, spec.SessionManager.GetStore()); !acquired {
+		t.Error("Expected the first request to be let through")
+	}
+	if _, acquired := sessionLimiter.AcquireInFlight(&thisSession, keyId, spec.SessionManager.GetStore()); acquired {
+		t.Error("Expected the limit to hold after a stray release")
+	}
+}
+
+// failingSessionStore fails the next failures session writes
+type failingSessionStore struct {
+	*RedisClusterStorageManager
+	failures int
+	attempts int
+}
+
+func (s *failingSessionStore) SetKey(keyName string, sessionState string, timeout int64) error {
+	s.attempts++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("store unavailable")
+	}
+	return s.RedisClusterStorageManager.SetKey(keyName, sessionState, timeout)
+}
+
+// goneRecorder is a recorder for a client that has already disconnected
+type goneRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (g goneRecorder) CloseNotify() <-chan bool {
+	gone := make(chan bool, 1)
+	gone <- true
+	return gone
+}
+
+func doSessionWriteFailureRequest(t *testing.T, failures int, clientGone bool) (int, *failingSessionStore) {
+	spec := createNonVersionedDefinition()
+	redisStore := &failingSessionStore{RedisClusterStorageManager: &RedisClusterStorageManager{KeyPrefix: "apikey-"}}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(redisStore, redisStore, healthStore, orgStore)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	// getChain re-initialises the spec with plain stores
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, &spec))
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	chain := alice.New(
+		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&RateLimitAndQuotaCheck{tykMiddleware}, tykMiddleware)).Then(proxyHandler)
+
+	redisStore.failures = failures
+	redisStore.attempts = 0
+	recorder := httptest.NewRecorder()
+	var w http.ResponseWriter = recorder
+	if clientGone {
+		w = goneRecorder{recorder}
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(w, req)
+
+	return recorder.Code, redisStore
+}
+
+func TestSessionWriteRetry(t *testing.T) {
+	defer func() {
+		config.SessionWriteRetry.MaxRetries = 0
+		config.SessionWriteRetry.BackoffMs = 0
+		config.SessionWriteRetry.MaxBackoffMs = 0
+		config.SessionWriteRetry.FailClosed = false
+	}()
+	config.SessionWriteRetry.MaxRetries = 2
+	config.SessionWriteRetry.BackoffMs = 1
+	config.SessionWriteRetry.FailClosed = true
+
+	// A blip is retried away
+	code, store := doSessionWriteFailureRequest(t, 1, false)
+	if code != 200 {
+		t.Error("Transient write failure should be retried, got: ", code)
+	}
+	if store.attempts != 2 {
+		t.Error("Expected 2 write attempts, got: ", store.attempts)
+	}
+
+	// Retries are bounded and the request fails closed
+	code, store = doSessionWriteFailureRequest(t, 10, false)
+	if code != 503 {
+		t.Error("Persistent write failure should fail closed with 503, got: ", code)
+	}
+	if store.attempts != 3 {
+		t.Error("Expected 3 write attempts, got: ", store.attempts)
+	}
+
+	// The total backoff is capped, waits of 1ms and 2ms fit in 3ms but 4ms more doesn't
+	config.SessionWriteRetry.MaxRetries = 10
+	config.SessionWriteRetry.MaxBackoffMs = 3
+	_, store = doSessionWriteFailureRequest(t, 10, false)
+	if store.attempts != 3 {
+		t.Error("Expected the backoff cap to stop retries after 3 write attempts, got: ", store.attempts)
+	}
+
+	// Nobody is waiting for the response, so there is no point retrying
+	_, store = doSessionWriteFailureRequest(t, 10, true)
+	if store.attempts != 1 {
+		t.Error("Expected no retries once the client is gone, got attempts: ", store.attempts)
+	}
+
+	// Failing open lets the request through
+	config.SessionWriteRetry.FailClosed = false
+	code, _ = doSessionWriteFailureRequest(t, 10, false)
+	if code != 200 {
+		t.Error("Persistent write failure should fail open, got: ", code)
+	}
+}
+
+func TestOrgRateLimit(t *testing.T) {
+	defer func() { config.EnforceOrgQuotas = false }()
+	config.EnforceOrgQuotas = true
+
+	spec := createNonVersionedDefinition()
+	spec.APIDefinition.OrgID = "org-" + randSeq(10)
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+
+	orgSession := createNonThrottledSession()
+	orgSession.Rate = 3
+	orgSession.Per = 60
+	orgSession.QuotaMax = -1
+	spec.OrgSessionManager.UpdateSession(spec.OrgID, orgSession, 60)
+
+	// Each key is well within its own rate limit
+	keys := []string{randSeq(10), randSeq(10)}
+	for _, keyId := range keys {
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+	}
+
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, &spec))
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	chain := alice.New(
+		CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&RateLimitAndQuotaCheck{tykMiddleware}, tykMiddleware)).Then(proxyHandler)
+
+	// The sentinel is set by the write of the request that reaches the rate
+	for i, expected := range []int{200, 200, 200, 429} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keys[i%2])
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != expected {
+			t.Errorf("Request %v: expected %v, got %v", i, expected, recorder.Code)
+		}
+
+		// The rolling window is written off thread
+		waitForRateWindow(t, orgStore, spec.OrgID, i+1, i+1 >= int(orgSession.Rate))
+	}
+}
+
+func TestNegativeAuthCache(t *testing.T) {
+	defer func() { config.LocalSessionCache.NegativeCacheTimeout = 0 }()
+	config.LocalSessionCache.NegativeCacheTimeout = 1
+
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	tykMiddleware := &TykMiddleware{Spec: &spec}
+
+	keyId := randSeq(10)
+	if _, found := tykMiddleware.CheckSessionAndIdentityForValidKey(keyId); found {
+		t.Fatal("Key should not exist yet")
+	}
+
+	// Written behind the gateway's back, the miss is still cached
+	sessionJSON, _ := json.Marshal(createNonThrottledSession())
+	redisStore.SetKey(keyId, string(sessionJSON), 60)
+	if _, found := tykMiddleware.CheckSessionAndIdentityForValidKey(keyId); found {
+		t.Error("Repeated lookup should be served from the negative cache")
+	}
+
+	// The entry expires
+	time.Sleep(1100 * time.Millisecond)
+	if _, found := tykMiddleware.CheckSessionAndIdentityForValidKey(keyId); !found {
+		t.Error("Key should be found once the negative cache entry expired")
+	}
+}
+
+func TestNegativeAuthCacheInvalidatedOnCreate(t *testing.T) {
+	defer func() { config.LocalSessionCache.NegativeCacheTimeout = 0 }()
+	config.LocalSessionCache.NegativeCacheTimeout = 60
+
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	tykMiddleware := &TykMiddleware{Spec: &spec}
+
+	keyId := randSeq(10)
+	if _, found := tykMiddleware.CheckSessionAndIdentityForValidKey(keyId); found {
+		t.Fatal("Key should not exist yet")
+	}
+
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+	if _, found := tykMiddleware.CheckSessionAndIdentityForValidKey(keyId); !found {
+		t.Error("Newly created key should not be blocked by the negative cache")
+	}
+}
+
+func TestNegativeAuthCacheEvictsOldest(t *testing.T) {
+	defer func() {
+		config.LocalSessionCache.NegativeCacheTimeout = 0
+		config.LocalSessionCache.NegativeCacheMaxEntries = 0
+	}()
+	config.LocalSessionCache.NegativeCacheTimeout = 60
+	config.LocalSessionCache.NegativeCacheMaxEntries = 2
+
+	oldest, older, newest := randSeq(10), randSeq(10), randSeq(10)
+	cacheNegativeAuthResult(oldest)
+	cacheNegativeAuthResult(older)
+	cacheNegativeAuthResult(newest)
+
+	if _, found := NegativeAuthCache.Get(oldest); found {
+		t.Error("The oldest entry should have been evicted to make room")
+	}
+	for _, key := range []string{older, newest} {
+		if _, found := NegativeAuthCache.Get(key); !found {
+			t.Error("A full cache should still take new misses, missing: ", key)
+		}
+	}
+}
+
+func TestNegativeAuthCacheInvalidateFreesEntry(t *testing.T) {
+	defer func() {
+		config.LocalSessionCache.NegativeCacheTimeout = 0
+		config.LocalSessionCache.NegativeCacheMaxEntries = 0
+	}()
+	config.LocalSessionCache.NegativeCacheTimeout = 60
+	config.LocalSessionCache.NegativeCacheMaxEntries = 2
+
+	created, missing, newest := randSeq(10), randSeq(10), randSeq(10)
+	cacheNegativeAuthResult(created)
+	cacheNegativeAuthResult(missing)
+
+	// A key that was saved no longer takes up room, so the next miss doesn't evict a live entry
+	invalidateNegativeAuthResult(created)
+	cacheNegativeAuthResult(newest)
+
+	if _, found := NegativeAuthCache.Get(created); found {
+		t.Error("The saved key should not be cached as a miss")
+	}
+	for _, key := range []string{missing, newest} {
+		if _, found := NegativeAuthCache.Get(key); !found {
+			t.Error("Live entries should not be evicted for a saved key, missing: ", key)
+		}
+	}
+}
+
+func TestIsErrorStatusCode(t *testing.T) {
+	defer func() { config.ErrorStatusCodes = nil }()
+
+	if IsErrorStatusCode(404) {
+		t.Error("404 should not be an error by default")
+	}
+	if !IsErrorStatusCode(502) {
+		t.Error("502 should be an error by default")
+	}
+
+	config.ErrorStatusCodes = []string{"4xx", "5xx"}
+	if !IsErrorStatusCode(404) || !IsErrorStatusCode(500) {
+		t.Error("4xx and 5xx should be errors when configured")
+	}
+
+	config.ErrorStatusCodes = []string{"5xx", "429"}
+	if IsErrorStatusCode(404) {
+		t.Error("404 should not be an error when only 429 is configured")
+	}
+	if !IsErrorStatusCode(429) {
+		t.Error("429 should be an error when configured")
+	}
+}
+
+func TestIsBreakerFailureCode(t *testing.T) {
+	defer func() { config.ErrorStatusCodes = nil }()
+
+	if !IsBreakerFailureCode(500) {
+		t.Error("500 should trip a breaker by default")
+	}
+	if IsBreakerFailureCode(502) || IsBreakerFailureCode(404) {
+		t.Error("Only 500 should trip a breaker when no error codes are configured")
+	}
+
+	config.ErrorStatusCodes = []string{"502", "429"}
+	if !IsBreakerFailureCode(502) || !IsBreakerFailureCode(429) {
+		t.Error("Configured codes should trip a breaker")
+	}
+	if IsBreakerFailureCode(500) {
+		t.Error("500 should not trip a breaker when it isn't one of the configured codes")
+	}
+}
+
+func TestAnalyticsRecordIsError(t *testing.T) {
+	defer func() { config.ErrorStatusCodes = nil }()
+	config.EnableAnalytics = true
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	defer upstream.Close()
+
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("errors", sink)
+	defer delete(AnalyticsSinks, "errors")
+
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "errors",`, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+	chain := getChain(spec)
+
+	for _, errorCodes := range [][]string{nil, {"4xx", "5xx"}} {
+		config.ErrorStatusCodes = errorCodes
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		select {
+		case thisRecord := <-sink.records:
+			if thisRecord.ResponseCode != 404 {
+				t.Fatal("Expected a 404 record, got: ", thisRecord.ResponseCode)
+			}
+			if thisRecord.IsError != (errorCodes != nil) {
+				t.Errorf("404 with error codes %v should have IsError %v", errorCodes, errorCodes != nil)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Record was not sent to the sink")
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	config.EnableAnalytics = true
+	upstreamIDs := make(chan string, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamIDs <- r.Header.Get("X-Request-ID")
+		// Echoed IDs must not be duplicated
+		w.Header().Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+	}))
+	defer upstream.Close()
+
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("request-ids", sink)
+	defer delete(AnalyticsSinks, "request-ids")
+
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "request-ids",`, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+	chain := getChain(spec)
+
+	for _, incomingID := range []string{"client-request-1", "", strings.Repeat("a", 200), "bad\x01id"} {
+		keepID := incomingID == "client-request-1"
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		if incomingID != "" {
+			req.Header.Set("X-Request-ID", incomingID)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		responseIDs := recorder.HeaderMap["X-Request-Id"]
+		if len(responseIDs) != 1 {
+			t.Fatal("Expected one request ID on the response, got: ", responseIDs)
+		}
+		requestID := responseIDs[0]
+		if keepID && requestID != incomingID {
+			t.Error("Incoming request ID should be kept, got: ", requestID)
+		}
+		if !keepID && len(requestID) != 36 {
+			t.Errorf("A UUID request ID should be generated for %q, got: %s", incomingID, requestID)
+		}
+
+		if upstreamID := <-upstreamIDs; upstreamID != requestID {
+			t.Error("Request ID should be passed to the upstream, got: ", upstreamID)
+		}
+
+		select {
+		case thisRecord := <-sink.records:
+			if thisRecord.RequestID != requestID {
+				t.Error("Request ID should be stored on the analytics record, got: ", thisRecord.RequestID)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Record was not sent to the sink")
+		}
+	}
+}
+
+func TestRateLimitExemptPaths(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "rate_limit_exempt_paths": ["^/health$", "^/version"],`, 1))
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createThrottledSession(), 60)
+
+	send := func(path, key string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Add("authorization", key)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		for _, path := range []string{"/health", "/version/info"} {
+			if code := send(path, keyId); code != 200 {
+				t.Fatalf("Exempt path %v request %v: expected 200, got %v", path, i+1, code)
+			}
+		}
+	}
+
+	if code := send("/health", "not-a-key"); code != 403 {
+		t.Errorf("Exempt paths should still be authenticated, expected 403, got %v", code)
+	}
+
+	// The exempt requests didn't use any of the allowance, so the limit is only hit after 3 requests
+	codes := []int{}
+	for i := 0; i < 4; i++ {
+		codes = append(codes, send("/other", keyId))
+		// The rolling window is written off thread
+		time.Sleep(50 * time.Millisecond)
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[3] != 429 {
+		t.Errorf("Non exempt path should be rate limited, got %v", codes)
+	}
+}
+
+func TestAnalyticsTagLimits(t *testing.T) {
+	defer func() {
+		config.AnalyticsConfig.MaxTags = 0
+		config.AnalyticsConfig.MaxTagsSize = 0
+	}()
+
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("tag-limits", sink)
+	defer delete(AnalyticsSinks, "tag-limits")
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "tag-limits",`, 1))
+
+	tags := []string{"one", "two", "three", "four", strings.Repeat("x", 100)}
+
+	for _, tc := range []struct {
+		name     string
+		maxTags  int
+		maxSize  int
+		expected []string
+	}{
+		{"no limits", 0, 0, tags},
+		{"tag count", 2, 0, []string{"one", "two"}},
+		{"tag size", 0, 12, []string{"one", "two", "three"}},
+		{"oversized tag", 0, 50, []string{"one", "two", "three", "four"}},
+		{"both", 3, 8, []string{"one", "two"}},
+		{"within limits", 10, 1000, tags},
+	} {
+		config.AnalyticsConfig.MaxTags = tc.maxTags
+		config.AnalyticsConfig.MaxTagsSize = tc.maxSize
+		recordAnalytics(&spec, AnalyticsRecord{APIID: spec.APIID, Tags: tags})
+
+		record := <-sink.records
+		if strings.Join(record.Tags, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%v: expected tags %v, got %v", tc.name, tc.expected, record.Tags)
+		}
+	}
+}
+
+func TestDebugRecordingHeader(t *testing.T) {
+	upstreamHeaders := make(chan http.Header, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders <- r.Header
+		w.Write([]byte("upstream body"))
+	}))
+	defer upstream.Close()
+
+	const debugSecret = "0123456789abcdef0123456789abcdef"
+	enableAnalytics := config.EnableAnalytics
+	defer func() {
+		config.EnableAnalytics = enableAnalytics
+		config.AnalyticsConfig.DebugRecordingHeader = ""
+		config.AnalyticsConfig.DebugRecordingSecret = ""
+	}()
+	config.EnableAnalytics = true
+	config.AnalyticsConfig.DebugRecordingHeader = "X-Tyk-Debug-Record"
+
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("debug-recording", sink)
+	defer delete(AnalyticsSinks, "debug-recording")
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "debug-recording",`, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for _, tc := range []struct {
+		name           string
+		configSecret   string
+		headerValue    string
+		expectDetailed bool
+	}{
+		{"no header", debugSecret, "", false},
+		{"wrong secret", debugSecret, "not-the-secret", false},
+		{"valid secret", debugSecret, debugSecret, true},
+		{"secret too short", "short", "short", false},
+		{"no secret configured", "", "", false},
+	} {
+		config.AnalyticsConfig.DebugRecordingSecret = tc.configSecret
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		if tc.headerValue != "" {
+			req.Header.Set("X-Tyk-Debug-Record", tc.headerValue)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Fatalf("%v: expected 200, got %v", tc.name, recorder.Code)
+		}
+		if header := (<-upstreamHeaders).Get("X-Tyk-Debug-Record"); header != "" {
+			t.Errorf("%v: debug header should not reach the upstream, got %v", tc.name, header)
+		}
+
+		select {
+		case thisRecord := <-sink.records:
+			if detailed := thisRecord.RawRequest != "" && thisRecord.RawResponse != ""; detailed != tc.expectDetailed {
+				t.Errorf("%v: expected detailed recording %v, got %v", tc.name, tc.expectDetailed, detailed)
+			}
+			rawRequest, _ := b64.StdEncoding.DecodeString(thisRecord.RawRequest)
+			if strings.Contains(string(rawRequest), debugSecret) {
+				t.Errorf("%v: debug secret should not be recorded", tc.name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: no analytics record", tc.name)
+		}
+	}
+}
+
+func TestPolicyMetaData(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	Policies["plan-policy"] = Policy{
+		ID:       "plan-policy",
+		OrgID:    spec.OrgID,
+		Rate:     100,
+		Per:      1,
+		QuotaMax: -1,
+		MetaData: map[string]interface{}{"plan": "gold", "tier": 2, "account": float64(1234567)},
+	}
+	defer delete(Policies, "plan-policy")
+
+	chain := getChain(spec)
+	thisSession := createStandardSession()
+	thisSession.ApplyPolicyID = "plan-policy"
+	thisSession.MetaData = map[string]interface{}{"customer": "acme", "plan": "silver"}
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	appliedSession, _ := spec.SessionManager.GetSessionDetail(keyId)
+	metaData, ok := appliedSession.MetaData.(map[string]interface{})
+	if !ok {
+		t.Fatal("Session should have meta data, got: ", appliedSession.MetaData)
+	}
+	if metaData["plan"] != "gold" || metaData["customer"] != "acme" || metaData["tier"] != float64(2) {
+		t.Error("Policy meta data should be merged into the session, got: ", metaData)
+	}
+
+	// The policy attributes can be sent upstream as headers
+	upstreamReq, _ := http.NewRequest("GET", "/", nil)
+	context.Set(upstreamReq, SessionData, appliedSession)
+	defer context.Clear(upstreamReq)
+	(&TransformHeaders{&TykMiddleware{&spec, nil}}).iterateAddHeaders(map[string]string{
+		"X-Plan":    "$tyk_meta.plan",
+		"X-Tier":    "$tyk_meta.tier",
+		"X-Account": "$tyk_meta.account",
+	}, upstreamReq)
+
+	if upstreamReq.Header.Get("X-Plan") != "gold" || upstreamReq.Header.Get("X-Tier") != "2" || upstreamReq.Header.Get("X-Account") != "1234567" {
+		t.Error("Policy meta data should be injectable as headers, got: ", upstreamReq.Header)
+	}
+}
+
+func TestPolicyMetaDataLeavesSessionMapAlone(t *testing.T) {
+	// A session from the SessionCache shares its meta data map with every request holding a copy
+	cachedMetaData := map[string]interface{}{"customer": "acme"}
+	thisSession := SessionState{MetaData: cachedMetaData}
+	applyPolicyMetaData(&thisSession, map[string]interface{}{"plan": "gold"})
+
+	if len(cachedMetaData) != 1 {
+		t.Error("The policy meta data must not be written into the shared map, got: ", cachedMetaData)
+	}
+	if metaData := thisSession.MetaData.(map[string]interface{}); metaData["plan"] != "gold" || metaData["customer"] != "acme" {
+		t.Error("Expected the merged meta data on the session, got: ", metaData)
+	}
+}
+
+func TestStrictPolicies(t *testing.T) {
+	strictSpec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "strict_policies": true,`, 1))
+	lenientSpec := createDefinitionFromString(nonExpiringDefNoWhiteList)
+	strictChain := getChain(strictSpec)
+	lenientChain := getChain(lenientSpec)
+
+	Policies["strict-policy"] = Policy{ID: "strict-policy", OrgID: strictSpec.OrgID, Rate: 100, Per: 1, QuotaMax: -1}
+	Policies["strict-other-org"] = Policy{ID: "strict-other-org", OrgID: "another-org", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "strict-policy")
+	defer delete(Policies, "strict-other-org")
+
+	for _, tc := range []struct {
+		name        string
+		policyID    string
+		perAPI      string
+		version     int
+		strictCode  int
+		lenientCode int
+	}{
+		{"policy found", "strict-policy", "", 0, 200, 200},
+		{"missing policy", "strict-missing", "", 0, 403, 200},
+		{"cross-org policy", "strict-other-org", "", 0, 403, 200},
+		{"missing per-API policy", "strict-policy", "strict-missing", 0, 403, 200},
+		{"cross-org per-API policy", "strict-policy", "strict-other-org", 0, 403, 200},
+		{"missing pinned version", "strict-policy", "", 7, 403, 200},
+	} {
+		for _, chainCase := range []struct {
+			spec  APISpec
+			chain http.Handler
+			code  int
+		}{
+			{strictSpec, strictChain, tc.strictCode},
+			{lenientSpec, lenientChain, tc.lenientCode},
+		} {
+			thisSession := createNonThrottledSession()
+			thisSession.ApplyPolicyID = tc.policyID
+			thisSession.ApplyPolicyVersion = tc.version
+			if tc.perAPI != "" {
+				thisSession.PolicyPerAPI = map[string]string{chainCase.spec.APIID: tc.perAPI}
+			}
+			keyId := randSeq(10)
+			chainCase.spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Add("authorization", keyId)
+			chainCase.chain.ServeHTTP(recorder, req)
+
+			if recorder.Code != chainCase.code {
+				t.Errorf("%v (strict %v): expected %v, got %v", tc.name, chainCase.spec.Options.StrictPolicies, chainCase.code, recorder.Code)
+			}
+		}
+	}
+}
+
+func TestParseLimitSpec(t *testing.T) {
+	specs := []struct {
+		spec   string
+		amount float64
+		per    float64
+	}{
+		{"10/second", 10, 1},
+		{"60/minute", 60, 60},
+		{"500 / hour", 500, 3600},
+		{"1000/day", 1000, 86400},
+		{"5000/week", 5000, 604800},
+		{"100/15 minutes", 100, 900},
+		{"2.5/Seconds", 2.5, 1},
+	}
+	for _, s := range specs {
+		amount, per, err := ParseLimitSpec(s.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", s.spec, err)
+			continue
+		}
+		if amount != s.amount || per != s.per {
+			t.Errorf("%q: expected %v/%v, got %v/%v", s.spec, s.amount, s.per, amount, per)
+		}
+	}
+
+	for _, spec := range []string{"", "1000", "1000/fortnight", "/day", "ten/day", "10/0 minutes", "10/day/hour"} {
+		if _, _, err := ParseLimitSpec(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestPolicyLimitSpecs(t *testing.T) {
+	policyFile, _ := ioutil.TempFile("", "policies")
+	defer os.Remove(policyFile.Name())
+	defer func() {
+		config.Policies.PolicyRecordName = ""
+		Policies = make(map[string]Policy)
+	}()
+	config.Policies.PolicyRecordName = policyFile.Name()
+
+	ioutil.WriteFile(policyFile.Name(), []byte(`{
+		"spec": {"rate": 1, "per": 1, "rate_limit": "100/minute", "quota": "1000/day"},
+		"numeric": {"rate": 5, "per": 10, "quota_max": 20, "quota_renewal_rate": 3600}
+	}`), 0644)
+	getPolicies()
+
+	policy := Policies["spec"]
+	if policy.Rate != 100 || policy.Per != 60 || policy.QuotaMax != 1000 || policy.QuotaRenewalRate != 86400 {
+		t.Error("Limit specs should set the numeric fields, got: ", policy)
+	}
+	policy = Policies["numeric"]
+	if policy.Rate != 5 || policy.Per != 10 || policy.QuotaMax != 20 || policy.QuotaRenewalRate != 3600 {
+		t.Error("Numeric limits should be left alone, got: ", policy)
+	}
+
+	// A malformed spec rejects the whole load
+	ioutil.WriteFile(policyFile.Name(), []byte(`{
+		"spec": {"rate_limit": "100/minute"},
+		"broken": {"quota": "1.5/day"}
+	}`), 0644)
+	getPolicies()
+
+	if _, found := Policies["broken"]; found {
+		t.Error("Policies with malformed limits should not be loaded")
+	}
+	if Policies["spec"].QuotaMax != 1000 {
+		t.Error("The previous policies should be kept, got: ", Policies)
+	}
+}
+
+func TestRPCPolicyCacheFallback(t *testing.T) {
+	cacheFile, _ := ioutil.TempFile("", "rpc-policies")
+	os.Remove(cacheFile.Name())
+	defer os.Remove(cacheFile.Name())
+	defer func() {
+		config.SlaveOptions.PolicyCacheFile = ""
+		GetPoliciesFromRPC = getPoliciesFromRPCStore
+	}()
+	config.SlaveOptions.PolicyCacheFile = cacheFile.Name()
+
+	rpcPolicies := `[{"_id": "525d4c8f1ef3bd4c95000001", "rate": 100, "per": 60}]`
+	GetPoliciesFromRPC = func(orgId string) string { return rpcPolicies }
+
+	// Nothing cached yet, so a failure is an error
+	rpcPolicies = ""
+	if _, err := LoadPoliciesFromRPC("default"); err == nil {
+		t.Error("A failed RPC load without a cache should be an error")
+	}
+
+	rpcPolicies = `[{"_id": "525d4c8f1ef3bd4c95000001", "rate": 100, "per": 60}]`
+	policies, err := LoadPoliciesFromRPC("default")
+	if err != nil || policies["525d4c8f1ef3bd4c95000001"].Rate != 100 {
+		t.Fatal("Expected the RPC policies to load, got: ", policies, err)
+	}
+
+	rpcPolicies = ""
+	policies, err = LoadPoliciesFromRPC("default")
+	if err != nil {
+		t.Fatal("A failed RPC load should fall back to the cache, got: ", err)
+	}
+	if policy, found := policies["525d4c8f1ef3bd4c95000001"]; !found || policy.Rate != 100 || policy.ID != "525d4c8f1ef3bd4c95000001" {
+		t.Error("Expected the cached policies, got: ", policies)
+	}
+
+	// A bad response must not overwrite the cache
+	rpcPolicies = `[{"_id": "525d4c8f1ef3bd4c95000001", "rate": 5`
+	policies, _ = LoadPoliciesFromRPC("default")
+	if policies["525d4c8f1ef3bd4c95000001"].Rate != 100 {
+		t.Error("Expected the cached policies after a malformed response, got: ", policies)
+	}
+
+	// A cache file others can write to could hold anyone's policies
+	os.Chmod(cacheFile.Name(), 0666)
+	rpcPolicies = ""
+	if _, err := LoadPoliciesFromRPC("default"); err == nil {
+		t.Error("A cache file writable by other users should not be loaded")
+	}
+}
+
+func TestRPCPolicyCacheDisabledByDefault(t *testing.T) {
+	defer func() { GetPoliciesFromRPC = getPoliciesFromRPCStore }()
+	config.SlaveOptions.PolicyCacheFile = ""
+
+	rpcPolicies := `[{"_id": "525d4c8f1ef3bd4c95000001", "rate": 100, "per": 60}]`
+	GetPoliciesFromRPC = func(orgId string) string { return rpcPolicies }
+	if _, err := LoadPoliciesFromRPC("default"); err != nil {
+		t.Fatal("Expected the RPC policies to load, got: ", err)
+	}
+
+	rpcPolicies = ""
+	if _, err := LoadPoliciesFromRPC("default"); err == nil {
+		t.Error("Without a cache file a failed RPC load should be an error")
+	}
+}
+
+func TestAnalyticsTLSDetails(t *testing.T) {
+	enableAnalytics := config.EnableAnalytics
+	defer func() { config.EnableAnalytics = enableAnalytics }()
+	config.EnableAnalytics = true
+
+	spec, sink := createRecordedSpec("tls", "http://example.com")
+	defer delete(AnalyticsSinks, "tls")
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	sh := SuccessHandler{&TykMiddleware{&spec, nil}}
+
+	plainReq, _ := http.NewRequest("GET", "/", nil)
+	tlsReq, _ := http.NewRequest("GET", "/", nil)
+	tlsReq.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+
+	unknownReq, _ := http.NewRequest("GET", "/", nil)
+	unknownReq.TLS = &tls.ConnectionState{Version: 0x0304, CipherSuite: 0x1301}
+
+	for _, req := range []*http.Request{plainReq, tlsReq, unknownReq} {
+		sh.RecordHit(httptest.NewRecorder(), req, 0, 200, nil, nil)
+	}
+
+	expected := [][2]string{{"", ""}, {"TLS 1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, {"0x0304", "0x1301"}}
+	for _, details := range expected {
+		select {
+		case thisRecord := <-sink.records:
+			if thisRecord.TLSVersion != details[0] || thisRecord.TLSCipher != details[1] {
+				t.Errorf("Expected %v, got %q %q", details, thisRecord.TLSVersion, thisRecord.TLSCipher)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No analytics record")
+		}
+	}
+}
+
+func TestAnalyticsVersionResolution(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	enableAnalytics := config.EnableAnalytics
+	defer func() { config.EnableAnalytics = enableAnalytics }()
+	config.EnableAnalytics = true
+
+	for _, tc := range []struct {
+		location     string
+		notVersioned bool
+		path         string
+		header       string
+		source       string
+	}{
+		{"header", false, "/api/widgets", "v1", "header"},
+		{"url-param", false, "/api/widgets?version=v1", "", "url-param"},
+		{"url", false, "/api/v1/widgets", "", "url"},
+		{"header", true, "/api/widgets", "", ""},
+	} {
+		spec, sink := createRecordedSpec("versions", upstream.URL)
+		spec.VersionData.NotVersioned = tc.notVersioned
+		spec.VersionDefinition.Location = tc.location
+		spec.VersionDefinition.Key = "version"
+		spec.Proxy.ListenPath = "/api/"
+		chain := getChain(spec)
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		// The url-param location reads the form, which needs a body
+		req, _ := http.NewRequest("GET", tc.path, strings.NewReader(""))
+		req.Header.Add("authorization", keyId)
+		if tc.header != "" {
+			req.Header.Add("version", tc.header)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Errorf("%v (not versioned: %v): expected 200, got %v", tc.location, tc.notVersioned, recorder.Code)
+		}
+		select {
+		case thisRecord := <-sink.records:
+			if thisRecord.VersionSource != tc.source || thisRecord.NotVersioned != tc.notVersioned {
+				t.Errorf("%v (not versioned: %v): got source %q, not versioned %v", tc.location, tc.notVersioned, thisRecord.VersionSource, thisRecord.NotVersioned)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No analytics record")
+		}
+		delete(AnalyticsSinks, "versions")
+	}
+}
+
+type brokenBody struct{}
+
+func (b brokenBody) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestAnalyticsCaptureFailure(t *testing.T) {
+	enableAnalytics := config.EnableAnalytics
+	detailed := config.AnalyticsConfig.EnableDetailedRecording
+	defer func() {
+		config.EnableAnalytics = enableAnalytics
+		config.AnalyticsConfig.EnableDetailedRecording = detailed
+	}()
+	config.EnableAnalytics = true
+	config.AnalyticsConfig.EnableDetailedRecording = true
+
+	spec, sink := createRecordedSpec("capture", "http://example.com")
+	defer delete(AnalyticsSinks, "capture")
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	sh := SuccessHandler{&TykMiddleware{&spec, nil}}
+
+	nextRecord := func() AnalyticsRecord {
+		select {
+		case thisRecord := <-sink.records:
+			return thisRecord
+		case <-time.After(time.Second):
+			t.Fatal("No analytics record")
+		}
+		return AnalyticsRecord{}
+	}
+
+	// A body that fails to read
+	req, _ := http.NewRequest("POST", "/widgets", ioutil.NopCloser(brokenBody{}))
+	sh.RecordHit(httptest.NewRecorder(), req, 0, 200, CopyHttpRequest(req), nil)
+	thisRecord := nextRecord()
+	if thisRecord.Method != "POST" || thisRecord.Path != "/widgets" || thisRecord.ResponseCode != 200 {
+		t.Error("The basic details should still be recorded, got: ", thisRecord)
+	}
+	if thisRecord.RawRequest != "" || !strings.Contains(thisRecord.CaptureError, "connection reset") {
+		t.Errorf("Expected the capture failure to be recorded, got %q %q", thisRecord.RawRequest, thisRecord.CaptureError)
+	}
+
+	// No copy made at all
+	req, _ = http.NewRequest("GET", "/widgets", nil)
+	sh.RecordHit(httptest.NewRecorder(), req, 0, 200, nil, nil)
+	if thisRecord := nextRecord(); thisRecord.CaptureError != "request: not copied" {
+		t.Errorf("Expected a missing copy to be recorded, got %q", thisRecord.CaptureError)
+	}
+
+	// An empty body is captured without an error
+	req, _ = http.NewRequest("GET", "/widgets", nil)
+	sh.RecordHit(httptest.NewRecorder(), req, 0, 200, CopyHttpRequest(req), nil)
+	if thisRecord := nextRecord(); thisRecord.RawRequest == "" || thisRecord.CaptureError != "" {
+		t.Errorf("Expected the request to be captured, got %q %q", thisRecord.RawRequest, thisRecord.CaptureError)
+	}
+}
+
+func TestFlushAnalyticsOnShutdown(t *testing.T) {
+	spec, sink := createRecordedSpec("shutdown", "http://example.com")
+	defer delete(AnalyticsSinks, "shutdown")
+
+	for i := 0; i < 5; i++ {
+		queueAnalyticsRecord(&spec, AnalyticsRecord{APIID: spec.APIID})
+	}
+	flushed, dropped := FlushAnalytics(time.Second)
+	if flushed != 5 || dropped != 0 {
+		t.Errorf("Expected 5 records flushed and none dropped, got %v and %v", flushed, dropped)
+	}
+	if len(sink.records) != 5 {
+		t.Error("Expected the queued records to be stored, got: ", len(sink.records))
+	}
+
+	// A sink that doesn't take the records before the timeout drops them
+	blockedSink := recordingAnalyticsSink{make(chan AnalyticsRecord)}
+	RegisterAnalyticsSink("shutdown", blockedSink)
+	for i := 0; i < 2; i++ {
+		queueAnalyticsRecord(&spec, AnalyticsRecord{APIID: spec.APIID})
+	}
+	flushed, dropped = FlushAnalytics(50 * time.Millisecond)
+	if flushed != 0 || dropped != 2 {
+		t.Errorf("Expected 2 records dropped, got %v flushed and %v dropped", flushed, dropped)
+	}
+	<-blockedSink.records
+	<-blockedSink.records
+}
+
+func TestAnalyticsIgnoredIPsTrustedProxies(t *testing.T) {
+	enableAnalytics, ignoredIPs := config.EnableAnalytics, config.AnalyticsConfig.IgnoredIPs
+	defer func() {
+		config.EnableAnalytics = enableAnalytics
+		config.AnalyticsConfig.IgnoredIPs = ignoredIPs
+		config.loadIgnoredIPs()
+		config.TrustedProxies = nil
+		config.loadTrustedProxies()
+	}()
+	config.EnableAnalytics = true
+	config.AnalyticsConfig.IgnoredIPs = []string{"192.0.2.10"}
+	config.loadIgnoredIPs()
+	config.TrustedProxies = []string{"10.0.0.1"}
+	config.loadTrustedProxies()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.10")
+	if !config.StoreAnalytics(req) {
+		t.Error("A client should not be able to skip analytics by spoofing an ignored IP")
+	}
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	if config.StoreAnalytics(req) {
+		t.Error("An ignored IP forwarded by a trusted proxy should not be recorded")
+	}
+}
+
+func TestPolicyVersionPinning(t *testing.T) {
+	policyFile, _ := ioutil.TempFile("", "policies")
+	defer os.Remove(policyFile.Name())
+	defer func() {
+		config.Policies.PolicyRecordName = ""
+		Policies = make(map[string]Policy)
+	}()
+	config.Policies.PolicyRecordName = policyFile.Name()
+
+	ioutil.WriteFile(policyFile.Name(), []byte(`{
+		"billing": {"org_id": "default", "version": 1, "rate": 10, "per": 1, "quota_max": -1}
+	}`), 0644)
+	getPolicies()
+
+	spec := createNonVersionedDefinition()
+	chain := getChain(spec)
+	applyPolicy := func(keyId string) SessionState {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		appliedSession, _ := spec.SessionManager.GetSessionDetail(keyId)
+		return appliedSession
+	}
+
+	latestKey, pinnedKey := randSeq(10), randSeq(10)
+	latestSession := createStandardSession()
+	latestSession.ApplyPolicyID = "billing"
+	pinnedSession := latestSession
+	pinnedSession.ApplyPolicyVersion = 1
+	spec.SessionManager.UpdateSession(latestKey, latestSession, 60)
+	spec.SessionManager.UpdateSession(pinnedKey, pinnedSession, 60)
+
+	if applyPolicy(latestKey).Rate != 10 || applyPolicy(pinnedKey).Rate != 10 {
+		t.Fatal("Both sessions should get version 1 of the policy")
+	}
+
+	// Edit the policy, the old version is kept with it
+	ioutil.WriteFile(policyFile.Name(), []byte(`{
+		"billing": {"org_id": "default", "version": 2, "rate_limit": "100/second", "quota_max": -1,
+			"previous_versions": [{"version": 1, "rate_limit": "10/second", "quota_max": -1}]}
+	}`), 0644)
+	getPolicies()
+
+	if rate := applyPolicy(latestKey).Rate; rate != 100 {
+		t.Error("Unpinned sessions should get the latest version, got rate: ", rate)
+	}
+	if rate := applyPolicy(pinnedKey).Rate; rate != 10 {
+		t.Error("Pinned sessions should keep their version, got rate: ", rate)
+	}
+
+	// Sessions pinned to the new version get it, an unknown version leaves the session as it is
+	migratedKey, unknownKey := randSeq(10), randSeq(10)
+	migratedSession := pinnedSession
+	migratedSession.ApplyPolicyVersion = 2
+	unknownSession := pinnedSession
+	unknownSession.ApplyPolicyVersion = 7
+	unknownSession.Rate = 42
+	spec.SessionManager.UpdateSession(migratedKey, migratedSession, 60)
+	spec.SessionManager.UpdateSession(unknownKey, unknownSession, 60)
+
+	if rate := applyPolicy(migratedKey).Rate; rate != 100 {
+		t.Error("Migrated sessions should get the new version, got rate: ", rate)
+	}
+	if rate := applyPolicy(unknownKey).Rate; rate != 42 {
+		t.Error("Sessions pinned to an unknown version should be left alone, got rate: ", rate)
+	}
+}
+
+func TestPolicyEditReachesCachedSessions(t *testing.T) {
+	policyFile, _ := ioutil.TempFile("", "policies")
+	defer os.Remove(policyFile.Name())
+	defer func() {
+		config.Policies.PolicyRecordName = ""
+		Policies = make(map[string]Policy)
+	}()
+	config.Policies.PolicyRecordName = policyFile.Name()
+	spec := createNonVersionedDefinition()
+
+	writePolicies := func(baseRate, apiRate int) {
+		ioutil.WriteFile(policyFile.Name(), []byte(fmt.Sprintf(`{
+			"base-plan": {"org_id": "default", "rate": %v, "per": 1, "quota_max": -1, "policy_per_api": {"%v": "api-plan"}},
+			"api-plan": {"org_id": "default", "rate": %v, "per": 1, "quota_max": -1}
+		}`, baseRate, spec.APIID, apiRate)), 0644)
+		getPolicies()
+	}
+	writePolicies(100, 50)
+
+	chain := getChain(spec)
+	thisSession := createStandardSession()
+	thisSession.ApplyPolicyID = "base-plan"
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+	sendRequest := func() {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Expected the request to pass, got: ", recorder.Code)
+		}
+		// The per-API session is written off thread
+		time.Sleep(50 * time.Millisecond)
+	}
+	sendRequest()
+	sendRequest()
+
+	// The session is now in the local cache, edit the policies
+	if _, cached := SessionCache.Get(keyId); !cached {
+		t.Fatal("The session should be cached")
+	}
+	writePolicies(200, 75)
+	sendRequest()
+
+	baseSession, _ := spec.SessionManager.GetSessionDetail(keyId)
+	if baseSession.Rate != 200 {
+		t.Error("The base session should get the edited policy, got rate: ", baseSession.Rate)
+	}
+	apiSession, _ := spec.SessionManager.GetSessionDetail(PerAPISessionKey(keyId, spec.APIID))
+	if apiSession.Rate != 75 {
+		t.Error("The per-API session should get the edited policy, got rate: ", apiSession.Rate)
+	}
+}
+
+func TestRateOverridePrecedence(t *testing.T) {
+	Policies = map[string]Policy{
+		"strict-plan": {OrgID: "default", Rate: 2, Per: 60, QuotaMax: -1},
+	}
+	defer func() { Policies = make(map[string]Policy) }()
+
+	spec := createNonVersionedDefinition()
+	chain := getChain(spec)
+
+	// Returns how many of the requests were let through
+	sendRequests := func(metaData interface{}) (int, string) {
+		thisSession := createStandardSession()
+		thisSession.Rate, thisSession.Per = 1000, 1
+		thisSession.ApplyPolicyID = "strict-plan"
+		thisSession.MetaData = metaData
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+		passed := 0
+		for i := 0; i < 5; i++ {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.Header.Add("authorization", keyId)
+			chain.ServeHTTP(recorder, req)
+			if recorder.Code == 200 {
+				passed++
+			}
+		}
+		return passed, keyId
+	}
+
+	// The policy rate wins over the session rate
+	if passed, _ := sendRequests(nil); passed == 5 {
+		t.Error("The policy rate should apply, all requests passed")
+	}
+
+	// The override wins over the policy
+	passed, keyId := sendRequests(map[string]interface{}{
+		RateOverrideMetaKey: map[string]interface{}{"rate": float64(100), "per": float64(60)},
+	})
+	if passed != 5 {
+		t.Error("The rate override should apply, requests passed: ", passed)
+	}
+	// It isn't written into the session
+	if thisSession, _ := spec.SessionManager.GetSessionDetail(keyId); thisSession.Rate != 2 || thisSession.Per != 60 {
+		t.Error("The session should keep the policy rate, got: ", thisSession.Rate, thisSession.Per)
+	}
+
+	// An invalid override is ignored
+	passed, _ = sendRequests(map[string]interface{}{
+		RateOverrideMetaKey: map[string]interface{}{"rate": float64(-1), "per": float64(60)},
+	})
+	if passed == 5 {
+		t.Error("An invalid override should be ignored, all requests passed")
+	}
+}
+
+func TestRequestCounters(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	spec.APIID = randSeq(10)
+	chain := getChain(spec)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createThrottledSession(), 60)
+
+	for i := 0; i < 5; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/stats/requests?api_id="+spec.APIID, nil)
+	requestCountersHandler(recorder, req)
+
+	var counters RequestCounters
+	if err := json.Unmarshal(recorder.Body.Bytes(), &counters); err != nil {
+		t.Fatal("Could not decode the counters: ", err, recorder.Body.String())
+	}
+	if counters.Total != 5 || counters.Allowed+counters.Rejected != 5 {
+		t.Error("Expected 5 requests to be counted, got: ", counters)
+	}
+	if counters.Allowed == 0 || counters.Rejected == 0 {
+		t.Error("Expected both allowed and rate limited requests, got: ", counters)
+	}
+
+	if _, found := RequestCountersSnapshot()[spec.APIID]; !found {
+		t.Error("The API should be in the counters of all APIs")
+	}
+}
+
+func TestPathNormalization(t *testing.T) {
+	upstreamPaths := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPaths <- r.URL.Path
+	}))
+	defer upstream.Close()
+
+	enableAnalytics := config.EnableAnalytics
+	defer func() { config.EnableAnalytics = enableAnalytics }()
+	config.EnableAnalytics = true
+
+	for _, tc := range []struct {
+		name     string
+		options  PathNormalizationOptions
+		expected string
+	}{
+		{"none", PathNormalizationOptions{}, "/v1/Users//42/"},
+		{"strip trailing slash", PathNormalizationOptions{StripTrailingSlash: true}, "/v1/Users//42"},
+		{"collapse slashes", PathNormalizationOptions{CollapseSlashes: true}, "/v1/Users/42/"},
+		{"lowercase", PathNormalizationOptions{Lowercase: true}, "/v1/users//42/"},
+		{"all", PathNormalizationOptions{StripTrailingSlash: true, CollapseSlashes: true, Lowercase: true}, "/v1/users/42"},
+	} {
+		spec, sink := createRecordedSpec("normalized", upstream.URL)
+		spec.Options.PathNormalization = tc.options
+		chain := getChain(spec)
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/Users//42/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Errorf("%v: expected 200, got %v", tc.name, recorder.Code)
+			delete(AnalyticsSinks, "normalized")
+			continue
+		}
+		if got := <-upstreamPaths; got != tc.expected {
+			t.Errorf("%v: expected upstream path %v, got %v", tc.name, tc.expected, got)
+		}
+		select {
+		case thisRecord := <-sink.records:
+			if thisRecord.Path != tc.expected {
+				t.Errorf("%v: expected analytics path %v, got %v", tc.name, tc.expected, thisRecord.Path)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No analytics record")
+		}
+		delete(AnalyticsSinks, "normalized")
+	}
+
+	if path := normalizePath(PathNormalizationOptions{StripTrailingSlash: true}, "/"); path != "/" {
+		t.Error("The root path should be left alone, got: ", path)
+	}
+}
+
+func TestPathNormalizationBeforeBlackList(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"black_list": []`, `"black_list": ["/admin"]`, 1))
+	spec.Options.PathNormalization = PathNormalizationOptions{CollapseSlashes: true, Lowercase: true}
+	chain := getChain(spec)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for _, path := range []string{"/v1/admin", "/v1/ADMIN", "/v1//admin", "/v1/Admin/"} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 403 {
+			t.Errorf("%v: expected the black list to see the normalized path, got %v", path, recorder.Code)
+		}
+	}
+}
+
+func TestMaxSessionLifetime(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "max_session_lifetime": 100,`, 1))
+	spec.SessionLifetime = 1000
+	chain := getChain(spec)
+
+	for _, tc := range []struct {
+		ttl      int64
+		expected int64
+	}{
+		{1000, 100},
+		{0, 100},
+		{50, 50},
+	} {
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), tc.ttl)
+		ttl, err := spec.SessionManager.GetStore().GetExp(keyId)
+		if err != nil || ttl <= 0 || ttl > tc.expected {
+			t.Errorf("Session saved with a TTL of %v: expected at most %v, got %v (%v)", tc.ttl, tc.expected, ttl, err)
+		}
+
+		// Writes made while serving requests use the API session lifetime, which is capped too
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Expected 200, got ", recorder.Code)
+		}
+		ttl, err = spec.SessionManager.GetStore().GetExp(keyId)
+		if err != nil || ttl <= 0 || ttl > 100 {
+			t.Errorf("Session saved with a TTL of %v: expected at most 100 after a request, got %v (%v)", tc.ttl, ttl, err)
+		}
+	}
+
+	// The cap counts from when the session was created, saving it again doesn't extend it
+	keyId := randSeq(10)
+	oldSession := createNonThrottledSession()
+	oldSession.DateCreated = time.Now().Unix() - 90
+	spec.SessionManager.UpdateSession(keyId, oldSession, 1000)
+	if ttl, _ := spec.SessionManager.GetStore().GetExp(keyId); ttl <= 0 || ttl > 10 {
+		t.Error("Expected the TTL to be capped at the lifetime left, got: ", ttl)
+	}
+	saved, _ := spec.SessionManager.GetSessionDetail(keyId)
+	if saved.DateCreated != oldSession.DateCreated {
+		t.Error("Expected the creation time to be kept, got: ", saved.DateCreated)
+	}
+	if saved.Expires != oldSession.DateCreated+100 {
+		t.Error("Expected the key to expire at the end of its lifetime, got: ", saved.Expires)
+	}
+
+	// An API without the cap sharing the session can't extend it
+	uncapped := DefaultSessionManager{Store: spec.SessionManager.GetStore()}
+	uncapped.UpdateSession(keyId, saved, 0)
+	if saved, _ := spec.SessionManager.GetSessionDetail(keyId); saved.Expires != oldSession.DateCreated+100 {
+		t.Error("Expected the expiry to be kept by an API without the cap, got: ", saved.Expires)
+	}
+
+	oldSession.DateCreated = time.Now().Unix() - 100
+	spec.SessionManager.UpdateSession(keyId, oldSession, 1000)
+	if _, found := spec.SessionManager.GetSessionDetail(keyId); found {
+		t.Error("A session that has outlived max_session_lifetime should be removed")
+	}
+}
+
+func TestErrorResponseShape(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	chain := getChain(spec)
+
+	throttledKey, deniedKey := randSeq(10), randSeq(10)
+	spec.SessionManager.UpdateSession(throttledKey, createThrottledSession(), 60)
+	deniedSession := createNonThrottledSession()
+	deniedSession.AccessRights = map[string]AccessDefinition{"other-api": {APIID: "other-api"}}
+	spec.SessionManager.UpdateSession(deniedKey, deniedSession, 60)
+
+	doRequest := func(key, accept string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		if key != "" {
+			req.Header.Add("authorization", key)
+		}
+		if accept != "" {
+			req.Header.Add("Accept", accept)
+		}
+		chain.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// Use up the rate limit of the throttled key
+	for i := 0; i < 3; i++ {
+		doRequest(throttledKey, "")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		key     string
+		status  int
+		code    string
+		message string
+	}{
+		{"missing key", "", 400, "bad_request", "Authorization field missing"},
+		{"unknown key", randSeq(10), 403, "forbidden", "Key not authorised"},
+		{"access denied", deniedKey, 403, "forbidden", "Access to this API has been disallowed"},
+		{"rate limited", throttledKey, 429, "too_many_requests", "Rate limit exceeded"},
+	} {
+		recorder := doRequest(tc.key, "application/json")
+		if recorder.Code != tc.status {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.status, recorder.Code)
+			continue
+		}
+
+		var body map[string]string
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Errorf("%v: expected a JSON body, got %v", tc.name, recorder.Body.String())
+			continue
+		}
+		requestID := recorder.Header().Get(RequestIDHeaderName())
+		if body["error"] != tc.message || body["code"] != tc.code || requestID == "" || body["request_id"] != requestID {
+			t.Errorf("%v: unexpected error body %v (request ID header %q)", tc.name, body, requestID)
+		}
+	}
+
+	recorder := doRequest("", "text/plain")
+	if recorder.Header().Get("Content-Type") != "text/plain; charset=utf-8" || recorder.Body.String() != "Authorization field missing\n" {
+		t.Error("Expected a plain text error for clients that don't accept JSON, got: ", recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for status, expected := range map[int]string{400: "bad_request", 429: "too_many_requests", 504: "gateway_timeout", 666: "error"} {
+		if code := errorCode(status); code != expected {
+			t.Errorf("%v: expected %v, got %v", status, expected, code)
+		}
+	}
+}
+
+func TestPolicyEmptyAccessRights(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	chain := getChain(spec)
+
+	emptyAccessRights := config.Policies.EmptyAccessRights
+	defer func() { config.Policies.EmptyAccessRights = emptyAccessRights }()
+
+	for _, tc := range []struct {
+		name         string
+		global       string
+		policy       string
+		accessRights map[string]AccessDefinition
+		code         int
+	}{
+		{"default", "", "", nil, 200},
+		{"global allow", EmptyAccessRightsAllow, "", nil, 200},
+		{"global deny", EmptyAccessRightsDeny, "", nil, 403},
+		{"policy deny", "", EmptyAccessRightsDeny, nil, 403},
+		{"policy allow overrides global deny", EmptyAccessRightsDeny, EmptyAccessRightsAllow, nil, 200},
+		{"deny with access rights", EmptyAccessRightsDeny, EmptyAccessRightsDeny, map[string]AccessDefinition{spec.APIID: {APIID: spec.APIID}}, 200},
+	} {
+		config.Policies.EmptyAccessRights = tc.global
+		Policies["empty-rights"] = Policy{
+			ID:                "empty-rights",
+			OrgID:             spec.OrgID,
+			Rate:              100,
+			Per:               1,
+			QuotaMax:          -1,
+			AccessRights:      tc.accessRights,
+			EmptyAccessRights: tc.policy,
+		}
+
+		thisSession := createNonThrottledSession()
+		thisSession.ApplyPolicyID = "empty-rights"
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+	delete(Policies, "empty-rights")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IsGRPCRequest is true for gRPC calls, which are HTTP/2 requests with an application/grpc content type
+func IsGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus returns the status of a gRPC call, it is sent as a trailer unless the upstream sent
+// a trailers-only response, in which case it is in the headers
+func GRPCStatus(res *http.Response) string {
+	if status := res.Trailer.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return res.Header.Get("Grpc-Status")
+}
+
+// TykHTTP2Transport is used for upstreams that speak HTTP/2 over TLS
+var TykHTTP2Transport http.RoundTripper = &http2.Transport{}
+
+// TykH2CTransport is used for upstreams that speak HTTP/2 over cleartext (h2c)
+var TykH2CTransport http.RoundTripper = &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+}
+
+// GetHTTP2Transport returns the transport for an API with upstream_http2 set, a hard timeout for
+// the path is applied to it like GetTransport does for HTTP/1.1 upstreams
+func GetHTTP2Transport(scheme string, timeOut int, spec *APISpec) http.RoundTripper {
+	var transport http.RoundTripper = TykHTTP2Transport
+	if scheme == "http" {
+		transport = TykH2CTransport
+	} else if spec.UpstreamHTTP2Transport != nil {
+		transport = spec.UpstreamHTTP2Transport
+	}
+
+	if timeOut > 0 {
+		log.Debug("Setting timeout for outbound HTTP/2 request to: ", timeOut)
+		return &http2TimeoutTransport{transport: transport, timeout: time.Duration(timeOut) * time.Second}
+	}
+	return transport
+}
+
+// errHTTP2HeaderTimeout reads like the HTTP/1.1 transport timeout so the proxy reports a hard timeout
+var errHTTP2HeaderTimeout = errors.New("http2: timeout awaiting response headers")
+
+// http2TimeoutTransport cancels a request that has no response headers within timeout, as
+// http2.Transport has no ResponseHeaderTimeout. Once the headers are in the body can stream for
+// as long as it needs to.
+type http2TimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (t *http2TimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := make(chan struct{})
+	timedReq := new(http.Request)
+	*timedReq = *req
+	timedReq.Cancel = cancel
+
+	timer := time.AfterFunc(t.timeout, func() { close(cancel) })
+	res, err := t.transport.RoundTrip(timedReq)
+	if !timer.Stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		return nil, errHTTP2HeaderTimeout
+	}
+
+	return res, err
+}
+
+// HTTP2Handler lets clients use HTTP/2 over cleartext (h2c) when http_server_options.enable_http2
+// is set, over TLS it is negotiated by the listener instead
+func HTTP2Handler(handler http.Handler) http.Handler {
+	if !config.HttpServerOptions.EnableHTTP2 {
+		return handler
+	}
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// copyStreamingResponse flushes every write so that streaming RPCs reach the client straight away
+func copyStreamingResponse(dst io.Writer, src io.Reader) {
+	flusher, canFlush := dst.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, wErr := dst.Write(buf[:n]); wErr != nil {
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A length-prefixed gRPC message frame
+var grpcTestFrame = []byte("\x00\x00\x00\x00\x05hello")
+
+func grpcTestUpstream(t *testing.T) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			t.Error("Upstream expected HTTP/2 with trailers, got: ", r.Proto, r.Header.Get("Te"))
+		}
+		ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(200)
+		w.Write(grpcTestFrame)
+		w.Header().Set("Grpc-Status", "5")
+	}), &http2.Server{}))
+}
+
+func grpcTestRequest(url, keyId string) *http.Request {
+	req, _ := http.NewRequest("POST", url+"/helloworld.Greeter/SayHello", bytes.NewReader(grpcTestFrame))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("authorization", keyId)
+	return req
+}
+
+func TestGRPCPassthrough(t *testing.T) {
+	upstream := grpcTestUpstream(t)
+	defer upstream.Close()
+
+	config.EnableAnalytics = true
+	config.HttpServerOptions.EnableHTTP2 = true
+	defer func() { config.HttpServerOptions.EnableHTTP2 = false }()
+
+	grpcSink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("grpc", grpcSink)
+	defer delete(AnalyticsSinks, "grpc")
+
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "upstream_http2": true, "analytics_sink": "grpc",`, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	gateway := httptest.NewServer(HTTP2Handler(getChain(spec)))
+	defer gateway.Close()
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	client := &http.Client{Transport: TykH2CTransport}
+	res, err := client.Do(grpcTestRequest(gateway.URL, keyId))
+	if err != nil {
+		t.Fatal("gRPC call failed: ", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.ProtoMajor != 2 || res.StatusCode != 200 {
+		t.Error("Expected an HTTP/2 200 response, got: ", res.Proto, res.StatusCode)
+	}
+	if !bytes.Equal(body, grpcTestFrame) {
+		t.Error("Response message was not passed through, got: ", body)
+	}
+	if res.Trailer.Get("Grpc-Status") != "5" {
+		t.Error("grpc-status trailer was not passed through, got: ", res.Trailer)
+	}
+
+	select {
+	case thisRecord := <-grpcSink.records:
+		if thisRecord.Path != "/helloworld.Greeter/SayHello" || thisRecord.GRPCStatus != "5" {
+			t.Error("Expected the RPC method and status to be recorded, got: ", thisRecord.Path, thisRecord.GRPCStatus)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RPC was not recorded")
+	}
+
+	// Every RPC goes through the middleware chain
+	res, err = client.Do(grpcTestRequest(gateway.URL, "unknown-"+keyId))
+	if err != nil {
+		t.Fatal("gRPC call failed: ", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 403 {
+		t.Error("RPC with an unknown key should be refused, got: ", res.StatusCode)
+	}
+}
+
+// blockingRoundTripper answers once release is closed, or fails when the request is cancelled
+type blockingRoundTripper struct {
+	release chan struct{}
+}
+
+func (b blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-b.release:
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+	case <-req.Cancel:
+		return nil, errors.New("request canceled")
+	}
+}
+
+func TestHTTP2HardTimeout(t *testing.T) {
+	spec := createDefinitionFromString(nonExpiringDefNoWhiteList)
+	if _, wrapped := GetHTTP2Transport("https", 5, &spec).(*http2TimeoutTransport); !wrapped {
+		t.Error("Expected a hard timeout to be applied to the HTTP/2 transport")
+	}
+	if GetHTTP2Transport("http", 0, &spec) != TykH2CTransport {
+		t.Error("Expected the h2c transport as is without a hard timeout")
+	}
+
+	upstream := blockingRoundTripper{make(chan struct{})}
+	transport := &http2TimeoutTransport{transport: upstream, timeout: 10 * time.Millisecond}
+	req, _ := http.NewRequest("POST", "https://upstream/helloworld.Greeter/SayHello", nil)
+	if _, err := transport.RoundTrip(req); err != errHTTP2HeaderTimeout {
+		t.Error("Expected the request to time out, got: ", err)
+	}
+
+	close(upstream.release)
+	transport.timeout = time.Minute
+	if res, err := transport.RoundTrip(req); err != nil || res.StatusCode != 200 {
+		t.Error("Expected a response within the timeout to be returned, got: ", err)
+	}
+}
@@ -1,19 +1,48 @@
 package main
 
 import (
-	"bytes"
-	b64 "encoding/base64"
 	"fmt"
 	"github.com/gorilla/context"
 	"net/http"
 	"runtime/pprof"
 	"strings"
 	"time"
+	"unicode"
 )
 
-// APIError is generic error object returned if there is something wrong with the request
+// APIError is generic error object returned if there is something wrong with the request, Code is a
+// machine readable form of the status and RequestID lets the client quote the request to support
 type APIError struct {
-	Message string
+	Message   string
+	Code      string
+	RequestID string
+}
+
+// errorCode is the machine readable code of an error status, e.g. "too_many_requests" for a 429
+func errorCode(errCode int) string {
+	words := strings.FieldsFunc(strings.ToLower(http.StatusText(errCode)), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	if len(words) == 0 {
+		return "error"
+	}
+	return strings.Join(words, "_")
+}
+
+// acceptsJSON is true unless the Accept header of the request rules out a JSON response
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0]))
+		if mediaType == "*/*" || mediaType == "application/*" || strings.HasSuffix(mediaType, "json") {
+			return true
+		}
+	}
+	return false
 }
 
 // ErrorHandler is invoked whenever there is an issue with a proxied request, most middleware will invoke
@@ -24,11 +53,12 @@ type ErrorHandler struct {
 
 // HandleError is the actual error handler and will store the error details in analytics if analytics processing is enabled.
 func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err string, errCode int) {
-	if e.Spec.DoNotTrack {
-		return
-	}
+	countRequest(e.Spec.APIID)
+
+	// Rejections happen before the request ID is set on the way to the upstream
+	setRequestID(w, r)
 
-	if config.StoreAnalytics(r) {
+	if !e.Spec.DoNotTrack && config.StoreAnalytics(r) {
 
 		t := time.Now()
 
@@ -61,19 +91,16 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 		}
 
 		var requestCopy *http.Request
-		if config.AnalyticsConfig.EnableDetailedRecording {
+		if DetailedRecording(r) && !IsGRPCRequest(r) {
 			requestCopy = CopyHttpRequest(r)
 		}
 
-		rawRequest := ""
-		rawResponse := ""
-		if config.AnalyticsConfig.EnableDetailedRecording {
-			if requestCopy != nil {
-				// Get the wire format representation
-				var wireFormatReq bytes.Buffer
-				requestCopy.Write(&wireFormatReq)
-				rawRequest = b64.StdEncoding.EncodeToString(wireFormatReq.Bytes())
-			}
+		tlsVersion, tlsCipher := requestTLSDetails(r)
+		versionSource, notVersioned := versionResolution(r)
+
+		rawRequest, rawResponse, captureError := "", "", ""
+		if DetailedRecording(r) {
+			rawRequest, rawResponse, captureError = captureRawDetail(requestCopy, nil)
 		}
 
 		thisRecord := AnalyticsRecord{
@@ -81,21 +108,33 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 			r.URL.Path,
 			r.ContentLength,
 			r.Header.Get("User-Agent"),
+			GetClientIP(r),
+			tlsVersion,
+			tlsCipher,
+			r.Header.Get(RequestIDHeaderName()),
 			t.Day(),
 			t.Month(),
 			t.Year(),
 			t.Hour(),
 			errCode,
+			IsErrorStatusCode(errCode),
+			"",
+			false,
 			keyName,
+			requestAlias(r),
 			t,
 			version,
+			versionSource,
+			notVersioned,
 			e.Spec.APIDefinition.Name,
 			e.Spec.APIDefinition.APIID,
 			e.Spec.APIDefinition.OrgID,
 			OauthClientID,
 			0,
+			queueTime(r),
 			rawRequest,
 			rawResponse,
+			captureError,
 			tags,
 			time.Now(),
 		}
@@ -112,13 +151,33 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 		}
 
 		thisRecord.SetExpiry(expiresAfter)
-		go analytics.RecordHit(thisRecord)
+		queueAnalyticsRecord(e.Spec, thisRecord)
 	}
 
 	// Report in health check
-	ReportHealthCheckValue(e.Spec.Health, BlockedRequestLog, "-1")
+	if !e.Spec.DoNotTrack {
+		ReportHealthCheckValue(e.Spec.Health, BlockedRequestLog, "-1")
+	}
+
+	writeErrorResponse(w, r, err, errCode)
+	if doMemoryProfile {
+		pprof.WriteHeapProfile(profileFile)
+	}
+
+	// Clean up
+	e.releaseInFlight(r)
+	context.Clear(r)
+}
 
-	w.Header().Add("Content-Type", "application/json")
+// writeErrorResponse renders every error returned to a client in the same shape, the error.json
+// template for clients that accept JSON and the bare message for those that don't
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, err string, errCode int) {
+	renderJSON := acceptsJSON(r)
+	if renderJSON {
+		w.Header().Add("Content-Type", "application/json")
+	} else {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	}
 	w.Header().Add("X-Generator", "tyk.io")
 	// Close connections
 	if config.CloseConnections {
@@ -127,12 +186,15 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 
 	log.Debug("Returning error header")
 	w.WriteHeader(errCode)
-	thisError := APIError{fmt.Sprintf("%s", err)}
-	templates.ExecuteTemplate(w, "error.json", &thisError)
-	if doMemoryProfile {
-		pprof.WriteHeapProfile(profileFile)
+	if !renderJSON {
+		fmt.Fprintln(w, err)
+		return
 	}
 
-	// Clean up
-	context.Clear(r)
+	thisError := APIError{
+		Message:   err,
+		Code:      errorCode(errCode),
+		RequestID: r.Header.Get(RequestIDHeaderName()),
+	}
+	templates.ExecuteTemplate(w, "error.json", &thisError)
 }
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	b64 "encoding/base64"
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"github.com/nu7hatch/gouuid"
 	"github.com/pmylund/go-cache"
 	"net/http"
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,14 +22,76 @@ type ContextKey int
 // Enums for keys to be stored in a session context - this is how gorilla expects
 // these to be implemented and is lifted pretty much from docs
 const (
-	SessionData       = 0
-	AuthHeaderValue   = 1
-	VersionData       = 2
-	VersionKeyContext = 3
+	SessionData        = 0
+	AuthHeaderValue    = 1
+	VersionData        = 2
+	VersionKeyContext  = 3
+	GRPCStatusData     = 4
+	JWTErrorData       = 5
+	IdentityData       = 6
+	DebugRecordData    = 7
+	MockedResponseData = 8
+	VersionSourceData  = 9
+	QueueTimeData      = 10
+	InFlightData       = 11
 )
 
 var SessionCache *cache.Cache = cache.New(10*time.Second, 5*time.Second)
 
+// NegativeAuthCache remembers keys that were not found for negative_cache_timeout seconds, so a
+// flood of bad keys doesn't hit the store on every request
+var NegativeAuthCache *cache.Cache = cache.New(5*time.Second, 5*time.Second)
+
+const defaultNegativeCacheMaxEntries = 10000
+
+func negativeAuthCacheEnabled() bool {
+	return !config.LocalSessionCache.DisableCacheSessionState && config.LocalSessionCache.NegativeCacheTimeout > 0
+}
+
+// negativeAuthLRU orders the NegativeAuthCache entries from the newest to the oldest, every entry
+// has the same TTL so the oldest is also the next to expire
+var negativeAuthLRU = list.New()
+var negativeAuthLRUEntries = make(map[string]*list.Element)
+var negativeAuthLRULock sync.Mutex
+
+// cacheNegativeAuthResult stores a key that wasn't found, once the cache is full the oldest
+// entries are evicted to make room
+func cacheNegativeAuthResult(key string) {
+	maxEntries := config.LocalSessionCache.NegativeCacheMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultNegativeCacheMaxEntries
+	}
+
+	negativeAuthLRULock.Lock()
+	defer negativeAuthLRULock.Unlock()
+
+	NegativeAuthCache.Set(key, true, time.Duration(config.LocalSessionCache.NegativeCacheTimeout)*time.Second)
+	if entry, found := negativeAuthLRUEntries[key]; found {
+		negativeAuthLRU.MoveToFront(entry)
+	} else {
+		negativeAuthLRUEntries[key] = negativeAuthLRU.PushFront(key)
+	}
+
+	for negativeAuthLRU.Len() > maxEntries {
+		oldest := negativeAuthLRU.Remove(negativeAuthLRU.Back()).(string)
+		delete(negativeAuthLRUEntries, oldest)
+		NegativeAuthCache.Delete(oldest)
+		log.Debug("Negative auth cache is full, evicted the oldest entry")
+	}
+}
+
+// invalidateNegativeAuthResult forgets that a key wasn't found, once it has been saved
+func invalidateNegativeAuthResult(key string) {
+	negativeAuthLRULock.Lock()
+	defer negativeAuthLRULock.Unlock()
+
+	NegativeAuthCache.Delete(key)
+	if entry, found := negativeAuthLRUEntries[key]; found {
+		negativeAuthLRU.Remove(entry)
+		delete(negativeAuthLRUEntries, key)
+	}
+}
+
 // TykMiddleware wraps up the ApiSpec and Proxy objects to be included in a
 // middleware handler, this can probably be handled better.
 type TykMiddleware struct {
@@ -60,37 +126,216 @@ func (t TykMiddleware) GetOrgSession(key string) (SessionState, bool) {
 	return thisSession, found
 }
 
+// sessionLifetime is the TTL a session of this API is saved with. It is the API session lifetime
+// that sessions are created with, if the API doesn't set one a session with an expiry is kept until
+// it expires, so later writes never make it live forever. Only sessions that don't expire get 0.
+func (t TykMiddleware) sessionLifetime(thisSession SessionState) int64 {
+	if t.Spec.SessionLifetime > 0 {
+		return t.Spec.SessionLifetime
+	}
+	if thisSession.Expires > 0 {
+		if left := thisSession.Expires - time.Now().Unix(); left > 0 {
+			return left
+		}
+		return 1
+	}
+	return 0
+}
+
 // ApplyPolicyIfExists will check if a policy is loaded, if it is, it will overwrite the session state to use the policy values
 func (t TykMiddleware) ApplyPolicyIfExists(key string, thisSession *SessionState) {
+	if len(thisSession.ApplyPolicyIDs) > 0 {
+		t.applyMergedPolicies(key, thisSession)
+		return
+	}
+
 	if thisSession.ApplyPolicyID != "" {
 		log.Debug("Session has policy, checking")
-		policy, ok := Policies[thisSession.ApplyPolicyID]
-		if ok {
-			// Check ownership, policy org owner must be the same as API,
-			// otherwise youcould overwrite a session key with a policy from a different org!
-			if policy.OrgID != t.Spec.APIDefinition.OrgID {
-				log.Error("Attempting to apply policy from different organisation to key, skipping")
-				return
-			}
-
+		policy, problem := t.appliedPolicy(*thisSession)
+		if problem != "" {
+			log.WithFields(logrus.Fields{
+				"policy_id": thisSession.ApplyPolicyID,
+				"version":   thisSession.ApplyPolicyVersion,
+			}).Debug("Policy not applied, keeping the values already on the key: ", problem)
+		} else {
 			log.Debug("Found policy, applying")
 			thisSession.Allowance = policy.Rate // This is a legacy thing, merely to make sure output is consistent. Needs to be purged
 			thisSession.Rate = policy.Rate
 			thisSession.Per = policy.Per
 			thisSession.QuotaMax = policy.QuotaMax
 			thisSession.QuotaRenewalRate = policy.QuotaRenewalRate
+			thisSession.QuotaRolling = policy.QuotaRolling
 			thisSession.AccessRights = policy.AccessRights
 			thisSession.HMACEnabled = policy.HMACEnabled
 			thisSession.IsInactive = policy.IsInactive
 			thisSession.Tags = policy.Tags
+			thisSession.SharedQuotaGroup = policy.SharedQuotaGroup
+			thisSession.QuotaGrace = policy.QuotaGrace
+			thisSession.QuotaGracePercent = policy.QuotaGracePercent
+			thisSession.MaxConcurrentRequests = policy.MaxConcurrentRequests
+			if len(policy.PolicyPerAPI) > 0 {
+				thisSession.PolicyPerAPI = policy.PolicyPerAPI
+			}
+			applyPolicyMetaData(thisSession, policy.MetaData)
 
 			// Update the session in the session manager in case it gets called again
-			t.Spec.SessionManager.UpdateSession(key, *thisSession, t.Spec.APIDefinition.SessionLifetime)
+			t.Spec.SessionManager.UpdateSession(key, *thisSession, t.sessionLifetime(*thisSession))
 			log.Debug("Policy applied to key")
 		}
 	}
 }
 
+// applyMergedPolicies merges the policies of a merged JWT session again and overwrites the session
+// state with the result, so policy edits reach it like they reach a single policy session
+func (t TykMiddleware) applyMergedPolicies(key string, thisSession *SessionState) {
+	merged, err := mergeSessionPolicies(t.Spec, thisSession.ApplyPolicyIDs)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"policy_ids": thisSession.ApplyPolicyIDs,
+		}).Debug("Policies not applied, keeping the values already on the key: ", err)
+		return
+	}
+
+	thisSession.Allowance = merged.Rate
+	thisSession.Rate = merged.Rate
+	thisSession.Per = merged.Per
+	thisSession.QuotaMax = merged.QuotaMax
+	thisSession.QuotaRenewalRate = merged.QuotaRenewalRate
+	thisSession.QuotaRolling = merged.QuotaRolling
+	thisSession.AccessRights = merged.AccessRights
+	thisSession.HMACEnabled = merged.HMACEnabled
+	thisSession.IsInactive = merged.IsInactive
+	thisSession.Tags = merged.Tags
+	thisSession.QuotaGrace = merged.QuotaGrace
+	thisSession.QuotaGracePercent = merged.QuotaGracePercent
+	thisSession.MaxConcurrentRequests = merged.MaxConcurrentRequests
+	thisSession.PolicyPerAPI = merged.PolicyPerAPI
+	if mergedMetaData, ok := merged.MetaData.(map[string]interface{}); ok {
+		applyPolicyMetaData(thisSession, mergedMetaData)
+	}
+
+	t.Spec.SessionManager.UpdateSession(key, *thisSession, t.sessionLifetime(*thisSession))
+}
+
+// appliedPolicy returns the policy of a session at the version it is pinned to, the problem is set
+// if it can't be applied. A policy from a different org than the API is never applied.
+func (t TykMiddleware) appliedPolicy(thisSession SessionState) (Policy, string) {
+	policyID := thisSession.ApplyPolicyID
+	policy, ok := GetPolicy(policyID)
+	if !ok {
+		return policy, "policy " + policyID + " not found"
+	}
+
+	// Check ownership, policy org owner must be the same as API,
+	// otherwise youcould overwrite a session key with a policy from a different org!
+	if policy.OrgID != t.Spec.APIDefinition.OrgID {
+		log.Error("Attempting to apply policy from different organisation to key, skipping")
+		return policy, "policy " + policyID + " belongs to a different organisation"
+	}
+
+	if thisSession.ApplyPolicyVersion != 0 {
+		var versionFound bool
+		policy, versionFound = policy.AtVersion(thisSession.ApplyPolicyVersion)
+		if !versionFound {
+			log.WithFields(logrus.Fields{
+				"policy_id": policyID,
+				"version":   thisSession.ApplyPolicyVersion,
+			}).Error("Pinned policy version not found, keeping the values already on the key")
+			return policy, "version " + strconv.Itoa(thisSession.ApplyPolicyVersion) + " of policy " + policyID + " not found"
+		}
+	}
+
+	return policy, ""
+}
+
+// applyPolicyMetaData copies the meta data of a policy into the session, policy values replace
+// session values with the same name and the rest of the session meta data is kept. The merge
+// goes into a new map as the session may be a copy of one in the SessionCache that other
+// requests are reading.
+func applyPolicyMetaData(thisSession *SessionState, policyMetaData map[string]interface{}) {
+	if len(policyMetaData) == 0 {
+		return
+	}
+
+	sessionMetaData, ok := thisSession.MetaData.(map[string]interface{})
+	if !ok && thisSession.MetaData != nil {
+		log.Warning("Session meta data is not an object, replacing it with the policy meta data")
+	}
+
+	mergedMetaData := make(map[string]interface{}, len(sessionMetaData)+len(policyMetaData))
+	for k, v := range sessionMetaData {
+		mergedMetaData[k] = v
+	}
+	for k, v := range policyMetaData {
+		mergedMetaData[k] = v
+	}
+	thisSession.MetaData = mergedMetaData
+}
+
+// PerAPISessionKey is the key that the session of a base key is stored under for a single API,
+// used when the base session maps that API to a policy of its own with policy_per_api
+func PerAPISessionKey(key, apiID string) string {
+	return key + "." + apiID
+}
+
+// createPerAPISession creates the per-API session for this API from the base session and the policy
+// it maps the API to, the rate limiter then limits the request on that session instead of the base
+// one. ok is false if the policy can't be applied.
+func (t TykMiddleware) createPerAPISession(key string, baseSession SessionState, policyID string) (SessionState, bool) {
+	if policyID == "" {
+		return SessionState{}, false
+	}
+
+	if problem := perAPIPolicyProblem(t.Spec.APIDefinition.OrgID, policyID, GetPolicy); problem != "" {
+		log.WithFields(logrus.Fields{
+			"key":       key,
+			"api_id":    t.Spec.APIID,
+			"policy_id": policyID,
+		}).Warning("Skipping per-API policy, base session will be used: ", problem)
+		return SessionState{}, false
+	}
+
+	apiSessionKey := PerAPISessionKey(key, t.Spec.APIID)
+	apiSession := baseSession
+	apiSession.PolicyPerAPI = nil
+	apiSession.ApplyPolicyID = policyID
+	apiSession.ApplyPolicyVersion = 0
+	t.ApplyPolicyIfExists(apiSessionKey, &apiSession)
+	return apiSession, true
+}
+
+// PolicyUnavailableDuringReload is true if the session's policy can't be found while policies
+// are being reloaded, in which case the client should be asked to retry rather than be refused
+func (t TykMiddleware) PolicyUnavailableDuringReload(thisSession SessionState) bool {
+	if config.Policies.ReloadRetryAfter <= 0 || thisSession.ApplyPolicyID == "" {
+		return false
+	}
+
+	if !PolicyReloadInProgress() {
+		return false
+	}
+
+	_, ok := GetPolicy(thisSession.ApplyPolicyID)
+	return !ok
+}
+
+// PolicyAmbiguity describes why the policies of a session can't be applied exactly as intended,
+// it is empty if they can. Normally these are skipped on a best effort basis, APIs with
+// strict_policies refuse the request instead.
+func (t TykMiddleware) PolicyAmbiguity(thisSession SessionState) string {
+	if thisSession.ApplyPolicyID != "" {
+		if _, problem := t.appliedPolicy(thisSession); problem != "" {
+			return problem
+		}
+	}
+
+	if policyID, ok := thisSession.PolicyPerAPI[t.Spec.APIID]; ok {
+		return perAPIPolicyProblem(t.Spec.APIDefinition.OrgID, policyID, GetPolicy)
+	}
+
+	return ""
+}
+
 // CheckSessionAndIdentityForValidKey will check first the Session store for a valid key, if not found, it will try
 // the Auth Handler, if not found it will fail
 func (t TykMiddleware) CheckSessionAndIdentityForValidKey(key string) (SessionState, bool) {
@@ -109,6 +354,14 @@ func (t TykMiddleware) CheckSessionAndIdentityForValidKey(key string) (SessionSt
 		}
 	}
 
+	// Check for a recent miss
+	if negativeAuthCacheEnabled() {
+		if _, found := NegativeAuthCache.Get(key); found {
+			log.Debug("Key found in negative cache")
+			return thisSession, false
+		}
+	}
+
 	// Check session store
 	thisSession, found = t.Spec.SessionManager.GetSessionDetail(key)
 	if found {
@@ -133,18 +386,120 @@ func (t TykMiddleware) CheckSessionAndIdentityForValidKey(key string) (SessionSt
 
 		// Check for a policy, if there is a policy, pull it and overwrite the session values
 		t.ApplyPolicyIfExists(key, &thisSession)
-		t.Spec.SessionManager.UpdateSession(key, thisSession, t.Spec.APIDefinition.SessionLifetime)
+		t.Spec.SessionManager.UpdateSession(key, thisSession, t.sessionLifetime(thisSession))
+	}
+
+	if !found && negativeAuthCacheEnabled() {
+		cacheNegativeAuthResult(key)
 	}
 
 	return thisSession, found
 }
 
+const defaultRequestIDHeader = "X-Request-ID"
+
+// RequestIDHeaderName is the header used to correlate requests, set with request_id_header
+func RequestIDHeaderName() string {
+	if config.RequestIDHeader != "" {
+		return config.RequestIDHeader
+	}
+	return defaultRequestIDHeader
+}
+
+// maxRequestIDLength bounds the request ID a client can send, longer IDs are replaced
+const maxRequestIDLength = 128
+
+// validRequestID is true for IDs that fit in maxRequestIDLength and only use printable ASCII, so
+// a client can't push oversized or control characters into upstream headers and analytics
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setRequestID keeps a valid request ID sent by the client or generates one, the ID is passed on
+// to the upstream and echoed back to the client
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	headerName := RequestIDHeaderName()
+	requestID := r.Header.Get(headerName)
+	if !validRequestID(requestID) {
+		if requestID != "" {
+			log.Debug("Replacing invalid request ID sent by the client")
+		}
+		u5, err := uuid.NewV4()
+		if err != nil {
+			log.Error("Failed to generate request ID: ", err)
+			return
+		}
+		requestID = u5.String()
+		r.Header.Set(headerName, requestID)
+	}
+
+	w.Header().Set(headerName, requestID)
+}
+
 // SuccessHandler represents the final ServeHTTP() request for a proxied API request
 type SuccessHandler struct {
 	*TykMiddleware
 }
 
+// requestAlias is the identity of the user behind a request for analytics, this is the identity
+// the JWT middleware resolved (virtual JWT sessions are keyed by a hash of it) or else the alias of
+// the session
+func requestAlias(r *http.Request) string {
+	if identity, found := context.GetOk(r, IdentityData); found {
+		return identity.(string)
+	}
+	if thisSessionState, found := context.GetOk(r, SessionData); found {
+		return thisSessionState.(SessionState).Alias
+	}
+	return ""
+}
+
+// captureRawDetail encodes the copies made for detailed recording. A copy that is missing or can't
+// be written is left empty and the reason is returned so that the record doesn't look like a
+// request without a body, a missing response copy is fine as not every hit has an upstream response
+func captureRawDetail(requestCopy *http.Request, responseCopy *http.Response) (string, string, string) {
+	rawRequest, rawResponse := "", ""
+	var failures []string
+
+	if requestCopy == nil {
+		failures = append(failures, "request: not copied")
+	} else {
+		// Get the wire format representation
+		var wireFormatReq bytes.Buffer
+		if err := requestCopy.Write(&wireFormatReq); err != nil {
+			failures = append(failures, "request: "+err.Error())
+		} else {
+			rawRequest = b64.StdEncoding.EncodeToString(wireFormatReq.Bytes())
+		}
+	}
+
+	if responseCopy != nil {
+		// Get the wire format representation
+		var wireFormatRes bytes.Buffer
+		if err := responseCopy.Write(&wireFormatRes); err != nil {
+			failures = append(failures, "response: "+err.Error())
+		} else {
+			rawResponse = b64.StdEncoding.EncodeToString(wireFormatRes.Bytes())
+		}
+	}
+
+	if len(failures) > 0 {
+		log.Debug("Detailed recording is incomplete: ", strings.Join(failures, ", "))
+	}
+	return rawRequest, rawResponse, strings.Join(failures, ", ")
+}
+
 func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing int64, code int, requestCopy *http.Request, responseCopy *http.Response) {
+	countRequest(s.Spec.APIID)
 
 	if s.Spec.DoNotTrack {
 		return
@@ -177,21 +532,17 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 			tags = thisSessionState.(SessionState).Tags
 		}
 
-		rawRequest := ""
-		rawResponse := ""
-		if config.AnalyticsConfig.EnableDetailedRecording {
-			if requestCopy != nil {
-				// Get the wire format representation
-				var wireFormatReq bytes.Buffer
-				requestCopy.Write(&wireFormatReq)
-				rawRequest = b64.StdEncoding.EncodeToString(wireFormatReq.Bytes())
-			}
-			if responseCopy != nil {
-				// Get the wire format representation
-				var wireFormatRes bytes.Buffer
-				responseCopy.Write(&wireFormatRes)
-				rawResponse = b64.StdEncoding.EncodeToString(wireFormatRes.Bytes())
-			}
+		tlsVersion, tlsCipher := requestTLSDetails(r)
+		versionSource, notVersioned := versionResolution(r)
+
+		grpcStatus := ""
+		if status := context.Get(r, GRPCStatusData); status != nil {
+			grpcStatus = status.(string)
+		}
+
+		rawRequest, rawResponse, captureError := "", "", ""
+		if DetailedRecording(r) {
+			rawRequest, rawResponse, captureError = captureRawDetail(requestCopy, responseCopy)
 		}
 
 		thisRecord := AnalyticsRecord{
@@ -199,21 +550,33 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 			r.URL.Path,
 			r.ContentLength,
 			r.Header.Get("User-Agent"),
+			GetClientIP(r),
+			tlsVersion,
+			tlsCipher,
+			r.Header.Get(RequestIDHeaderName()),
 			t.Day(),
 			t.Month(),
 			t.Year(),
 			t.Hour(),
 			code,
+			IsErrorStatusCode(code),
+			grpcStatus,
+			context.Get(r, MockedResponseData) != nil,
 			keyName,
+			requestAlias(r),
 			t,
 			version,
+			versionSource,
+			notVersioned,
 			s.Spec.APIDefinition.Name,
 			s.Spec.APIDefinition.APIID,
 			s.Spec.APIDefinition.OrgID,
 			OauthClientID,
 			timing,
+			queueTime(r),
 			rawRequest,
 			rawResponse,
+			captureError,
 			tags,
 			time.Now(),
 		}
@@ -231,19 +594,41 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 
 		thisRecord.SetExpiry(expiresAfter)
 
-		go analytics.RecordHit(thisRecord)
+		queueAnalyticsRecord(s.Spec, thisRecord)
 	}
 
 	// Report in health check
 	ReportHealthCheckValue(s.Spec.Health, RequestLog, strconv.FormatInt(int64(timing), 10))
+	if IsErrorStatusCode(code) {
+		ReportHealthCheckValue(s.Spec.Health, UpstreamError, "-1")
+	}
 
 	if doMemoryProfile {
 		pprof.WriteHeapProfile(profileFile)
 	}
 
+	s.releaseInFlight(r)
 	context.Clear(r)
 }
 
+// releaseInFlight gives back the slot the request took from the MaxConcurrentRequests of its key,
+// it has to run before the request context is cleared as that is where the key is kept
+func (t TykMiddleware) releaseInFlight(r *http.Request) {
+	slot, ok := context.GetOk(r, InFlightData)
+	if !ok {
+		return
+	}
+	context.Delete(r, InFlightData)
+	inFlight := slot.(inFlightSlot)
+	sessionLimiter.ReleaseInFlight(inFlight.key, inFlight.entry, t.Spec.SessionManager.GetStore())
+}
+
+// inFlightSlot is kept in the request context while a request counts against MaxConcurrentRequests
+type inFlightSlot struct {
+	key   string
+	entry string
+}
+
 // ServeHTTP will store the request details in the analytics store if necessary and proxy the request to it's
 // final destination, this is invoked by the ProxyHandler or right at the start of a request chain if the URL
 // Spec states the path is Ignored
@@ -254,9 +639,15 @@ func (s SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) *http.
 		r.URL.Path = strings.Replace(r.URL.Path, s.Spec.Proxy.ListenPath, "", 1)
 		log.Debug("Upstream Path is: ", r.URL.Path)
 	}
+	rewriteUpstreamPath(s.Spec, r)
+
+	setRequestID(w, r)
+
+	// Streaming RPCs can't be buffered to record their detail
+	recordDetail := DetailedRecording(r) && !IsGRPCRequest(r)
 
 	var copiedRequest *http.Request
-	if config.AnalyticsConfig.EnableDetailedRecording {
+	if recordDetail {
 		copiedRequest = CopyHttpRequest(r)
 	}
 
@@ -265,7 +656,7 @@ func (s SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) *http.
 	t2 := time.Now()
 
 	var copiedResponse *http.Response
-	if config.AnalyticsConfig.EnableDetailedRecording {
+	if recordDetail {
 		copiedResponse = CopyHttpResponse(resp)
 	}
 
@@ -287,9 +678,12 @@ func (s SuccessHandler) ServeHTTPWithCache(w http.ResponseWriter, r *http.Reques
 	if s.Spec.APIDefinition.Proxy.StripListenPath {
 		r.URL.Path = strings.Replace(r.URL.Path, s.Spec.Proxy.ListenPath, "", 1)
 	}
+	rewriteUpstreamPath(s.Spec, r)
+
+	setRequestID(w, r)
 
 	var copiedRequest *http.Request
-	if config.AnalyticsConfig.EnableDetailedRecording {
+	if DetailedRecording(r) {
 		copiedRequest = CopyHttpRequest(r)
 	}
 
@@ -298,7 +692,7 @@ func (s SuccessHandler) ServeHTTPWithCache(w http.ResponseWriter, r *http.Reques
 	t2 := time.Now()
 
 	var copiedResponse *http.Response
-	if config.AnalyticsConfig.EnableDetailedRecording {
+	if DetailedRecording(r) {
 		copiedResponse = CopyHttpResponse(inRes)
 	}
 
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// JWKCacheStats count how the JWKS documents of a JWT source were served since the process started.
+// Hits were answered from the JWKCache, Misses had nothing cached and Refreshes replaced a cached
+// document that didn't have the kid or failed a signature check. FetchErrors counts the downloads
+// that failed, ConsecutiveFetchErrors those since the last successful one.
+type JWKCacheStats struct {
+	Hits                   int64 `json:"hits"`
+	Misses                 int64 `json:"misses"`
+	Refreshes              int64 `json:"refreshes"`
+	FetchErrors            int64 `json:"fetch_errors"`
+	ConsecutiveFetchErrors int64 `json:"consecutive_fetch_errors"`
+
+	// alerted is set once a JWKSourceFailing event has been fired for the current run of errors
+	alerted int32
+}
+
+var jwkCacheStatsLock sync.RWMutex
+var jwkCacheStats = make(map[string]*JWKCacheStats)
+
+// jwkStatsForSource returns the stats of a JWT source URL, creating them on first use
+func jwkStatsForSource(url string) *JWKCacheStats {
+	jwkCacheStatsLock.RLock()
+	stats, found := jwkCacheStats[url]
+	jwkCacheStatsLock.RUnlock()
+	if found {
+		return stats
+	}
+
+	jwkCacheStatsLock.Lock()
+	defer jwkCacheStatsLock.Unlock()
+	if stats, found = jwkCacheStats[url]; !found {
+		stats = &JWKCacheStats{}
+		jwkCacheStats[url] = stats
+	}
+
+	return stats
+}
+
+func countJWKCacheHit(url string) {
+	atomic.AddInt64(&jwkStatsForSource(url).Hits, 1)
+}
+
+func countJWKCacheMiss(url string) {
+	atomic.AddInt64(&jwkStatsForSource(url).Misses, 1)
+}
+
+func countJWKRefresh(url string) {
+	atomic.AddInt64(&jwkStatsForSource(url).Refreshes, 1)
+}
+
+// countJWKFetch records the result of a download of the JWKS document, a success ends a run of errors
+func countJWKFetch(url string, err error) {
+	stats := jwkStatsForSource(url)
+	if err == nil {
+		atomic.StoreInt64(&stats.ConsecutiveFetchErrors, 0)
+		atomic.StoreInt32(&stats.alerted, 0)
+		return
+	}
+
+	atomic.AddInt64(&stats.FetchErrors, 1)
+	atomic.AddInt64(&stats.ConsecutiveFetchErrors, 1)
+}
+
+// jwkSourceFailing is true the first time a source reaches threshold fetch errors in a row, it is
+// only true again after a fetch has succeeded so a long outage raises a single alert
+func jwkSourceFailing(url string, threshold int64) (bool, int64) {
+	stats := jwkStatsForSource(url)
+	failures := atomic.LoadInt64(&stats.ConsecutiveFetchErrors)
+	if threshold <= 0 || failures < threshold {
+		return false, failures
+	}
+
+	return atomic.CompareAndSwapInt32(&stats.alerted, 0, 1), failures
+}
+
+// JWKCacheStatsSnapshot copies the stats of every JWT source that has been used, keyed by URL
+func JWKCacheStatsSnapshot() map[string]JWKCacheStats {
+	jwkCacheStatsLock.RLock()
+	defer jwkCacheStatsLock.RUnlock()
+
+	snapshot := make(map[string]JWKCacheStats, len(jwkCacheStats))
+	for url, stats := range jwkCacheStats {
+		snapshot[url] = JWKCacheStats{
+			Hits:                   atomic.LoadInt64(&stats.Hits),
+			Misses:                 atomic.LoadInt64(&stats.Misses),
+			Refreshes:              atomic.LoadInt64(&stats.Refreshes),
+			FetchErrors:            atomic.LoadInt64(&stats.FetchErrors),
+			ConsecutiveFetchErrors: atomic.LoadInt64(&stats.ConsecutiveFetchErrors),
+		}
+	}
+
+	return snapshot
+}
+
+// jwkCacheStatsHandler returns the JWKS cache stats of this node, like the request counters they
+// are kept in memory. Pass source to get the stats of one JWT source URL.
+func jwkCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	snapshot := JWKCacheStatsSnapshot()
+	var responseMessage []byte
+	var err error
+	if source := r.FormValue("source"); source != "" {
+		responseMessage, err = json.Marshal(snapshot[source])
+	} else {
+		responseMessage, err = json.Marshal(snapshot)
+	}
+	if err != nil {
+		DoJSONWrite(w, 500, createError("Failed to encode data"))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
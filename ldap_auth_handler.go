@@ -144,11 +144,20 @@ func (l *LDAPStorageHandler) Decrement(keyName string) {
 	l.notifyReadOnly()
 }
 
+func (l *LDAPStorageHandler) DecrementBy(keyName string, by int64) {
+	l.notifyReadOnly()
+}
+
 func (l *LDAPStorageHandler) IncrememntWithExpire(keyName string, timeout int64) int64 {
 	l.notifyReadOnly()
 	return 999
 }
 
+func (l *LDAPStorageHandler) IncrementByWithExpire(keyName string, by int64, timeout int64) int64 {
+	l.notifyReadOnly()
+	return 999
+}
+
 func (l *LDAPStorageHandler) notifyReadOnly() bool {
 	log.Warning("LDAP storage is READ ONLY")
 	return false
@@ -159,6 +168,15 @@ func (s *LDAPStorageHandler) SetRollingWindow(keyName string, per int64, val str
 	return 0, []interface{}{}
 }
 
+func (s *LDAPStorageHandler) AddToRollingWindow(keyName string, per int64, values []string) (int, []interface{}) {
+	log.Warning("Not Implemented!")
+	return 0, []interface{}{}
+}
+
+func (s *LDAPStorageHandler) RemoveFromRollingWindow(keyName string, values ...string) {
+	log.Warning("Not Implemented!")
+}
+
 func (s LDAPStorageHandler) GetSet(keyName string) (map[string]string, error) {
 	log.Error("Not implemented")
 	return map[string]string{}, nil
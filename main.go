@@ -23,6 +23,8 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +37,9 @@ var GlobalEventsJSVM = &JSVM{}
 var doMemoryProfile bool
 var doCpuProfile bool
 var Policies = make(map[string]Policy)
+
+// policiesMu guards Policies and PolicyPerAPIIssues, both are replaced when the policies are reloaded
+var policiesMu sync.RWMutex
 var MainNotifier = RedisNotifier{}
 var DefaultOrgStore = DefaultSessionManager{}
 var DefaultQuotaStore = DefaultSessionManager{}
@@ -106,7 +111,7 @@ func setupGlobals() {
 
 		} else if config.AnalyticsConfig.Type == "mongo" {
 			log.Debug("Using MongoDB cache purge")
-			analytics.Clean = &MongoPurger{&AnalyticsStore, nil, "", ""}
+			analytics.Clean = &MongoPurger{&AnalyticsStore, nil, "", "", ""}
 			GlobalHostChecker.Clean = &MongoUptimePurger{HealthCheckStore, nil, "tyk_uptime_analytics", UptimeAnalytics_KEYNAME}
 		} else if config.AnalyticsConfig.Type == "rpc" {
 			log.Debug("Using RPC cache purge")
@@ -122,6 +127,8 @@ func setupGlobals() {
 		} else {
 			log.Warn("Cache purge turned off, you are responsible for Redis storage maintenance.")
 		}
+
+		setupAnalyticsSinks(&AnalyticsStore)
 	}
 
 	//genericOsinStorage = MakeNewOsinServer()
@@ -183,6 +190,27 @@ func getAPISpecs() *[]*APISpec {
 	return APISpecs
 }
 
+// policyReloadInProgress is set while the Policies map is being swapped for a newly loaded one, not
+// while the new policies are fetched, so a slow or failing source doesn't turn every missing
+// policy into a 503
+var policyReloadInProgress int32
+
+// PolicyReloadInProgress tells callers that a missing policy may only be missing temporarily
+func PolicyReloadInProgress() bool {
+	return atomic.LoadInt32(&policyReloadInProgress) == 1
+}
+
+// swapPolicies replaces the loaded policies and their policy_per_api issues
+func swapPolicies(policies map[string]Policy, issues []PolicyPerAPIIssue) {
+	atomic.StoreInt32(&policyReloadInProgress, 1)
+	defer atomic.StoreInt32(&policyReloadInProgress, 0)
+
+	policiesMu.Lock()
+	PolicyPerAPIIssues = issues
+	Policies = policies
+	policiesMu.Unlock()
+}
+
 func getPolicies() {
 	log.Debug("Loading policies")
 	if config.Policies.PolicyRecordName == "" {
@@ -190,15 +218,38 @@ func getPolicies() {
 		return
 	}
 
+	if config.Policies.LazyLoad {
+		log.Debug("Lazy policy loading enabled, policies will be fetched on demand")
+		resetLazyPolicyCache()
+		swapPolicies(make(map[string]Policy), []PolicyPerAPIIssue{})
+		return
+	}
+
+	var policies map[string]Policy
+	var err error
 	if config.Policies.PolicySource == "mongo" {
 		log.Debug("Using Policies from Mongo DB")
-		Policies = LoadPoliciesFromMongo(config.Policies.PolicyRecordName)
+		policies, err = LoadPoliciesFromMongo(config.Policies.PolicyRecordName)
 	} else if config.Policies.PolicySource == "rpc" {
 		log.Debug("Using Policies from RPC")
-		Policies = LoadPoliciesFromRPC(config.SlaveOptions.RPCKey)
+		policies, err = LoadPoliciesFromRPC(config.SlaveOptions.RPCKey)
 	} else {
-		Policies = LoadPoliciesFromFile(config.Policies.PolicyRecordName)
+		policies, err = LoadPoliciesFromFile(config.Policies.PolicyRecordName)
+	}
+
+	if err == nil {
+		err = ParsePolicyLimits(policies)
+	}
+
+	// A failed load must not wipe out the policies we already have
+	if err != nil {
+		policiesMu.RLock()
+		log.Error("Failed to load policies, keeping the ", len(Policies), " policies already loaded")
+		policiesMu.RUnlock()
+		return
 	}
+
+	swapPolicies(policies, ValidatePolicyPerAPI(policies))
 }
 
 // Set up default Tyk control API endpoints - these are global, so need to be added first
@@ -223,6 +274,8 @@ func loadAPIEndpoints(Muxer *mux.Router) {
 		ApiMuxer.HandleFunc("/tyk/org/keys/"+"{rest:.*}", CheckIsAPIOwner(orgHandler))
 		ApiMuxer.HandleFunc("/tyk/keys/policy/"+"{rest:.*}", CheckIsAPIOwner(policyUpdateHandler))
 		ApiMuxer.HandleFunc("/tyk/keys/create", CheckIsAPIOwner(createKeyHandler))
+		ApiMuxer.HandleFunc("/tyk/jwt/sessions", CheckIsAPIOwner(createJWTSessionHandler))
+		ApiMuxer.HandleFunc("/tyk/jwt/revocations", CheckIsAPIOwner(jwtRevocationHandler))
 		ApiMuxer.HandleFunc("/tyk/apis/"+"{rest:.*}", CheckIsAPIOwner(apiHandler))
 		ApiMuxer.HandleFunc("/tyk/health/", CheckIsAPIOwner(healthCheckhandler))
 		ApiMuxer.HandleFunc("/tyk/oauth/clients/create", CheckIsAPIOwner(createOauthClient))
@@ -233,6 +286,10 @@ func loadAPIEndpoints(Muxer *mux.Router) {
 
 	ApiMuxer.HandleFunc("/tyk/keys/"+"{rest:.*}", CheckIsAPIOwner(keyHandler))
 	ApiMuxer.HandleFunc("/tyk/oauth/clients/"+"{rest:.*}", CheckIsAPIOwner(oAuthClientHandler))
+	ApiMuxer.HandleFunc("/tyk/jwt/validate", CheckIsAPIOwner(validateJWTHandler))
+	ApiMuxer.HandleFunc("/tyk/policies/validation", CheckIsAPIOwner(policyValidationHandler))
+	ApiMuxer.HandleFunc("/tyk/stats/requests", CheckIsAPIOwner(requestCountersHandler))
+	ApiMuxer.HandleFunc("/tyk/stats/jwks", CheckIsAPIOwner(jwkCacheStatsHandler))
 }
 
 // Create API-specific OAuth handlers and respective auth servers
@@ -463,6 +520,11 @@ func loadApps(APISpecs *[]*APISpec, Muxer *mux.Router) {
 			skip = true
 		}
 
+		if referenceSpec.EnableJWT && !ValidateJWTSigningMethod(referenceSpec) {
+			log.Error("Invalid JWT signing method, skipping API ID: ", referenceSpec.APIID)
+			skip = true
+		}
+
 		remote, err := url.Parse(referenceSpec.APIDefinition.Proxy.TargetURL)
 		if err != nil {
 			log.Error("Culdn't parse target URL: ", err)
@@ -568,12 +630,17 @@ func loadApps(APISpecs *[]*APISpec, Muxer *mux.Router) {
 				// Add pre-process MW
 				var chainArray = []alice.Constructor{}
 				handleCORS(&chainArray, referenceSpec)
+				chainArray = append(chainArray, CreateMiddleware(&NormalizePathMiddleware{tykMiddleware}, tykMiddleware))
 
 				var baseChainArray = []alice.Constructor{
+					CreateMiddleware(&RequestHeaderLimitMiddleware{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&IPAccessListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&RequestSizeLimitMiddleware{tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&MockResponseMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&ValidateJSON{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&TransformMiddleware{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&TransformHeaders{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&RedisCacheMiddleware{TykMiddleware: tykMiddleware, CacheStore: CacheStore}, tykMiddleware),
@@ -596,7 +663,7 @@ func loadApps(APISpecs *[]*APISpec, Muxer *mux.Router) {
 				// for KeyLessAccess we can't support rate limiting, versioning or access rules
 				chain := alice.New(chainArray...).Then(DummyProxyHandler{SH: SuccessHandler{tykMiddleware}})
 				log.Debug("----> Setting Listen Path: ", referenceSpec.Proxy.ListenPath)
-				subrouter.Handle(referenceSpec.Proxy.ListenPath+"{rest:.*}", chain)
+				subrouter.Handle(referenceSpec.Proxy.ListenPath+"{rest:.*}", RequestTimeout(tykMiddleware, chain))
 
 			} else {
 
@@ -628,16 +695,22 @@ func loadApps(APISpecs *[]*APISpec, Muxer *mux.Router) {
 				var chainArray = []alice.Constructor{}
 
 				handleCORS(&chainArray, referenceSpec)
+				chainArray = append(chainArray, CreateMiddleware(&NormalizePathMiddleware{tykMiddleware}, tykMiddleware))
 				var baseChainArray = []alice.Constructor{
+					CreateMiddleware(&RequestHeaderLimitMiddleware{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&IPAccessListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&RequestSizeLimitMiddleware{tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&StrictAuthHeaderCheck{tykMiddleware}, tykMiddleware),
 					keyCheck,
 					CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&RateLimitAndQuotaCheck{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&GranularAccessMiddleware{tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&MockResponseMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&ValidateJSON{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&TransformMiddleware{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&TransformHeaders{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&URLRewriteMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
@@ -666,8 +739,10 @@ func loadApps(APISpecs *[]*APISpec, Muxer *mux.Router) {
 				userCheckHandler := http.HandlerFunc(UserRatesCheck())
 				simpleChain := alice.New(
 					CreateMiddleware(&IPWhiteListMiddleware{tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&IPAccessListMiddleware{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&StrictAuthHeaderCheck{tykMiddleware}, tykMiddleware),
 					keyCheck,
 					CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware)).Then(userCheckHandler)
@@ -676,9 +751,12 @@ func loadApps(APISpecs *[]*APISpec, Muxer *mux.Router) {
 				log.Debug("----> Rate limits available at: ", rateLimitPath)
 				subrouter.Handle(rateLimitPath, simpleChain)
 				log.Debug("----> Setting Listen Path: ", referenceSpec.Proxy.ListenPath)
-				subrouter.Handle(referenceSpec.Proxy.ListenPath+"{rest:.*}", chain)
+				subrouter.Handle(referenceSpec.Proxy.ListenPath+"{rest:.*}", RequestTimeout(tykMiddleware, chain))
 			}
 
+			if ApiSpecRegister != nil {
+				ResetJWKCacheOnReload((*ApiSpecRegister)[referenceSpec.APIDefinition.APIID], referenceSpec)
+			}
 			tempSpecRegister[referenceSpec.APIDefinition.APIID] = referenceSpec
 
 		} else {
@@ -810,6 +888,7 @@ func init() {
 	}
 
 	loadConfig(filename, &config)
+	config.loadTrustedProxies()
 
 	if config.Storage.Type != "redis" {
 		log.Fatal("Redis connection details not set, please ensure that the storage type is set to Redis and that the connection parameters are correct.")
@@ -854,6 +933,15 @@ func init() {
 		log.Debug("Sentry hook active")
 	}
 
+	if config.DevMode {
+		log.Warning("*** DEV MODE IS ENABLED, THIS GATEWAY MUST NOT BE USED IN PRODUCTION ***")
+		if devModeJWTBypassEnabled() {
+			log.Warning("*** JWT auth can be bypassed with the ", config.DevModeOptions.JWTBypassHeader, " header ***")
+		} else if config.DevModeOptions.JWTBypassHeader != "" {
+			log.Error("Dev mode JWT bypass secret must be at least ", devModeMinSecretLength, " characters, bypass disabled")
+		}
+	}
+
 }
 
 func GetGlobalStorageHandler(KeyPrefix string, hashKeys bool) StorageHandler {
@@ -910,6 +998,9 @@ func main() {
 		DefaultQuotaStore.Init(GetGlobalStorageHandler("orgkey.", false))
 	}
 
+	// Event handlers for APIs that don't set their own
+	GlobalEventPaths = InitEventHandlers(config.EventHandlers, &APISpec{})
+
 	loadAPIEndpoints(defaultRouter)
 
 	// Start listening for reload messages
@@ -949,11 +1040,17 @@ func main() {
 				certNameMap[certData.Name] = &certs[i]
 			}
 
+			var nextProtos []string
+			if config.HttpServerOptions.EnableHTTP2 {
+				nextProtos = []string{"h2", "http/1.1"}
+			}
+
 			config := tls.Config{
 				Certificates:      certs,
 				NameToCertificate: certNameMap,
 				ServerName:        config.HttpServerOptions.ServerName,
 				MinVersion:        config.HttpServerOptions.MinVersion,
+				NextProtos:        nextProtos,
 			}
 			l, err = tls.Listen("tcp", targetPort, &config)
 		} else {
@@ -974,14 +1071,14 @@ func main() {
 				Addr:         ":" + targetPort,
 				ReadTimeout:  time.Duration(ReadTimeout) * time.Second,
 				WriteTimeout: time.Duration(WriteTimeout) * time.Second,
-				Handler:      defaultRouter,
+				Handler:      HTTP2Handler(defaultRouter),
 			}
 
 			go s.Serve(l)
 			displayConfig()
 		} else {
 			log.Printf("Gateway started (%v)", VERSION)
-			http.Handle("/", mainRouter)
+			http.Handle("/", HTTP2Handler(mainRouter))
 			go http.Serve(l, nil)
 			displayConfig()
 		}
@@ -1000,7 +1097,7 @@ func main() {
 				Addr:         ":" + targetPort,
 				ReadTimeout:  time.Duration(ReadTimeout) * time.Second,
 				WriteTimeout: time.Duration(WriteTimeout) * time.Second,
-				Handler:      defaultRouter,
+				Handler:      HTTP2Handler(defaultRouter),
 			}
 
 			log.Info("Custom gateway started")
@@ -1009,7 +1106,7 @@ func main() {
 		} else {
 			log.Printf("Gateway resumed (%v)", VERSION)
 			displayConfig()
-			http.Handle("/", mainRouter)
+			http.Handle("/", HTTP2Handler(mainRouter))
 			http.Serve(l, nil)
 		}
 
@@ -1032,5 +1129,13 @@ func main() {
 	if err := l.Close(); nil != err {
 		log.Fatalln(err)
 	}
+
+	if config.EnableAnalytics {
+		flushTimeout := config.AnalyticsConfig.ShutdownFlushTimeout
+		if flushTimeout <= 0 {
+			flushTimeout = defaultShutdownFlushTimeout
+		}
+		FlushAnalytics(time.Duration(flushTimeout) * time.Second)
+	}
 	//time.Sleep(1e9)
 }
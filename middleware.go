@@ -10,6 +10,12 @@ type TykMiddlewareImplementation interface {
 	ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) // Handles request
 }
 
+// TykMiddlewareCleanup is implemented by middleware that holds something for the lifetime of a
+// request. Cleanup runs once the rest of the chain has returned, even if a later handler panicked.
+type TykMiddlewareCleanup interface {
+	Cleanup(r *http.Request)
+}
+
 func CreateDynamicMiddleware(MiddlewareName string, IsPre, UseSession bool, tykMwSuper *TykMiddleware) func(http.Handler) http.Handler {
 	dMiddleware := &DynamicMiddleware{
 		TykMiddleware:       tykMwSuper,
@@ -35,12 +41,17 @@ func CreateMiddleware(mw TykMiddlewareImplementation, tykMwSuper *TykMiddleware)
 		//handler.HandleError(w, r, confErr.Error(), 403)
 	}
 
+	cleanup, hasCleanup := mw.(TykMiddlewareCleanup)
+
 	aliceHandler := func(h http.Handler) http.Handler {
 		thisHandler := func(w http.ResponseWriter, r *http.Request) {
 
 			if (tykMwSuper.Spec.CORS.OptionsPassthrough) && (r.Method == "OPTIONS") {
 				h.ServeHTTP(w, r)
 			} else {
+				if hasCleanup {
+					defer cleanup.Cleanup(r)
+				}
 				reqErr, errCode := mw.ProcessRequest(w, r, thisMwConfiguration)
 				if reqErr != nil {
 					handler := ErrorHandler{tykMwSuper}
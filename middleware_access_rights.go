@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"strconv"
 )
 
 // AccessRightsCheck is a middleware that will check if the key bing used to access the API has
@@ -29,6 +30,46 @@ func (a *AccessRightsCheck) ProcessRequest(w http.ResponseWriter, r *http.Reques
 	thisSessionState := context.Get(r, SessionData).(SessionState)
 	authHeaderValue := context.Get(r, AuthHeaderValue)
 
+	// The policy may only be missing because it is being reloaded, ask the client to retry
+	if a.TykMiddleware.PolicyUnavailableDuringReload(thisSessionState) {
+		log.WithFields(logrus.Fields{
+			"path":      r.URL.Path,
+			"origin":    r.RemoteAddr,
+			"key":       authHeaderValue,
+			"policy_id": thisSessionState.ApplyPolicyID,
+		}).Warning("Policy not found during policy reload, asking client to retry.")
+
+		w.Header().Set("Retry-After", strconv.Itoa(config.Policies.ReloadRetryAfter))
+		return errors.New("Policies are being reloaded, please retry"), 503
+	}
+
+	if a.Spec.Options.StrictPolicies {
+		if ambiguity := a.TykMiddleware.PolicyAmbiguity(thisSessionState); ambiguity != "" {
+			log.WithFields(logrus.Fields{
+				"path":      r.URL.Path,
+				"origin":    r.RemoteAddr,
+				"key":       authHeaderValue,
+				"ambiguity": ambiguity,
+			}).Warning("Policy could not be applied exactly, refusing access.")
+
+			return errors.New("Access to this API has been disallowed"), 403
+		}
+	}
+
+	// A policy can read its empty access rights as access to nothing
+	if len(thisSessionState.AccessRights) == 0 && thisSessionState.ApplyPolicyID != "" {
+		if policy, problem := a.TykMiddleware.appliedPolicy(thisSessionState); problem == "" && policy.DeniesAllAPIs() {
+			log.WithFields(logrus.Fields{
+				"path":      r.URL.Path,
+				"origin":    r.RemoteAddr,
+				"key":       authHeaderValue,
+				"policy_id": thisSessionState.ApplyPolicyID,
+			}).Info("Attempted access with a policy that has no access rights.")
+
+			return errors.New("Access to this API has been disallowed"), 403
+		}
+	}
+
 	// If there's nothing in our profile, we let them through to the next phase
 	if len(thisSessionState.AccessRights) > 0 {
 		// Otherwise, run auth checks
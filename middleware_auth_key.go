@@ -79,6 +79,11 @@ func (k *AuthKey) ProcessRequest(w http.ResponseWriter, r *http.Request, configu
 		return errors.New("Authorization field missing"), 400
 	}
 
+	return k.checkKey(r, authHeaderValue)
+}
+
+// checkKey looks up the session of an API key and sets it on the request
+func (k *AuthKey) checkKey(r *http.Request, authHeaderValue string) (error, int) {
 	// Check if API key valid
 	thisSessionState, keyExists := k.TykMiddleware.CheckSessionAndIdentityForValidKey(authHeaderValue)
 	if !keyExists {
@@ -89,7 +94,7 @@ func (k *AuthKey) ProcessRequest(w http.ResponseWriter, r *http.Request, configu
 		}).Info("Attempted access with non-existent key.")
 
 		// Fire Authfailed Event
-		AuthFailed(k.TykMiddleware, r, authHeaderValue)
+		AuthFailed(k.TykMiddleware, r, authHeaderValue, AuthFailureKeyNotFound)
 
 		// Report in health check
 		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
@@ -104,12 +109,13 @@ func (k *AuthKey) ProcessRequest(w http.ResponseWriter, r *http.Request, configu
 	return nil, 200
 }
 
-func AuthFailed(m *TykMiddleware, r *http.Request, authHeaderValue string) {
+func AuthFailed(m *TykMiddleware, r *http.Request, authHeaderValue string, reason AuthFailureReason) {
 	go m.FireEvent(EVENT_AuthFailure,
 		EVENT_AuthFailureMeta{
 			EventMetaDefault: EventMetaDefault{Message: "Auth Failure", OriginatingRequest: EncodeRequestToEvent(r)},
 			Path:             r.URL.Path,
 			Origin:           r.RemoteAddr,
 			Key:              authHeaderValue,
+			Reason:           reason,
 		})
 }
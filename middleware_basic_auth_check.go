@@ -3,25 +3,137 @@ package main
 import "net/http"
 
 import (
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pmylund/go-cache"
 	"golang.org/x/crypto/bcrypt"
 	"strings"
+	"time"
 )
 
+const defaultBasicAuthJWTExpiry int64 = 300
+
+// BasicAuthJWTCache holds the tokens minted for basic auth users so they aren't re-signed on every request
+var BasicAuthJWTCache *cache.Cache = cache.New(time.Duration(defaultBasicAuthJWTExpiry)*time.Second, 30*time.Second)
+
 // BasicAuthKeyIsValid uses a username instead of
 type BasicAuthKeyIsValid struct {
 	*TykMiddleware
 }
 
+// BasicAuthJWTOptions configure swapping valid basic auth credentials for a JWT that is sent to the
+// upstream instead, for clients that can only send basic auth to upstreams that expect a JWT
+type BasicAuthJWTOptions struct {
+	Enabled bool `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	// SigningMethod is hmac (HS256) or rsa (RS256)
+	SigningMethod string `mapstructure:"signing_method" bson:"signing_method" json:"signing_method"`
+	// SigningKey is the HMAC secret or a PEM encoded RSA private key
+	SigningKey string `mapstructure:"signing_key" bson:"signing_key" json:"signing_key"`
+	// ExpiresIn is the lifetime of a minted token in seconds, it is never longer than the session, defaults to 300
+	ExpiresIn int64  `mapstructure:"expires_in" bson:"expires_in" json:"expires_in"`
+	Issuer    string `mapstructure:"issuer" bson:"issuer" json:"issuer"`
+
+	rsaKey *rsa.PrivateKey
+}
+
+// BasicAuthMiddlewareConfig holds the basic auth options that are read from the raw API definition
+type BasicAuthMiddlewareConfig struct {
+	BasicAuthToJWT BasicAuthJWTOptions `mapstructure:"basic_auth_to_jwt" bson:"basic_auth_to_jwt" json:"basic_auth_to_jwt"`
+}
+
 // New lets you do any initialisations for the object can be done here
 func (k *BasicAuthKeyIsValid) New() {}
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (k *BasicAuthKeyIsValid) GetConfig() (interface{}, error) {
-	return nil, nil
+	var thisModuleConfig BasicAuthMiddlewareConfig
+
+	err := mapstructure.Decode(k.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	jwtOptions := &thisModuleConfig.BasicAuthToJWT
+	if !jwtOptions.Enabled {
+		return thisModuleConfig, nil
+	}
+
+	if jwtOptions.ExpiresIn <= 0 {
+		jwtOptions.ExpiresIn = defaultBasicAuthJWTExpiry
+	}
+
+	switch jwtOptions.SigningMethod {
+	case "rsa":
+		jwtOptions.rsaKey, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(jwtOptions.SigningKey))
+		if err != nil {
+			log.Error("Failed to parse basic auth JWT signing key: ", err)
+			return nil, err
+		}
+	case "hmac", "":
+		if jwtOptions.SigningKey == "" {
+			return nil, errors.New("basic_auth_to_jwt requires a signing_key")
+		}
+	default:
+		return nil, errors.New("unsupported basic_auth_to_jwt signing method: " + jwtOptions.SigningMethod)
+	}
+
+	return thisModuleConfig, nil
+}
+
+// basicAuthJWTCacheKey includes a hash of the stored credentials so a changed password gets a new token
+func basicAuthJWTCacheKey(apiID, keyName string, session SessionState) string {
+	credentials := sha256.Sum256([]byte(string(session.BasicAuthData.Hash) + ":" + session.BasicAuthData.Password))
+	return apiID + "." + keyName + "." + hex.EncodeToString(credentials[:])
+}
+
+// upstreamJWT returns a JWT for a basic auth user, tokens are cached until they expire
+func (k *BasicAuthKeyIsValid) upstreamJWT(options BasicAuthJWTOptions, username, keyName string, session SessionState) (string, error) {
+	cacheKey := basicAuthJWTCacheKey(k.Spec.APIID, keyName, session)
+	if cachedToken, found := BasicAuthJWTCache.Get(cacheKey); found {
+		return cachedToken.(string), nil
+	}
+
+	now := time.Now().Unix()
+	expires := now + options.ExpiresIn
+	if session.Expires > 0 && session.Expires < expires {
+		expires = session.Expires
+	}
+
+	var token *jwt.Token
+	var signingKey interface{}
+	if options.SigningMethod == "rsa" {
+		token = jwt.New(jwt.SigningMethodRS256)
+		signingKey = options.rsaKey
+	} else {
+		token = jwt.New(jwt.SigningMethodHS256)
+		signingKey = []byte(options.SigningKey)
+	}
+
+	token.Claims["sub"] = username
+	token.Claims["iat"] = now
+	token.Claims["exp"] = expires
+	if options.Issuer != "" {
+		token.Claims["iss"] = options.Issuer
+	}
+
+	signed, err := token.SignedString(signingKey)
+	if err != nil {
+		return "", err
+	}
+
+	// go-cache keeps entries with a non-positive duration forever, tokens of expired sessions are never cached
+	if expires > now {
+		BasicAuthJWTCache.Set(cacheKey, signed, time.Duration(expires-now)*time.Second)
+	}
+	return signed, nil
 }
 
 // requestForBasicAuth sends error code and message along with WWW-Authenticate header to client.
@@ -89,7 +201,7 @@ func (k *BasicAuthKeyIsValid) ProcessRequest(w http.ResponseWriter, r *http.Requ
 		}).Info("Attempted access with non-existent user.")
 
 		// Fire Authfailed Event
-		AuthFailed(k.TykMiddleware, r, authHeaderValue)
+		AuthFailed(k.TykMiddleware, r, authHeaderValue, AuthFailureKeyNotFound)
 
 		// Report in health check
 		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "-1")
@@ -121,7 +233,7 @@ func (k *BasicAuthKeyIsValid) ProcessRequest(w http.ResponseWriter, r *http.Requ
 		}).Info("Attempted access with existing user but failed password check.")
 
 		// Fire Authfailed Event
-		AuthFailed(k.TykMiddleware, r, authHeaderValue)
+		AuthFailed(k.TykMiddleware, r, authHeaderValue, AuthFailureBadPassword)
 
 		// Report in health check
 		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "-1")
@@ -129,6 +241,23 @@ func (k *BasicAuthKeyIsValid) ProcessRequest(w http.ResponseWriter, r *http.Requ
 		return k.requestForBasicAuth(w, "User not authorised")
 	}
 
+	thisConfig := configuration.(BasicAuthMiddlewareConfig)
+	if thisConfig.BasicAuthToJWT.Enabled {
+		upstreamToken, tokenErr := k.upstreamJWT(thisConfig.BasicAuthToJWT, authValues[0], keyName, thisSessionState)
+		if tokenErr != nil {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+				"key":    keyName,
+			}).Error("Failed to create upstream JWT: ", tokenErr)
+
+			return errors.New("Failed to create upstream token"), 500
+		}
+
+		// The upstream gets the JWT instead of the basic auth credentials
+		r.Header.Set("Authorization", "Bearer "+upstreamToken)
+	}
+
 	// Set session state on context, we will need it later
 	context.Set(r, SessionData, thisSessionState)
 	context.Set(r, AuthHeaderValue, keyName)
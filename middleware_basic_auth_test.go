@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/justinas/alice"
 )
 
@@ -349,3 +350,100 @@ func TestBasicAuthWrongPassword(t *testing.T) {
 		t.Error("Request should have returned WWW-Authenticate header!: \n")
 	}
 }
+
+func TestBasicAuthToJWT(t *testing.T) {
+	var upstreamAuth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamAuth = append(upstreamAuth, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	def := strings.Replace(basicAuthDef, `"use_basic_auth": true,`, `"use_basic_auth": true,
+		"basic_auth_to_jwt": {"enabled": true, "signing_method": "hmac", "signing_key": "upstream-secret", "expires_in": 60, "issuer": "tyk"},`, 1)
+	spec := createDefinitionFromString(def)
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	remote, _ := url.Parse(upstream.URL)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	chain := alice.New(
+		CreateMiddleware(&BasicAuthKeyIsValid{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware)).Then(http.HandlerFunc(ProxyHandler(proxy, &spec)))
+
+	username := randSeq(10)
+	spec.SessionManager.UpdateSession("default"+username, createBasicAuthSession(), 60)
+
+	send := func(password string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(username, password)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := send("WRONG"); code != 401 {
+		t.Fatalf("Invalid credentials should be rejected, got %v", code)
+	}
+	if len(upstreamAuth) != 0 {
+		t.Fatal("Invalid credentials should not reach the upstream")
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := send("TEST"); code != 200 {
+			t.Fatalf("Valid credentials should be accepted, got %v", code)
+		}
+	}
+
+	if len(upstreamAuth) != 2 || upstreamAuth[0] != upstreamAuth[1] {
+		t.Fatalf("Expected the same cached token for both requests, got %v", upstreamAuth)
+	}
+	if !strings.HasPrefix(upstreamAuth[0], "Bearer ") {
+		t.Fatalf("Upstream should get a bearer token, got %v", upstreamAuth[0])
+	}
+
+	token, err := jwt.Parse(strings.TrimPrefix(upstreamAuth[0], "Bearer "), func(token *jwt.Token) (interface{}, error) {
+		return []byte("upstream-secret"), nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatal("Upstream token should be signed with the configured key: ", err)
+	}
+	if token.Claims["sub"] != username || token.Claims["iss"] != "tyk" {
+		t.Error("Unexpected claims in upstream token: ", token.Claims)
+	}
+	if exp := int64(token.Claims["exp"].(float64)); exp > time.Now().Unix()+60 {
+		t.Error("Upstream token should expire within expires_in, got exp ", exp)
+	}
+
+	// A changed password doesn't reuse the token minted for the old one
+	thisSession := createBasicAuthSession()
+	oldCacheKey := basicAuthJWTCacheKey(spec.APIID, "default"+username, thisSession)
+	thisSession.BasicAuthData.Password = "CHANGED"
+	spec.SessionManager.UpdateSession("default"+username, thisSession, 60)
+	SessionCache.Delete("default" + username)
+	if code := send("TEST"); code != 401 {
+		t.Fatalf("The old password should be rejected, got %v", code)
+	}
+	if code := send("CHANGED"); code != 200 {
+		t.Fatalf("The new password should be accepted, got %v", code)
+	}
+	if _, found := BasicAuthJWTCache.Get(basicAuthJWTCacheKey(spec.APIID, "default"+username, thisSession)); !found {
+		t.Error("Expected a token cached for the new credentials")
+	}
+	if basicAuthJWTCacheKey(spec.APIID, "default"+username, thisSession) == oldCacheKey {
+		t.Error("Expected the cache key to change with the credentials")
+	}
+
+	// Tokens for sessions that have already expired aren't cached forever
+	thisSession.Expires = time.Now().Unix() - 10
+	middleware := &BasicAuthKeyIsValid{tykMiddleware}
+	thisConfig, _ := middleware.GetConfig()
+	if _, err := middleware.upstreamJWT(thisConfig.(BasicAuthMiddlewareConfig).BasicAuthToJWT, username, "expired"+username, thisSession); err != nil {
+		t.Fatal("Failed to create upstream token: ", err)
+	}
+	if _, found := BasicAuthJWTCache.Get(basicAuthJWTCacheKey(spec.APIID, "expired"+username, thisSession)); found {
+		t.Error("A token for an expired session should not be cached")
+	}
+}
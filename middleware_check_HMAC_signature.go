@@ -169,7 +169,7 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 		}).Info("Request signature is invalid")
 
 		// Fire Authfailed Event
-		AuthFailed(hm.TykMiddleware, r, keyId)
+		AuthFailed(hm.TykMiddleware, r, keyId, AuthFailureBadSignature)
 		// Report in health check
 		ReportHealthCheckValue(hm.Spec.Health, KeyFailure, "-1")
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"net"
+	"net/http"
+)
+
+// IPAccessListMiddleware rejects clients by IP range before any auth is done, the client IP is
+// resolved the same way as for analytics so trusted_proxies are honoured
+type IPAccessListMiddleware struct {
+	*TykMiddleware
+}
+
+// IPAccessListConfig holds the CIDR ranges (or single IPs) to allow and deny for an API, the
+// deny list is checked first and an empty allow list allows every IP that isn't denied
+type IPAccessListConfig struct {
+	IPAllowList []string `mapstructure:"ip_allow_list" bson:"ip_allow_list" json:"ip_allow_list"`
+	IPDenyList  []string `mapstructure:"ip_deny_list" bson:"ip_deny_list" json:"ip_deny_list"`
+
+	allowedNets []*net.IPNet
+	deniedNets  []*net.IPNet
+}
+
+// New lets you do any initialisations for the object can be done here
+func (i *IPAccessListMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (i *IPAccessListMiddleware) GetConfig() (interface{}, error) {
+	var thisModuleConfig IPAccessListConfig
+
+	err := mapstructure.Decode(i.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	thisModuleConfig.allowedNets = ParseIPNets(thisModuleConfig.IPAllowList)
+	thisModuleConfig.deniedNets = ParseIPNets(thisModuleConfig.IPDenyList)
+
+	return thisModuleConfig, nil
+}
+
+func (i *IPAccessListMiddleware) isAllowed(thisConfig IPAccessListConfig, clientIP net.IP) bool {
+	if clientIP == nil {
+		// Can't tell who this is, only let it through if no ranges apply
+		return len(thisConfig.IPAllowList) == 0 && len(thisConfig.IPDenyList) == 0
+	}
+
+	if IPInNets(clientIP, thisConfig.deniedNets) {
+		return false
+	}
+
+	if len(thisConfig.IPAllowList) > 0 {
+		return IPInNets(clientIP, thisConfig.allowedNets)
+	}
+
+	return true
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (i *IPAccessListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(IPAccessListConfig)
+
+	// Disabled, pass through
+	if len(thisConfig.IPAllowList) == 0 && len(thisConfig.IPDenyList) == 0 {
+		return nil, 200
+	}
+
+	clientIP := GetClientIP(r)
+	if i.isAllowed(thisConfig, net.ParseIP(clientIP)) {
+		return nil, 200
+	}
+
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": clientIP,
+	}).Info("Client IP denied by access list.")
+
+	// Fire an IP denied event
+	go i.TykMiddleware.FireEvent(EVENT_IPAccessDenied,
+		EVENT_IPAccessDeniedMeta{
+			EventMetaDefault: EventMetaDefault{Message: "Client IP denied by access list", OriginatingRequest: EncodeRequestToEvent(r)},
+			Path:             r.URL.Path,
+			Origin:           clientIP,
+		})
+
+	// Report in health check
+	ReportHealthCheckValue(i.Spec.Health, KeyFailure, "-1")
+
+	return errors.New("Access from this IP has been disallowed"), 403
+}
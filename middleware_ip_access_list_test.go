@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func doIPAccessListRequest(t *testing.T, allowList, denyList []string, remoteAddr, forwardedFor string) int {
+	spec := createNonVersionedDefinition()
+	spec.APIDefinition.RawData["ip_allow_list"] = allowList
+	spec.APIDefinition.RawData["ip_deny_list"] = denyList
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+	chain := getChain(spec)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Add("authorization", keyId)
+	if forwardedFor != "" {
+		req.Header.Add("X-Forwarded-For", forwardedFor)
+	}
+	chain.ServeHTTP(recorder, req)
+
+	return recorder.Code
+}
+
+func TestIPAccessList(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowList  []string
+		denyList   []string
+		remoteAddr string
+		expected   int
+	}{
+		{"no lists", nil, nil, "192.168.1.1:1234", 200},
+		{"IPv4 allowed", []string{"10.0.0.0/8"}, nil, "10.1.2.3:1234", 200},
+		{"IPv4 not in allow list", []string{"10.0.0.0/8"}, nil, "192.168.1.1:1234", 403},
+		{"IPv4 denied", nil, []string{"192.168.0.0/16"}, "192.168.1.1:1234", 403},
+		{"IPv4 single IP denied", nil, []string{"192.168.1.1"}, "192.168.1.1:1234", 403},
+		{"IPv4 deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.1.2.3:1234", 403},
+		{"IPv6 allowed", []string{"2001:db8::/32"}, nil, "[2001:db8::1]:1234", 200},
+		{"IPv6 not in allow list", []string{"2001:db8::/32"}, nil, "[2001:db9::1]:1234", 403},
+		{"IPv6 denied", nil, []string{"fd00::/8"}, "[fd12::1]:1234", 403},
+		{"IPv6 not denied", nil, []string{"fd00::/8"}, "[2001:db8::1]:1234", 200},
+	}
+
+	for _, test := range tests {
+		code := doIPAccessListRequest(t, test.allowList, test.denyList, test.remoteAddr, "")
+		if code != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, code)
+		}
+	}
+}
+
+func TestIPAccessListTrustedProxy(t *testing.T) {
+	defer func() {
+		config.TrustedProxies = nil
+		config.loadTrustedProxies()
+	}()
+	config.TrustedProxies = []string{"10.0.0.1", "fd00::/8"}
+	config.loadTrustedProxies()
+	allowList := []string{"203.0.113.0/24"}
+
+	// Forwarded by a trusted proxy, the client is taken from X-Forwarded-For
+	if code := doIPAccessListRequest(t, allowList, nil, "10.0.0.1:1234", "203.0.113.7"); code != 200 {
+		t.Error("Client forwarded by a trusted proxy should be allowed, got: ", code)
+	}
+
+	// Chained trusted proxies are skipped
+	if code := doIPAccessListRequest(t, allowList, nil, "[fd00::2]:1234", "203.0.113.7, 10.0.0.1"); code != 200 {
+		t.Error("Client forwarded by chained trusted proxies should be allowed, got: ", code)
+	}
+
+	// A spoofed left-most entry is ignored
+	if code := doIPAccessListRequest(t, allowList, nil, "10.0.0.1:1234", "203.0.113.7, 198.51.100.1"); code != 403 {
+		t.Error("Untrusted hop should be treated as the client, got: ", code)
+	}
+
+	// X-Forwarded-For is ignored when the peer isn't trusted
+	if code := doIPAccessListRequest(t, allowList, nil, "198.51.100.1:1234", "203.0.113.7"); code != 403 {
+		t.Error("X-Forwarded-For from an untrusted peer should be ignored, got: ", code)
+	}
+}
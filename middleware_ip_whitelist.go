@@ -4,7 +4,6 @@ import (
 	"errors"
 	"net"
 	"net/http"
-	"strings"
 )
 
 // IPWhiteListMiddleware lets you define a list of IPs to allow upstream
@@ -28,7 +27,8 @@ func (i *IPWhiteListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Re
 		return nil, 200
 	}
 
-	var remoteIP net.IP
+	// X-Forwarded-For is only used when the request came through one of the trusted_proxies
+	remoteIP := net.ParseIP(GetClientIP(r))
 
 	// Enabled, check incoming IP address
 	for _, ip := range i.TykMiddleware.Spec.AllowedIPs {
@@ -38,14 +38,6 @@ func (i *IPWhiteListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Re
 			allowedIP = net.ParseIP(ip)
 		}
 
-		splitIP := strings.Split(r.RemoteAddr, ":")
-		remoteIPString := splitIP[0]
-		if len(splitIP) > 2 {
-			// Might be an IPv6 address, don't mess with it
-			remoteIPString = r.RemoteAddr
-		}
-		remoteIP = net.ParseIP(remoteIPString)
-
 		// Check CIDR if possible
 		if allowedNet != nil && allowedNet.Contains(remoteIP) {
 			// matched, pass through
@@ -60,7 +52,7 @@ func (i *IPWhiteListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Re
 	}
 
 	// Fire Authfailed Event
-	AuthFailed(i.TykMiddleware, r, remoteIP.String())
+	AuthFailed(i.TykMiddleware, r, remoteIP.String(), AuthFailureIPNotAllowed)
 	// Report in health check
 	ReportHealthCheckValue(i.Spec.Health, KeyFailure, "-1")
 
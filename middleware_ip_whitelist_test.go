@@ -321,3 +321,49 @@ func TestIpMiddlewareIPDisabled(t *testing.T) {
 		t.Error("Invalid response code, should be 200:  \n", recorder.Code, recorder.Body)
 	}
 }
+
+func TestIpMiddlewareTrustedProxies(t *testing.T) {
+	spec := MakeIPSampleAPI(ipMiddlewareTestDefinitionEnabledFail)
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	thisSession := createNonThrottledSession()
+	spec.SessionManager.UpdateSession("trustedproxy1234", thisSession, 60)
+	chain := getChain(*spec)
+
+	defer func() {
+		config.TrustedProxies = nil
+		config.loadTrustedProxies()
+	}()
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	config.loadTrustedProxies()
+
+	for _, tc := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expectedCode int
+	}{
+		{"forwarded by a trusted proxy", "10.0.0.1:1234", []string{"12.12.12.12"}, 200},
+		{"forwarded by chained trusted proxies", "10.0.0.1:1234", []string{"12.12.12.12, 10.0.0.2"}, 200},
+		{"spoofed by the client", "198.51.100.1:1234", []string{"12.12.12.12"}, 403},
+		{"spoofed behind a trusted proxy", "10.0.0.1:1234", []string{"12.12.12.12, 198.51.100.1"}, 403},
+		// The trusted proxy added its hop on a header line of its own
+		{"forwarded on two header lines", "10.0.0.1:1234", []string{"12.12.12.12", "10.0.0.2"}, 200},
+		{"spoofed on the first of two header lines", "10.0.0.1:1234", []string{"12.12.12.12", "198.51.100.1"}, 403},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/about-lonelycoder/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, forwardedFor := range tc.forwardedFor {
+			req.Header.Add("X-Forwarded-For", forwardedFor)
+		}
+		req.Header.Add("authorization", "trustedproxy1234")
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.expectedCode {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.expectedCode, recorder.Code)
+		}
+	}
+}
@@ -3,12 +3,30 @@ package main
 import "net/http"
 
 import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pmylund/go-cache"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // KeyExists will check if the key being used to access the API is in the request data,
@@ -17,38 +35,1805 @@ type JWTMiddleware struct {
 	*TykMiddleware
 }
 
+// JWTMiddlewareConfig holds the JWT options that are read from the raw API definition
+type JWTMiddlewareConfig struct {
+	// JWTSource is a URL to a JWKS document, if set the token kid is used to select the
+	// signing key from it and the sub claim identifies the session
+	JWTSource string `mapstructure:"jwt_source" bson:"jwt_source" json:"jwt_source"`
+	// JWTSources are more sources to try in order after JWTSource, e.g. while moving to another
+	// IdP. Each is a URL to a JWKS document or a base64 encoded DER certificate, which is used for
+	// any kid. The first source with a key for the kid that verifies the token is used.
+	JWTSources []string `mapstructure:"jwt_sources" bson:"jwt_sources" json:"jwt_sources"`
+	// JWTPinnedThumbprints restricts the keys accepted from JWTSource to certificates with
+	// these (hex encoded) SHA-256 thumbprints, leave empty to disable pinning
+	JWTPinnedThumbprints []string `mapstructure:"jwt_pinned_thumbprints" bson:"jwt_pinned_thumbprints" json:"jwt_pinned_thumbprints"`
+	// JWTMaxTokenAge rejects tokens issued (iat) more than this many seconds ago, 0 disables the check
+	JWTMaxTokenAge int64 `mapstructure:"jwt_max_token_age" bson:"jwt_max_token_age" json:"jwt_max_token_age"`
+	// JWTClockSkew is the number of seconds a token is still accepted after its exp or before its
+	// nbf, to allow for clients and issuers whose clocks are slightly off
+	JWTClockSkew int64 `mapstructure:"jwt_clock_skew" bson:"jwt_clock_skew" json:"jwt_clock_skew"`
+	// JWTAuthSchemes are the schemes the token may be prefixed with in the auth header, matched
+	// case-insensitively, defaults to Bearer
+	JWTAuthSchemes []string `mapstructure:"jwt_auth_schemes" bson:"jwt_auth_schemes" json:"jwt_auth_schemes"`
+	// JWTIdentityBaseField is the claim that identifies the session of a JWTSource token, defaults to
+	// sub. It can be a dotted path to a claim nested in objects, e.g. user.email, if part of the
+	// path is missing the sub claim is used instead.
+	JWTIdentityBaseField string `mapstructure:"jwt_identity_base_field" bson:"jwt_identity_base_field" json:"jwt_identity_base_field"`
+	// JWTPolicyFieldName is the claim holding a policy ID, if set JWTSource tokens get a virtual
+	// session created from that policy the first time their identity is seen. The claim can also
+	// be an array of policy IDs, the session is then merged from them like the scope policies.
+	JWTPolicyFieldName string `mapstructure:"jwt_policy_field_name" bson:"jwt_policy_field_name" json:"jwt_policy_field_name"`
+	// JWTScopeToPolicyMapping maps the scopes of the scope claim to policy IDs, if set JWTSource
+	// tokens get a virtual session with the access rights of every policy their scopes map to and
+	// the most generous rate limit and quota among them. A policy named in JWTPolicyFieldName takes
+	// precedence, the scopes are only used for tokens that don't have that claim.
+	JWTScopeToPolicyMapping map[string]string `mapstructure:"jwt_scope_to_policy_mapping" bson:"jwt_scope_to_policy_mapping" json:"jwt_scope_to_policy_mapping"`
+	// JWTDefaultPolicies make the virtual session of JWTSource tokens that have neither a policy
+	// claim nor a mapped scope, merged like the scope policies. They have to belong to the org of
+	// the API like any other policy.
+	JWTDefaultPolicies []string `mapstructure:"jwt_default_policies" bson:"jwt_default_policies" json:"jwt_default_policies"`
+	// JWTClaimsToHeaders maps claims to headers that are sent upstream with their values once the
+	// token is valid. Client headers with these names are always removed so they can't be spoofed,
+	// a header is left out if the token doesn't have the claim.
+	JWTClaimsToHeaders map[string]string `mapstructure:"jwt_claims_to_headers" bson:"jwt_claims_to_headers" json:"jwt_claims_to_headers"`
+	// JWTRefreshOnVerifyFailure refetches the JWTSource once when a token fails signature
+	// verification, in case the IdP has changed the key behind a cached kid
+	JWTRefreshOnVerifyFailure bool `mapstructure:"jwt_refresh_on_verify_failure" bson:"jwt_refresh_on_verify_failure" json:"jwt_refresh_on_verify_failure"`
+	// JWTMinRefreshInterval is the minimum number of seconds between these refreshes, and the ones
+	// made for a kid missing from the cached JWKS, defaults to 30
+	JWTMinRefreshInterval int64 `mapstructure:"jwt_min_refresh_interval" bson:"jwt_min_refresh_interval" json:"jwt_min_refresh_interval"`
+	// JWTAudiences are the audiences a token is accepted for, a trailing * matches any suffix. If set,
+	// a token must have an aud claim (a string or an array) with at least one matching entry
+	JWTAudiences []string `mapstructure:"jwt_audiences" bson:"jwt_audiences" json:"jwt_audiences"`
+	// JWTExpectedAudience is the audience of this API, if set a token whose aud claim doesn't
+	// contain it exactly is refused with a 403
+	JWTExpectedAudience string `mapstructure:"jwt_expected_audience" bson:"jwt_expected_audience" json:"jwt_expected_audience"`
+	// JWTExpectedIssuer is the only iss claim accepted, if set other tokens are refused with a 403
+	// and no virtual session is created for them
+	JWTExpectedIssuer string `mapstructure:"jwt_expected_issuer" bson:"jwt_expected_issuer" json:"jwt_expected_issuer"`
+	// JWTRequiredClaims are claims a token must have with a non-empty value
+	JWTRequiredClaims []string `mapstructure:"jwt_required_claims" bson:"jwt_required_claims" json:"jwt_required_claims"`
+	// JWTRequiredClaimValues are claims a token must have with a specific value, a claim that is
+	// an array matches if any of its entries has the value
+	JWTRequiredClaimValues map[string]string `mapstructure:"jwt_required_claim_values" bson:"jwt_required_claim_values" json:"jwt_required_claim_values"`
+	// JWTMinRSAKeyBits rejects tokens verified with an RSA key that has a shorter modulus, 0 disables the check
+	JWTMinRSAKeyBits int `mapstructure:"jwt_min_rsa_key_bits" bson:"jwt_min_rsa_key_bits" json:"jwt_min_rsa_key_bits"`
+	// JWTMinECKeyBits rejects tokens verified with an EC key on a smaller curve, 0 disables the check
+	JWTMinECKeyBits int `mapstructure:"jwt_min_ec_key_bits" bson:"jwt_min_ec_key_bits" json:"jwt_min_ec_key_bits"`
+	// JWTRequireTLS rejects requests that didn't arrive over HTTPS, an X-Forwarded-Proto of https is
+	// accepted from trusted_proxies that terminate TLS
+	JWTRequireTLS bool `mapstructure:"jwt_require_tls" bson:"jwt_require_tls" json:"jwt_require_tls"`
+	// JWTFallbackAuthKeyHeader is a header holding a standard API key, requests without a JWT are
+	// authenticated with it instead. A JWT that is present but invalid is still refused, so a bad
+	// token can't be downgraded to a key. The header must not be the one that holds the JWT, and the
+	// sessions of JWTs (a kid, sub or JWTSource identity) are never accepted as keys.
+	JWTFallbackAuthKeyHeader string `mapstructure:"jwt_fallback_auth_key_header" bson:"jwt_fallback_auth_key_header" json:"jwt_fallback_auth_key_header"`
+	// JWTTokenConflict decides which token is used when use_cookie is set and the request has one
+	// in both the auth header and the cookie: "prefer_header", "prefer_cookie" or "reject", which
+	// refuses requests where they differ. By default the cookie is the only source that is read.
+	JWTTokenConflict string `mapstructure:"jwt_token_conflict" bson:"jwt_token_conflict" json:"jwt_token_conflict"`
+	// JWTSourceFailureThreshold fires a JWKSourceFailing event when this many fetches of the
+	// JWTSource have failed in a row, 0 disables the event
+	JWTSourceFailureThreshold int64 `mapstructure:"jwt_source_failure_threshold" bson:"jwt_source_failure_threshold" json:"jwt_source_failure_threshold"`
+	// JWTVerifyX5cChain only trusts JWTSource keys whose x5c certificate chain verifies up to a
+	// trusted root and is within its validity period, the roots are the system ones unless
+	// JWTX5cCABundle is set
+	JWTVerifyX5cChain bool `mapstructure:"jwt_verify_x5c_chain" bson:"jwt_verify_x5c_chain" json:"jwt_verify_x5c_chain"`
+	// JWTX5cCABundle is a PEM file with the root certificates x5c chains are verified against
+	JWTX5cCABundle string `mapstructure:"jwt_x5c_ca_bundle" bson:"jwt_x5c_ca_bundle" json:"jwt_x5c_ca_bundle"`
+
+	// x5cRoots are the roots loaded from JWTX5cCABundle, nil for the system roots
+	x5cRoots *x509.CertPool
+	// sources are JWTSource followed by JWTSources
+	sources []string
+	// validateOnly is set to check a token outside of a request, JWT sources are fetched if they
+	// aren't cached but nothing is refreshed, remembered or fired because of the token
+	validateOnly bool
+}
+
+// createsVirtualSessions is true if JWTSource tokens get a session made from policies when their
+// identity is first seen
+func (c JWTMiddlewareConfig) createsVirtualSessions() bool {
+	return c.JWTPolicyFieldName != "" || len(c.JWTScopeToPolicyMapping) > 0 || len(c.JWTDefaultPolicies) > 0
+}
+
+const (
+	// JWTConflictPreferHeader uses the header token, or the cookie if there is no header
+	JWTConflictPreferHeader = "prefer_header"
+	// JWTConflictPreferCookie uses the cookie token, or the header if there is no cookie
+	JWTConflictPreferCookie = "prefer_cookie"
+	// JWTConflictReject refuses a request with different tokens in the header and the cookie, so a
+	// cookie planted by an attacker can't be used in place of the client's own token
+	JWTConflictReject = "reject"
+)
+
+// JWK is a single key in a JWKS document
+type JWK struct {
+	Alg string   `json:"alg"`
+	Kty string   `json:"kty"`
+	Use string   `json:"use"`
+	X5c []string `json:"x5c"`
+	N   string   `json:"n"`
+	E   string   `json:"e"`
+	Kid string   `json:"kid"`
+	X5t string   `json:"x5t"`
+}
+
+// JWKs is the JWKS document served by a JWTSource
+type JWKs struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKCache holds fetched JWKS documents so we don't hit the source on every request, it is keyed
+// by source URL so APIs that use the same IdP share one copy. It is created on first use as its
+// settings come from the config, use getJWKCache rather than reading it directly.
+var JWKCache *cache.Cache
+var jwkCacheOnce sync.Once
+
+const defaultJWKCacheMaxSources = 100
+const defaultJWKCacheTTL = 240
+const defaultJWKCachePurgeInterval = 30
+
+// newJWKCache creates the JWKCache with the jwk_cache_ttl and jwk_cache_purge_interval settings
+func newJWKCache() *cache.Cache {
+	ttl := config.JWKCacheTTL
+	if ttl <= 0 {
+		ttl = defaultJWKCacheTTL
+	}
+	purgeInterval := config.JWKCachePurgeInterval
+	if purgeInterval <= 0 {
+		purgeInterval = defaultJWKCachePurgeInterval
+	}
+
+	return cache.New(time.Duration(ttl)*time.Second, time.Duration(purgeInterval)*time.Second)
+}
+
+// getJWKCache returns the JWKCache, creating it once however many requests find it cold together
+func getJWKCache() *cache.Cache {
+	jwkCacheOnce.Do(func() {
+		if JWKCache == nil {
+			JWKCache = newJWKCache()
+		}
+	})
+	return JWKCache
+}
+
+// jwkCacheLRU orders the JWKCache entries from the most to the least recently used, the entries
+// that have since expired or been deleted are dropped as they reach the back
+var jwkCacheLRU = list.New()
+var jwkCacheLRUEntries = make(map[string]*list.Element)
+var jwkCacheLRULock sync.Mutex
+
+// touchJWKSource marks a JWKCache entry as the most recently used. If more JWKS documents are
+// cached than jwk_cache_max_sources the least recently used ones are evicted, the number evicted
+// is returned.
+func touchJWKSource(cacheKey string) int {
+	max := config.JWKCacheMaxSources
+	if max <= 0 {
+		max = defaultJWKCacheMaxSources
+	}
+
+	jwkCacheLRULock.Lock()
+	defer jwkCacheLRULock.Unlock()
+
+	if entry, found := jwkCacheLRUEntries[cacheKey]; found {
+		jwkCacheLRU.MoveToFront(entry)
+	} else {
+		jwkCacheLRUEntries[cacheKey] = jwkCacheLRU.PushFront(cacheKey)
+	}
+
+	evicted := 0
+	for jwkCacheLRU.Len() > max {
+		oldest := jwkCacheLRU.Remove(jwkCacheLRU.Back()).(string)
+		delete(jwkCacheLRUEntries, oldest)
+		if _, cached := getJWKCache().Get(oldest); cached {
+			getJWKCache().Delete(oldest)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		log.WithFields(logrus.Fields{
+			"evicted":     evicted,
+			"max_sources": max,
+		}).Warning("JWKS cache is full, least recently used sources evicted")
+	}
+
+	return evicted
+}
+
+var jwkHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// devModeMinSecretLength stops a trivial (or empty) bypass secret from being used
+const devModeMinSecretLength = 32
+
+// DevModeSessionKey is the identity given to requests that use the dev mode JWT bypass
+const DevModeSessionKey = "tyk-dev-mode-session"
+
 func (k JWTMiddleware) New() {}
 
-// GetConfig retrieves the configuration from the API config
-func (k *JWTMiddleware) GetConfig() (interface{}, error) {
-	return k.TykMiddleware.Spec.APIDefinition.Auth, nil
+// GetConfig retrieves the configuration from the API config
+func (k *JWTMiddleware) GetConfig() (interface{}, error) {
+	var thisModuleConfig JWTMiddlewareConfig
+
+	err := mapstructure.Decode(k.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if len(thisModuleConfig.JWTAuthSchemes) == 0 {
+		thisModuleConfig.JWTAuthSchemes = []string{"Bearer"}
+	}
+	if thisModuleConfig.JWTIdentityBaseField == "" {
+		thisModuleConfig.JWTIdentityBaseField = "sub"
+	}
+	if thisModuleConfig.JWTMinRefreshInterval <= 0 {
+		thisModuleConfig.JWTMinRefreshInterval = defaultJWKMinRefreshInterval
+	}
+	thisModuleConfig.sources = jwtSourceList(thisModuleConfig.JWTSource, thisModuleConfig.JWTSources)
+	if thisModuleConfig.JWTVerifyX5cChain && thisModuleConfig.JWTX5cCABundle != "" {
+		thisModuleConfig.x5cRoots = x509.NewCertPool()
+		caData, readErr := ioutil.ReadFile(thisModuleConfig.JWTX5cCABundle)
+		if readErr != nil || !thisModuleConfig.x5cRoots.AppendCertsFromPEM(caData) {
+			// The pool stays empty so that no chain is trusted rather than falling back to the system roots
+			log.WithFields(logrus.Fields{
+				"api_id": k.TykMiddleware.Spec.APIID,
+			}).Error("Failed to load the x5c CA bundle ", thisModuleConfig.JWTX5cCABundle, ", no JWK will be trusted: ", readErr)
+		}
+	}
+
+	return thisModuleConfig, nil
+}
+
+// x5cVerifyOptions are the options JWK certificate chains are verified with, nil if they aren't
+func (c JWTMiddlewareConfig) x5cVerifyOptions() *x509.VerifyOptions {
+	if !c.JWTVerifyX5cChain {
+		return nil
+	}
+
+	return &x509.VerifyOptions{
+		Roots:     c.x5cRoots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+}
+
+// minRefreshInterval is how often a token can make the JWT sources be fetched again
+func (c JWTMiddlewareConfig) minRefreshInterval() time.Duration {
+	return time.Duration(c.JWTMinRefreshInterval) * time.Second
+}
+
+// stripAuthScheme removes the auth scheme from a header value if it is one of schemes, any other
+// value is treated as the bare token
+func stripAuthScheme(value string, schemes []string) string {
+	parts := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if len(parts) != 2 {
+		return value
+	}
+
+	for _, scheme := range schemes {
+		if strings.EqualFold(parts[0], scheme) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+
+	return value
+}
+
+// chooseTokenSource picks the token to use from the header and the cookie according to mode, an
+// error means they conflict and the request should be refused
+func chooseTokenSource(mode, headerJWT, cookieJWT string) (string, error) {
+	switch mode {
+	case JWTConflictPreferHeader:
+		if headerJWT != "" {
+			return headerJWT, nil
+		}
+	case JWTConflictPreferCookie:
+		if cookieJWT == "" {
+			return headerJWT, nil
+		}
+	case JWTConflictReject:
+		if headerJWT != "" && cookieJWT != "" && headerJWT != cookieJWT {
+			return "", errors.New("Conflicting tokens in header and cookie")
+		}
+		if cookieJWT == "" {
+			return headerJWT, nil
+		}
+	}
+
+	return cookieJWT, nil
+}
+
+// JWTSessionID is the key of the virtual session of a centralised JWT identity, the identity is
+// hashed so that it can't be used to guess other keys in the org
+func JWTSessionID(orgID, identity string) string {
+	hash := md5.Sum([]byte(identity))
+	return expandKey(orgID, hex.EncodeToString(hash[:]))
+}
+
+// CreateJWTVirtualSession creates (or replaces) the virtual session of a centralised JWT identity
+// from a policy, the policy has to belong to the same org as the API
+func CreateJWTVirtualSession(spec *APISpec, sessionID, policyID string) (SessionState, error) {
+	return createJWTVirtualSession(spec, sessionID, policyID, 0)
+}
+
+// createJWTVirtualSession is CreateJWTVirtualSession for a session that replaces one created at
+// created, so that max_session_lifetime still counts from the first one
+func createJWTVirtualSession(spec *APISpec, sessionID, policyID string, created int64) (SessionState, error) {
+	if err := checkVirtualSessionPolicy(spec, policyID); err != nil {
+		return SessionState{}, err
+	}
+
+	thisSession := SessionState{
+		OrgID:         spec.OrgID,
+		ApplyPolicyID: policyID,
+		LastCheck:     time.Now().Unix(),
+		DateCreated:   created,
+	}
+	thisSession.JWTData.Virtual = true
+
+	// Applying the policy saves the session
+	TykMiddleware{Spec: spec}.ApplyPolicyIfExists(sessionID, &thisSession)
+	return thisSession, nil
+}
+
+// checkVirtualSessionPolicy makes sure a virtual session can be made from policyID
+func checkVirtualSessionPolicy(spec *APISpec, policyID string) error {
+	if policyID == "" {
+		return errors.New("no policy set for the identity")
+	}
+
+	policy, found := GetPolicy(policyID)
+	if !found {
+		return errors.New("policy not found: " + policyID)
+	}
+	if policy.OrgID != spec.OrgID {
+		return errors.New("policy belongs to a different organisation")
+	}
+	return nil
+}
+
+// isJWTSession is true for the sessions that authenticate JWTs, those holding a JWT secret and the
+// virtual sessions of JWTSource identities. Their keys aren't secret so they can't be API keys.
+func isJWTSession(thisSession SessionState) bool {
+	return thisSession.JWTData.Secret != "" || thisSession.JWTData.Virtual
+}
+
+// claimAtPath reads a claim nested in objects, path names the claim at each level separated by dots
+func claimAtPath(claims map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = claims
+	for _, segment := range strings.Split(path, ".") {
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil, false
+		}
+		var found bool
+		if value, found = object[segment]; !found {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// tokenIdentity reads the identity of a JWTSource token from the identity base field. A claim
+// with the full name is used first as namespaced claim names often have dots in them, then the
+// field is read as a path and if that is missing the sub claim is used.
+func tokenIdentity(token *jwt.Token, field string) (string, bool) {
+	if value, found := token.Claims[field]; found || !strings.Contains(field, ".") {
+		identity, isString := value.(string)
+		return identity, isString
+	}
+
+	if value, found := claimAtPath(token.Claims, field); found {
+		identity, isString := value.(string)
+		return identity, isString
+	}
+
+	log.Debug("Identity base field ", field, " not found, using sub")
+	identity, isString := token.Claims["sub"].(string)
+	return identity, isString
+}
+
+// claimHeaderValue formats a string, number or boolean claim as a header value
+func claimHeaderValue(claim interface{}) (string, bool) {
+	var value string
+	switch typedClaim := claim.(type) {
+	case string:
+		value = typedClaim
+	case float64:
+		value = strconv.FormatFloat(typedClaim, 'f', -1, 64)
+	case bool:
+		value = strconv.FormatBool(typedClaim)
+	default:
+		return "", false
+	}
+
+	return value, !strings.ContainsAny(value, "\r\n")
+}
+
+// setClaimHeaders copies the claims in JWTClaimsToHeaders to the request headers that go upstream
+func setClaimHeaders(thisModuleConfig JWTMiddlewareConfig, r *http.Request, token *jwt.Token) {
+	for claimName, headerName := range thisModuleConfig.JWTClaimsToHeaders {
+		claim, found := token.Claims[claimName]
+		if !found {
+			continue
+		}
+		value, ok := claimHeaderValue(claim)
+		if !ok {
+			log.Debug("Claim ", claimName, " can't be sent as a header, skipping")
+			continue
+		}
+		r.Header.Set(headerName, value)
+	}
+}
+
+// claimPolicies reads the policy claim, a single policy ID or an array of them. Entries of an
+// array that aren't strings are skipped.
+func claimPolicies(token *jwt.Token, fieldName string) []string {
+	if fieldName == "" {
+		return nil
+	}
+
+	var policyIDs []string
+	switch claim := token.Claims[fieldName].(type) {
+	case string:
+		if claim != "" {
+			policyIDs = []string{claim}
+		}
+	case []interface{}:
+		for _, entry := range claim {
+			policyID, isString := entry.(string)
+			if !isString {
+				log.WithFields(logrus.Fields{
+					"claim": fieldName,
+				}).Warning("Skipping policy claim entry that isn't a string: ", entry)
+				continue
+			}
+			if policyID != "" {
+				policyIDs = appendMissing(policyIDs, policyID)
+			}
+		}
+	}
+	return policyIDs
+}
+
+// tokenPolicies returns the policies the virtual session of a JWTSource token is made from: the
+// policy claim if the token has one, else the policies its scopes map to and failing that the
+// default policies
+func tokenPolicies(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) []string {
+	if policyIDs := claimPolicies(token, thisModuleConfig.JWTPolicyFieldName); len(policyIDs) > 0 {
+		return policyIDs
+	}
+
+	if policyIDs := scopePolicies(tokenScopes(token), thisModuleConfig.JWTScopeToPolicyMapping); len(policyIDs) > 0 {
+		return policyIDs
+	}
+
+	if len(thisModuleConfig.JWTDefaultPolicies) > 0 {
+		log.Debug("No policy claim or mapped scope in token, using the default policies")
+		return thisModuleConfig.JWTDefaultPolicies
+	}
+
+	return nil
+}
+
+// sessionPolicies returns the policies a session was made from
+func sessionPolicies(thisSession SessionState) []string {
+	if len(thisSession.ApplyPolicyIDs) > 0 {
+		return thisSession.ApplyPolicyIDs
+	}
+	if thisSession.ApplyPolicyID != "" {
+		return []string{thisSession.ApplyPolicyID}
+	}
+	return nil
+}
+
+// samePolicies is true if both lists name the same policies, in any order
+func samePolicies(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, policyID := range a {
+		if len(appendMissing(b, policyID)) != len(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// createVirtualSession creates the session of a JWTSource identity from the policies of its token,
+// when it replaces the session of an earlier token created is the time that session was created
+func createVirtualSession(thisModuleConfig JWTMiddlewareConfig, spec *APISpec, sessionID string, token *jwt.Token, created int64) (SessionState, error) {
+	policyIDs := tokenPolicies(thisModuleConfig, token)
+	switch len(policyIDs) {
+	case 0:
+		return createJWTVirtualSession(spec, sessionID, "", created)
+	case 1:
+		return createJWTVirtualSession(spec, sessionID, policyIDs[0], created)
+	}
+	return createJWTMergedSession(spec, sessionID, policyIDs, created)
+}
+
+// checkVirtualSession is createVirtualSession without creating or saving the session
+func checkVirtualSession(spec *APISpec, policyIDs []string) error {
+	switch len(policyIDs) {
+	case 0:
+		return checkVirtualSessionPolicy(spec, "")
+	case 1:
+		return checkVirtualSessionPolicy(spec, policyIDs[0])
+	}
+	_, err := mergeSessionPolicies(spec, policyIDs)
+	return err
+}
+
+// tokenScopes reads the scope claim, a space delimited string or an array of strings
+func tokenScopes(token *jwt.Token) []string {
+	var scopes []string
+	switch scope := token.Claims["scope"].(type) {
+	case string:
+		scopes = strings.Fields(scope)
+	case []interface{}:
+		for _, entry := range scope {
+			if entryStr, ok := entry.(string); ok && entryStr != "" {
+				scopes = append(scopes, entryStr)
+			}
+		}
+	}
+	return scopes
+}
+
+// scopePolicies returns the IDs of the policies that scopes are mapped to
+func scopePolicies(scopes []string, mapping map[string]string) []string {
+	var policyIDs []string
+	for _, scope := range scopes {
+		if policyID, mapped := mapping[scope]; mapped {
+			policyIDs = appendMissing(policyIDs, policyID)
+		}
+	}
+	return policyIDs
+}
+
+// CreateJWTMergedSession creates (or replaces) the virtual session of a centralised JWT identity
+// from several policies, those that aren't loaded or belong to another org are skipped. The
+// session gets the union of their access rights and the most generous rate limit and quota. The
+// policy IDs are kept on the session and merged again whenever the policies are applied, so policy
+// changes reach the session like they reach a single policy session.
+func CreateJWTMergedSession(spec *APISpec, sessionID string, policyIDs []string) (SessionState, error) {
+	return createJWTMergedSession(spec, sessionID, policyIDs, 0)
+}
+
+// createJWTMergedSession is CreateJWTMergedSession for a session that replaces one created at
+// created, so that max_session_lifetime still counts from the first one
+func createJWTMergedSession(spec *APISpec, sessionID string, policyIDs []string, created int64) (SessionState, error) {
+	if _, err := mergeSessionPolicies(spec, policyIDs); err != nil {
+		return SessionState{}, err
+	}
+
+	thisSession := SessionState{
+		OrgID:          spec.OrgID,
+		ApplyPolicyIDs: policyIDs,
+		LastCheck:      time.Now().Unix(),
+		DateCreated:    created,
+	}
+	thisSession.JWTData.Virtual = true
+
+	// Applying the policies saves the session
+	TykMiddleware{Spec: spec}.ApplyPolicyIfExists(sessionID, &thisSession)
+	return thisSession, nil
+}
+
+// mergeSessionPolicies merges the policies of a merged session, those that aren't loaded or belong
+// to another org than the API are skipped
+func mergeSessionPolicies(spec *APISpec, policyIDs []string) (SessionState, error) {
+	var policies []Policy
+	for _, policyID := range policyIDs {
+		policy, found := GetPolicy(policyID)
+		if !found || policy.OrgID != spec.OrgID {
+			log.WithFields(logrus.Fields{
+				"policy_id": policyID,
+			}).Debug("Skipping policy for JWT session, it isn't loaded or belongs to a different organisation")
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	if len(policies) == 0 {
+		return SessionState{}, errors.New("none of the policies for the JWT session could be used")
+	}
+
+	return mergePolicies(policies)
+}
+
+// mergePolicies builds a session from several policies, taking the union of their access rights
+// and per-API policies and the highest rate (per second) and quota among them, the quota grace
+// comes with the quota. The session is inactive or needs HMAC if any of the policies says so. A
+// policy without access rights gives access to every API unless it is read as denying all of
+// them, in which case it adds nothing.
+func mergePolicies(policies []Policy) (SessionState, error) {
+	var thisSession SessionState
+	accessRights := make(map[string]AccessDefinition)
+	grantsAll, grantsAny := false, false
+
+	for i, policy := range policies {
+		if i == 0 || policy.Per > 0 && (thisSession.Per <= 0 || policy.Rate/policy.Per > thisSession.Rate/thisSession.Per) {
+			thisSession.Rate = policy.Rate
+			thisSession.Per = policy.Per
+		}
+		if i == 0 || thisSession.QuotaMax != -1 && (policy.QuotaMax == -1 || policy.QuotaMax > thisSession.QuotaMax) {
+			thisSession.QuotaMax = policy.QuotaMax
+			thisSession.QuotaRenewalRate = policy.QuotaRenewalRate
+			thisSession.QuotaRolling = policy.QuotaRolling
+			thisSession.QuotaGrace = policy.QuotaGrace
+			thisSession.QuotaGracePercent = policy.QuotaGracePercent
+		}
+		// 0 doesn't cap the requests in flight
+		if i == 0 || thisSession.MaxConcurrentRequests != 0 && (policy.MaxConcurrentRequests == 0 || policy.MaxConcurrentRequests > thisSession.MaxConcurrentRequests) {
+			thisSession.MaxConcurrentRequests = policy.MaxConcurrentRequests
+		}
+		thisSession.IsInactive = thisSession.IsInactive || policy.IsInactive
+		thisSession.HMACEnabled = thisSession.HMACEnabled || policy.HMACEnabled
+		for apiID, perAPIPolicyID := range policy.PolicyPerAPI {
+			if _, found := thisSession.PolicyPerAPI[apiID]; !found {
+				if thisSession.PolicyPerAPI == nil {
+					thisSession.PolicyPerAPI = make(map[string]string)
+				}
+				thisSession.PolicyPerAPI[apiID] = perAPIPolicyID
+			}
+		}
+		thisSession.Tags = appendMissing(thisSession.Tags, policy.Tags...)
+		applyPolicyMetaData(&thisSession, policy.MetaData)
+
+		if len(policy.AccessRights) == 0 {
+			if !policy.DeniesAllAPIs() {
+				grantsAll, grantsAny = true, true
+			}
+			continue
+		}
+		grantsAny = true
+		for apiID, access := range policy.AccessRights {
+			accessRights[apiID] = mergeAccessDefinitions(accessRights[apiID], access)
+		}
+	}
+
+	if !grantsAny {
+		return thisSession, errors.New("the policies of the token scopes don't give access to any API")
+	}
+	if !grantsAll {
+		thisSession.AccessRights = accessRights
+	}
+	thisSession.Allowance = thisSession.Rate
+
+	return thisSession, nil
+}
+
+// mergeAccessDefinitions gives access to the versions of both definitions, the URLs are only
+// restricted if both restrict them
+func mergeAccessDefinitions(existing, access AccessDefinition) AccessDefinition {
+	if existing.APIID == "" {
+		return access
+	}
+
+	existing.Versions = appendMissing(existing.Versions, access.Versions...)
+	if len(existing.AllowedURLs) == 0 || len(access.AllowedURLs) == 0 {
+		existing.AllowedURLs = nil
+	} else {
+		existing.AllowedURLs = append(existing.AllowedURLs, access.AllowedURLs...)
+	}
+	return existing
+}
+
+// appendMissing adds the values that aren't in list yet
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// jwtSigningAlgs are the algorithms jwt_signing_method can be pinned to instead of a family
+var jwtSigningAlgs = map[string]bool{
+	"HS256": true, "HS384": true, "HS512": true,
+	"RS256": true, "RS384": true, "RS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+}
+
+// ValidateJWTSigningMethod checks the signing method of a JWT API when it is loaded, an API
+// without a valid jwt_signing_method is not loaded unless jwt_allow_default_signing_method is
+// set, in which case it defaults to HMAC like older versions did
+func ValidateJWTSigningMethod(spec *APISpec) bool {
+	switch spec.JWTSigningMethod {
+	case "hmac", "rsa", "ecdsa":
+		return true
+	}
+	if jwtSigningAlgs[spec.JWTSigningMethod] {
+		return true
+	}
+
+	if config.JWTAllowDefaultSigningMethod {
+		log.WithFields(logrus.Fields{
+			"api_id": spec.APIID,
+		}).Warning("No valid JWT signing method set (", spec.JWTSigningMethod, "), defaulting to HMAC")
+		return true
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id": spec.APIID,
+	}).Error("No valid JWT signing method set (", spec.JWTSigningMethod, "), set jwt_signing_method to hmac, rsa, ecdsa or an algorithm such as RS256")
+	return false
+}
+
+// checkSigningMethod makes sure a token is signed the way the API expects, signingMethod is either
+// a family (hmac, rsa or ecdsa) or an exact algorithm such as HS512. Pinning the algorithm stops a
+// token signed with a weaker one of the same family from being accepted.
+func checkSigningMethod(signingMethod string, token *jwt.Token) error {
+	var ok bool
+	switch signingMethod {
+	case "rsa":
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case "ecdsa":
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	default:
+		if jwtSigningAlgs[signingMethod] {
+			ok = token.Method.Alg() == signingMethod
+		} else {
+			// hmac, or no valid method with jwt_allow_default_signing_method, see ValidateJWTSigningMethod
+			_, ok = token.Method.(*jwt.SigningMethodHMAC)
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return nil
+}
+
+func (k *JWTMiddleware) copyResponse(dst io.Writer, src io.Reader) {
+	io.Copy(dst, src)
+}
+
+// jwkRefresh is an in-flight JWKS fetch that other requests for the same source can wait on
+type jwkRefresh struct {
+	wg     sync.WaitGroup
+	jwkSet JWKs
+	err    error
+}
+
+var jwkRefreshLock sync.Mutex
+var jwkRefreshes = make(map[string]*jwkRefresh)
+
+var errJWKNotFound = errors.New("No matching KID could be found")
+
+var errJWTKeyNotFound = errors.New("Token invalid, key not found.")
+var errJWTIssuerMismatch = errors.New("Token issuer mismatch")
+
+// JWTRevocableClaims are the claims that tokens can be revoked by
+var JWTRevocableClaims = []string{"jti", "sub"}
+
+// JWTRevocationKey is the session store entry that revokes the tokens of an organisation that have
+// a claim with this value
+func JWTRevocationKey(orgID, claim, value string) string {
+	return "jwt-revoked-" + orgID + "-" + claim + "-" + value
+}
+
+// isTokenRevoked is true if the jti or sub of the token has been revoked with /tyk/jwt/revocations
+func (k *JWTMiddleware) isTokenRevoked(token *jwt.Token) bool {
+	store := k.Spec.SessionManager.GetStore()
+	for _, claim := range JWTRevocableClaims {
+		value, ok := token.Claims[claim].(string)
+		if !ok || value == "" {
+			continue
+		}
+		if _, err := store.GetRawKey(JWTRevocationKey(k.Spec.OrgID, claim, value)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultJWKFetchConcurrency = 10
+
+// jwkFetchesRunning counts the JWKS fetches in progress, it is capped at jwk_fetch_concurrency so a
+// gateway with many JWT APIs can't open a connection per API to the IdP at the same time
+var jwkFetchesRunning int
+var jwkFetchLock sync.Mutex
+var jwkFetchDone = sync.NewCond(&jwkFetchLock)
+
+func acquireJWKFetch() {
+	limit := config.JWKFetchConcurrency
+	if limit <= 0 {
+		limit = defaultJWKFetchConcurrency
+	}
+
+	jwkFetchLock.Lock()
+	for jwkFetchesRunning >= limit {
+		jwkFetchDone.Wait()
+	}
+	jwkFetchesRunning++
+	jwkFetchLock.Unlock()
+}
+
+func releaseJWKFetch() {
+	jwkFetchLock.Lock()
+	jwkFetchesRunning--
+	jwkFetchLock.Unlock()
+	jwkFetchDone.Signal()
+}
+
+// fetchJWKs downloads and decodes the JWKS document at url
+func fetchJWKs(url string) (JWKs, error) {
+	var jwkSet JWKs
+
+	acquireJWKFetch()
+	defer releaseJWKFetch()
+
+	log.Debug("Pulling JWK from: ", url)
+	resp, err := jwkHTTPClient.Get(url)
+	if err != nil {
+		log.Error("Failed to get resource URL: ", err)
+		return jwkSet, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error("JWK source returned status: ", resp.StatusCode)
+		return jwkSet, fmt.Errorf("JWK source returned status %v", resp.StatusCode)
+	}
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		log.Error("Failed to read JWK body: ", readErr)
+		return jwkSet, readErr
+	}
+
+	if decErr := json.Unmarshal(body, &jwkSet); decErr != nil {
+		log.Error("Failed to decode JWK: ", decErr)
+		return jwkSet, decErr
+	}
+
+	return jwkSet, nil
+}
+
+// refreshJWKs fetches the JWKS document and replaces the cached copy, concurrent refreshes of
+// the same cache entry share a single fetch
+func refreshJWKs(cacheKey, url string) (JWKs, error) {
+	jwkSet, _, err := refreshJWKsIf(cacheKey, url, nil)
+	return jwkSet, err
+}
+
+// refreshJWKsIf is refreshJWKs for refreshes that allow can refuse, it is false if the cache entry
+// wasn't refreshed. A refresh already in progress is always joined, so requests that arrive while
+// it runs see the document it fetches.
+func refreshJWKsIf(cacheKey, url string, allow func() bool) (JWKs, bool, error) {
+	jwkRefreshLock.Lock()
+	if inFlight, found := jwkRefreshes[cacheKey]; found {
+		jwkRefreshLock.Unlock()
+		inFlight.wg.Wait()
+		return inFlight.jwkSet, true, inFlight.err
+	}
+	if allow != nil && !allow() {
+		jwkRefreshLock.Unlock()
+		return JWKs{}, false, nil
+	}
+
+	thisRefresh := &jwkRefresh{}
+	thisRefresh.wg.Add(1)
+	jwkRefreshes[cacheKey] = thisRefresh
+	jwkRefreshLock.Unlock()
+
+	thisRefresh.jwkSet, thisRefresh.err = fetchJWKs(url)
+	countJWKFetch(url, thisRefresh.err)
+	if thisRefresh.err == nil {
+		getJWKCache().Set(cacheKey, thisRefresh.jwkSet, cache.DefaultExpiration)
+	}
+
+	jwkRefreshLock.Lock()
+	delete(jwkRefreshes, cacheKey)
+	jwkRefreshLock.Unlock()
+	thisRefresh.wg.Done()
+
+	return thisRefresh.jwkSet, true, thisRefresh.err
+}
+
+// findJWK returns the DER encoded certificate of the signing key matching kid and keyType, keys
+// marked for encryption (use "enc") are skipped even if their kid matches. An RSA key that only
+// has n and e is returned as a DER encoded PKIX public key instead.
+func findJWK(jwkSet JWKs, kid, keyType string) ([]byte, error) {
+	chain, err := findJWKChain(jwkSet, kid, keyType)
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+// findJWKChain returns the DER encoded x5c chain of the signing key matching kid and keyType, the
+// first certificate holds the key and each one after it certifies the one before
+func findJWKChain(jwkSet JWKs, kid, keyType string) ([][]byte, error) {
+	for _, val := range jwkSet.Keys {
+		if val.Kid != kid || strings.ToLower(val.Kty) != strings.ToLower(keyType) {
+			continue
+		}
+		if val.Use != "" && val.Use != "sig" {
+			log.Debug("Skipping JWK that isn't a signing key: ", val.Kid, ", use: ", val.Use)
+			continue
+		}
+		if len(val.X5c) == 0 {
+			if strings.ToUpper(val.Kty) == "RSA" && val.N != "" && val.E != "" {
+				der, err := rsaJWKPublicKey(val)
+				if err != nil {
+					return nil, err
+				}
+				return [][]byte{der}, nil
+			}
+			return nil, errors.New("No certificates in JWK!")
+		}
+
+		chain := make([][]byte, len(val.X5c))
+		for i, encoded := range val.X5c {
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+			chain[i] = der
+		}
+		return chain, nil
+	}
+
+	return nil, errJWKNotFound
+}
+
+// rsaJWKPublicKey builds the RSA public key of a JWK from its base64url encoded modulus and
+// exponent, it is returned DER encoded like the certificates of x5c keys
+func rsaJWKPublicKey(jwk JWK) ([]byte, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWK modulus: %v", err)
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWK exponent: %v", err)
+	}
+
+	e := new(big.Int).SetBytes(exponent)
+	if e.Sign() <= 0 || e.BitLen() > 31 {
+		return nil, errors.New("Invalid JWK exponent")
+	}
+
+	return x509.MarshalPKIXPublicKey(&rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(e.Int64()),
+	})
+}
+
+// jwkPublicKey reads the public key out of a key returned by findJWK, either a certificate or a
+// PKIX public key
+func jwkPublicKey(der []byte) (interface{}, error) {
+	if cert, err := x509.ParseCertificate(der); err == nil {
+		return cert.PublicKey, nil
+	}
+
+	return x509.ParsePKIXPublicKey(der)
+}
+
+const x5cVerifyCacheTTL = 5 * time.Minute
+
+// x5cVerification is the outcome of verifying a JWK chain
+type x5cVerification struct {
+	err error
+}
+
+// x5cVerifications caches x5cVerification by the roots and the fingerprint of the chain, so a chain
+// is verified once every x5cVerifyCacheTTL rather than for every token
+var x5cVerifications = cache.New(x5cVerifyCacheTTL, x5cVerifyCacheTTL)
+
+// x5cVerifyCacheKey identifies a chain verified against roots, the roots of an API are loaded once
+// with its config so they are told apart by their address
+func x5cVerifyCacheKey(chain [][]byte, roots *x509.CertPool) string {
+	hash := sha256.New()
+	for _, der := range chain {
+		hash.Write(der)
+	}
+	return fmt.Sprintf("%p.%x", roots, hash.Sum(nil))
+}
+
+// verifyX5cChain checks that the first certificate of a JWK chain is certified by a trusted root,
+// through the others if needed, and that none of them has expired. The outcome is cached, but a
+// verified chain never for longer than its first certificate to expire is valid.
+func verifyX5cChain(chain [][]byte, options x509.VerifyOptions) error {
+	cacheKey := x5cVerifyCacheKey(chain, options.Roots)
+	if cached, found := x5cVerifications.Get(cacheKey); found {
+		return cached.(x5cVerification).err
+	}
+
+	notAfter, err := verifyX5cChainCerts(chain, options)
+	ttl := x5cVerifyCacheTTL
+	if untilExpiry := notAfter.Sub(time.Now()); err == nil && untilExpiry < ttl {
+		ttl = untilExpiry
+	}
+	// go-cache reads a duration of 0 or less as the default or no expiry
+	if ttl > 0 {
+		x5cVerifications.Set(cacheKey, x5cVerification{err}, ttl)
+	}
+	return err
+}
+
+// verifyX5cChainCerts is verifyX5cChain without the cache, it also returns when the first
+// certificate of the chain expires
+func verifyX5cChainCerts(chain [][]byte, options x509.VerifyOptions) (time.Time, error) {
+	var notAfter time.Time
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return notAfter, err
+		}
+		if i == 0 || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+		certs[i] = cert
+	}
+
+	options.Intermediates = x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		options.Intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(options)
+	return notAfter, err
+}
+
+// getSecretFromURL fetches (or reads from cache) the JWKS document at url and returns the
+// DER encoded certificate of the key matching kid and keyType. If the cached document doesn't
+// have the kid (e.g. the IdP has just rotated its keys) it is refreshed before failing, at most
+// once every refreshInterval, and a kid the fresh document doesn't have either is refused without
+// another fetch until the interval is up.
+// With verifyOptions the x5c chain of the key has to verify or the key isn't returned.
+func (k *JWTMiddleware) getSecretFromURL(url, kid, keyType string, verifyOptions *x509.VerifyOptions, refreshInterval time.Duration) ([]byte, error) {
+	cacheKey := jwkCacheKey(url)
+	cachedJWK, found := getJWKCache().Get(cacheKey)
+	if found {
+		k.touchJWKSource(cacheKey)
+		chain, err := findJWKChain(cachedJWK.(JWKs), kid, keyType)
+		if err != errJWKNotFound {
+			countJWKCacheHit(url)
+			if err != nil {
+				return nil, err
+			}
+			return k.trustedJWK(chain, kid, verifyOptions)
+		}
+		if _, unknown := jwkUnknownKIDs.Get(cacheKey + "#" + kid); unknown {
+			return nil, errJWKNotFound
+		}
+	} else {
+		countJWKCacheMiss(url)
+	}
+
+	var jwkSet JWKs
+	var err error
+	if found {
+		var refreshed bool
+		jwkSet, refreshed, err = refreshJWKsIf(cacheKey, url, func() bool {
+			return allowJWKRefresh(cacheKey, refreshInterval)
+		})
+		if !refreshed {
+			log.Debug("KID not found in cached JWK, refresh skipped as the source was refreshed recently: ", kid)
+			return nil, errJWKNotFound
+		}
+		log.Debug("KID not found in cached JWK, refreshed: ", kid)
+		countJWKRefresh(url)
+	} else {
+		jwkSet, err = refreshJWKs(cacheKey, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.touchJWKSource(cacheKey)
+
+	chain, err := findJWKChain(jwkSet, kid, keyType)
+	if err == errJWKNotFound {
+		// Only kids missing from a fresh document are remembered, so there is at most one per refresh
+		jwkUnknownKIDs.Set(cacheKey+"#"+kid, true, refreshInterval)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.trustedJWK(chain, kid, verifyOptions)
+}
+
+// peekSecretFromURL is getSecretFromURL for a token that is only being validated, the JWKS document
+// is fetched if it isn't cached but a missing kid doesn't refresh it or get remembered
+func (k *JWTMiddleware) peekSecretFromURL(url, kid, keyType string, verifyOptions *x509.VerifyOptions) ([]byte, error) {
+	cacheKey := jwkCacheKey(url)
+	var jwkSet JWKs
+	if cachedJWK, found := getJWKCache().Get(cacheKey); found {
+		jwkSet = cachedJWK.(JWKs)
+	} else {
+		var err error
+		if jwkSet, err = refreshJWKs(cacheKey, url); err != nil {
+			return nil, err
+		}
+	}
+
+	chain, err := findJWKChain(jwkSet, kid, keyType)
+	if err != nil {
+		return nil, err
+	}
+	return k.trustedJWK(chain, kid, verifyOptions)
+}
+
+// trustedJWK returns the certificate holding the key of a JWK chain, after verifying the chain if
+// verifyOptions are set
+func (k *JWTMiddleware) trustedJWK(chain [][]byte, kid string, verifyOptions *x509.VerifyOptions) ([]byte, error) {
+	if verifyOptions != nil {
+		if err := verifyX5cChain(chain, *verifyOptions); err != nil {
+			log.WithFields(logrus.Fields{
+				"api_id": k.TykMiddleware.Spec.APIID,
+				"kid":    kid,
+			}).Warning("JWK certificate chain could not be verified, rejecting key: ", err)
+			return nil, err
+		}
+	}
+
+	return chain[0], nil
+}
+
+// touchJWKSource marks the cache entry as used and reports any evictions in the health check of the
+// API, so that jwk_cache_max_sources can be sized from it
+func (k *JWTMiddleware) touchJWKSource(cacheKey string) {
+	for i := touchJWKSource(cacheKey); i > 0; i-- {
+		ReportHealthCheckValue(k.Spec.Health, JWKCacheEviction, "1")
+	}
+}
+
+const defaultJWKMinRefreshInterval int64 = 30
+
+// jwkRefreshTimes holds when each JWT source was last refreshed because of a token, a missing kid
+// or a failed signature check, so that tokens can't be used to hammer the source
+var jwkRefreshTimesLock sync.Mutex
+var jwkRefreshTimes = make(map[string]time.Time)
+
+// jwkUnknownKIDs remembers the kids that a freshly fetched JWKS document didn't have
+var jwkUnknownKIDs = cache.New(time.Duration(defaultJWKMinRefreshInterval)*time.Second, time.Duration(defaultJWKCachePurgeInterval)*time.Second)
+
+// allowJWKRefresh is true if the source hasn't been refreshed because of a token in the last interval
+func allowJWKRefresh(cacheKey string, interval time.Duration) bool {
+	jwkRefreshTimesLock.Lock()
+	defer jwkRefreshTimesLock.Unlock()
+	if last, found := jwkRefreshTimes[cacheKey]; found && time.Since(last) < interval {
+		return false
+	}
+	jwkRefreshTimes[cacheKey] = time.Now()
+	return true
+}
+
+// jwtFailureReason works out why a token was rejected from the error jwt.Parse returned, a bad
+// signature takes precedence over an expired token as it is the more likely sign of an attack
+func jwtFailureReason(err error) AuthFailureReason {
+	validationErr, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return AuthFailureUnverifiable
+	}
+
+	switch {
+	case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return AuthFailureMalformedToken
+	case validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return AuthFailureBadSignature
+	case validationErr.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0:
+		return AuthFailureExpired
+	case validationErr.Inner == errJWTKeyNotFound || validationErr.Inner == errJWKNotFound:
+		return AuthFailureKeyNotFound
+	}
+
+	return AuthFailureUnverifiable
+}
+
+// isSignatureError is true if a token was rejected because its signature didn't match the key
+func isSignatureError(err error) bool {
+	validationErr, ok := err.(*jwt.ValidationError)
+	return ok && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
+
+// allowForcedJWKRefresh rate limits the refreshes made after a failed signature check, so that
+// invalid tokens can't be used to hammer a JWT source
+func (k *JWTMiddleware) allowForcedJWKRefresh(thisModuleConfig JWTMiddlewareConfig, source string) bool {
+	if !thisModuleConfig.JWTRefreshOnVerifyFailure || !isJWKSourceURL(source) {
+		return false
+	}
+
+	if !allowJWKRefresh(jwkCacheKey(source), thisModuleConfig.minRefreshInterval()) {
+		log.Debug("JWK refresh after a failed signature check skipped, the source was refreshed recently: ", source)
+		return false
+	}
+	return true
+}
+
+// jwkCacheKey is the JWKCache entry for a JWT source, it only depends on the URL so that every API
+// using the source shares the entry and one that switches source can't be served the old keys
+func jwkCacheKey(source string) string {
+	return source
+}
+
+// jwtSourceList puts jwt_source and jwt_sources together in the order they are tried, leaving out
+// empty and repeated entries
+func jwtSourceList(source string, sources []string) []string {
+	var list []string
+	seen := make(map[string]bool)
+	for _, entry := range append([]string{source}, sources...) {
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		list = append(list, entry)
+	}
+	return list
+}
+
+// isJWKSourceURL tells the JWT sources that are fetched apart from inline certificates
+func isJWKSourceURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// jwtSourcesOf reads the jwt_source and jwt_sources of an API from its raw definition
+func jwtSourcesOf(spec *APISpec) []string {
+	source, _ := spec.APIDefinition.RawData["jwt_source"].(string)
+	var sources []string
+	if rawSources, ok := spec.APIDefinition.RawData["jwt_sources"].([]interface{}); ok {
+		for _, rawSource := range rawSources {
+			if entry, isString := rawSource.(string); isString {
+				sources = append(sources, entry)
+			}
+		}
+	}
+	return jwtSourceList(source, sources)
+}
+
+// ResetJWKCacheOnReload drops the cached JWKS documents of the old sources if a reload has changed
+// the JWT sources or signing method of an API, other APIs that still use them will fetch them again.
+// Requests that are already running keep the spec and middleware config they started with, the
+// new chain only ever sees the new settings.
+func ResetJWKCacheOnReload(oldSpec, newSpec *APISpec) {
+	if oldSpec == nil {
+		return
+	}
+	oldSources, newSources := jwtSourcesOf(oldSpec), jwtSourcesOf(newSpec)
+	if oldSpec.JWTSigningMethod == newSpec.JWTSigningMethod && strings.Join(oldSources, " ") == strings.Join(newSources, " ") {
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id":     newSpec.APIID,
+		"old_method": oldSpec.JWTSigningMethod,
+		"new_method": newSpec.JWTSigningMethod,
+		"old_source": strings.Join(oldSources, ", "),
+		"new_source": strings.Join(newSources, ", "),
+	}).Info("JWT configuration changed, clearing cached JWKs")
+
+	for _, oldSource := range oldSources {
+		if isJWKSourceURL(oldSource) {
+			getJWKCache().Delete(jwkCacheKey(oldSource))
+		}
+	}
+}
+
+// keyThumbprint returns the hex encoded SHA-256 thumbprint of a DER encoded certificate
+func keyThumbprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPinnedThumbprint makes sure a key served by the JWTSource is one we expect, an empty
+// pin list disables the check
+func (k *JWTMiddleware) checkPinnedThumbprint(thisModuleConfig JWTMiddlewareConfig, kid string, der []byte) error {
+	if len(thisModuleConfig.JWTPinnedThumbprints) == 0 {
+		return nil
+	}
+
+	thumbprint := keyThumbprint(der)
+	for _, pinned := range thisModuleConfig.JWTPinnedThumbprints {
+		if strings.ToLower(strings.Replace(pinned, ":", "", -1)) == thumbprint {
+			return nil
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id":     k.TykMiddleware.Spec.APIID,
+		"kid":        kid,
+		"thumbprint": thumbprint,
+	}).Warning("JWK thumbprint is not in the pinned set for this API, rejecting key")
+
+	return errors.New("Key thumbprint is not pinned")
+}
+
+// getKeyFromSource resolves the verification key for a token from the JWT sources. They are tried
+// in order and the first key for the kid that verifies the token is used, a source that can't be
+// reached or doesn't have a usable key is skipped. If no key verifies the token the first one
+// found is returned so that the token fails with a bad signature.
+func (k *JWTMiddleware) getKeyFromSource(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("Token has no kid, cannot select a key from the JWK source")
+	}
+
+	keyType := "RSA"
+	if _, isEC := token.Method.(*jwt.SigningMethodECDSA); isEC {
+		keyType = "EC"
+	}
+
+	var firstKey interface{}
+	var lastErr error
+	for _, source := range thisModuleConfig.sources {
+		publicKey, err := k.getKeyFromOneSource(thisModuleConfig, source, kid, keyType)
+		if err != nil {
+			log.Debug("No key for kid ", kid, " from JWT source ", source, ": ", err)
+			lastErr = err
+			continue
+		}
+		if len(thisModuleConfig.sources) == 1 || verifiesToken(token, publicKey) {
+			return publicKey, nil
+		}
+		if firstKey == nil {
+			firstKey = publicKey
+		}
+	}
+
+	if firstKey != nil {
+		return firstKey, nil
+	}
+	return nil, lastErr
 }
 
-func (k *JWTMiddleware) copyResponse(dst io.Writer, src io.Reader) {
-	io.Copy(dst, src)
+// verifiesToken checks the signature of a token with a candidate key, jwt.Parse only reads the
+// signature once the key has been chosen so it is taken from the raw token
+func verifiesToken(token *jwt.Token, key interface{}) bool {
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	return token.Method.Verify(parts[0]+"."+parts[1], parts[2], key) == nil
+}
+
+// getKeyFromOneSource returns the key for kid from a JWKS URL, or the key of an inline certificate
+func (k *JWTMiddleware) getKeyFromOneSource(thisModuleConfig JWTMiddlewareConfig, source, kid, keyType string) (interface{}, error) {
+	var der []byte
+	var err error
+	if isJWKSourceURL(source) && thisModuleConfig.validateOnly {
+		if der, err = k.peekSecretFromURL(source, kid, keyType, thisModuleConfig.x5cVerifyOptions()); err != nil {
+			return nil, err
+		}
+	} else if isJWKSourceURL(source) {
+		der, err = k.getSecretFromURL(source, kid, keyType, thisModuleConfig.x5cVerifyOptions(), thisModuleConfig.minRefreshInterval())
+		if err != nil {
+			k.checkJWKSourceFailing(thisModuleConfig, source, err)
+			return nil, err
+		}
+	} else if der, err = base64.StdEncoding.DecodeString(source); err != nil {
+		return nil, errors.New("JWT source is neither a URL nor a base64 encoded certificate")
+	}
+
+	if pinErr := k.checkPinnedThumbprint(thisModuleConfig, kid, der); pinErr != nil {
+		return nil, pinErr
+	}
+
+	publicKey, keyErr := jwkPublicKey(der)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	if strengthErr := checkKeyStrength(thisModuleConfig, publicKey); strengthErr != nil {
+		return nil, strengthErr
+	}
+
+	return publicKey, nil
+}
+
+// checkJWKSourceFailing fires a JWKSourceFailing event if a JWT source has just reached the
+// configured number of fetch errors in a row, a sign that the IdP is degraded
+func (k *JWTMiddleware) checkJWKSourceFailing(thisModuleConfig JWTMiddlewareConfig, source string, err error) {
+	failing, failures := jwkSourceFailing(source, thisModuleConfig.JWTSourceFailureThreshold)
+	if !failing {
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"api_id": k.Spec.APIID,
+		"source": source,
+	}).Warning("JWK source has failed ", failures, " times in a row: ", err)
+
+	go k.TykMiddleware.FireEvent(EVENT_JWKSourceFailing,
+		EVENT_JWKSourceFailingMeta{
+			EventMetaDefault: EventMetaDefault{Message: "JWK Source Failing"},
+			APIID:            k.Spec.APIID,
+			Source:           source,
+			Failures:         failures,
+			Error:            err.Error(),
+		})
+}
+
+// checkKeyStrength rejects RSA and EC public keys that are smaller than the configured minimums
+func checkKeyStrength(thisModuleConfig JWTMiddlewareConfig, key interface{}) error {
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if bits := publicKey.N.BitLen(); bits < thisModuleConfig.JWTMinRSAKeyBits {
+			return fmt.Errorf("RSA key is too weak: %v bits, at least %v required", bits, thisModuleConfig.JWTMinRSAKeyBits)
+		}
+	case *ecdsa.PublicKey:
+		if bits := publicKey.Curve.Params().BitSize; bits < thisModuleConfig.JWTMinECKeyBits {
+			return fmt.Errorf("EC key is too weak: %v bits, at least %v required", bits, thisModuleConfig.JWTMinECKeyBits)
+		}
+	}
+	return nil
+}
+
+// getKeyFromSession returns the secret stored on the session, when a minimum key size is set for
+// the signing method the PEM is parsed here so the key can be checked before it is used
+func (k *JWTMiddleware) getKeyFromSession(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token, secret []byte) (interface{}, error) {
+	var key interface{}
+	var err error
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		if thisModuleConfig.JWTMinRSAKeyBits <= 0 {
+			return secret, nil
+		}
+		key, err = jwt.ParseRSAPublicKeyFromPEM(secret)
+	case *jwt.SigningMethodECDSA:
+		if thisModuleConfig.JWTMinECKeyBits <= 0 {
+			return secret, nil
+		}
+		key, err = jwt.ParseECPublicKeyFromPEM(secret)
+	default:
+		return secret, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if strengthErr := checkKeyStrength(thisModuleConfig, key); strengthErr != nil {
+		return nil, strengthErr
+	}
+
+	return key, nil
+}
+
+// devModeJWTBypassEnabled is only true if dev mode is explicitly on and a bypass header and
+// a long enough secret have been configured
+func devModeJWTBypassEnabled() bool {
+	if !config.DevMode {
+		return false
+	}
+	if config.DevModeOptions.JWTBypassHeader == "" {
+		return false
+	}
+
+	return len(config.DevModeOptions.JWTBypassSecret) >= devModeMinSecretLength
+}
+
+// createDevModeSession is the fixed session injected for dev mode bypass requests
+func createDevModeSession() SessionState {
+	var thisSession SessionState
+	thisSession.Rate = 1000.0
+	thisSession.Allowance = thisSession.Rate
+	thisSession.LastCheck = time.Now().Unix()
+	thisSession.Per = 1.0
+	thisSession.Expires = 0
+	thisSession.QuotaMax = -1
+	thisSession.Tags = []string{"dev-mode"}
+
+	return thisSession
+}
+
+// checkDevModeBypass lets integration tests through without a real JWT, it is disabled
+// unless dev mode is explicitly switched on and the shared secret matches
+func (k *JWTMiddleware) checkDevModeBypass(r *http.Request) bool {
+	if !devModeJWTBypassEnabled() {
+		return false
+	}
+
+	headerName := config.DevModeOptions.JWTBypassHeader
+	provided := r.Header.Get(headerName)
+	if provided == "" {
+		return false
+	}
+	r.Header.Del(headerName)
+
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(config.DevModeOptions.JWTBypassSecret)) != 1 {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+		}).Error("DEV MODE: JWT bypass attempted with the wrong secret")
+		return false
+	}
+
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": r.RemoteAddr,
+		"api_id": k.TykMiddleware.Spec.APIID,
+	}).Warning("DEV MODE: JWT authentication bypassed, injecting test session")
+
+	return true
+}
+
+// checkTokenAge makes sure a token was issued less than JWTMaxTokenAge seconds ago, tokens without
+// an iat claim can't be checked so they are rejected when the setting is enabled
+func (k *JWTMiddleware) checkTokenAge(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) error {
+	if thisModuleConfig.JWTMaxTokenAge <= 0 {
+		return nil
+	}
+
+	iat, found := token.Claims["iat"].(float64)
+	if !found {
+		return errors.New("Token has no iat claim")
+	}
+
+	if time.Now().Unix()-int64(iat) > thisModuleConfig.JWTMaxTokenAge {
+		return errors.New("Token is too old")
+	}
+
+	return nil
+}
+
+var errJWTExpired = errors.New("Token has expired")
+var errJWTNotValidYet = errors.New("Token is not valid yet")
+
+// timeClaim reads a date claim, which has to be a number of seconds since the epoch if it is set
+func timeClaim(token *jwt.Token, claim string) (int64, bool, error) {
+	value, found := token.Claims[claim]
+	if !found {
+		return 0, false, nil
+	}
+
+	seconds, isNumber := value.(float64)
+	if !isNumber {
+		return 0, true, fmt.Errorf("Token %v claim is not a number", claim)
+	}
+
+	return int64(seconds), true, nil
+}
+
+// checkTimeClaims validates exp and nbf, allowing for JWTClockSkew seconds either way. Either
+// claim may be left out, but one that isn't a number fails the token.
+func (k *JWTMiddleware) checkTimeClaims(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) error {
+	now := jwt.TimeFunc().Unix()
+
+	exp, found, err := timeClaim(token, "exp")
+	if err != nil {
+		return err
+	}
+	if found && now-thisModuleConfig.JWTClockSkew > exp {
+		return errJWTExpired
+	}
+
+	nbf, found, err := timeClaim(token, "nbf")
+	if err != nil {
+		return err
+	}
+	if found && now+thisModuleConfig.JWTClockSkew < nbf {
+		return errJWTNotValidYet
+	}
+
+	return nil
+}
+
+// isTimeClaimError is true if jwt.Parse only rejected a token because of its exp or nbf, the
+// signature has been verified by then
+func isTimeClaimError(err error) bool {
+	validationErr, ok := err.(*jwt.ValidationError)
+	timeErrors := jwt.ValidationErrorExpired | jwt.ValidationErrorNotValidYet
+	return ok && validationErr.Errors != 0 && validationErr.Errors&^timeErrors == 0
+}
+
+// tokenAudiences reads the aud claim, which may be a single string or an array of strings,
+// empty strings are ignored
+func tokenAudiences(token *jwt.Token) []string {
+	var audiences []string
+	switch aud := token.Claims["aud"].(type) {
+	case string:
+		if aud != "" {
+			audiences = append(audiences, aud)
+		}
+	case []interface{}:
+		for _, entry := range aud {
+			if entryStr, ok := entry.(string); ok && entryStr != "" {
+				audiences = append(audiences, entryStr)
+			}
+		}
+	}
+	return audiences
+}
+
+// audienceMatches compares an audience to a configured pattern, a pattern ending in * matches
+// any audience that starts with the rest of the pattern
+func audienceMatches(pattern, audience string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(audience, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == audience
+}
+
+// checkAudience makes sure one of the token audiences matches one of JWTAudiences, a token with
+// a missing or empty aud claim is rejected when audiences are configured
+func (k *JWTMiddleware) checkAudience(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) error {
+	if len(thisModuleConfig.JWTAudiences) == 0 {
+		return nil
+	}
+
+	audiences := tokenAudiences(token)
+	if len(audiences) == 0 {
+		return errors.New("Token has no aud claim")
+	}
+
+	for _, pattern := range thisModuleConfig.JWTAudiences {
+		for _, audience := range audiences {
+			if audienceMatches(pattern, audience) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("Token audience not accepted")
+}
+
+// checkIssuer makes sure the token was issued by JWTExpectedIssuer, it returns the iss claim of
+// the token so that rejections can be logged with it
+func (k *JWTMiddleware) checkIssuer(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) (string, error) {
+	issuer, _ := token.Claims["iss"].(string)
+	if thisModuleConfig.JWTExpectedIssuer == "" || issuer == thisModuleConfig.JWTExpectedIssuer {
+		return issuer, nil
+	}
+
+	return issuer, errJWTIssuerMismatch
+}
+
+// checkExpectedAudience makes sure the token was minted for this API, one of its audiences has
+// to be JWTExpectedAudience as is, wildcards don't apply
+func (k *JWTMiddleware) checkExpectedAudience(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) error {
+	if thisModuleConfig.JWTExpectedAudience == "" {
+		return nil
+	}
+
+	for _, audience := range tokenAudiences(token) {
+		if audience == thisModuleConfig.JWTExpectedAudience {
+			return nil
+		}
+	}
+
+	return errors.New("Token audience mismatch")
+}
+
+// claimIsEmpty is true for a missing claim and for an empty string, array or object
+func claimIsEmpty(claim interface{}) bool {
+	switch value := claim.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case []interface{}:
+		return len(value) == 0
+	case map[string]interface{}:
+		return len(value) == 0
+	}
+	return false
+}
+
+// claimHasValue compares a claim to a required value, scalars are compared by their string form
+func claimHasValue(claim interface{}, value string) bool {
+	if entries, isArray := claim.([]interface{}); isArray {
+		for _, entry := range entries {
+			if claimHasValue(entry, value) {
+				return true
+			}
+		}
+		return false
+	}
+	if claimIsEmpty(claim) {
+		return false
+	}
+	if number, isNumber := claim.(float64); isNumber {
+		// JSON numbers are float64, fmt would print large ones with an exponent
+		return strconv.FormatFloat(number, 'f', -1, 64) == value
+	}
+	return fmt.Sprint(claim) == value
+}
+
+// checkRequiredClaims makes sure the token has all of JWTRequiredClaims and JWTRequiredClaimValues
+func (k *JWTMiddleware) checkRequiredClaims(thisModuleConfig JWTMiddlewareConfig, token *jwt.Token) error {
+	for _, claimName := range thisModuleConfig.JWTRequiredClaims {
+		if claimIsEmpty(token.Claims[claimName]) {
+			return errors.New("Token is missing required claim: " + claimName)
+		}
+	}
+
+	for claimName, value := range thisModuleConfig.JWTRequiredClaimValues {
+		if !claimHasValue(token.Claims[claimName], value) {
+			return errors.New("Token claim does not have the required value: " + claimName)
+		}
+	}
+
+	return nil
 }
 
 func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
 	thisConfig := k.TykMiddleware.Spec.APIDefinition.Auth
-	var thisSessionState SessionState
-	var tykId string
+	thisModuleConfig := configuration.(JWTMiddlewareConfig)
+
+	// Only a valid token can set the claim headers, whatever way the request is authenticated
+	for _, headerName := range thisModuleConfig.JWTClaimsToHeaders {
+		r.Header.Del(headerName)
+	}
+
+	if thisModuleConfig.JWTRequireTLS && !IsSecureRequest(r) {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetClientIP(r),
+		}).Warning("Attempted JWT access over plain HTTP.")
 
+		return errors.New("JWT authentication requires HTTPS"), 400
+	}
+
+	if k.checkDevModeBypass(r) {
+		context.Set(r, SessionData, createDevModeSession())
+		context.Set(r, AuthHeaderValue, DevModeSessionKey)
+		return nil, 200
+	}
 	// Get the token
-	rawJWT := r.Header.Get(thisConfig.AuthHeaderName)
+	rawJWT := stripAuthScheme(r.Header.Get(thisConfig.AuthHeaderName), thisModuleConfig.JWTAuthSchemes)
 	if thisConfig.UseParam {
-		tempRes := CopyRequest(r)
-
-		// Set hte header name
-		rawJWT = tempRes.FormValue(thisConfig.AuthHeaderName)
+		// A form-encoded body takes precedence over the query string, like FormValue
+		rawJWT = GetFormValueFromBody(r, thisConfig.AuthHeaderName)
+		if rawJWT == "" {
+			rawJWT = r.URL.Query().Get(thisConfig.AuthHeaderName)
+		}
 	}
 
 	if thisConfig.UseCookie {
 		tempRes := CopyRequest(r)
 		authCookie, notFoundErr := tempRes.Cookie(thisConfig.AuthHeaderName)
-		if notFoundErr != nil {
-			rawJWT = ""
-		} else {
-			rawJWT = authCookie.Value
+		cookieJWT := ""
+		if notFoundErr == nil {
+			cookieJWT = authCookie.Value
+		}
+
+		var conflictErr error
+		rawJWT, conflictErr = chooseTokenSource(thisModuleConfig.JWTTokenConflict, rawJWT, cookieJWT)
+		if conflictErr != nil {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+			}).Warning("Attempted JWT access with different tokens in the header and cookie.")
+
+			AuthFailed(k.TykMiddleware, r, "", AuthFailureTokenConflict)
+			return conflictErr, 400
+		}
+	}
+
+	if rawJWT == "" && thisModuleConfig.JWTFallbackAuthKeyHeader != "" {
+		if authHeaderValue := r.Header.Get(thisModuleConfig.JWTFallbackAuthKeyHeader); authHeaderValue != "" {
+			log.Debug("No JWT found, authenticating with the API key in ", thisModuleConfig.JWTFallbackAuthKeyHeader)
+			authKey := AuthKey{k.TykMiddleware}
+			if keyErr, errCode := authKey.checkKey(r, authHeaderValue); keyErr != nil {
+				return keyErr, errCode
+			}
+
+			// The kid, sub or identity that keys a JWT session can be read from any token
+			if isJWTSession(context.Get(r, SessionData).(SessionState)) {
+				context.Delete(r, SessionData)
+				context.Delete(r, AuthHeaderValue)
+				log.WithFields(logrus.Fields{
+					"path":   r.URL.Path,
+					"origin": r.RemoteAddr,
+				}).Warning("Attempted to use the session of a JWT as an API key.")
+
+				AuthFailed(k.TykMiddleware, r, authHeaderValue, AuthFailureKeyNotFound)
+				return errors.New("Key not authorised"), 403
+			}
+			return nil, 200
 		}
 	}
 
@@ -63,29 +1848,112 @@ func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, c
 		log.Debug("Raw data was: ", rawJWT)
 		log.Debug("Headers are: ", r.Header)
 
+		AuthFailed(k.TykMiddleware, r, "", AuthFailureMissingCredentials)
 		return errors.New("Authorization field missing"), 400
 	}
 
-	// Verify the token
-	token, err := jwt.Parse(rawJWT, func(token *jwt.Token) (interface{}, error) {
+	check := k.checkJWT(thisModuleConfig, r, rawJWT)
+	if check.err == nil && check.needsVirtualSession {
+		thisSessionState, createErr := createVirtualSession(thisModuleConfig, k.Spec, check.tykId, check.token, check.session.DateCreated)
+		if createErr != nil {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+				"key":    check.tykId,
+			}).Warning("Failed to create JWT session for identity: ", createErr)
+
+			check.err, check.code, check.reason = errors.New("Key not authorised"), 403, AuthFailureKeyNotFound
+		} else {
+			check.session = thisSessionState
+		}
+	}
+
+	if check.err != nil {
+		if check.tokenErr != nil {
+			context.Set(r, JWTErrorData, check.tokenErr)
+		}
+
+		// Fire Authfailed Event
+		AuthFailed(k.TykMiddleware, r, check.tykId, check.reason)
+
+		if check.token == nil || !check.token.Valid {
+			// Report in health check
+			ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+		}
+		return check.err, check.code
+	}
+
+	// all good to go
+	setClaimHeaders(thisModuleConfig, r, check.token)
+	context.Set(r, SessionData, check.session)
+	context.Set(r, AuthHeaderValue, check.tykId)
+	if check.identity != "" {
+		context.Set(r, IdentityData, check.identity)
+	}
+	return nil, 200
+}
+
+// jwtCheck is the outcome of checking a token, the session and identity it authenticates or why
+// it was refused
+type jwtCheck struct {
+	token    *jwt.Token
+	tykId    string
+	identity string
+	session  SessionState
+	// needsVirtualSession is set for a JWTSource identity without a session, or whose token names
+	// other policies than its session was made from
+	needsVirtualSession bool
+
+	// err and code are what the request is refused with, reason is the AuthFailure reason and
+	// tokenErr the error from jwt-go if the token itself couldn't be verified
+	err      error
+	code     int
+	reason   AuthFailureReason
+	tokenErr error
+}
+
+// checkJWT verifies a token and checks its claims. Events, health checks and sessions are left to
+// the caller so that a token can be checked without authenticating a request.
+func (k *JWTMiddleware) checkJWT(thisModuleConfig JWTMiddlewareConfig, r *http.Request, rawJWT string) jwtCheck {
+	var thisSessionState SessionState
+	var tykId string
+	var jwtIdentity string
+	// needsVirtualSession is set for a JWTSource identity without a session, the session is only
+	// created once the token has been verified and its claims checked
+	var needsVirtualSession bool
+
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		// Unsigned tokens are never accepted, whatever the signing method of the API
+		if alg, _ := token.Header["alg"].(string); strings.EqualFold(alg, "none") {
+			return nil, errors.New("Unsupported signing method: none")
+		}
+
 		// Don't forget to validate the alg is what you expect:
-		if k.TykMiddleware.Spec.JWTSigningMethod == "hmac" {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-		} else if k.TykMiddleware.Spec.JWTSigningMethod == "rsa" {
-			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		if err := checkSigningMethod(k.TykMiddleware.Spec.JWTSigningMethod, token); err != nil {
+			return nil, err
+		}
+
+		if len(thisModuleConfig.sources) > 0 {
+			// The kid selects the signing key, so the identity comes from the claims
+			identity, identityFound := tokenIdentity(token, thisModuleConfig.JWTIdentityBaseField)
+			if !identityFound {
+				return nil, errors.New("Token invalid, no " + thisModuleConfig.JWTIdentityBaseField + " claim found.")
 			}
-		} else if k.TykMiddleware.Spec.JWTSigningMethod == "ecdsa" {
-			if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			tykId = identity
+			jwtIdentity = identity
+			if thisModuleConfig.createsVirtualSessions() {
+				tykId = JWTSessionID(k.Spec.OrgID, identity)
 			}
-		} else {
-			log.Warning("No signing method found in API Definition, defaulting to HMAC")
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+
+			// keyFunc runs before the signature is checked, it must only look the key up
+			var keyExists bool
+			thisSessionState, keyExists = k.lookupJWTSession(thisModuleConfig, tykId)
+			if !keyExists && !thisModuleConfig.createsVirtualSessions() {
+				return nil, errJWTKeyNotFound
 			}
+			needsVirtualSession = !keyExists
+
+			return k.getKeyFromSource(thisModuleConfig, token)
 		}
 
 		idFound := false
@@ -102,22 +1970,45 @@ func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, c
 		}
 
 		var keyExists bool
-		thisSessionState, keyExists = k.TykMiddleware.CheckSessionAndIdentityForValidKey(tykId)
+		thisSessionState, keyExists = k.lookupJWTSession(thisModuleConfig, tykId)
 
 		if !keyExists {
-			return nil, errors.New("Token ivalid, key not found.")
+			return nil, errJWTKeyNotFound
 		}
 
-		return []byte(thisSessionState.JWTData.Secret), nil
-	})
+		return k.getKeyFromSession(thisModuleConfig, token, []byte(thisSessionState.JWTData.Secret))
+	}
+	token, err := jwt.Parse(rawJWT, keyFunc)
 
-	if err == nil && token.Valid {
-		// all good to go
-		context.Set(r, SessionData, thisSessionState)
-		context.Set(r, AuthHeaderValue, tykId)
-		return nil, 200
+	if isSignatureError(err) && !thisModuleConfig.validateOnly {
+		// The IdP may have rotated the key behind a kid we have cached, check once more with fresh keys
+		refreshed := false
+		for _, source := range thisModuleConfig.sources {
+			if !k.allowForcedJWKRefresh(thisModuleConfig, source) {
+				continue
+			}
+			log.WithFields(logrus.Fields{
+				"api_id": k.Spec.APIID,
+				"path":   r.URL.Path,
+				"source": source,
+			}).Info("JWT signature check failed, refreshing JWKs and retrying")
 
-	} else {
+			countJWKRefresh(source)
+			refreshJWKs(jwkCacheKey(source), source)
+			refreshed = true
+		}
+		if refreshed {
+			token, err = jwt.Parse(rawJWT, keyFunc)
+		}
+	}
+
+	if thisModuleConfig.JWTClockSkew > 0 && isTimeClaimError(err) {
+		// jwt-go has no leeway, checkTimeClaims has another look at exp and nbf
+		token.Valid = true
+		err = nil
+	}
+
+	if err != nil || !token.Valid {
 		var kID string
 		var found bool
 		if token != nil {
@@ -135,12 +2026,106 @@ func (k *JWTMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, c
 			log.Error("Token validtion errored: ", err)
 		}
 
-		// Fire Authfailed Event
-		AuthFailed(k.TykMiddleware, r, tykId)
+		return jwtCheck{tykId: tykId, err: errors.New("Key not authorised"), code: 403, reason: jwtFailureReason(err), tokenErr: err}
+	}
+
+	if timeErr := k.checkTimeClaims(thisModuleConfig, token); timeErr != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+		}).Info("Attempted JWT access outside of the token validity period: ", timeErr)
+
+		reason := AuthFailureExpired
+		if timeErr != errJWTExpired && timeErr != errJWTNotValidYet {
+			reason = AuthFailureInvalidClaims
+		}
+		return jwtCheck{tykId: tykId, err: timeErr, code: 401, reason: reason}
+	}
+
+	if k.isTokenRevoked(token) {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+		}).Warning("Attempted JWT access with a revoked token.")
+
+		return jwtCheck{tykId: tykId, err: errors.New("Token has been revoked"), code: 401, reason: AuthFailureRevoked}
+	}
+
+	if ageErr := k.checkTokenAge(thisModuleConfig, token); ageErr != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+		}).Info("Attempted JWT access with a stale token: ", ageErr)
+
+		return jwtCheck{tykId: tykId, err: ageErr, code: 401, reason: AuthFailureExpired}
+	}
+
+	if audErr := k.checkAudience(thisModuleConfig, token); audErr != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+		}).Info("Attempted JWT access with an invalid audience: ", audErr)
+
+		return jwtCheck{tykId: tykId, err: audErr, code: 401, reason: AuthFailureInvalidClaims}
+	}
+
+	if audErr := k.checkExpectedAudience(thisModuleConfig, token); audErr != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+		}).Info("Attempted JWT access with a token for another audience: ", audErr)
+
+		return jwtCheck{tykId: tykId, err: audErr, code: 403, reason: AuthFailureInvalidClaims}
+	}
+
+	if issuer, issErr := k.checkIssuer(thisModuleConfig, token); issErr != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+			"issuer": issuer,
+		}).Info("Attempted JWT access with a token from an unexpected issuer.")
+
+		return jwtCheck{tykId: tykId, err: issErr, code: 403, reason: AuthFailureInvalidClaims}
+	}
+
+	if claimsErr := k.checkRequiredClaims(thisModuleConfig, token); claimsErr != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    tykId,
+		}).Info("Attempted JWT access without required claims: ", claimsErr)
+
+		return jwtCheck{tykId: tykId, err: claimsErr, code: 403, reason: AuthFailureInvalidClaims}
+	}
+
+	// A later token of the identity can carry other policies, the session is made again from them.
+	// A token that names no policies uses the session the identity already has.
+	if !needsVirtualSession && thisSessionState.JWTData.Virtual && len(thisModuleConfig.sources) > 0 && thisModuleConfig.createsVirtualSessions() {
+		if policyIDs := tokenPolicies(thisModuleConfig, token); len(policyIDs) > 0 {
+			needsVirtualSession = !samePolicies(sessionPolicies(thisSessionState), policyIDs)
+		}
+	}
 
-		// Report in health check
-		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+	return jwtCheck{
+		token:               token,
+		tykId:               tykId,
+		identity:            jwtIdentity,
+		session:             thisSessionState,
+		needsVirtualSession: needsVirtualSession,
+	}
+}
 
-		return errors.New("Key not authorised"), 403
+// lookupJWTSession finds the session of a token identity, a token that is only being validated
+// reads it from the session store without caching, recreating or applying policies to it
+func (k *JWTMiddleware) lookupJWTSession(thisModuleConfig JWTMiddlewareConfig, key string) (SessionState, bool) {
+	if thisModuleConfig.validateOnly {
+		return k.Spec.SessionManager.GetSessionDetail(key)
 	}
+	return k.TykMiddleware.CheckSessionAndIdentityForValidKey(key)
 }
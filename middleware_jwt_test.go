@@ -1,19 +1,40 @@
 package main
 
 import (
-	//"encoding/base64"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	//"fmt"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	//"strings"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/justinas/alice"
+	"github.com/lonelycode/tykcommon"
+	"github.com/pmylund/go-cache"
 )
 
+// jwtTestUpstream stands in for the upstream of the JWT test APIs, so proxied requests stay local
+var jwtTestUpstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
 var jwtDef string = `
 
 	{
@@ -45,7 +66,7 @@ var jwtDef string = `
 		},
 		"proxy": {
 			"listen_path": "/jwt_test",
-			"target_url": "http://example.com/",
+			"target_url": "` + jwtTestUpstream.URL + `",
 			"strip_listen_path": true
 		}
 	}
@@ -135,7 +156,7 @@ func getJWTChain(spec APISpec) http.Handler {
 	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
 	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
 	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
-	remote, _ := url.Parse("http://lonelycode.com/")
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
 	proxy := TykNewSingleHostReverseProxy(remote, &spec)
 	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, &spec))
 	tykMiddleware := &TykMiddleware{&spec, proxy}
@@ -240,3 +261,2434 @@ func TestJWTSessionRSA(t *testing.T) {
 		t.Error("Initial request failed with non-200 code, should have gone through!: \n", recorder.Code)
 	}
 }
+
+// createJWTSpecWithOptions adds extra top-level fields to the JWT API definition
+func createJWTSpecWithOptions(options string) APISpec {
+	return createDefinitionFromString(strings.Replace(jwtDef, `"enable_jwt": true,`, `"enable_jwt": true,`+options+`,`, 1))
+}
+
+// createJWKCertificate creates a self-signed DER certificate for the test RSA key
+func createJWKCertificate(t *testing.T) []byte {
+	privKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(JWTRSA_PRIVKEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tyk-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privKey.PublicKey, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+// createJWKSource serves a JWKS document holding a self-signed certificate for the test RSA key
+func createJWKSource(t *testing.T, kid string) (*httptest.Server, []byte) {
+	der := createJWKCertificate(t)
+	jwks := JWKs{Keys: []JWK{{Kty: "RSA", Kid: kid, X5c: []string{base64.StdEncoding.EncodeToString(der)}}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+
+	getJWKCache().Flush()
+
+	return server, der
+}
+
+func createJWKSourcedToken(t *testing.T, kid, sub string) string {
+	return createJWKSourcedTokenWithClaims(t, kid, map[string]interface{}{"sub": sub})
+}
+
+func createJWKSourcedTokenWithClaims(t *testing.T, kid string, claims map[string]interface{}) string {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Header["kid"] = kid
+	for claim, value := range claims {
+		token.Claims[claim] = value
+	}
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+
+	signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(JWTRSA_PRIVKEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenString, err := token.SignedString(signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenString
+}
+
+func TestJWTSourcePinnedThumbprint(t *testing.T) {
+	server, der := createJWKSource(t, "pinned-kid")
+	defer server.Close()
+
+	for _, tc := range []struct {
+		thumbprint string
+		code       int
+	}{
+		{keyThumbprint(der), 200},
+		{strings.Repeat("ab", 32), 403},
+	} {
+		spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_pinned_thumbprints": ["` + tc.thumbprint + `"]`)
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession("pinned-user", createJWTSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedToken(t, "pinned-kid", "pinned-user"))
+
+		chain := getJWTChain(spec)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("Expected %v for pinned thumbprint %v, got %v", tc.code, tc.thumbprint, recorder.Code)
+		}
+	}
+}
+
+func TestJWTSourceSkipsEncryptionKeys(t *testing.T) {
+	der := createJWKCertificate(t)
+	jwks := JWKs{Keys: []JWK{
+		{Kty: "RSA", Use: "enc", Kid: "shared-kid", X5c: []string{base64.StdEncoding.EncodeToString([]byte("not the signing key"))}},
+		{Kty: "RSA", Use: "sig", Kid: "shared-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	getJWKCache().Flush()
+
+	found, err := findJWK(jwks, "shared-kid", "RSA")
+	if err != nil || !bytes.Equal(found, der) {
+		t.Fatal("Expected the signing key, got: ", err)
+	}
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `"`)
+	spec.JWTSigningMethod = "rsa"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession("sig-user", createJWTSession(), 60)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", createJWKSourcedToken(t, "shared-kid", "sig-user"))
+
+	chain := getJWTChain(spec)
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Error("The token should be verified with the signing key, got: ", recorder.Code, recorder.Body.String())
+	}
+
+	// A set with only the encryption key has no key for the token
+	if _, err := findJWK(JWKs{Keys: jwks.Keys[:1]}, "shared-kid", "RSA"); err != errJWKNotFound {
+		t.Error("An encryption key should not be used to verify tokens, got: ", err)
+	}
+}
+
+// createModulusJWK describes the test RSA key with n and e only, like IdPs that don't publish x5c
+func createModulusJWK(t *testing.T, kid string) JWK {
+	privKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(JWTRSA_PRIVKEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(privKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privKey.E)).Bytes()),
+	}
+}
+
+func TestFindJWKModulusExponent(t *testing.T) {
+	privKey, _ := jwt.ParseRSAPrivateKeyFromPEM([]byte(JWTRSA_PRIVKEY))
+	modulusJWK := createModulusJWK(t, "ne-kid")
+	if modulusJWK.E != "AQAB" {
+		t.Fatal("Expected the usual 65537 exponent in the fixture, got: ", modulusJWK.E)
+	}
+
+	der, err := findJWK(JWKs{Keys: []JWK{modulusJWK}}, "ne-kid", "RSA")
+	if err != nil {
+		t.Fatal("A JWK with n and e should be usable without x5c: ", err)
+	}
+	publicKey, err := jwkPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsaKey, ok := publicKey.(*rsa.PublicKey); !ok || rsaKey.N.Cmp(privKey.N) != 0 || rsaKey.E != privKey.E {
+		t.Error("Public key built from n and e doesn't match the signing key")
+	}
+
+	// x5c is preferred when a JWK has both
+	cert := createJWKCertificate(t)
+	modulusJWK.X5c = []string{base64.StdEncoding.EncodeToString(cert)}
+	if der, _ := findJWK(JWKs{Keys: []JWK{modulusJWK}}, "ne-kid", "RSA"); !bytes.Equal(der, cert) {
+		t.Error("The x5c certificate should be used when the JWK has one")
+	}
+
+	for name, broken := range map[string]JWK{
+		"bad modulus":   {Kty: "RSA", Kid: "ne-kid", N: "not*base64", E: "AQAB"},
+		"zero exponent": {Kty: "RSA", Kid: "ne-kid", N: modulusJWK.N, E: "AA"},
+		"no exponent":   {Kty: "RSA", Kid: "ne-kid", N: modulusJWK.N},
+	} {
+		if _, err := findJWK(JWKs{Keys: []JWK{broken}}, "ne-kid", "RSA"); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestJWTSourceModulusExponent(t *testing.T) {
+	jwks := JWKs{Keys: []JWK{createModulusJWK(t, "ne-kid")}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	getJWKCache().Flush()
+
+	for _, tc := range []struct {
+		options string
+		code    int
+	}{
+		{`"jwt_source": "` + server.URL + `"`, 200},
+		// There is no chain to verify without x5c
+		{`"jwt_source": "` + server.URL + `", "jwt_verify_x5c_chain": true`, 403},
+	} {
+		spec := createJWTSpecWithOptions(tc.options)
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession("ne-user", createJWTSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedToken(t, "ne-kid", "ne-user"))
+		getJWTChain(spec).ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.options, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTDevModeBypass(t *testing.T) {
+	defer func() {
+		config.DevMode = false
+		config.DevModeOptions.JWTBypassHeader = ""
+		config.DevModeOptions.JWTBypassSecret = ""
+	}()
+
+	bypassSecret := strings.Repeat("s", devModeMinSecretLength)
+	config.DevModeOptions.JWTBypassHeader = "X-Tyk-Dev-Bypass"
+	config.DevModeOptions.JWTBypassSecret = bypassSecret
+
+	spec := createDefinitionFromString(jwtDef)
+	spec.JWTSigningMethod = "hmac"
+
+	for _, tc := range []struct {
+		devMode bool
+		secret  string
+		code    int
+	}{
+		{false, bypassSecret, 400},
+		{true, "wrong", 400},
+		{true, bypassSecret, 200},
+	} {
+		config.DevMode = tc.devMode
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("X-Tyk-Dev-Bypass", tc.secret)
+
+		chain := getJWTChain(spec)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("Dev mode %v with secret %q: expected %v, got %v", tc.devMode, tc.secret, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTSourceRefreshOnUnknownKID(t *testing.T) {
+	der := createJWKCertificate(t)
+	jwks := JWKs{Keys: []JWK{{Kty: "RSA", Kid: "old-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}}}}
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	getJWKCache().Flush()
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `"`)
+	spec.JWTSigningMethod = "rsa"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession("rotated-user", createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	doRequest := func(kid string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedToken(t, kid, "rotated-user"))
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := doRequest("old-kid"); code != 200 {
+		t.Fatal("Request with the original key failed: ", code)
+	}
+
+	// The IdP rotates, the new kid is only served after a refresh
+	jwks.Keys = append(jwks.Keys, JWK{Kty: "RSA", Kid: "new-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}})
+	if code := doRequest("new-kid"); code != 200 {
+		t.Error("Request with the rotated key should trigger a refresh and go through, got: ", code)
+	}
+	if fetched := atomic.LoadInt32(&fetches); fetched != 2 {
+		t.Error("Expected exactly one refresh, JWK source was fetched: ", fetched)
+	}
+
+	// Made-up kids can't refresh the source again before jwt_min_refresh_interval is up
+	for i := 0; i < 5; i++ {
+		if code := doRequest(randSeq(10)); code != 403 {
+			t.Error("Request with a kid that isn't served should fail, got: ", code)
+		}
+	}
+	if fetched := atomic.LoadInt32(&fetches); fetched != 2 {
+		t.Error("Unknown kids should not refresh a recently refreshed source, JWK source was fetched: ", fetched)
+	}
+
+	// A kid the fresh document didn't have is refused without another fetch
+	resetRefreshTime := func() {
+		jwkRefreshTimesLock.Lock()
+		delete(jwkRefreshTimes, jwkCacheKey(server.URL))
+		jwkRefreshTimesLock.Unlock()
+	}
+	resetRefreshTime()
+	if code := doRequest("unknown-kid"); code != 403 {
+		t.Error("Request with a kid that isn't served should fail, got: ", code)
+	}
+	resetRefreshTime()
+	if code := doRequest("unknown-kid"); code != 403 {
+		t.Error("Request with a kid that isn't served should fail, got: ", code)
+	}
+	if fetched := atomic.LoadInt32(&fetches); fetched != 3 {
+		t.Error("Expected the unknown kid to be remembered after one refresh, JWK source was fetched: ", fetched)
+	}
+}
+
+func TestJWTSourceRefreshOnUnknownKIDShared(t *testing.T) {
+	der := createJWKCertificate(t)
+	jwks := JWKs{Keys: []JWK{{Kty: "RSA", Kid: "old-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}}}}
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	getJWKCache().Flush()
+
+	spec := createDefinitionFromString(jwtDef)
+	k := &JWTMiddleware{&TykMiddleware{&spec, nil}}
+	if _, err := k.getSecretFromURL(server.URL, "old-kid", "RSA", nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The IdP rotates and every request arriving with the new kid misses the cache at once
+	jwks.Keys = append(jwks.Keys, JWK{Kty: "RSA", Kid: "new-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}})
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := k.getSecretFromURL(server.URL, "new-kid", "RSA", nil, time.Minute); err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Error("Every request with the rotated kid should find it, failed: ", failed)
+	}
+	if fetched := atomic.LoadInt32(&fetches); fetched != 2 {
+		t.Error("Concurrent kid misses should share a single refresh, JWK source was fetched: ", fetched)
+	}
+}
+
+// Run with -race, requests that find the JWKCache cold together must not both create it
+func TestJWKCacheColdConcurrentRequests(t *testing.T) {
+	server, _ := createJWKSource(t, "cold-kid")
+	defer server.Close()
+	JWKCache = nil
+	jwkCacheOnce = sync.Once{}
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `"`)
+	spec.JWTSigningMethod = "rsa"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession("cold-user", createJWTSession(), 60)
+
+	k := &JWTMiddleware{&TykMiddleware{&spec, nil}}
+	configuration, _ := k.GetConfig()
+	token := createJWKSourcedToken(t, "cold-kid", "cold-user")
+
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+			req.Header.Add("authorization", token)
+			if err, code := k.ProcessRequest(httptest.NewRecorder(), req, configuration); err != nil {
+				t.Log("Request failed: ", code, err)
+				atomic.AddInt32(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Error("Every request should be authorised once the JWKS document is fetched, failed: ", failed)
+	}
+	if _, found := getJWKCache().Get(jwkCacheKey(server.URL)); !found {
+		t.Error("The JWKS document should be cached")
+	}
+}
+
+func TestJWTMultipleSources(t *testing.T) {
+	oldDER := createJWKCertificate(t)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "tyk-test-new-idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	newDER, err := x509.CreateCertificate(rand.Reader, &newTemplate, &newTemplate, &newKey.PublicKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both IdPs use the same kid for different keys during the migration
+	serveJWKs := func(der []byte) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(JWKs{Keys: []JWK{{Kty: "RSA", Kid: "migration-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}}}})
+		}))
+	}
+	oldIdP, newIdP := serveJWKs(oldDER), serveJWKs(newDER)
+	defer oldIdP.Close()
+	defer newIdP.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	getJWKCache().Flush()
+
+	signWith := func(key *rsa.PrivateKey) string {
+		token := jwt.New(jwt.GetSigningMethod("RS256"))
+		token.Header["kid"] = "migration-kid"
+		token.Claims["sub"] = "migration-user"
+		token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, _ := token.SignedString(key)
+		return tokenString
+	}
+	oldKey, _ := jwt.ParseRSAPrivateKeyFromPEM([]byte(JWTRSA_PRIVKEY))
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for _, tc := range []struct {
+		name    string
+		options string
+		token   string
+		code    int
+	}{
+		{"old IdP", `"jwt_source": "` + oldIdP.URL + `", "jwt_sources": ["` + newIdP.URL + `"]`, signWith(oldKey), 200},
+		{"new IdP", `"jwt_source": "` + oldIdP.URL + `", "jwt_sources": ["` + newIdP.URL + `"]`, signWith(newKey), 200},
+		{"unknown signer", `"jwt_source": "` + oldIdP.URL + `", "jwt_sources": ["` + newIdP.URL + `"]`, signWith(otherKey), 403},
+		{"unreachable source first", `"jwt_sources": ["` + unreachable.URL + `", "` + newIdP.URL + `"]`, signWith(newKey), 200},
+		{"inline certificate", `"jwt_sources": ["` + oldIdP.URL + `", "` + base64.StdEncoding.EncodeToString(newDER) + `"]`, signWith(newKey), 200},
+	} {
+		spec := createJWTSpecWithOptions(tc.options)
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession("migration-user", createJWTSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tc.token)
+		getJWTChain(spec).ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+
+	for _, source := range []string{oldIdP.URL, newIdP.URL} {
+		if _, found := getJWKCache().Get(jwkCacheKey(source)); !found {
+			t.Error("Each JWKS source should be cached on its own, missing: ", source)
+		}
+	}
+}
+
+func TestJWTSourceList(t *testing.T) {
+	sources := jwtSourceList("https://a.example.com", []string{"", "https://b.example.com", "https://a.example.com"})
+	if strings.Join(sources, " ") != "https://a.example.com https://b.example.com" {
+		t.Error("Expected jwt_source first without repeats, got: ", sources)
+	}
+	if sources := jwtSourceList("", nil); len(sources) != 0 {
+		t.Error("Expected no sources, got: ", sources)
+	}
+}
+
+type jwkSourceFailingRecorder struct {
+	events chan EVENT_JWKSourceFailingMeta
+}
+
+func (j jwkSourceFailingRecorder) New(interface{}) (TykEventHandler, error) {
+	return j, nil
+}
+
+func (j jwkSourceFailingRecorder) HandleEvent(em EventMessage) {
+	j.events <- em.EventMetaData.(EVENT_JWKSourceFailingMeta)
+}
+
+func TestJWKCacheStats(t *testing.T) {
+	der := createJWKCertificate(t)
+	jwks := JWKs{Keys: []JWK{{Kty: "RSA", Kid: "stats-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}}}}
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	getJWKCache().Flush()
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_source_failure_threshold": 2`)
+	spec.JWTSigningMethod = "rsa"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession("stats-user", createJWTSession(), 60)
+	events := make(chan EVENT_JWKSourceFailingMeta, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_JWKSourceFailing: {jwkSourceFailingRecorder{events}}}
+	chain := getJWTChain(spec)
+
+	doRequest := func(kid string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedToken(t, kid, "stats-user"))
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	expectStats := func(step string, expected JWKCacheStats) {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/tyk/stats/jwks?source="+url.QueryEscape(server.URL), nil)
+		jwkCacheStatsHandler(recorder, req)
+
+		var stats JWKCacheStats
+		json.Unmarshal(recorder.Body.Bytes(), &stats)
+		if stats != expected {
+			t.Errorf("%v: expected %+v, got %+v", step, expected, stats)
+		}
+	}
+
+	doRequest("stats-kid")
+	expectStats("first request", JWKCacheStats{Misses: 1})
+	doRequest("stats-kid")
+	expectStats("cached", JWKCacheStats{Hits: 1, Misses: 1})
+
+	jwks.Keys = append(jwks.Keys, JWK{Kty: "RSA", Kid: "rotated-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}})
+	if code := doRequest("rotated-kid"); code != 200 {
+		t.Error("Request with the rotated key should go through, got: ", code)
+	}
+	expectStats("refreshed", JWKCacheStats{Hits: 1, Misses: 1, Refreshes: 1})
+
+	// The IdP goes down, the event is fired once when the threshold is reached
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 3; i++ {
+		getJWKCache().Flush()
+		doRequest("stats-kid")
+	}
+	expectStats("failing", JWKCacheStats{Hits: 1, Misses: 4, Refreshes: 1, FetchErrors: 3, ConsecutiveFetchErrors: 3})
+
+	select {
+	case event := <-events:
+		if event.Source != server.URL || event.Failures != 2 || event.APIID != spec.APIID {
+			t.Error("Unexpected JWKSourceFailing event: ", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No JWKSourceFailing event was fired")
+	}
+	select {
+	case event := <-events:
+		t.Error("Expected a single event for the outage, got another: ", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	if code := doRequest("stats-kid"); code != 200 {
+		t.Error("Request should go through once the IdP has recovered, got: ", code)
+	}
+	expectStats("recovered", JWKCacheStats{Hits: 1, Misses: 5, Refreshes: 1, FetchErrors: 3})
+}
+
+func TestJWTFromFormBody(t *testing.T) {
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamBody = string(body)
+	}))
+	defer upstream.Close()
+
+	var thisTokenKID string = "form-body-kid"
+	spec := createDefinitionFromString(jwtDef)
+	spec.JWTSigningMethod = "hmac"
+	spec.APIDefinition.Auth.UseParam = true
+	spec.APIDefinition.Auth.AuthHeaderName = "access_token"
+	spec.Proxy.TargetURL = upstream.URL
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = thisTokenKID
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tokenString, err := token.SignedString([]byte(JWTSECRET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"access_token": {tokenString}, "foo": {"bar"}}.Encode()
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/jwt_test/", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	chain := getJWTChain(spec)
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Error("Request with a token in the form body failed: ", recorder.Code)
+	}
+	if upstreamBody != form {
+		t.Error("Body did not reach the upstream unchanged, got: ", upstreamBody)
+	}
+
+	// Oversized bodies aren't parsed, but still reach the upstream intact
+	largeForm := form + "&padding=" + strings.Repeat("a", maxFormBodySize)
+	req, _ = http.NewRequest("POST", "/jwt_test/", strings.NewReader(largeForm))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if value := GetFormValueFromBody(req, "access_token"); value != "" {
+		t.Error("Token should not be read from an oversized body, got: ", value)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != largeForm {
+		t.Error("Oversized body was not restored, got length: ", len(body))
+	}
+}
+
+func TestJWTMaxTokenAge(t *testing.T) {
+	var thisTokenKID string = "max-age-kid"
+	spec := createJWTSpecWithOptions(`"jwt_max_token_age": 60`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	for _, tc := range []struct {
+		name string
+		iat  interface{}
+		code int
+	}{
+		{"fresh", time.Now().Add(-10 * time.Second).Unix(), 200},
+		{"stale", time.Now().Add(-2 * time.Minute).Unix(), 401},
+		{"missing", nil, 401},
+	} {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		if tc.iat != nil {
+			token.Claims["iat"] = tc.iat
+		}
+		tokenString, err := token.SignedString([]byte(JWTSECRET))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v iat: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTClockSkew(t *testing.T) {
+	var thisTokenKID string = "clock-skew-kid"
+	spec := createJWTSpecWithOptions(`"jwt_clock_skew": 30`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		secret string
+		code   int
+	}{
+		{"expired within skew", map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}, JWTSECRET, 200},
+		{"expired beyond skew", map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}, JWTSECRET, 401},
+		{"not yet valid within skew", map[string]interface{}{"nbf": now.Add(10 * time.Second).Unix()}, JWTSECRET, 200},
+		{"not yet valid beyond skew", map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}, JWTSECRET, 401},
+		{"no exp or nbf", map[string]interface{}{}, JWTSECRET, 200},
+		{"non-numeric exp", map[string]interface{}{"exp": "tomorrow"}, JWTSECRET, 401},
+		{"non-numeric nbf", map[string]interface{}{"nbf": "yesterday"}, JWTSECRET, 401},
+		{"expired within skew, bad signature", map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}, "wrong-secret", 403},
+	} {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = thisTokenKID
+		for claim, value := range tc.claims {
+			token.Claims[claim] = value
+		}
+		tokenString, err := token.SignedString([]byte(tc.secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTRejectsNoneAlgorithm(t *testing.T) {
+	var thisTokenKID string = "none-alg-kid"
+	// A blank signing method falls back to HMAC
+	spec := createDefinitionFromString(jwtDef)
+	spec.JWTSigningMethod = ""
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	reasons := make(chan AuthFailureReason, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_AuthFailure: {authFailureRecorder{reasons}}}
+	chain := getJWTChain(spec)
+
+	claims, _ := json.Marshal(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+	for _, alg := range []string{"none", "None", "NONE"} {
+		header, _ := json.Marshal(map[string]interface{}{"alg": alg, "typ": "JWT", "kid": thisTokenKID})
+		tokenString := jwt.EncodeSegment(header) + "." + jwt.EncodeSegment(claims) + "."
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 403 {
+			t.Errorf("Expected 403 for an unsigned token with alg %v, got %v", alg, recorder.Code)
+		}
+		select {
+		case <-reasons:
+		case <-time.After(time.Second):
+			t.Errorf("No auth failure event fired for alg %v", alg)
+		}
+	}
+}
+
+func TestJWTPinnedSigningAlgorithm(t *testing.T) {
+	var thisTokenKID string = "pinned-alg-kid"
+	for _, tc := range []struct {
+		signingMethod string
+		method        jwt.SigningMethod
+		code          int
+	}{
+		{"HS512", jwt.SigningMethodHS512, 200},
+		{"HS512", jwt.SigningMethodHS256, 403},
+		{"HS512", jwt.SigningMethodHS384, 403},
+		{"HS256", jwt.SigningMethodHS256, 200},
+		// The family still accepts every strength
+		{"hmac", jwt.SigningMethodHS256, 200},
+		{"hmac", jwt.SigningMethodHS512, 200},
+	} {
+		spec := createDefinitionFromString(jwtDef)
+		spec.JWTSigningMethod = tc.signingMethod
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+
+		token := jwt.New(tc.method)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, _ := token.SignedString([]byte(JWTSECRET))
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		getJWTChain(spec).ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v token for signing method %v: expected %v, got %v", tc.method.Alg(), tc.signingMethod, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestValidateJWTSigningMethod(t *testing.T) {
+	defer func() { config.JWTAllowDefaultSigningMethod = false }()
+
+	for _, method := range []string{"hmac", "rsa", "ecdsa", "HS512", "RS256", "ES384"} {
+		spec := createDefinitionFromString(jwtDef)
+		spec.JWTSigningMethod = method
+		if !ValidateJWTSigningMethod(&spec) {
+			t.Error("Signing method should be valid: ", method)
+		}
+	}
+
+	for _, method := range []string{"", "RSA", "none", "hs512", "PS256"} {
+		spec := createDefinitionFromString(jwtDef)
+		spec.JWTSigningMethod = method
+		if ValidateJWTSigningMethod(&spec) {
+			t.Error("Signing method should be rejected: ", method)
+		}
+
+		config.JWTAllowDefaultSigningMethod = true
+		if !ValidateJWTSigningMethod(&spec) {
+			t.Error("Signing method should default to HMAC with the compatibility flag: ", method)
+		}
+		config.JWTAllowDefaultSigningMethod = false
+	}
+}
+
+func TestStripAuthScheme(t *testing.T) {
+	schemes := []string{"Bearer", "JWT", "Token"}
+	for _, tc := range []struct {
+		value    string
+		expected string
+	}{
+		{"Bearer abc.def.ghi", "abc.def.ghi"},
+		{"JWT abc.def.ghi", "abc.def.ghi"},
+		{"token abc.def.ghi", "abc.def.ghi"},
+		{"abc.def.ghi", "abc.def.ghi"},
+		{"Basic abc.def.ghi", "Basic abc.def.ghi"},
+	} {
+		if stripped := stripAuthScheme(tc.value, schemes); stripped != tc.expected {
+			t.Errorf("%v: expected %v, got %v", tc.value, tc.expected, stripped)
+		}
+	}
+}
+
+func TestJWTAuthSchemes(t *testing.T) {
+	var thisTokenKID string = "auth-scheme-kid"
+	spec := createJWTSpecWithOptions(`"jwt_auth_schemes": ["JWT", "Token"]`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = thisTokenKID
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tokenString, err := token.SignedString([]byte(JWTSECRET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		value string
+		code  int
+	}{
+		{"JWT " + tokenString, 200},
+		{"Token " + tokenString, 200},
+		{tokenString, 200},
+		{"Bearer " + tokenString, 403},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tc.value)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", strings.SplitN(tc.value, " ", 2)[0], tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTVirtualSession(t *testing.T) {
+	server, _ := createJWKSource(t, "virtual-kid")
+	defer server.Close()
+
+	Policies["jwt-virtual-policy"] = Policy{ID: "jwt-virtual-policy", OrgID: "default", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-virtual-policy")
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol"`)
+	spec.JWTSigningMethod = "rsa"
+	chain := getJWTChain(spec)
+
+	identity := randSeq(10) + "@example.com"
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		code   int
+	}{
+		{"first request", map[string]interface{}{"email": identity, "pol": "jwt-virtual-policy"}, 200},
+		{"existing session", map[string]interface{}{"email": identity}, 200},
+		{"unknown policy", map[string]interface{}{"email": "other-" + identity, "pol": "missing-policy"}, 403},
+		{"no identity", map[string]interface{}{"sub": identity, "pol": "jwt-virtual-policy"}, 403},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "virtual-kid", tc.claims))
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+
+	thisSession, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", identity))
+	if !found {
+		t.Fatal("Virtual session was not created")
+	}
+	if thisSession.ApplyPolicyID != "jwt-virtual-policy" || thisSession.Rate != 100 {
+		t.Error("Policy was not applied to the virtual session: ", thisSession)
+	}
+}
+
+func TestJWTNestedIdentityBaseField(t *testing.T) {
+	server, _ := createJWKSource(t, "nested-kid")
+	defer server.Close()
+
+	subject := randSeq(10)
+	for _, tc := range []struct {
+		name     string
+		field    string
+		claims   map[string]interface{}
+		identity string
+	}{
+		{"two levels", "user.email", map[string]interface{}{"sub": subject, "user": map[string]interface{}{"email": "two@example.com"}}, "two@example.com"},
+		{"three levels", "org.user.email", map[string]interface{}{"sub": subject, "org": map[string]interface{}{"user": map[string]interface{}{"email": "three@example.com"}}}, "three@example.com"},
+		{"missing intermediate", "org.user.email", map[string]interface{}{"sub": subject, "org": map[string]interface{}{"name": "acme"}}, subject},
+		{"intermediate not an object", "user.email", map[string]interface{}{"sub": subject, "user": "two@example.com"}, subject},
+		{"namespaced claim", "https://example.com/email", map[string]interface{}{"sub": subject, "https://example.com/email": "namespaced@example.com"}, "namespaced@example.com"},
+	} {
+		spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "` + tc.field + `"`)
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession(tc.identity, createJWTSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "nested-kid", tc.claims))
+		getJWTChain(spec).ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Errorf("%v: expected the session of %v to be used, got %v", tc.name, tc.identity, recorder.Code)
+		}
+		spec.SessionManager.RemoveSession(tc.identity)
+	}
+}
+
+func TestJWTScopeToPolicyMapping(t *testing.T) {
+	server, _ := createJWKSource(t, "scope-kid")
+	defer server.Close()
+
+	Policies["jwt-scope-read"] = Policy{ID: "jwt-scope-read", OrgID: "default", Rate: 10, Per: 1, QuotaMax: 100, QuotaRenewalRate: 3600,
+		AccessRights: map[string]AccessDefinition{"api-a": {APIID: "api-a", Versions: []string{"v1"}}}}
+	Policies["jwt-scope-write"] = Policy{ID: "jwt-scope-write", OrgID: "default", Rate: 100, Per: 60, QuotaMax: -1,
+		AccessRights: map[string]AccessDefinition{"api-a": {APIID: "api-a", Versions: []string{"v2"}}, "76": {APIID: "76", Versions: []string{"v1"}}}}
+	Policies["jwt-scope-named"] = Policy{ID: "jwt-scope-named", OrgID: "default", Rate: 1, Per: 1, QuotaMax: -1}
+	defer func() {
+		for _, policyID := range []string{"jwt-scope-read", "jwt-scope-write", "jwt-scope-named"} {
+			delete(Policies, policyID)
+		}
+	}()
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol", "jwt_scope_to_policy_mapping": {"read": "jwt-scope-read", "write": "jwt-scope-write"}`)
+	spec.JWTSigningMethod = "rsa"
+	chain := getJWTChain(spec)
+
+	scopedIdentity, namedIdentity, unmappedIdentity := randSeq(10)+"@example.com", randSeq(10)+"@example.com", randSeq(10)+"@example.com"
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		code   int
+	}{
+		{"scopes", map[string]interface{}{"email": scopedIdentity, "scope": "read write profile"}, 200},
+		{"policy claim and scopes", map[string]interface{}{"email": namedIdentity, "pol": "jwt-scope-named", "scope": "write"}, 200},
+		{"unmapped scopes", map[string]interface{}{"email": unmappedIdentity, "scope": "profile email"}, 403},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "scope-kid", tc.claims))
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+
+	scopedSession, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", scopedIdentity))
+	if !found {
+		t.Fatal("Virtual session was not created from the scopes")
+	}
+	if scopedSession.ApplyPolicyID != "" || scopedSession.Rate != 10 || scopedSession.Per != 1 || scopedSession.QuotaMax != -1 {
+		t.Error("Expected the most generous rate and quota of the scope policies, got: ", scopedSession)
+	}
+	if len(scopedSession.AccessRights) != 2 || strings.Join(scopedSession.AccessRights["api-a"].Versions, ",") != "v1,v2" {
+		t.Error("Expected the union of the access rights of the scope policies, got: ", scopedSession.AccessRights)
+	}
+
+	namedSession, _ := spec.SessionManager.GetSessionDetail(JWTSessionID("default", namedIdentity))
+	if namedSession.ApplyPolicyID != "jwt-scope-named" {
+		t.Error("The policy claim should take precedence over the scopes, got: ", namedSession.ApplyPolicyID)
+	}
+}
+
+func TestJWTDefaultPolicies(t *testing.T) {
+	server, _ := createJWKSource(t, "default-policy-kid")
+	defer server.Close()
+
+	Policies["jwt-default-policy"] = Policy{ID: "jwt-default-policy", OrgID: "default", Rate: 5, Per: 1, QuotaMax: -1,
+		AccessRights: map[string]AccessDefinition{"76": {APIID: "76", Versions: []string{"v1"}}}}
+	Policies["jwt-default-other-org"] = Policy{ID: "jwt-default-other-org", OrgID: "other-org", Rate: 1000, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-default-policy")
+	defer delete(Policies, "jwt-default-other-org")
+
+	for _, tc := range []struct {
+		name    string
+		options string
+		code    int
+	}{
+		{"default policy", `, "jwt_default_policies": ["jwt-default-policy"]`, 200},
+		{"no default policy", ``, 403},
+		{"default policy from another org", `, "jwt_default_policies": ["jwt-default-other-org"]`, 403},
+	} {
+		spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol"` + tc.options)
+		spec.JWTSigningMethod = "rsa"
+		chain := getJWTChain(spec)
+
+		identity := randSeq(10) + "@example.com"
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "default-policy-kid", map[string]interface{}{"email": identity}))
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+		thisSession, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", identity))
+		if found != (tc.code == 200) {
+			t.Errorf("%v: expected a session to be created only for a usable default policy", tc.name)
+		}
+		if found && (thisSession.Rate != 5 || len(thisSession.AccessRights) != 1) {
+			t.Errorf("%v: expected the default policy to be applied, got %v", tc.name, thisSession)
+		}
+	}
+}
+
+func TestJWTPolicyClaimArray(t *testing.T) {
+	server, _ := createJWKSource(t, "policy-array-kid")
+	defer server.Close()
+
+	Policies["jwt-array-basic"] = Policy{ID: "jwt-array-basic", OrgID: "default", Rate: 5, Per: 1, QuotaMax: 10,
+		AccessRights: map[string]AccessDefinition{"76": {APIID: "76", Versions: []string{"v1"}}}}
+	Policies["jwt-array-beta"] = Policy{ID: "jwt-array-beta", OrgID: "default", Rate: 50, Per: 1, QuotaMax: 10,
+		AccessRights: map[string]AccessDefinition{"beta-api": {APIID: "beta-api", Versions: []string{"v1"}}}}
+	defer delete(Policies, "jwt-array-basic")
+	defer delete(Policies, "jwt-array-beta")
+
+	for _, tc := range []struct {
+		name     string
+		claim    interface{}
+		code     int
+		rate     float64
+		policyID string
+		apis     int
+	}{
+		{"single policy", "jwt-array-basic", 200, 5, "jwt-array-basic", 1},
+		{"array of policies", []interface{}{"jwt-array-basic", "jwt-array-beta"}, 200, 50, "", 2},
+		{"array with one policy", []interface{}{"jwt-array-basic"}, 200, 5, "jwt-array-basic", 1},
+		{"entries that aren't strings", []interface{}{42, "jwt-array-basic", nil}, 200, 5, "jwt-array-basic", 1},
+		{"array without a string", []interface{}{42, true}, 403, 0, "", 0},
+	} {
+		spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol"`)
+		spec.JWTSigningMethod = "rsa"
+		chain := getJWTChain(spec)
+
+		identity := randSeq(10) + "@example.com"
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "policy-array-kid", map[string]interface{}{"email": identity, "pol": tc.claim}))
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+			continue
+		}
+		thisSession, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", identity))
+		if found != (tc.code == 200) {
+			t.Errorf("%v: expected a session to be created only for a usable policy claim", tc.name)
+		}
+		if found && (thisSession.Rate != tc.rate || thisSession.ApplyPolicyID != tc.policyID || len(thisSession.AccessRights) != tc.apis) {
+			t.Errorf("%v: expected the policies of the claim to be applied, got %v", tc.name, thisSession)
+		}
+	}
+}
+
+func TestMergePolicies(t *testing.T) {
+	restricted := Policy{Rate: 5, Per: 1, QuotaMax: 10, AccessRights: map[string]AccessDefinition{
+		"api-a": {APIID: "api-a", Versions: []string{"v1"}, AllowedURLs: []AccessSpec{{URL: "/a", Methods: []string{"GET"}}}},
+	}}
+	unrestricted := Policy{Rate: 1, Per: 1, QuotaMax: 20, AccessRights: map[string]AccessDefinition{
+		"api-a": {APIID: "api-a", Versions: []string{"v1"}},
+	}}
+	allowsAll := Policy{Rate: 1, Per: 1, QuotaMax: 1}
+	deniesAll := Policy{Rate: 1000, Per: 1, QuotaMax: -1, EmptyAccessRights: EmptyAccessRightsDeny}
+
+	session, err := mergePolicies([]Policy{restricted, unrestricted})
+	if err != nil || session.Rate != 5 || session.QuotaMax != 20 || len(session.AccessRights["api-a"].AllowedURLs) != 0 {
+		t.Error("URLs should only stay restricted if every policy restricts them, got: ", session, err)
+	}
+
+	if session, _ := mergePolicies([]Policy{restricted, allowsAll}); session.AccessRights != nil {
+		t.Error("A policy that gives access to every API should win, got: ", session.AccessRights)
+	}
+
+	if _, err := mergePolicies([]Policy{deniesAll}); err == nil {
+		t.Error("Policies that give no access must not create a session that reads as access to every API")
+	}
+
+	restricted.MaxConcurrentRequests, unrestricted.MaxConcurrentRequests = 2, 5
+	if session, _ := mergePolicies([]Policy{restricted, unrestricted}); session.MaxConcurrentRequests != 5 {
+		t.Error("Expected the highest concurrent request limit, got: ", session.MaxConcurrentRequests)
+	}
+	if session, _ := mergePolicies([]Policy{restricted, allowsAll}); session.MaxConcurrentRequests != 0 {
+		t.Error("A policy that doesn't limit concurrent requests should win, got: ", session.MaxConcurrentRequests)
+	}
+
+	restricted.IsInactive, restricted.QuotaGrace, restricted.PolicyPerAPI = true, 1, map[string]string{"api-a": "per-api-a"}
+	unrestricted.HMACEnabled, unrestricted.QuotaGrace, unrestricted.PolicyPerAPI = true, 5, map[string]string{"api-a": "other", "api-b": "per-api-b"}
+	session, _ = mergePolicies([]Policy{restricted, unrestricted})
+	if !session.IsInactive || !session.HMACEnabled {
+		t.Error("The session should be inactive and need HMAC if any policy says so, got: ", session)
+	}
+	if session.QuotaGrace != 5 {
+		t.Error("Expected the quota grace of the policy the quota came from, got: ", session.QuotaGrace)
+	}
+	if len(session.PolicyPerAPI) != 2 || session.PolicyPerAPI["api-a"] != "per-api-a" || session.PolicyPerAPI["api-b"] != "per-api-b" {
+		t.Error("Expected the per-API policies of every policy, got: ", session.PolicyPerAPI)
+	}
+}
+
+func TestJWTMergedSessionFollowsPolicies(t *testing.T) {
+	server, _ := createJWKSource(t, "merged-kid")
+	defer server.Close()
+
+	Policies["jwt-merged-read"] = Policy{ID: "jwt-merged-read", OrgID: "default", Rate: 10, Per: 1, QuotaMax: -1}
+	Policies["jwt-merged-write"] = Policy{ID: "jwt-merged-write", OrgID: "default", Rate: 20, Per: 1, QuotaMax: -1}
+	Policies["jwt-merged-admin"] = Policy{ID: "jwt-merged-admin", OrgID: "default", Rate: 50, Per: 1, QuotaMax: -1}
+	defer func() {
+		for _, policyID := range []string{"jwt-merged-read", "jwt-merged-write", "jwt-merged-admin"} {
+			delete(Policies, policyID)
+		}
+	}()
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_scope_to_policy_mapping": {"read": "jwt-merged-read", "write": "jwt-merged-write", "admin": "jwt-merged-admin"}`)
+	spec.JWTSigningMethod = "rsa"
+	chain := getJWTChain(spec)
+
+	identity := randSeq(10) + "@example.com"
+	sessionID := JWTSessionID("default", identity)
+	send := func(scope string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "merged-kid", map[string]interface{}{"email": identity, "scope": scope}))
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := send("read write"); code != 200 {
+		t.Fatal("Expected 200, got ", code)
+	}
+	thisSession, _ := spec.SessionManager.GetSessionDetail(sessionID)
+	if !samePolicies(thisSession.ApplyPolicyIDs, []string{"jwt-merged-read", "jwt-merged-write"}) || thisSession.Rate != 20 {
+		t.Error("Expected the merged session to keep its policies, got: ", thisSession)
+	}
+
+	// Policy edits reach the merged session
+	writePolicy := Policies["jwt-merged-write"]
+	writePolicy.Rate = 30
+	Policies["jwt-merged-write"] = writePolicy
+	if code := send("read write"); code != 200 {
+		t.Fatal("Expected 200, got ", code)
+	}
+	if thisSession, _ := spec.SessionManager.GetSessionDetail(sessionID); thisSession.Rate != 30 {
+		t.Error("Expected the policy edit to reach the merged session, got rate: ", thisSession.Rate)
+	}
+
+	// A token with other scopes doesn't keep the rights of the first one
+	if code := send("read admin"); code != 200 {
+		t.Fatal("Expected 200, got ", code)
+	}
+	thisSession, _ = spec.SessionManager.GetSessionDetail(sessionID)
+	if !samePolicies(thisSession.ApplyPolicyIDs, []string{"jwt-merged-read", "jwt-merged-admin"}) || thisSession.Rate != 50 {
+		t.Error("Expected the session to be made from the policies of the new token, got: ", thisSession)
+	}
+	if code := send("read"); code != 200 {
+		t.Fatal("Expected 200, got ", code)
+	}
+	if thisSession, _ := spec.SessionManager.GetSessionDetail(sessionID); thisSession.ApplyPolicyID != "jwt-merged-read" || thisSession.Rate != 10 {
+		t.Error("Expected a single policy session for a single scope, got: ", thisSession)
+	}
+
+	// Deactivating a policy locks out the sessions made from it
+	readPolicy := Policies["jwt-merged-read"]
+	readPolicy.IsInactive = true
+	Policies["jwt-merged-read"] = readPolicy
+	if code := send("read"); code == 200 {
+		t.Error("Expected an inactive policy to refuse the request")
+	}
+}
+
+func TestJWTExpectedIssuer(t *testing.T) {
+	server, _ := createJWKSource(t, "issuer-kid")
+	defer server.Close()
+
+	Policies["jwt-issuer-policy"] = Policy{ID: "jwt-issuer-policy", OrgID: "default", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-issuer-policy")
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol", "jwt_expected_issuer": "https://idp.example.com"`)
+	spec.JWTSigningMethod = "rsa"
+	chain := getJWTChain(spec)
+
+	identity, spoofedIdentity := randSeq(10)+"@example.com", randSeq(10)+"@example.com"
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		code   int
+	}{
+		{"spoofed issuer", map[string]interface{}{"email": spoofedIdentity, "pol": "jwt-issuer-policy", "iss": "https://evil.example.com"}, 403},
+		{"missing issuer", map[string]interface{}{"email": spoofedIdentity, "pol": "jwt-issuer-policy"}, 403},
+		{"expected issuer", map[string]interface{}{"email": identity, "pol": "jwt-issuer-policy", "iss": "https://idp.example.com"}, 200},
+		{"existing session, spoofed issuer", map[string]interface{}{"email": identity, "iss": "https://evil.example.com"}, 403},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "issuer-kid", tc.claims))
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+
+	if _, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", spoofedIdentity)); found {
+		t.Error("No virtual session should be created for a token from another issuer")
+	}
+}
+
+func TestJWTForgedTokenCreatesNoSession(t *testing.T) {
+	server, _ := createJWKSource(t, "forged-kid")
+	defer server.Close()
+
+	Policies["jwt-forged-policy"] = Policy{ID: "jwt-forged-policy", OrgID: "default", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-forged-policy")
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol"`)
+	spec.JWTSigningMethod = "rsa"
+	chain := getJWTChain(spec)
+
+	// The claims of one token with the signature of another
+	victim := randSeq(10) + "@example.com"
+	signed := strings.Split(createJWKSourcedTokenWithClaims(t, "forged-kid", map[string]interface{}{"email": randSeq(10) + "@example.com", "pol": "jwt-forged-policy"}), ".")
+	forged := strings.Split(createJWKSourcedTokenWithClaims(t, "forged-kid", map[string]interface{}{"email": victim, "pol": "jwt-forged-policy"}), ".")
+	forged[2] = signed[2]
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", strings.Join(forged, "."))
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 403 {
+		t.Error("Expected a forged token to be refused, got: ", recorder.Code)
+	}
+	if _, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", victim)); found {
+		t.Error("No virtual session should be created for a token whose signature doesn't verify")
+	}
+}
+
+func TestJWTAnalyticsAlias(t *testing.T) {
+	server, _ := createJWKSource(t, "alias-kid")
+	defer server.Close()
+
+	enableAnalytics := config.EnableAnalytics
+	config.EnableAnalytics = true
+	defer func() { config.EnableAnalytics = enableAnalytics }()
+
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("jwt-alias", sink)
+	defer delete(AnalyticsSinks, "jwt-alias")
+
+	Policies["jwt-alias-policy"] = Policy{ID: "jwt-alias-policy", OrgID: "default", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-alias-policy")
+
+	// Raw key, the alias comes from the session
+	rawKID := randSeq(10)
+	rawSpec := createJWTSpecWithOptions(`"analytics_sink": "jwt-alias"`)
+	rawSpec.JWTSigningMethod = "hmac"
+	rawChain := getJWTChain(rawSpec)
+	rawSession := createJWTSession()
+	rawSession.Alias = "raw-user"
+	rawSpec.SessionManager.UpdateSession(rawKID, rawSession, 60)
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = rawKID
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, err := token.SignedString([]byte(JWTSECRET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", tokenString)
+	rawChain.ServeHTTP(recorder, req)
+
+	select {
+	case thisRecord := <-sink.records:
+		if thisRecord.APIKey != rawKID || thisRecord.Alias != "raw-user" {
+			t.Errorf("Raw key record should use the key and session alias, got %v / %v", thisRecord.APIKey, thisRecord.Alias)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No analytics record for the raw key")
+	}
+
+	// Virtual session, the alias is the identity the session was derived from
+	virtualSpec := createJWTSpecWithOptions(`"analytics_sink": "jwt-alias", "jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol"`)
+	virtualSpec.JWTSigningMethod = "rsa"
+	virtualChain := getJWTChain(virtualSpec)
+
+	identity := randSeq(10) + "@example.com"
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "alias-kid", map[string]interface{}{"email": identity, "pol": "jwt-alias-policy"}))
+	virtualChain.ServeHTTP(recorder, req)
+
+	select {
+	case thisRecord := <-sink.records:
+		if thisRecord.APIKey != JWTSessionID("default", identity) {
+			t.Error("Virtual session record should use the virtual key, got: ", thisRecord.APIKey)
+		}
+		if thisRecord.Alias != identity {
+			t.Error("Virtual session record should use the identity as alias, got: ", thisRecord.Alias)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No analytics record for the virtual session")
+	}
+}
+
+func TestJWTClaimsToHeaders(t *testing.T) {
+	var thisTokenKID string = "claim-headers-kid"
+	spec := createJWTSpecWithOptions(`"jwt_claims_to_headers": {"email": "X-User-Email", "department": "X-User-Department", "level": "X-User-Level", "admin": "X-User-Admin", "groups": "X-User-Groups"}`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = thisTokenKID
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token.Claims["email"] = "jane@example.com"
+	token.Claims["level"] = 3
+	token.Claims["admin"] = true
+	token.Claims["groups"] = []string{"staff"}
+	tokenString, err := token.SignedString([]byte(JWTSECRET))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", tokenString)
+	req.Header.Add("X-User-Email", "spoofed@example.com")
+	req.Header.Add("X-User-Department", "finance")
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatal("Expected the token to be accepted, got: ", recorder.Code)
+	}
+	for header, expected := range map[string]string{
+		"X-User-Email":      "jane@example.com",
+		"X-User-Level":      "3",
+		"X-User-Admin":      "true",
+		"X-User-Department": "",
+		"X-User-Groups":     "",
+	} {
+		if values := req.Header[header]; strings.Join(values, ",") != expected {
+			t.Errorf("Expected %v to be %q, got %q", header, expected, values)
+		}
+	}
+
+	// An invalid token doesn't get to set them either
+	req, _ = http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", "not-a-token")
+	req.Header.Add("X-User-Email", "spoofed@example.com")
+	chain.ServeHTTP(httptest.NewRecorder(), req)
+	if value := req.Header.Get("X-User-Email"); value != "" {
+		t.Error("Client supplied claim headers should be removed, got: ", value)
+	}
+}
+
+func TestJWTAudiences(t *testing.T) {
+	var thisTokenKID string = "audience-kid"
+	spec := createJWTSpecWithOptions(`"jwt_audiences": ["https://api.example.com/*", "billing"]`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	for _, tc := range []struct {
+		name string
+		aud  interface{}
+		code int
+	}{
+		{"exact string", "billing", 200},
+		{"wildcard string", "https://api.example.com/orders", 200},
+		{"array with a match", []string{"https://other.example.com", "https://api.example.com/users"}, 200},
+		{"array with an exact match", []string{"reports", "billing"}, 200},
+		{"no match", "https://other.example.com/orders", 401},
+		{"array without a match", []string{"reports", "https://api.example.org/users"}, 401},
+		{"wildcard prefix only", "https://api.example.com", 401},
+		{"empty array", []string{}, 401},
+		{"empty string", "", 401},
+		{"missing", nil, 401},
+	} {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		if tc.aud != nil {
+			token.Claims["aud"] = tc.aud
+		}
+		tokenString, err := token.SignedString([]byte(JWTSECRET))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v aud: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTExpectedAudience(t *testing.T) {
+	var thisTokenKID string = "expected-audience-kid"
+	spec := createJWTSpecWithOptions(`"jwt_expected_audience": "orders-service"`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	reasons := make(chan AuthFailureReason, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_AuthFailure: {authFailureRecorder{reasons}}}
+	chain := getJWTChain(spec)
+
+	for _, tc := range []struct {
+		name string
+		aud  interface{}
+		code int
+	}{
+		{"matching string", "orders-service", 200},
+		{"array with a match", []string{"billing-service", "orders-service"}, 200},
+		{"other service", "billing-service", 403},
+		{"array without a match", []string{"billing-service", "orders-service-v2"}, 403},
+		{"missing", nil, 403},
+	} {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		if tc.aud != nil {
+			token.Claims["aud"] = tc.aud
+		}
+		tokenString, err := token.SignedString([]byte(JWTSECRET))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v aud: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+		if tc.code == 200 {
+			continue
+		}
+		select {
+		case reason := <-reasons:
+			if reason != AuthFailureInvalidClaims {
+				t.Errorf("%v aud: expected reason %q, got %q", tc.name, AuthFailureInvalidClaims, reason)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v aud: no auth failure event fired", tc.name)
+		}
+	}
+}
+
+func TestJWTExpectedAudienceWithAudiences(t *testing.T) {
+	// Both checks apply, matching a jwt_audiences pattern doesn't make up for the expected audience
+	config := JWTMiddlewareConfig{JWTAudiences: []string{"orders-*"}, JWTExpectedAudience: "orders-service"}
+	k := &JWTMiddleware{}
+	for _, tc := range []struct {
+		aud      interface{}
+		audErr   bool
+		expected bool
+	}{
+		{"orders-service", false, true},
+		{"orders-billing", false, false},
+		{[]interface{}{"orders-billing", "orders-service"}, false, true},
+		{"billing-service", true, false},
+	} {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Claims["aud"] = tc.aud
+		if err := k.checkAudience(config, token); (err != nil) != tc.audErr {
+			t.Errorf("aud %v: expected the jwt_audiences check to fail: %v, got %v", tc.aud, tc.audErr, err)
+		}
+		if err := k.checkExpectedAudience(config, token); (err == nil) != tc.expected {
+			t.Errorf("aud %v: expected the expected audience check to pass: %v, got %v", tc.aud, tc.expected, err)
+		}
+	}
+}
+
+func TestJWTNoAudiencesConfigured(t *testing.T) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	if err := (&JWTMiddleware{}).checkAudience(JWTMiddlewareConfig{}, token); err != nil {
+		t.Error("Tokens without aud should be accepted when no audiences are configured: ", err)
+	}
+}
+
+func TestJWTRequiredClaims(t *testing.T) {
+	var thisTokenKID string = "required-claims-kid"
+	spec := createJWTSpecWithOptions(`"jwt_required_claims": ["tenant_id", "roles"], "jwt_required_claim_values": {"env": "prod", "roles": "admin"}`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		code   int
+	}{
+		{"all present", map[string]interface{}{"tenant_id": "acme", "roles": []string{"user", "admin"}, "env": "prod"}, 200},
+		{"single role", map[string]interface{}{"tenant_id": 42, "roles": "admin", "env": "prod"}, 200},
+		{"absent claim", map[string]interface{}{"roles": []string{"admin"}, "env": "prod"}, 403},
+		{"empty claim", map[string]interface{}{"tenant_id": "", "roles": []string{"admin"}, "env": "prod"}, 403},
+		{"empty array", map[string]interface{}{"tenant_id": "acme", "roles": []string{}, "env": "prod"}, 403},
+		{"wrong value", map[string]interface{}{"tenant_id": "acme", "roles": []string{"admin"}, "env": "staging"}, 403},
+		{"wrong array value", map[string]interface{}{"tenant_id": "acme", "roles": []string{"user"}, "env": "prod"}, 403},
+		{"absent value claim", map[string]interface{}{"tenant_id": "acme", "roles": []string{"admin"}}, 403},
+	} {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		for claim, value := range tc.claims {
+			token.Claims[claim] = value
+		}
+		tokenString, err := token.SignedString([]byte(JWTSECRET))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+
+	// Numeric claims are compared the way they are written in the token
+	for _, tc := range []struct {
+		claim interface{}
+		value string
+		match bool
+	}{
+		{float64(12345678), "12345678", true},
+		{float64(1.5), "1.5", true},
+		{[]interface{}{float64(1), float64(20000000)}, "20000000", true},
+		{float64(12345678), "1.2345678e+07", false},
+	} {
+		if claimHasValue(tc.claim, tc.value) != tc.match {
+			t.Errorf("Expected claim %v matching %v to be %v", tc.claim, tc.value, tc.match)
+		}
+	}
+}
+
+func TestJWTRequiredClaimsCreateNoSession(t *testing.T) {
+	server, _ := createJWKSource(t, "required-source-kid")
+	defer server.Close()
+
+	Policies["jwt-required-policy"] = Policy{ID: "jwt-required-policy", OrgID: "default", Rate: 100, Per: 1, QuotaMax: -1}
+	defer delete(Policies, "jwt-required-policy")
+
+	spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_identity_base_field": "email", "jwt_policy_field_name": "pol", "jwt_required_claim_values": {"env": "prod"}`)
+	spec.JWTSigningMethod = "rsa"
+	chain := getJWTChain(spec)
+
+	identity := randSeq(10) + "@example.com"
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", createJWKSourcedTokenWithClaims(t, "required-source-kid", map[string]interface{}{"email": identity, "pol": "jwt-required-policy", "env": "staging"}))
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 403 {
+		t.Error("Expected a token without the required claim value to be refused, got: ", recorder.Code)
+	}
+	if _, found := spec.SessionManager.GetSessionDetail(JWTSessionID("default", identity)); found {
+		t.Error("No virtual session should be created for a token that fails the claim checks")
+	}
+}
+
+func TestJWTSigningMethodReload(t *testing.T) {
+	server, _ := createJWKSource(t, "reload-kid")
+	defer server.Close()
+
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+
+	hmacSpec := createDefinitionFromString(jwtDef)
+	hmacSpec.JWTSigningMethod = "hmac"
+	hmacSpec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	hmacSpec.SessionManager.UpdateSession("reload-hmac-kid", createJWTSession(), 60)
+	hmacSpec.SessionManager.UpdateSession("reload-user", createJWTSession(), 60)
+	hmacChain := getJWTChain(hmacSpec)
+
+	hmacToken := jwt.New(jwt.SigningMethodHS256)
+	hmacToken.Header["kid"] = "reload-hmac-kid"
+	hmacToken.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	hmacTokenString, _ := hmacToken.SignedString([]byte(JWTSECRET))
+	rsaTokenString := createJWKSourcedToken(t, "reload-kid", "reload-user")
+
+	send := func(chain http.Handler, token string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", token)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := send(hmacChain, hmacTokenString); code != 200 {
+		t.Fatal("HMAC token should be accepted before the reload, got ", code)
+	}
+	if code := send(hmacChain, rsaTokenString); code == 200 {
+		t.Fatal("RSA token should be rejected before the reload")
+	}
+
+	rsaSpec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `"`)
+	rsaSpec.JWTSigningMethod = "rsa"
+	ResetJWKCacheOnReload(&hmacSpec, &rsaSpec)
+	rsaChain := getJWTChain(rsaSpec)
+
+	// The document of a source the API has moved away from isn't kept
+	getJWKCache().Set(jwkCacheKey("http://old-idp.example.com/jwks"), JWKs{}, 0)
+	oldSourceSpec := createJWTSpecWithOptions(`"jwt_source": "http://old-idp.example.com/jwks"`)
+	oldSourceSpec.JWTSigningMethod = "rsa"
+	ResetJWKCacheOnReload(&oldSourceSpec, &rsaSpec)
+
+	if _, found := getJWKCache().Get(jwkCacheKey("http://old-idp.example.com/jwks")); found {
+		t.Error("Changing the JWT source should clear the cached JWKs of the old source")
+	}
+
+	if code := send(rsaChain, rsaTokenString); code != 200 {
+		t.Error("RSA token should be accepted after the reload, got ", code)
+	}
+	if code := send(rsaChain, hmacTokenString); code == 200 {
+		t.Error("HMAC token should be rejected after the reload")
+	}
+
+	// Requests still running on the old chain keep the old configuration
+	if code := send(hmacChain, hmacTokenString); code != 200 {
+		t.Error("The old chain should keep its configuration, got ", code)
+	}
+
+	// Reloading without a change keeps the cache
+	ResetJWKCacheOnReload(&rsaSpec, &rsaSpec)
+	if _, found := getJWKCache().Get(jwkCacheKey(server.URL)); !found {
+		t.Error("An unchanged reload should keep the cached JWKs")
+	}
+}
+
+func TestJWTSourceRefreshOnVerifyFailure(t *testing.T) {
+	der := createJWKCertificate(t)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(JWKs{Keys: []JWK{{Kty: "RSA", Kid: "rotated-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}}}})
+	}))
+	defer server.Close()
+
+	// The cache holds a key the IdP has since replaced under the same kid
+	staleKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	staleTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "tyk-test-stale"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	staleDER, _ := x509.CreateCertificate(rand.Reader, &staleTemplate, &staleTemplate, &staleKey.PublicKey, staleKey)
+	staleJWKs := JWKs{Keys: []JWK{{Kty: "RSA", Kid: "rotated-kid", X5c: []string{base64.StdEncoding.EncodeToString(staleDER)}}}}
+
+	validToken := createJWKSourcedToken(t, "rotated-kid", "rotated-user")
+	invalidToken := jwt.New(jwt.GetSigningMethod("RS256"))
+	invalidToken.Header["kid"] = "rotated-kid"
+	invalidToken.Claims["sub"] = "rotated-user"
+	invalidToken.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	invalidTokenString, _ := invalidToken.SignedString(staleKey)
+
+	for _, tc := range []struct {
+		name    string
+		options string
+		token   string
+		code    int
+		fetches int32
+	}{
+		{"refresh disabled", `"jwt_source": "` + server.URL + `"`, validToken, 403, 0},
+		{"refresh enabled", `"jwt_source": "` + server.URL + `", "jwt_refresh_on_verify_failure": true`, validToken, 200, 1},
+		{"refresh rate limited", `"jwt_source": "` + server.URL + `", "jwt_refresh_on_verify_failure": true`, invalidTokenString, 403, 0},
+	} {
+		spec := createJWTSpecWithOptions(tc.options)
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession("rotated-user", createJWTSession(), 60)
+		chain := getJWTChain(spec)
+
+		if tc.name != "refresh rate limited" {
+			jwkRefreshTimesLock.Lock()
+			delete(jwkRefreshTimes, jwkCacheKey(server.URL))
+			jwkRefreshTimesLock.Unlock()
+			getJWKCache().Set(jwkCacheKey(server.URL), staleJWKs, cache.DefaultExpiration)
+		}
+		atomic.StoreInt32(&fetches, 0)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tc.token)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+		if fetched := atomic.LoadInt32(&fetches); fetched != tc.fetches {
+			t.Errorf("%v: expected %v JWK fetches, got %v", tc.name, tc.fetches, fetched)
+		}
+	}
+}
+
+func TestJWKFetchConcurrencyLimit(t *testing.T) {
+	var running, maxRunning int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&maxRunning)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxRunning, seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	defer source.Close()
+
+	defer func() { config.JWKFetchConcurrency = 0 }()
+	config.JWKFetchConcurrency = 3
+
+	// Every fetch is for a different source so none of them are shared
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if _, err := refreshJWKs(jwkCacheKey(url), url); err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+		}(source.URL + "/" + randSeq(10))
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Error("Fetches should wait for a free slot, not fail, failed: ", failed)
+	}
+	if maxRunning > 3 {
+		t.Error("Expected at most 3 concurrent JWKS fetches, got: ", maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Error("Fetches should still run concurrently, got: ", maxRunning)
+	}
+}
+
+func TestJWKCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	defer source.Close()
+
+	defer func() { config.JWKCacheMaxSources = 0 }()
+	config.JWKCacheMaxSources = 2
+
+	spec := createDefinitionFromString(jwtDef)
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	k := &JWTMiddleware{&TykMiddleware{&spec, nil}}
+
+	sources := map[string]string{}
+	for _, name := range []string{"a", "b", "a", "c"} {
+		sources[name] = source.URL + "/" + name
+		k.getSecretFromURL(sources[name], "kid", "RSA", nil, time.Minute)
+	}
+
+	for name, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, found := getJWKCache().Get(jwkCacheKey(sources[name])); found != cached {
+			t.Errorf("Source %v: expected cached to be %v", name, cached)
+		}
+	}
+}
+
+func TestJWKCacheSharedAcrossAPIs(t *testing.T) {
+	der := createJWKCertificate(t)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(JWKs{Keys: []JWK{{Kty: "RSA", Kid: "shared-kid", X5c: []string{base64.StdEncoding.EncodeToString(der)}}}})
+	}))
+	defer server.Close()
+	getJWKCache().Flush()
+
+	tokenString := createJWKSourcedToken(t, "shared-kid", "shared-user")
+	for _, apiID := range []string{"shared-source-a", "shared-source-b"} {
+		spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `"`)
+		spec.APIID = apiID
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession("shared-user", createJWTSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		getJWTChain(spec).ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Errorf("%v: expected 200, got %v", apiID, recorder.Code)
+		}
+	}
+
+	if fetched := atomic.LoadInt32(&fetches); fetched != 1 {
+		t.Error("APIs with the same JWT source should share the cached JWKS, fetches: ", fetched)
+	}
+}
+
+func TestJWTMinRSAKeyBits(t *testing.T) {
+	spec := createJWTSpecWithOptions(`"jwt_min_rsa_key_bits": 2048`)
+	spec.JWTSigningMethod = "rsa"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	chain := getJWTChain(spec)
+
+	for _, tc := range []struct {
+		bits int
+		code int
+	}{
+		{1024, 403},
+		{2048, 200},
+	} {
+		privateKey, _ := rsa.GenerateKey(rand.Reader, tc.bits)
+		der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		thisSession := createJWTSessionWithRSA()
+		thisSession.JWTData.Secret = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		thisTokenKID := randSeq(10)
+		spec.SessionManager.UpdateSession(thisTokenKID, thisSession, 60)
+
+		token := jwt.New(jwt.SigningMethodRS256)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		tokenString, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v bit key: expected %v, got %v", tc.bits, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTMinECKeyBits(t *testing.T) {
+	thisModuleConfig := JWTMiddlewareConfig{JWTMinECKeyBits: 384}
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	if checkKeyStrength(thisModuleConfig, &p256Key.PublicKey) == nil {
+		t.Error("A P-256 key should be rejected when 384 bits are required")
+	}
+	if err := checkKeyStrength(thisModuleConfig, &p384Key.PublicKey); err != nil {
+		t.Error("A P-384 key should be accepted, got: ", err)
+	}
+}
+
+func TestJWTFallbackAuthKey(t *testing.T) {
+	var thisTokenKID string = "fallback-kid"
+	legacyKey, virtualKey := randSeq(10), randSeq(10)
+	virtualSession := createStandardSession()
+	virtualSession.JWTData.Virtual = true
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = thisTokenKID
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tokenString, _ := token.SignedString([]byte(JWTSECRET))
+	badToken, _ := token.SignedString([]byte("not-the-secret"))
+
+	for _, tc := range []struct {
+		name     string
+		fallback bool
+		jwt      string
+		key      string
+		code     int
+	}{
+		{"valid JWT", true, tokenString, "", 200},
+		{"valid JWT and key", true, tokenString, legacyKey, 200},
+		{"key only", true, "", legacyKey, 200},
+		{"unknown key", true, "", "unknown-key", 403},
+		{"kid of a JWT session", true, "", thisTokenKID, 403},
+		{"virtual session of a JWT identity", true, "", virtualKey, 403},
+		{"invalid JWT and valid key", true, badToken, legacyKey, 403},
+		{"nothing", true, "", "", 400},
+		{"key only without fallback", false, "", legacyKey, 400},
+	} {
+		spec := createDefinitionFromString(jwtDef)
+		if tc.fallback {
+			spec = createJWTSpecWithOptions(`"jwt_fallback_auth_key_header": "X-Api-Key"`)
+		}
+		spec.JWTSigningMethod = "hmac"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+		spec.SessionManager.UpdateSession(legacyKey, createStandardSession(), 60)
+		spec.SessionManager.UpdateSession(virtualKey, virtualSession, 60)
+		chain := getJWTChain(spec)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		if tc.jwt != "" {
+			req.Header.Add("authorization", tc.jwt)
+		}
+		if tc.key != "" {
+			req.Header.Add("X-Api-Key", tc.key)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTTokenConflict(t *testing.T) {
+	var thisTokenKID string = "conflict-kid"
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = thisTokenKID
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tokenString, _ := token.SignedString([]byte(JWTSECRET))
+	plantedToken, _ := token.SignedString([]byte("not-the-secret"))
+
+	for _, tc := range []struct {
+		mode   string
+		header string
+		cookie string
+		code   int
+	}{
+		{"", tokenString, plantedToken, 403},
+		{"", tokenString, "", 400},
+		{JWTConflictPreferHeader, tokenString, plantedToken, 200},
+		{JWTConflictPreferHeader, "", tokenString, 200},
+		{JWTConflictPreferCookie, plantedToken, tokenString, 200},
+		{JWTConflictPreferCookie, tokenString, "", 200},
+		{JWTConflictReject, tokenString, plantedToken, 400},
+		{JWTConflictReject, tokenString, tokenString, 200},
+		{JWTConflictReject, "", tokenString, 200},
+		{JWTConflictReject, tokenString, "", 200},
+	} {
+		spec := createJWTSpecWithOptions(`"jwt_token_conflict": "` + tc.mode + `"`)
+		spec.JWTSigningMethod = "hmac"
+		spec.APIDefinition.Auth.UseCookie = true
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+		chain := getJWTChain(spec)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", strings.NewReader(""))
+		if tc.header != "" {
+			req.Header.Add("authorization", tc.header)
+		}
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "authorization", Value: tc.cookie})
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%q with header %v and cookie %v: expected %v, got %v", tc.mode, tc.header != "", tc.cookie != "", tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestJWTRevocation(t *testing.T) {
+	// The revocation endpoint finds the organisation through the sample API
+	MakeSampleAPI()
+
+	var thisTokenKID string = "revocation-kid"
+	spec := createDefinitionFromString(jwtDef)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	jti, sub := randSeq(10), randSeq(10)
+	createToken := func(jti string) string {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = thisTokenKID
+		token.Claims["jti"] = jti
+		token.Claims["sub"] = sub
+		token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+		tokenString, _ := token.SignedString([]byte(JWTSECRET))
+		return tokenString
+	}
+
+	sendRequest := func(tokenString string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", tokenString)
+		chain.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	revoke := func(method, claim, value string, ttl int64) {
+		recorder := httptest.NewRecorder()
+		var req *http.Request
+		if method == "POST" {
+			body, _ := json.Marshal(JWTRevocationRequest{APIID: "1", Claim: claim, Value: value, TTL: ttl})
+			req, _ = http.NewRequest("POST", "/tyk/jwt/revocations", bytes.NewReader(body))
+		} else {
+			req, _ = http.NewRequest("DELETE", "/tyk/jwt/revocations?api_id=1&claim="+claim+"&value="+value, nil)
+		}
+		jwtRevocationHandler(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatal("Revocation request failed: ", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	leakedToken := createToken(jti)
+	if code := sendRequest(leakedToken); code != 200 {
+		t.Fatal("Expected the token to be accepted before it is revoked, got: ", code)
+	}
+
+	revocationTTL := func(claim, value string) int64 {
+		db := redisStore.pool.Get()
+		defer db.Close()
+		ttl, _ := redis.Int64(db.Do("TTL", JWTRevocationKey(spec.OrgID, claim, value)))
+		return ttl
+	}
+
+	revoke("POST", "jti", jti, 60)
+	if code := sendRequest(leakedToken); code != 401 {
+		t.Error("Expected the revoked token to be refused, got: ", code)
+	}
+	if code := sendRequest(createToken(randSeq(10))); code != 200 {
+		t.Error("Other tokens should still be accepted, got: ", code)
+	}
+
+	// The revocation expires with its TTL, after which the token is accepted again
+	if ttl := revocationTTL("jti", jti); ttl <= 0 || ttl > 60 {
+		t.Error("Expected the revocation to expire in 60 seconds, got: ", ttl)
+	}
+	revoke("DELETE", "jti", jti, 0)
+	if code := sendRequest(leakedToken); code != 200 {
+		t.Error("Expected the token to be accepted once its revocation is gone, got: ", code)
+	}
+
+	// Revoking the subject refuses all of its tokens until it is removed
+	revoke("POST", "sub", sub, 0)
+	if ttl := revocationTTL("sub", sub); ttl != -1 {
+		t.Error("A revocation without a TTL should not expire, got: ", ttl)
+	}
+	if code := sendRequest(createToken(randSeq(10))); code != 401 {
+		t.Error("Expected tokens of the revoked subject to be refused, got: ", code)
+	}
+	revoke("DELETE", "sub", sub, 0)
+	if code := sendRequest(leakedToken); code != 200 {
+		t.Error("Expected the token to be accepted after the revocation was removed, got: ", code)
+	}
+}
+
+func TestJWTRequireTLS(t *testing.T) {
+	var thisTokenKID string = "require-tls-kid"
+	spec := createJWTSpecWithOptions(`"jwt_require_tls": true`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	chain := getJWTChain(spec)
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = thisTokenKID
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tokenString, _ := token.SignedString([]byte(JWTSECRET))
+
+	defer func() {
+		config.TrustedProxies = nil
+		config.loadTrustedProxies()
+	}()
+	config.TrustedProxies = []string{"10.0.0.1"}
+	config.loadTrustedProxies()
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		code       int
+	}{
+		{"plain HTTP", "192.168.1.1:1234", false, "", 400},
+		{"HTTPS", "192.168.1.1:1234", true, "", 200},
+		{"HTTPS at a trusted proxy", "10.0.0.1:1234", false, "https", 200},
+		{"HTTP at a trusted proxy", "10.0.0.1:1234", false, "http", 400},
+		{"untrusted forwarded proto", "192.168.1.1:1234", false, "https", 400},
+		// The trusted proxy appends its value to the one the client sent
+		{"client proto before the proxy's", "10.0.0.1:1234", false, "https, http", 400},
+		{"proxy proto after the client's", "10.0.0.1:1234", false, "http, https", 200},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Add("authorization", tokenString)
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if tc.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+}
+
+type authFailureRecorder struct {
+	reasons chan AuthFailureReason
+}
+
+func (a authFailureRecorder) New(interface{}) (TykEventHandler, error) {
+	return a, nil
+}
+
+func (a authFailureRecorder) HandleEvent(em EventMessage) {
+	a.reasons <- em.EventMetaData.(EVENT_AuthFailureMeta).Reason
+}
+
+func TestJWTAuthFailureReasons(t *testing.T) {
+	var thisTokenKID string = "failure-reason-kid"
+	spec := createJWTSpecWithOptions(`"jwt_audiences": ["tyk"]`)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.SessionManager.UpdateSession(thisTokenKID, createJWTSession(), 60)
+	reasons := make(chan AuthFailureReason, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_AuthFailure: {authFailureRecorder{reasons}}}
+	chain := getJWTChain(spec)
+
+	createToken := func(kid, secret, audience string, expires time.Time) string {
+		token := jwt.New(jwt.SigningMethodHS256)
+		token.Header["kid"] = kid
+		token.Claims["aud"] = audience
+		token.Claims["exp"] = expires.Unix()
+		tokenString, _ := token.SignedString([]byte(secret))
+		return tokenString
+	}
+	later := time.Now().Add(time.Hour)
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		reason AuthFailureReason
+	}{
+		{"no token", "", AuthFailureMissingCredentials},
+		{"malformed", "not-a-token", AuthFailureMalformedToken},
+		{"wrong secret", createToken(thisTokenKID, "wrong-secret", "tyk", later), AuthFailureBadSignature},
+		{"expired", createToken(thisTokenKID, JWTSECRET, "tyk", time.Now().Add(-time.Hour)), AuthFailureExpired},
+		{"unknown key", createToken("unknown-kid", JWTSECRET, "tyk", later), AuthFailureKeyNotFound},
+		{"wrong audience", createToken(thisTokenKID, JWTSECRET, "other", later), AuthFailureInvalidClaims},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		if tc.token != "" {
+			req.Header.Add("authorization", tc.token)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		select {
+		case reason := <-reasons:
+			if reason != tc.reason {
+				t.Errorf("%v: expected reason %q, got %q", tc.name, tc.reason, reason)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: no auth failure event fired", tc.name)
+		}
+	}
+}
+
+// createX5cCA creates a CA certificate and key, signed by parent or self-signed if parent is nil
+func createX5cCA(t *testing.T, name string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// createX5cLeaf certifies the test RSA key with ca, valid until notAfter
+func createX5cLeaf(t *testing.T, ca *x509.Certificate, caKey *rsa.PrivateKey, notAfter time.Time) []byte {
+	privKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(JWTRSA_PRIVKEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "tyk-test-signer"},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &privKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der
+}
+
+func TestJWTVerifyX5cChain(t *testing.T) {
+	root, rootKey := createX5cCA(t, "tyk-test-root", nil, nil)
+	intermediate, intermediateKey := createX5cCA(t, "tyk-test-intermediate", root, rootKey)
+	otherRoot, otherRootKey := createX5cCA(t, "tyk-test-other-root", nil, nil)
+
+	bundle, err := ioutil.TempFile("", "x5c-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	bundle.Close()
+
+	for _, tc := range []struct {
+		name  string
+		chain [][]byte
+		code  int
+	}{
+		{"valid chain", [][]byte{createX5cLeaf(t, intermediate, intermediateKey, time.Now().Add(time.Hour)), intermediate.Raw}, 200},
+		{"expired leaf", [][]byte{createX5cLeaf(t, intermediate, intermediateKey, time.Now().Add(-time.Minute)), intermediate.Raw}, 403},
+		{"missing intermediate", [][]byte{createX5cLeaf(t, intermediate, intermediateKey, time.Now().Add(time.Hour))}, 403},
+		{"untrusted chain", [][]byte{createX5cLeaf(t, otherRoot, otherRootKey, time.Now().Add(time.Hour)), otherRoot.Raw}, 403},
+	} {
+		x5c := make([]string, len(tc.chain))
+		for i, der := range tc.chain {
+			x5c[i] = base64.StdEncoding.EncodeToString(der)
+		}
+		jwks := JWKs{Keys: []JWK{{Kty: "RSA", Kid: "x5c-kid", X5c: x5c}}}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(jwks)
+		}))
+		getJWKCache().Flush()
+
+		spec := createJWTSpecWithOptions(`"jwt_source": "` + server.URL + `", "jwt_verify_x5c_chain": true, "jwt_x5c_ca_bundle": "` + bundle.Name() + `"`)
+		spec.JWTSigningMethod = "rsa"
+		redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+		healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+		orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+		spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+		spec.SessionManager.UpdateSession("x5c-user", createJWTSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+		req.Header.Add("authorization", createJWKSourcedToken(t, "x5c-kid", "x5c-user"))
+
+		chain := getJWTChain(spec)
+		chain.ServeHTTP(recorder, req)
+		server.Close()
+
+		if recorder.Code != tc.code {
+			t.Errorf("Expected %v for a JWK with a %v, got %v", tc.code, tc.name, recorder.Code)
+		}
+	}
+}
+
+func TestX5cVerificationCache(t *testing.T) {
+	root, rootKey := createX5cCA(t, "tyk-test-root", nil, nil)
+	otherRoot, _ := createX5cCA(t, "tyk-test-other-root", nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherRoot)
+
+	validChain := [][]byte{createX5cLeaf(t, root, rootKey, time.Now().Add(time.Hour))}
+	expiredChain := [][]byte{createX5cLeaf(t, root, rootKey, time.Now().Add(-time.Minute))}
+	options := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	otherOptions := x509.VerifyOptions{Roots: otherRoots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+
+	for _, tc := range []struct {
+		name    string
+		chain   [][]byte
+		options x509.VerifyOptions
+		valid   bool
+	}{
+		{"valid chain", validChain, options, true},
+		{"valid chain again", validChain, options, true},
+		{"valid chain with other roots", validChain, otherOptions, false},
+		{"expired chain", expiredChain, options, false},
+		{"expired chain again", expiredChain, options, false},
+	} {
+		if err := verifyX5cChain(tc.chain, tc.options); (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid %v, got %v", tc.name, tc.valid, err)
+		}
+		cached, found := x5cVerifications.Get(x5cVerifyCacheKey(tc.chain, tc.options.Roots))
+		if !found || (cached.(x5cVerification).err == nil) != tc.valid {
+			t.Errorf("%v: expected the outcome to be cached, got %v %v", tc.name, cached, found)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MockResponseMeta is a canned reply for a path and method, an empty method matches any method
+type MockResponseMeta struct {
+	Path    string            `mapstructure:"path" bson:"path" json:"path"`
+	Method  string            `mapstructure:"method" bson:"method" json:"method"`
+	Code    int               `mapstructure:"code" bson:"code" json:"code"`
+	Headers map[string]string `mapstructure:"headers" bson:"headers" json:"headers"`
+	Body    string            `mapstructure:"body" bson:"body" json:"body"`
+}
+
+// MockResponseConfig holds the mock responses of each version of the API Definition, they are set
+// under extended_paths like the other path options:
+//
+//	"version_data": {"versions": {"Default": {"extended_paths": {"mock_responses": [...]}}}}
+type MockResponseConfig struct {
+	VersionData struct {
+		Versions map[string]struct {
+			ExtendedPaths struct {
+				MockResponses []MockResponseMeta `mapstructure:"mock_responses" bson:"mock_responses" json:"mock_responses"`
+			} `mapstructure:"extended_paths" bson:"extended_paths" json:"extended_paths"`
+		} `mapstructure:"versions" bson:"versions" json:"versions"`
+	} `mapstructure:"version_data" bson:"version_data" json:"version_data"`
+
+	specs map[string][]mockResponseSpec
+}
+
+type mockResponseSpec struct {
+	URLSpec
+	Meta MockResponseMeta
+}
+
+// mockPathParams are the {name} placeholders of a mock response path, each matches one path segment
+var mockPathParams = regexp.MustCompile("{(.*?)}")
+
+// compileMockResponsePath turns a mock response path into a regex anchored at both ends, so a mock
+// for /widgets doesn't answer for /widgets/1/parts or /v2/widgets
+func compileMockResponsePath(path string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + mockPathParams.ReplaceAllString(path, "([^/]+)") + "$")
+}
+
+// MockResponseMiddleware replies to matching paths with a configured response instead of proxying
+// the request, it runs after the auth checks so mocked paths are still protected and rate limited
+type MockResponseMiddleware struct {
+	*TykMiddleware
+	sh SuccessHandler
+}
+
+// New lets you do any initialisations for the object can be done here
+func (m *MockResponseMiddleware) New() {
+	m.sh = SuccessHandler{m.TykMiddleware}
+}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (m *MockResponseMiddleware) GetConfig() (interface{}, error) {
+	var thisModuleConfig MockResponseConfig
+
+	err := mapstructure.Decode(m.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	thisModuleConfig.specs = make(map[string][]mockResponseSpec)
+	for versionName, version := range thisModuleConfig.VersionData.Versions {
+		for _, meta := range version.ExtendedPaths.MockResponses {
+			asRegex, regexErr := compileMockResponsePath(meta.Path)
+			if regexErr != nil {
+				log.WithFields(logrus.Fields{
+					"api_id":  m.Spec.APIID,
+					"version": versionName,
+				}).Error("Invalid mock response path ", meta.Path, ", skipping: ", regexErr)
+				continue
+			}
+			if meta.Code == 0 {
+				meta.Code = 200
+			}
+
+			newSpec := mockResponseSpec{Meta: meta}
+			newSpec.Status = MockResponse
+			newSpec.Spec = asRegex
+			thisModuleConfig.specs[versionName] = append(thisModuleConfig.specs[versionName], newSpec)
+		}
+	}
+
+	return thisModuleConfig, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (m *MockResponseMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(MockResponseConfig)
+	if len(thisConfig.specs) == 0 {
+		return nil, 200
+	}
+
+	_, _, _, versionStatus := m.TykMiddleware.Spec.GetVersionData(r)
+	if versionStatus != StatusOk {
+		return nil, 200
+	}
+	versionName, _ := context.Get(r, VersionKeyContext).(string)
+
+	for _, thisSpec := range thisConfig.specs[versionName] {
+		if thisSpec.Meta.Method != "" && !strings.EqualFold(r.Method, thisSpec.Meta.Method) {
+			continue
+		}
+		if !thisSpec.Spec.MatchString(r.URL.Path) {
+			continue
+		}
+
+		m.reply(w, r, thisSpec.Meta)
+		return nil, 666
+	}
+
+	return nil, 200
+}
+
+func (m *MockResponseMiddleware) reply(w http.ResponseWriter, r *http.Request, meta MockResponseMeta) {
+	t1 := time.Now()
+
+	var requestCopy *http.Request
+	if DetailedRecording(r) {
+		requestCopy = CopyHttpRequest(r)
+	}
+
+	for header, value := range meta.Headers {
+		w.Header().Set(header, value)
+	}
+	if config.CloseConnections {
+		w.Header().Set("Connection", "close")
+	}
+	w.WriteHeader(meta.Code)
+	w.Write([]byte(meta.Body))
+
+	context.Set(r, MockedResponseData, true)
+	m.sh.RecordHit(w, r, int64(time.Since(t1).Nanoseconds()/1000000), meta.Code, requestCopy, nil)
+}
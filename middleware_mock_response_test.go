@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getMockResponseChain(spec *APISpec) http.Handler {
+	versions := spec.APIDefinition.RawData["version_data"].(map[string]interface{})["versions"].(map[string]interface{})
+	versions["v1"].(map[string]interface{})["extended_paths"] = map[string]interface{}{
+		"mock_responses": []interface{}{
+			map[string]interface{}{
+				"path": "/broken/(",
+				"body": "an invalid path is skipped",
+			},
+			map[string]interface{}{
+				"path":    "/widgets/{id}",
+				"method":  "GET",
+				"code":    201,
+				"headers": map[string]interface{}{"X-Mock": "widget"},
+				"body":    `{"name": "sprocket"}`,
+			},
+		},
+	}
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
+	proxy := TykNewSingleHostReverseProxy(remote, spec)
+	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, spec))
+	tykMiddleware := &TykMiddleware{spec, proxy}
+	return alice.New(
+		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&MockResponseMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware)).Then(proxyHandler)
+}
+
+func TestMockResponse(t *testing.T) {
+	var upstreamHits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+	}))
+	defer upstream.Close()
+
+	enableAnalytics := config.EnableAnalytics
+	defer func() { config.EnableAnalytics = enableAnalytics }()
+	config.EnableAnalytics = true
+
+	spec, sink := createRecordedSpec("mocked", upstream.URL)
+	defer delete(AnalyticsSinks, "mocked")
+	chain := getMockResponseChain(&spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	doRequest := func(method, path, key string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Add("authorization", key)
+		chain.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := doRequest("GET", "/widgets/1", keyId)
+	if recorder.Code != 201 || recorder.Body.String() != `{"name": "sprocket"}` || recorder.Header().Get("X-Mock") != "widget" {
+		t.Error("Expected the mock response, got: ", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+	if atomic.LoadInt32(&upstreamHits) != 0 {
+		t.Error("The upstream should not be called for a mocked path")
+	}
+
+	select {
+	case thisRecord := <-sink.records:
+		if !thisRecord.Mocked || thisRecord.ResponseCode != 201 {
+			t.Error("The hit should be recorded as mocked, got: ", thisRecord)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No analytics record for the mocked request")
+	}
+
+	// Auth still runs before the mock
+	recorder = doRequest("GET", "/widgets/1", randSeq(10))
+	if recorder.Code != 403 {
+		t.Error("Mocked paths should still need a key, got: ", recorder.Code)
+	}
+
+	// Other methods and paths go to the upstream, mock paths match the whole path
+	doRequest("POST", "/widgets/1", keyId)
+	doRequest("GET", "/gadgets/1", keyId)
+	doRequest("GET", "/widgets/1/parts", keyId)
+	doRequest("GET", "/v2/widgets/1", keyId)
+	if hits := atomic.LoadInt32(&upstreamHits); hits != 4 {
+		t.Error("Unmocked requests should be proxied, upstream got: ", hits)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gorilla/context"
 	"github.com/lonelycode/tykcommon"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -44,7 +46,12 @@ func (t *TransformHeaders) iterateAddHeaders(kv map[string]string, r *http.Reque
 				if thisSessionState.MetaData != nil {
 					tempVal, ok := thisSessionState.MetaData.(map[string]interface{})[metaKey]
 					if ok {
-						nVal = tempVal.(string)
+						// Policy meta data isn't always a string (e.g. a tier number)
+						if number, isNumber := tempVal.(float64); isNumber {
+							nVal = strconv.FormatFloat(number, 'f', -1, 64)
+						} else {
+							nVal = fmt.Sprint(tempVal)
+						}
 						r.Header.Add(nKey, nVal)
 					} else {
 						log.Warning("Session Meta Data not found for key in map: ", metaKey)
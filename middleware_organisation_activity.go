@@ -63,12 +63,41 @@ func (k *OrganizationMonitor) ProcessRequestLive(w http.ResponseWriter, r *http.
 		return errors.New("This organisation access has been disabled, please contact your API administrator."), 403
 	}
 
-	// We found a session, apply the quota limiter
-	forwardMessage, reason := k.sessionlimiter.ForwardMessage(&thisSessionState, k.Spec.OrgID, k.Spec.OrgSessionManager.GetStore())
+	// We found a session, apply the limiter, the org rate limit only applies when one is set
+	var forwardMessage bool
+	var reason int
+	if thisSessionState.Rate > 0 {
+		forwardMessage, reason = k.sessionlimiter.ForwardMessage(&thisSessionState, k.Spec.OrgID, k.Spec.OrgSessionManager.GetStore())
+	} else {
+		isQuotaExceeded, _ := k.sessionlimiter.IsRedisQuotaExceeded(&thisSessionState, k.Spec.OrgID, k.Spec.OrgSessionManager.GetStore())
+		forwardMessage = !isQuotaExceeded
+		if isQuotaExceeded {
+			reason = 2
+		}
+	}
 
 	k.Spec.OrgSessionManager.UpdateSession(k.Spec.OrgID, thisSessionState, 0)
 
 	if !forwardMessage {
+		if reason == 1 {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+				"key":    k.Spec.OrgID,
+			}).Warning("Organisation rate limit has been exceeded.")
+
+			// Fire an org rate limit exceeded event
+			go k.TykMiddleware.FireEvent(EVENT_OrgRateLimitExceeded,
+				EVENT_RateLimitExceededMeta{
+					EventMetaDefault: EventMetaDefault{Message: "Organisation rate limit has been exceeded", OriginatingRequest: EncodeRequestToEvent(r)},
+					Path:             r.URL.Path,
+					Origin:           r.RemoteAddr,
+					Key:              k.Spec.OrgID,
+				})
+
+			return errors.New("This organisation rate limit has been exceeded, please contact your API administrator"), 429
+		}
+
 		if reason == 2 {
 			log.WithFields(logrus.Fields{
 				"path":   r.URL.Path,
@@ -164,7 +193,7 @@ func (k *OrganizationMonitor) AllowAccessNext(orgChan chan bool, r *http.Request
 	}
 
 	// We found a session, apply the quota limiter
-	isQuotaExceeded := k.sessionlimiter.IsRedisQuotaExceeded(&thisSessionState, k.Spec.OrgID, k.Spec.OrgSessionManager.GetStore())
+	isQuotaExceeded, _ := k.sessionlimiter.IsRedisQuotaExceeded(&thisSessionState, k.Spec.OrgID, k.Spec.OrgSessionManager.GetStore())
 
 	k.Spec.OrgSessionManager.UpdateSession(k.Spec.OrgID, thisSessionState, 0)
 
@@ -6,6 +6,10 @@ import (
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 var sessionLimiter = SessionLimiter{}
@@ -17,32 +21,334 @@ type RateLimitAndQuotaCheck struct {
 	*TykMiddleware
 }
 
+// RateLimitAndQuotaCheckConfig holds the per-API options of the rate limiter
+type RateLimitAndQuotaCheckConfig struct {
+	// InjectQuotaHeaders adds X-Quota-Remaining and X-Rate-Remaining to the upstream request
+	InjectQuotaHeaders bool `mapstructure:"inject_quota_headers" bson:"inject_quota_headers" json:"inject_quota_headers"`
+	// RateLimitExemptPaths are regular expressions of paths that don't count against the rate limit
+	// or quota, requests to them are still authenticated
+	RateLimitExemptPaths []string `mapstructure:"rate_limit_exempt_paths" bson:"rate_limit_exempt_paths" json:"rate_limit_exempt_paths"`
+
+	exemptPaths []*regexp.Regexp
+}
+
 // New lets you do any initialisations for the object can be done here
 func (k *RateLimitAndQuotaCheck) New() {}
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (k *RateLimitAndQuotaCheck) GetConfig() (interface{}, error) {
-	return nil, nil
+	var thisModuleConfig RateLimitAndQuotaCheckConfig
+
+	err := mapstructure.Decode(k.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	for _, path := range thisModuleConfig.RateLimitExemptPaths {
+		rx, rxErr := regexp.Compile(path)
+		if rxErr != nil {
+			log.Error("Invalid rate limit exempt path ", path, ": ", rxErr)
+			return nil, rxErr
+		}
+		thisModuleConfig.exemptPaths = append(thisModuleConfig.exemptPaths, rx)
+	}
+
+	return thisModuleConfig, nil
+}
+
+// isExemptPath is true if the request path matches one of rate_limit_exempt_paths
+func (c RateLimitAndQuotaCheckConfig) isExemptPath(path string) bool {
+	for _, rx := range c.exemptPaths {
+		if rx.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateOverrideMetaKey is the session meta data field that overrides the rate limit of one key,
+// e.g. "rate_override": {"rate": 100, "per": 60}
+const RateOverrideMetaKey = "rate_override"
+
+// rateOverride reads the rate override from the session meta data, found is false if the session
+// doesn't have one. The override needs a positive rate and per, otherwise it is an error.
+func rateOverride(thisSessionState *SessionState) (rate float64, per float64, found bool, err error) {
+	metaData, ok := thisSessionState.MetaData.(map[string]interface{})
+	if !ok {
+		return 0, 0, false, nil
+	}
+	value, found := metaData[RateOverrideMetaKey]
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	override, ok := value.(map[string]interface{})
+	if !ok {
+		return 0, 0, true, errors.New("rate_override must be an object with rate and per")
+	}
+	rate, rateOk := override["rate"].(float64)
+	per, perOk := override["per"].(float64)
+	if !rateOk || !perOk || rate <= 0 || per <= 0 {
+		return 0, 0, true, errors.New("rate_override needs a positive rate and per")
+	}
+
+	return rate, per, true, nil
+}
+
+// effectiveRate is the rate limit that applies to the session. The precedence is the rate_override
+// in the session meta data, then the policy (which has already replaced the session values when it
+// was applied), then the rate set on the session itself.
+func effectiveRate(thisSessionState *SessionState) (float64, float64) {
+	if rate, per, found, err := rateOverride(thisSessionState); found && err == nil {
+		return rate, per
+	}
+	return thisSessionState.Rate, thisSessionState.Per
+}
+
+// applyRateLimiting counts the request cost times against the session rate limit and quota and
+// returns the number of requests in the current rate window too. The rate limit headers are set on
+// the response from the session the limiter evaluated.
+func (k *RateLimitAndQuotaCheck) applyRateLimiting(w http.ResponseWriter, thisSessionState *SessionState, authHeaderValue string, cost int) (bool, int, int) {
+	if _, _, found, err := rateOverride(thisSessionState); found && err != nil {
+		log.WithField("key", authHeaderValue).Warning("Ignoring the rate override of the session: ", err)
+	}
+
+	// The override is only used for the check and the session is saved with its own rate, so the
+	// limiter gets a copy that keeps the override
+	limitedSession := *thisSessionState
+	limitedSession.Rate, limitedSession.Per = effectiveRate(thisSessionState)
+	defer func(rate, per float64) {
+		*thisSessionState = limitedSession
+		thisSessionState.Rate, thisSessionState.Per = rate, per
+	}(thisSessionState.Rate, thisSessionState.Per)
+
+	forwardMessage, reason, rateCount, rateResets := sessionLimiter.ForwardMessageAndCount(&limitedSession, authHeaderValue, k.Spec.SessionManager.GetStore(), cost)
+	countRateLimitDecision(k.Spec.APIID, forwardMessage)
+	setQuotaRetryAfter(w, &limitedSession, reason)
+	setRateLimitHeaders(w, &limitedSession, rateCount, rateResets, reason)
+	return forwardMessage, reason, rateCount
+}
+
+// setRateLimitHeaders tells the client how many requests it has left in the rate window and when the
+// window resets, as a Unix time like the quota reset the proxy sends. A request refused by the rate
+// limit (reason 1) also gets Retry-After, the seconds until the oldest request leaves the window.
+func setRateLimitHeaders(w http.ResponseWriter, limitedSession *SessionState, rateCount int, resets int64, reason int) {
+	if limitedSession.Per <= 0 {
+		return
+	}
+
+	remaining := int(limitedSession.Rate) - rateCount
+	if remaining < 0 || reason == 1 {
+		remaining = 0
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(limitedSession.Rate)))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(resets, 10))
+	if reason == 1 {
+		retryAfter := resets - time.Now().Unix()
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+}
+
+// setQuotaRetryAfter tells a client refused by a quota that renews (reason 2) how many seconds to
+// wait before it does
+func setQuotaRetryAfter(w http.ResponseWriter, limitedSession *SessionState, reason int) {
+	if reason != 2 {
+		return
+	}
+	if retryAfter := quotaRetryAfter(limitedSession); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+}
+
+// quotaRetryAfter is the number of seconds until the quota of the session renews, 0 if it doesn't.
+// The renewal time is kept within one renewal period in case the session has a stale one.
+func quotaRetryAfter(thisSessionState *SessionState) int64 {
+	if thisSessionState.QuotaRenewalRate <= 0 {
+		return 0
+	}
+
+	retryAfter := thisSessionState.QuotaRenews - time.Now().Unix()
+	if retryAfter <= 0 || retryAfter > thisSessionState.QuotaRenewalRate {
+		return thisSessionState.QuotaRenewalRate
+	}
+	return retryAfter
+}
+
+// defaultSessionWriteMaxBackoff caps the time spent waiting between session write retries
+// when session_write_retry.max_backoff_ms isn't set
+const defaultSessionWriteMaxBackoff = time.Second
+
+// updateSessionWithRetry saves the session, retrying up to session_write_retry.max_retries times
+// with a backoff that doubles after each attempt. It gives up early once the next wait would take
+// the total past max_backoff_ms or when the client has gone away.
+func (k *RateLimitAndQuotaCheck) updateSessionWithRetry(w http.ResponseWriter, authHeaderValue string, thisSessionState SessionState) error {
+	backoff := time.Duration(config.SessionWriteRetry.BackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(config.SessionWriteRetry.MaxBackoffMs) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = defaultSessionWriteMaxBackoff
+	}
+
+	var clientGone <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		clientGone = notifier.CloseNotify()
+	}
+
+	ttl := k.sessionLifetime(thisSessionState)
+	err := k.Spec.SessionManager.UpdateSession(authHeaderValue, thisSessionState, ttl)
+	var waited time.Duration
+	for attempt := 0; err != nil && attempt < config.SessionWriteRetry.MaxRetries; attempt++ {
+		if waited+backoff > maxBackoff {
+			log.Warning("Session write retry backoff exhausted after ", waited)
+			break
+		}
+		log.Warning("Session write failed, retrying: ", err)
+		select {
+		case <-clientGone:
+			log.Warning("Client went away, no longer retrying the session write")
+			return err
+		case <-time.After(backoff):
+		}
+		waited += backoff
+		backoff *= 2
+		err = k.Spec.SessionManager.UpdateSession(authHeaderValue, thisSessionState, ttl)
+	}
+
+	return err
+}
+
+// injectQuotaHeaders tells the upstream how much of the session quota and rate limit is left
+// after this request, a quota of -1 means it is unlimited
+func (k *RateLimitAndQuotaCheck) injectQuotaHeaders(r *http.Request, thisSessionState *SessionState, rateCount int) {
+	quotaRemaining := thisSessionState.QuotaRemaining
+	if thisSessionState.QuotaMax == -1 {
+		quotaRemaining = -1
+	}
+	r.Header.Set("X-Quota-Remaining", strconv.FormatInt(quotaRemaining, 10))
+
+	rate, _ := effectiveRate(thisSessionState)
+	rateRemaining := int(rate) - rateCount
+	if rateRemaining < 0 {
+		rateRemaining = 0
+	}
+	r.Header.Set("X-Rate-Remaining", strconv.Itoa(rateRemaining))
+}
+
+// perAPISession returns the session and key that the request is limited on, a base key that maps this
+// API to a policy of its own with policy_per_api is limited on its per-API session instead. The
+// per-API session is created on the first request that needs it, or if it has expired since.
+func (k *RateLimitAndQuotaCheck) perAPISession(r *http.Request, thisSessionState SessionState, authHeaderValue string) (SessionState, string) {
+	policyID, ok := thisSessionState.PolicyPerAPI[k.Spec.APIID]
+	if !ok {
+		return thisSessionState, authHeaderValue
+	}
+
+	fields := logrus.Fields{
+		"path":      r.URL.Path,
+		"key":       authHeaderValue,
+		"api_id":    k.Spec.APIID,
+		"policy_id": policyID,
+	}
+
+	apiSessionKey := PerAPISessionKey(authHeaderValue, k.Spec.APIID)
+	apiSession, found := k.Spec.SessionManager.GetSessionDetail(apiSessionKey)
+	if found {
+		// The per-API session was created from its policy once, apply it again so that policy edits reach it
+		k.ApplyPolicyIfExists(apiSessionKey, &apiSession)
+	} else if apiSession, found = k.createPerAPISession(authHeaderValue, thisSessionState, policyID); !found {
+		fields["reason"] = "per-API policy can't be applied"
+		log.WithFields(fields).Debug("Request governed by base session")
+		return thisSessionState, authHeaderValue
+	}
+
+	fields["reason"] = "session maps this API to a per-API policy"
+	log.WithFields(fields).Debug("Request governed by per-API policy")
+	return apiSession, apiSessionKey
+}
+
+// Cleanup gives back the in-flight slot of a request that never reached the success or error
+// handler, e.g. it was answered from the cache or the upstream panicked
+func (k *RateLimitAndQuotaCheck) Cleanup(r *http.Request) {
+	k.releaseInFlight(r)
 }
 
 // ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
 func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
-	thisSessionState := context.Get(r, SessionData).(SessionState)
+	thisConfig := configuration.(RateLimitAndQuotaCheckConfig)
+	if thisConfig.isExemptPath(r.URL.Path) {
+		log.Debug("Path is exempt from rate limiting: ", r.URL.Path)
+		return nil, 200
+	}
+
 	authHeaderValue := context.Get(r, AuthHeaderValue).(string)
+	thisSessionState, sessionKey := k.perAPISession(r, context.Get(r, SessionData).(SessionState), authHeaderValue)
 
-	storeRef := k.Spec.SessionManager.GetStore()
-	forwardMessage, reason := sessionLimiter.ForwardMessage(&thisSessionState, authHeaderValue, storeRef)
+	if thisSessionState.MaxConcurrentRequests > 0 {
+		entry, acquired := sessionLimiter.AcquireInFlight(&thisSessionState, sessionKey, k.Spec.SessionManager.GetStore())
+		if !acquired {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+				"key":    authHeaderValue,
+			}).Info("Key concurrent request limit exceeded.")
+
+			return errors.New("Too many concurrent requests, the key already has the maximum number of requests in flight"), 429
+		}
+		// Released by the success or error handler once the request has completed, or by Cleanup
+		context.Set(r, InFlightData, inFlightSlot{key: sessionKey, entry: entry})
+	}
+
+	var forwardMessage bool
+	var reason, rateCount int
+	cost, decision := runBeforeRateLimitHooks(r, &thisSessionState, authHeaderValue)
+	switch decision {
+	case RateLimitAllow:
+		forwardMessage = true
+	case RateLimitBlock:
+		forwardMessage, reason = false, 1
+	default:
+		forwardMessage, reason, rateCount = k.applyRateLimiting(w, &thisSessionState, sessionKey, cost)
+	}
+	forwardMessage, reason = runAfterRateLimitHooks(r, &thisSessionState, authHeaderValue, forwardMessage, reason)
 
 	// Ensure quota and rate data for this session are recorded
 	if !config.UseAsyncSessionWrite {
-		k.Spec.SessionManager.UpdateSession(authHeaderValue, thisSessionState, 0)
+		if err := k.updateSessionWithRetry(w, sessionKey, thisSessionState); err != nil {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+				"key":    authHeaderValue,
+			}).Error("Failed to save session, quota and rate data for this request is lost: ", err)
+
+			// Fire a session write failed event
+			go k.TykMiddleware.FireEvent(EVENT_SessionWriteFailed,
+				EVENT_SessionWriteFailedMeta{
+					EventMetaDefault: EventMetaDefault{Message: "Session Write Failed", OriginatingRequest: EncodeRequestToEvent(r)},
+					Path:             r.URL.Path,
+					Origin:           r.RemoteAddr,
+					Key:              authHeaderValue,
+					Error:            err.Error(),
+				})
+
+			if config.SessionWriteRetry.FailClosed {
+				return errors.New("Session could not be saved, please retry"), 503
+			}
+		}
 		context.Set(r, SessionData, thisSessionState)
 	} else {
-		go k.Spec.SessionManager.UpdateSession(authHeaderValue, thisSessionState, 0)
+		go func(sessionKey string, thisSessionState SessionState) {
+			k.Spec.SessionManager.UpdateSession(sessionKey, thisSessionState, k.sessionLifetime(thisSessionState))
+		}(sessionKey, thisSessionState)
 		go context.Set(r, SessionData, thisSessionState)
 	}
 
-	log.Debug("SessionState: ", thisSessionState)
+	// Don't log the whole session, it holds decrypted secrets
+	log.Debug("Session allowance: ", thisSessionState.Allowance, ", quota remaining: ", thisSessionState.QuotaRemaining)
 
 	if !forwardMessage {
 		// TODO Use an Enum!
@@ -92,6 +398,27 @@ func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.R
 		return errors.New("Access denied"), 403
 	}
 
+	if reason == 3 {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+			"key":    authHeaderValue,
+		}).Info("Key quota exceeded, request allowed by quota grace.")
+
+		// Fire a quota grace event
+		go k.TykMiddleware.FireEvent(EVENT_QuotaGraceUsed,
+			EVENT_QuotaGraceUsedMeta{
+				EventMetaDefault: EventMetaDefault{Message: "Key Quota Grace Used", OriginatingRequest: EncodeRequestToEvent(r)},
+				Path:             r.URL.Path,
+				Origin:           r.RemoteAddr,
+				Key:              authHeaderValue,
+			})
+	}
+
+	if thisConfig.InjectQuotaHeaders {
+		k.injectQuotaHeaders(r, &thisSessionState, rateCount)
+	}
+
 	// Run the trigger monitor
 	if config.Monitor.MonitorUserKeys {
 		sessionMonitor.Check(&thisSessionState, authHeaderValue)
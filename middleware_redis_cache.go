@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
 	"io"
 	"net/http"
 	"strconv"
@@ -25,7 +26,24 @@ type RedisCacheMiddleware struct {
 	sh         SuccessHandler
 }
 
+// CacheKeyOptions sets what cached responses are keyed on, by default this is the method, the URL
+// and the key of the request (or the IP of keyless requests)
+type CacheKeyOptions struct {
+	// IgnoreQuery leaves the query string out of the cache key
+	IgnoreQuery bool `mapstructure:"ignore_query" bson:"ignore_query" json:"ignore_query"`
+	// Headers are request headers whose values are added to the cache key, e.g. a language header
+	Headers []string `mapstructure:"headers" bson:"headers" json:"headers"`
+	// TenantMetaField is the session meta data field that names the tenant of a key
+	TenantMetaField string `mapstructure:"tenant_meta_field" bson:"tenant_meta_field" json:"tenant_meta_field"`
+	// SharedAcrossKeys replaces the key of the request with its tenant in the cache key so that the
+	// keys of a tenant share cached responses. It needs TenantMetaField, requests whose session has
+	// no tenant are still keyed on their key.
+	SharedAcrossKeys bool `mapstructure:"shared_across_keys" bson:"shared_across_keys" json:"shared_across_keys"`
+}
+
+// RedisCacheMiddlewareConfig is read from the cache_options of the API definition
 type RedisCacheMiddlewareConfig struct {
+	CacheKey CacheKeyOptions `mapstructure:"cache_key" bson:"cache_key" json:"cache_key"`
 }
 
 // New lets you do any initialisations for the object can be done here
@@ -36,12 +54,41 @@ func (m *RedisCacheMiddleware) New() {
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (m *RedisCacheMiddleware) GetConfig() (interface{}, error) {
 	var thisModuleConfig RedisCacheMiddlewareConfig
+
+	err := mapstructure.Decode(m.TykMiddleware.Spec.APIDefinition.RawData["cache_options"], &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if thisModuleConfig.CacheKey.SharedAcrossKeys && thisModuleConfig.CacheKey.TenantMetaField == "" {
+		log.Warning("cache_key.shared_across_keys needs a tenant_meta_field to key responses on, responses will not be shared")
+		thisModuleConfig.CacheKey.SharedAcrossKeys = false
+	}
+
 	return thisModuleConfig, nil
 }
 
-func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string) string {
+func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string, options CacheKeyOptions) string {
+	thisURL := *req.URL
+	if options.IgnoreQuery {
+		thisURL.RawQuery = ""
+	}
+
+	parts := []string{req.Method, thisURL.String()}
+	for _, header := range options.Headers {
+		parts = append(parts, header+":"+req.Header.Get(header))
+	}
+	if options.SharedAcrossKeys {
+		// The tenant comes from the session, never from the request, so a client can't name another one
+		if tenant := cacheTenant(req, options.TenantMetaField); tenant != "" {
+			parts = append(parts, "tenant:"+tenant)
+			keyName = ""
+		}
+	}
+
 	h := md5.New()
-	toEncode := strings.Join([]string{req.Method, req.URL.String()}, "-")
+	toEncode := strings.Join(parts, "-")
 	log.Debug("Cache encoding: ", toEncode)
 	io.WriteString(h, toEncode)
 	reqChecksum := hex.EncodeToString(h.Sum(nil))
@@ -51,6 +98,18 @@ func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string)
 	return cacheKey
 }
 
+// cacheTenant reads the tenant of a request from the meta data of its session, it is empty for
+// keyless requests and sessions that don't have the field
+func cacheTenant(req *http.Request, field string) string {
+	thisSession, ok := context.Get(req, SessionData).(SessionState)
+	if !ok {
+		return ""
+	}
+	metaData, _ := thisSession.MetaData.(map[string]interface{})
+	tenant, _ := metaData[field].(string)
+	return tenant
+}
+
 func GetIP(ip string) (string, error) {
 	IPWithoutPort := strings.Split(ip, ":")
 
@@ -71,6 +130,7 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 	if !m.Spec.APIDefinition.CacheOptions.EnableCache {
 		return nil, 200
 	}
+	thisConfig := configuration.(RedisCacheMiddlewareConfig)
 
 	var stat RequestStatus
 	var isVirtual bool
@@ -107,11 +167,11 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 			}
 
 			var copiedRequest *http.Request
-			if config.AnalyticsConfig.EnableDetailedRecording {
+			if DetailedRecording(r) {
 				copiedRequest = CopyHttpRequest(r)
 			}
 
-			thisKey := m.CreateCheckSum(r, authHeaderValue)
+			thisKey := m.CreateCheckSum(r, authHeaderValue, thisConfig.CacheKey)
 			retBlob, found := m.CacheStore.GetKey(thisKey)
 			if found != nil {
 				log.Debug("Cache enabled, but record not found")
@@ -178,13 +238,17 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 			for _, h := range hopHeaders {
 				newRes.Header.Del(h)
 			}
+			// The cached rate limit headers were for the request that was cached
+			for _, h := range []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"} {
+				newRes.Header.Del(h)
+			}
 
 			copyHeader(w.Header(), newRes.Header)
 			sessObj := context.Get(r, SessionData)
 			var thisSessionState SessionState
 
-			// Only add ratelimit data to keyed sessions
-			if sessObj != nil {
+			// Only add ratelimit data to keyed sessions the rate limiter hasn't reported on
+			if sessObj != nil && w.Header().Get("X-RateLimit-Limit") == "" {
 				thisSessionState = sessObj.(SessionState)
 				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(thisSessionState.QuotaMax)))
 				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(thisSessionState.QuotaRemaining)))
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func getCacheChain(spec *APISpec, cacheKey map[string]interface{}) http.Handler {
+	spec.CacheOptions.EnableCache = true
+	spec.CacheOptions.CacheAllSafeRequests = true
+	spec.CacheOptions.CacheTimeout = 60
+	spec.APIDefinition.RawData["cache_options"] = map[string]interface{}{"cache_key": cacheKey}
+
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
+	proxy := TykNewSingleHostReverseProxy(remote, spec)
+	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, spec))
+	tykMiddleware := &TykMiddleware{spec, proxy}
+	cacheStore := &RedisClusterStorageManager{KeyPrefix: "cache-" + randSeq(10)}
+	cacheStore.Connect()
+
+	return alice.New(
+		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&RedisCacheMiddleware{TykMiddleware: tykMiddleware, CacheStore: cacheStore}, tykMiddleware)).Then(proxyHandler)
+}
+
+// createTenantSession creates a session whose meta data names its tenant, no tenant leaves it out
+func createTenantSession(tenant string) SessionState {
+	thisSession := createNonThrottledSession()
+	if tenant != "" {
+		thisSession.MetaData = map[string]interface{}{"tenant": tenant}
+	}
+	return thisSession
+}
+
+// cachedTenantResponse makes a request and returns the body the client got, the upstream echoes
+// the key of the request
+func cachedTenantResponse(chain http.Handler, key, tenantHeader, path string) string {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Add("authorization", key)
+	req.Header.Add("X-Tenant", tenantHeader)
+	chain.ServeHTTP(recorder, req)
+
+	// The response is written to the cache off thread
+	time.Sleep(50 * time.Millisecond)
+	return recorder.Body.String()
+}
+
+func createKeyEchoUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("authorization")))
+	}))
+}
+
+func TestCacheKeyTenantIsolation(t *testing.T) {
+	upstream := createKeyEchoUpstream()
+	defer upstream.Close()
+
+	spec := createNonVersionedDefinition()
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getCacheChain(&spec, map[string]interface{}{
+		"headers":            []interface{}{"X-Tenant"},
+		"tenant_meta_field":  "tenant",
+		"shared_across_keys": true,
+		"ignore_query":       true,
+	})
+
+	acmeKey, otherAcmeKey, globexKey := randSeq(10), randSeq(10), randSeq(10)
+	spec.SessionManager.UpdateSession(acmeKey, createTenantSession("acme"), 60)
+	spec.SessionManager.UpdateSession(otherAcmeKey, createTenantSession("acme"), 60)
+	spec.SessionManager.UpdateSession(globexKey, createTenantSession("globex"), 60)
+
+	if body := cachedTenantResponse(chain, acmeKey, "acme", "/?page=1"); body != acmeKey {
+		t.Fatal("Expected the upstream response, got: ", body)
+	}
+	if body := cachedTenantResponse(chain, globexKey, "acme", "/?page=1"); body != globexKey {
+		t.Error("A key must not get the cached responses of another tenant by sending its header, got: ", body)
+	}
+	if body := cachedTenantResponse(chain, otherAcmeKey, "acme", "/?page=2"); body != acmeKey {
+		t.Error("Keys of the same tenant should share the cached response when the query is ignored, got: ", body)
+	}
+}
+
+func TestCacheKeyNotSharedWithoutTenant(t *testing.T) {
+	upstream := createKeyEchoUpstream()
+	defer upstream.Close()
+
+	spec := createNonVersionedDefinition()
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getCacheChain(&spec, map[string]interface{}{"tenant_meta_field": "tenant", "shared_across_keys": true})
+
+	firstKey, secondKey := randSeq(10), randSeq(10)
+	spec.SessionManager.UpdateSession(firstKey, createTenantSession(""), 60)
+	spec.SessionManager.UpdateSession(secondKey, createTenantSession(""), 60)
+
+	cachedTenantResponse(chain, firstKey, "acme", "/")
+	if body := cachedTenantResponse(chain, secondKey, "acme", "/"); body != secondKey {
+		t.Error("Responses must not be shared between keys without a tenant, got: ", body)
+	}
+	if body := cachedTenantResponse(chain, firstKey, "acme", "/"); body != firstKey {
+		t.Error("Expected the cached response of the first key, got: ", body)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// defaultMaxRequestHeaderSize matches the limit the HTTP server already applies
+const defaultMaxRequestHeaderSize = http.DefaultMaxHeaderBytes
+
+// RequestHeaderLimitMiddleware rejects requests with too many headers or too large a header
+// section before any other work is done on them
+type RequestHeaderLimitMiddleware struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (h *RequestHeaderLimitMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (h *RequestHeaderLimitMiddleware) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// requestHeaderSize is the size of the header section as it was sent, each header line being
+// the name, ": ", the value and CRLF
+func requestHeaderSize(header http.Header) (count int, size int) {
+	for name, values := range header {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value) + 4
+		}
+	}
+	return count, size
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (h *RequestHeaderLimitMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	maxCount := h.Spec.Options.MaxRequestHeaders
+	maxSize := h.Spec.Options.MaxRequestHeaderSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxRequestHeaderSize
+	}
+
+	count, size := requestHeaderSize(r.Header)
+	var limitErr error
+	if maxCount > 0 && count > maxCount {
+		limitErr = errors.New("Request has too many headers")
+	} else if size > maxSize {
+		limitErr = errors.New("Request headers are too large")
+	}
+
+	if limitErr == nil {
+		return nil, 200
+	}
+
+	log.WithFields(logrus.Fields{
+		"path":         r.URL.Path,
+		"origin":       r.RemoteAddr,
+		"header_count": count,
+		"header_size":  size,
+	}).Info("Request header limit exceeded.")
+
+	go h.TykMiddleware.FireEvent(EVENT_RequestHeadersTooLarge,
+		EVENT_RequestHeadersTooLargeMeta{
+			EventMetaDefault: EventMetaDefault{Message: limitErr.Error(), OriginatingRequest: EncodeRequestToEvent(r)},
+			Path:             r.URL.Path,
+			Origin:           r.RemoteAddr,
+			HeaderCount:      count,
+			HeaderSize:       size,
+		})
+
+	return limitErr, 431
+}
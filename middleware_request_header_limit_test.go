@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestHeaderLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	events := make(chan string, 10)
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "max_request_headers": 10, "max_request_header_size": 1024,`, 1))
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{EVENT_RequestHeadersTooLarge: {recordingEventHandler{"limit", events}}}
+
+	remote, _ := url.Parse(upstream.URL)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	chain := alice.New(CreateMiddleware(&RequestHeaderLimitMiddleware{tykMiddleware}, tykMiddleware)).Then(http.HandlerFunc(ProxyHandler(proxy, &spec)))
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		code    int
+	}{
+		{"within limits", map[string]string{"X-One": "1", "X-Two": "2"}, 200},
+		{"too many headers", manyHeaders(20, "v"), 431},
+		{"too large", map[string]string{"X-Large": strings.Repeat("x", 2048)}, 431},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+		if tc.code != 431 {
+			continue
+		}
+
+		select {
+		case handled := <-events:
+			if handled != "limit:"+string(EVENT_RequestHeadersTooLarge) {
+				t.Errorf("%v: unexpected event %v", tc.name, handled)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: no event was fired", tc.name)
+		}
+	}
+}
+
+func manyHeaders(count int, value string) map[string]string {
+	headers := make(map[string]string)
+	for i := 0; i < count; i++ {
+		headers["X-Header-"+strconv.Itoa(i)] = value
+	}
+	return headers
+}
+
+func TestRequestHeaderSize(t *testing.T) {
+	header := http.Header{}
+	header.Add("X-Test", "abc")
+	header.Add("X-Test", "de")
+	header.Set("Accept", "*/*")
+
+	count, size := requestHeaderSize(header)
+	if count != 3 || size != (6+3+4)+(6+2+4)+(6+3+4) {
+		t.Errorf("Unexpected count %v and size %v", count, size)
+	}
+}
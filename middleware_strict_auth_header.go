@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// StrictAuthHeaderCheck rejects requests that send more than one value for the auth header when
+// strict_auth_headers is set, otherwise the first value would be used and the others ignored
+type StrictAuthHeaderCheck struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (s *StrictAuthHeaderCheck) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (s *StrictAuthHeaderCheck) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (s *StrictAuthHeaderCheck) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	if !config.StrictAuthHeaders {
+		return nil, 200
+	}
+
+	// Basic auth and HMAC always use Authorization, whatever the configured header is
+	headerNames := []string{"Authorization"}
+	if s.Spec.Auth.AuthHeaderName != "" {
+		headerNames = append(headerNames, s.Spec.Auth.AuthHeaderName)
+	}
+
+	for _, name := range headerNames {
+		if len(r.Header[http.CanonicalHeaderKey(name)]) > 1 {
+			log.WithFields(logrus.Fields{
+				"path":   r.URL.Path,
+				"origin": r.RemoteAddr,
+				"header": name,
+			}).Warning("Attempted access with more than one auth header value.")
+
+			return errors.New("Multiple values for the authorization header are not allowed"), 400
+		}
+	}
+
+	return nil, 200
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/justinas/alice"
+)
+
+func getStrictAuthHeaderChain(spec APISpec, target string) http.Handler {
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	remote, _ := url.Parse(target)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	return alice.New(
+		CreateMiddleware(&StrictAuthHeaderCheck{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware)).Then(http.HandlerFunc(ProxyHandler(proxy, &spec)))
+}
+
+func TestStrictAuthHeaders(t *testing.T) {
+	defer func() { config.StrictAuthHeaders = false }()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	spec := createDefinitionFromString(nonExpiringDefNoWhiteList)
+	chain := getStrictAuthHeaderChain(spec, upstream.URL)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for _, tc := range []struct {
+		strict  bool
+		headers []string
+		code    int
+	}{
+		{false, []string{keyId}, 200},
+		{false, []string{keyId, "someone-else"}, 200},
+		{true, []string{keyId}, 200},
+		{true, []string{keyId, "someone-else"}, 400},
+		{true, []string{keyId, keyId}, 400},
+	} {
+		config.StrictAuthHeaders = tc.strict
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		for _, value := range tc.headers {
+			req.Header.Add("authorization", value)
+		}
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("Strict %v with %v auth headers: expected %v, got %v", tc.strict, len(tc.headers), tc.code, recorder.Code)
+		}
+	}
+}
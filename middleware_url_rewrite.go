@@ -10,6 +10,9 @@ import (
 
 type URLRewriter struct{}
 
+// rewriteGroupRef finds the $n references to captured groups in a rewrite target
+var rewriteGroupRef = regexp.MustCompile(`\$\d`)
+
 func (u URLRewriter) Rewrite(thisMeta *tykcommon.URLRewriteMeta, path string) (string, error) {
 	// Find all the matching groups:
 	mp, mpErr := regexp.Compile(thisMeta.MatchPattern)
@@ -17,15 +20,19 @@ func (u URLRewriter) Rewrite(thisMeta *tykcommon.URLRewriteMeta, path string) (s
 		log.Debug("Compilation error: ", mpErr)
 		return "", mpErr
 	}
+	return u.rewriteWithPattern(mp, thisMeta.RewriteTo, path), nil
+}
+
+// rewriteWithPattern is Rewrite with a pattern that has already been compiled
+func (u URLRewriter) rewriteWithPattern(mp *regexp.Regexp, rewriteTo string, path string) string {
 	result_slice := mp.FindAllStringSubmatch(path, -1)
 
 	// Make sure it matches the string
 	log.Debug("Rewriter checking matches, len is: ", len(result_slice))
 	if len(result_slice) > 0 {
-		newpath := thisMeta.RewriteTo
+		newpath := rewriteTo
 		// get the indices for the replacements:
-		dollarMatch, _ := regexp.Compile(`\$\d`) // Prepare our regex
-		replace_slice := dollarMatch.FindAllStringSubmatch(thisMeta.RewriteTo, -1)
+		replace_slice := rewriteGroupRef.FindAllStringSubmatch(rewriteTo, -1)
 
 		// log.Debug(result_slice)
 		// log.Debug(replace_slice)
@@ -44,9 +51,125 @@ func (u URLRewriter) Rewrite(thisMeta *tykcommon.URLRewriteMeta, path string) (s
 		log.Debug("URL Re-written to: ", newpath)
 		log.Debug("URL Re-written from: ", path)
 		// matched?? Set the modified path
-		return newpath, nil
+		return newpath
+	}
+	return path
+}
+
+// UpstreamRewriteOptions is a per-API rule that maps the path of a request to a differently
+// structured upstream path, $1 to $9 in RewriteTo are the groups captured by MatchPattern
+type UpstreamRewriteOptions struct {
+	MatchPattern string `mapstructure:"match_pattern" bson:"match_pattern" json:"match_pattern"`
+	RewriteTo    string `mapstructure:"rewrite_to" bson:"rewrite_to" json:"rewrite_to"`
+
+	// match is MatchPattern compiled when the API is loaded
+	match *regexp.Regexp
+}
+
+// compileUpstreamRewrites compiles the patterns of the upstream_rewrites of an API, rules with an
+// invalid pattern are logged and left out
+func compileUpstreamRewrites(apiName string, rules []UpstreamRewriteOptions) []UpstreamRewriteOptions {
+	compiled := make([]UpstreamRewriteOptions, 0, len(rules))
+	for _, rule := range rules {
+		mp, mpErr := regexp.Compile(rule.MatchPattern)
+		if mpErr != nil {
+			log.Error("Invalid upstream rewrite pattern ", rule.MatchPattern, " for API ", apiName, ", skipping it: ", mpErr)
+			continue
+		}
+		rule.match = mp
+		compiled = append(compiled, rule)
+	}
+	return compiled
+}
+
+// PathNormalizationOptions clean up the path of a request after the listen path, so that
+// inconsistent clients reach the same upstream path and are grouped together in analytics
+type PathNormalizationOptions struct {
+	StripTrailingSlash bool `mapstructure:"strip_trailing_slash" bson:"strip_trailing_slash" json:"strip_trailing_slash"`
+	CollapseSlashes    bool `mapstructure:"collapse_slashes" bson:"collapse_slashes" json:"collapse_slashes"`
+	Lowercase          bool `mapstructure:"lowercase" bson:"lowercase" json:"lowercase"`
+}
+
+// normalizePath applies the enabled normalizations to path, a path of just "/" is left alone
+func normalizePath(options PathNormalizationOptions, path string) string {
+	if options.CollapseSlashes {
+		for strings.Contains(path, "//") {
+			path = strings.Replace(path, "//", "/", -1)
+		}
+	}
+	if options.StripTrailingSlash {
+		for len(path) > 1 && strings.HasSuffix(path, "/") {
+			path = path[:len(path)-1]
+		}
+	}
+	if options.Lowercase {
+		path = strings.ToLower(path)
+	}
+
+	return path
+}
+
+// NormalizePathMiddleware applies the path_normalization options as the first step of the chain,
+// so the access checks and URL specs see the same path that is proxied upstream
+type NormalizePathMiddleware struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (m *NormalizePathMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (m *NormalizePathMiddleware) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// normalizeRequestPath normalizes the part of a request path after the listen path, the listen
+// path is left as it is so that it can still be stripped
+func normalizeRequestPath(spec *APISpec, path string) string {
+	options := spec.Options.PathNormalization
+	listenPath := spec.Proxy.ListenPath
+	if !strings.HasPrefix(path, listenPath) {
+		return normalizePath(options, path)
+	}
+
+	rest := path[len(listenPath):]
+	if rest == "" {
+		return path
+	}
+	rest = normalizePath(options, rest)
+	if options.CollapseSlashes && strings.HasSuffix(listenPath, "/") {
+		rest = strings.TrimLeft(rest, "/")
+	}
+	return listenPath + rest
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (m *NormalizePathMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	r.URL.Path = normalizeRequestPath(m.Spec, r.URL.Path)
+	return nil, 200
+}
+
+// rewriteUpstreamPath applies the first of the API upstream_rewrites that matches the request path,
+// a query string in the rewritten path is added to the query of the request
+func rewriteUpstreamPath(spec *APISpec, r *http.Request) {
+	rewriter := URLRewriter{}
+	for _, rule := range spec.Options.UpstreamRewrites {
+		if rule.match == nil || !rule.match.MatchString(r.URL.Path) {
+			continue
+		}
+
+		p := rewriter.rewriteWithPattern(rule.match, rule.RewriteTo, r.URL.Path)
+		if queryStart := strings.Index(p, "?"); queryStart != -1 {
+			query := p[queryStart+1:]
+			if r.URL.RawQuery != "" {
+				query += "&" + r.URL.RawQuery
+			}
+			r.URL.RawQuery = query
+			p = p[:queryStart]
+		}
+		r.URL.Path = p
+		return
 	}
-	return path, nil
 }
 
 // URLRewriteMiddleware Will rewrite an inbund URL to a matching outbound one, it can also handle dynamic variable substitution
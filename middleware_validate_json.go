@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"github.com/xeipuuv/gojsonschema"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ValidateJSONMeta attaches a JSON Schema to a path and method, if Policies is set the schema is
+// only enforced for sessions that have one of these policies applied
+type ValidateJSONMeta struct {
+	Path     string                 `mapstructure:"path" bson:"path" json:"path"`
+	Method   string                 `mapstructure:"method" bson:"method" json:"method"`
+	Schema   map[string]interface{} `mapstructure:"schema" bson:"schema" json:"schema"`
+	Policies []string               `mapstructure:"policies" bson:"policies" json:"policies"`
+}
+
+// ValidateJSONConfig is set under validate_json in the API Definition, it lists the schemas and
+// bounds how much of a body is read to validate it
+type ValidateJSONConfig struct {
+	Paths       []ValidateJSONMeta `mapstructure:"paths" bson:"paths" json:"paths"`
+	MaxBodySize int64              `mapstructure:"max_body_size" bson:"max_body_size" json:"max_body_size"`
+
+	specs []validateJSONSpec
+}
+
+// defaultValidateJSONMaxBodySize is used when max_body_size isn't set, larger bodies are rejected
+const defaultValidateJSONMaxBodySize = 1 << 20
+
+// validateJSONSpec holds a compiled schema so it is only parsed once, when the API is loaded
+type validateJSONSpec struct {
+	URLSpec
+	Meta   ValidateJSONMeta
+	Schema *gojsonschema.Schema
+}
+
+// ValidateJSON validates request bodies against the JSON Schema of the matching path
+type ValidateJSON struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (v *ValidateJSON) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (v *ValidateJSON) GetConfig() (interface{}, error) {
+	var thisModuleConfig ValidateJSONConfig
+
+	err := mapstructure.Decode(v.TykMiddleware.Spec.APIDefinition.RawData["validate_json"], &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if thisModuleConfig.MaxBodySize <= 0 {
+		thisModuleConfig.MaxBodySize = defaultValidateJSONMaxBodySize
+	}
+
+	loader := APIDefinitionLoader{}
+	for _, meta := range thisModuleConfig.Paths {
+		schema, schemaErr := gojsonschema.NewSchema(gojsonschema.NewGoLoader(meta.Schema))
+		if schemaErr != nil {
+			log.Error("Invalid JSON Schema for path ", meta.Path, ", skipping: ", schemaErr)
+			continue
+		}
+
+		newSpec := validateJSONSpec{Meta: meta, Schema: schema}
+		loader.generateRegex(meta.Path, &newSpec.URLSpec, ValidateJSONRequest)
+		thisModuleConfig.specs = append(thisModuleConfig.specs, newSpec)
+	}
+
+	return thisModuleConfig, nil
+}
+
+// appliesToSession checks the policy gate of a schema, a request without a session can't match a gated schema
+func (v *ValidateJSON) appliesToSession(r *http.Request, meta ValidateJSONMeta) bool {
+	if len(meta.Policies) == 0 {
+		return true
+	}
+
+	thisSessionState, ok := context.Get(r, SessionData).(SessionState)
+	if !ok {
+		return false
+	}
+
+	for _, policyID := range meta.Policies {
+		if policyID == thisSessionState.ApplyPolicyID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (v *ValidateJSON) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(ValidateJSONConfig)
+
+	for _, thisSpec := range thisConfig.specs {
+		if !strings.EqualFold(r.Method, thisSpec.Meta.Method) || !thisSpec.Spec.MatchString(r.URL.Path) {
+			continue
+		}
+
+		if !v.appliesToSession(r, thisSpec.Meta) {
+			continue
+		}
+
+		return v.validateBody(r, thisSpec.Schema, thisConfig.MaxBodySize)
+	}
+
+	return nil, 200
+}
+
+// validateBody reads up to maxBodySize bytes of the body, anything larger is rejected without
+// being buffered
+func (v *ValidateJSON) validateBody(r *http.Request, schema *gojsonschema.Schema, maxBodySize int64) (error, int) {
+	var body []byte
+	if r.Body != nil {
+		var readErr error
+		body, readErr = ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		r.Body.Close()
+		if readErr != nil {
+			log.Error("Failed to read request body: ", readErr)
+			return errors.New("Request body could not be read"), 400
+		}
+		if int64(len(body)) > maxBodySize {
+			return errors.New("Request body is too large to validate"), 413
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return errors.New("Request body is not valid JSON"), 400
+	}
+
+	if !result.Valid() {
+		validationErrors := []string{}
+		for _, resultErr := range result.Errors() {
+			validationErrors = append(validationErrors, resultErr.String())
+		}
+
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": r.RemoteAddr,
+		}).Info("Request body failed JSON Schema validation.")
+
+		return errors.New("Request body failed validation: " + strings.Join(validationErrors, "; ")), 400
+	}
+
+	return nil, 200
+}
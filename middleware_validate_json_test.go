@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var validateJSONSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"name": map[string]interface{}{"type": "string"},
+		"size": map[string]interface{}{"type": "integer", "minimum": 1},
+	},
+	"required": []interface{}{"name"},
+}
+
+func getValidateJSONChain(policies []interface{}) (http.Handler, APISpec) {
+	spec := createNonVersionedDefinition()
+	spec.APIDefinition.RawData["validate_json"] = map[string]interface{}{
+		"max_body_size": 64,
+		"paths": []interface{}{
+			map[string]interface{}{
+				"path":     "/widgets/{id}",
+				"method":   "post",
+				"schema":   validateJSONSchema,
+				"policies": policies,
+			},
+		},
+	}
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	remote, _ := url.Parse(spec.Proxy.TargetURL)
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	proxyHandler := http.HandlerFunc(ProxyHandler(proxy, &spec))
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	chain := alice.New(
+		CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware),
+		CreateMiddleware(&ValidateJSON{TykMiddleware: tykMiddleware}, tykMiddleware)).Then(proxyHandler)
+
+	return chain, spec
+}
+
+func doValidateJSONRequest(chain http.Handler, keyId, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func TestValidateJSON(t *testing.T) {
+	chain, spec := getValidateJSONChain(nil)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	recorder := doValidateJSONRequest(chain, keyId, "/widgets/1", `{"name": "sprocket", "size": 3}`)
+	if recorder.Code != 200 {
+		t.Error("Valid payload should pass, got: ", recorder.Code, recorder.Body)
+	}
+
+	recorder = doValidateJSONRequest(chain, keyId, "/widgets/1", `{"size": 0}`)
+	if recorder.Code != 400 {
+		t.Error("Invalid payload should be rejected, got: ", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "name") || !strings.Contains(recorder.Body.String(), "size") {
+		t.Error("Validation errors should be returned, got: ", recorder.Body)
+	}
+
+	recorder = doValidateJSONRequest(chain, keyId, "/widgets/1", `{"name": `)
+	if recorder.Code != 400 {
+		t.Error("Malformed JSON should be rejected, got: ", recorder.Code)
+	}
+
+	recorder = doValidateJSONRequest(chain, keyId, "/widgets/1", `{"name": "`+strings.Repeat("a", 64)+`"}`)
+	if recorder.Code != 413 {
+		t.Error("Bodies over max_body_size should be rejected, got: ", recorder.Code)
+	}
+
+	recorder = doValidateJSONRequest(chain, keyId, "/gadgets/1", `{"size": 0}`)
+	if recorder.Code != 200 {
+		t.Error("Paths without a schema should not be validated, got: ", recorder.Code)
+	}
+}
+
+func TestValidateJSONGatedByPolicy(t *testing.T) {
+	chain, spec := getValidateJSONChain([]interface{}{"strict-plan"})
+
+	standardKey := randSeq(10)
+	spec.SessionManager.UpdateSession(standardKey, createNonThrottledSession(), 60)
+
+	strictSession := createNonThrottledSession()
+	strictSession.ApplyPolicyID = "strict-plan"
+	strictKey := randSeq(10)
+	spec.SessionManager.UpdateSession(strictKey, strictSession, 60)
+
+	recorder := doValidateJSONRequest(chain, standardKey, "/widgets/1", `{"size": 0}`)
+	if recorder.Code != 200 {
+		t.Error("Schema should not apply to sessions without the policy, got: ", recorder.Code)
+	}
+
+	recorder = doValidateJSONRequest(chain, strictKey, "/widgets/1", `{"size": 0}`)
+	if recorder.Code != 400 {
+		t.Error("Schema should apply to sessions with the policy, got: ", recorder.Code)
+	}
+}
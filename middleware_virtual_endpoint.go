@@ -117,7 +117,7 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 	}
 
 	var copiedRequest *http.Request
-	if config.AnalyticsConfig.EnableDetailedRecording {
+	if DetailedRecording(r) {
 		copiedRequest = CopyHttpRequest(r)
 	}
 
@@ -232,7 +232,7 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 
 	// deep logging
 	var copiedResponse *http.Response
-	if config.AnalyticsConfig.EnableDetailedRecording {
+	if DetailedRecording(r) {
 		copiedResponse = CopyHttpResponse(newResponse)
 	}
 
@@ -283,8 +283,8 @@ func (d *VirtualEndpoint) HandleResponse(rw http.ResponseWriter, res *http.Respo
 		res.Header.Set("Connection", "close")
 	}
 
-	// Add resource headers
-	if ses != nil {
+	// Add resource headers, unless the rate limiter has already reported on the session it evaluated
+	if ses != nil && rw.Header().Get("X-RateLimit-Limit") == "" {
 		// We have found a session, lets report back
 		res.Header.Add("X-RateLimit-Limit", strconv.Itoa(int(ses.QuotaMax)))
 		res.Header.Add("X-RateLimit-Remaining", strconv.Itoa(int(ses.QuotaRemaining)))
@@ -2,56 +2,278 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/pmylund/go-cache"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Policy struct {
-	MID              bson.ObjectId               `bson:"_id,omitempty" json:"_id"`
-	ID               string                      `bson:"id,omitempty" json:"id"`
-	OrgID            string                      `bson:"org_id" json:"org_id"`
-	Rate             float64                     `bson:"rate" json:"rate"`
-	Per              float64                     `bson:"per" json:"per"`
-	QuotaMax         int64                       `bson:"quota_max" json:"quota_max"`
-	QuotaRenewalRate int64                       `bson:"quota_renewal_rate" json:"quota_renewal_rate"`
-	AccessRights     map[string]AccessDefinition `bson:"access_rights" json:"access_rights"`
-	HMACEnabled      bool                        `bson:"hmac_enabled" json:"hmac_enabled"`
-	Active           bool                        `bson:"active" json:"active"`
-	IsInactive       bool                        `bson:"is_inactive" json:"is_inactive"`
-	Tags             []string                    `bson:"tags" json:"tags"`
-	KeyExpiresIn     int64                       `bson:"key_expires_in" json:"key_expires_in"`
-}
-
-func LoadPoliciesFromFile(filePath string) map[string]Policy {
+	MID                   bson.ObjectId               `bson:"_id,omitempty" json:"_id"`
+	ID                    string                      `bson:"id,omitempty" json:"id"`
+	OrgID                 string                      `bson:"org_id" json:"org_id"`
+	Rate                  float64                     `bson:"rate" json:"rate"`
+	Per                   float64                     `bson:"per" json:"per"`
+	QuotaMax              int64                       `bson:"quota_max" json:"quota_max"`
+	QuotaRenewalRate      int64                       `bson:"quota_renewal_rate" json:"quota_renewal_rate"`
+	QuotaRolling          bool                        `bson:"quota_rolling" json:"quota_rolling"`
+	RateLimit             string                      `bson:"rate_limit" json:"rate_limit"`
+	Quota                 string                      `bson:"quota" json:"quota"`
+	AccessRights          map[string]AccessDefinition `bson:"access_rights" json:"access_rights"`
+	HMACEnabled           bool                        `bson:"hmac_enabled" json:"hmac_enabled"`
+	Active                bool                        `bson:"active" json:"active"`
+	IsInactive            bool                        `bson:"is_inactive" json:"is_inactive"`
+	Tags                  []string                    `bson:"tags" json:"tags"`
+	KeyExpiresIn          int64                       `bson:"key_expires_in" json:"key_expires_in"`
+	SharedQuotaGroup      string                      `bson:"shared_quota_group" json:"shared_quota_group"`
+	QuotaGrace            int64                       `bson:"quota_grace" json:"quota_grace"`
+	QuotaGracePercent     float64                     `bson:"quota_grace_percent" json:"quota_grace_percent"`
+	PolicyPerAPI          map[string]string           `bson:"policy_per_api" json:"policy_per_api"`
+	MetaData              map[string]interface{}      `bson:"meta_data" json:"meta_data"`
+	Version               int                         `bson:"version" json:"version"`
+	PreviousVersions      []Policy                    `bson:"previous_versions" json:"previous_versions"`
+	EmptyAccessRights     string                      `bson:"empty_access_rights" json:"empty_access_rights"`
+	MaxConcurrentRequests int64                       `bson:"max_concurrent_requests" json:"max_concurrent_requests"`
+}
+
+const (
+	// EmptyAccessRightsAllow reads a policy without access rights as access to every API
+	EmptyAccessRightsAllow = "allow"
+	// EmptyAccessRightsDeny reads a policy without access rights as access to no API
+	EmptyAccessRightsDeny = "deny"
+)
+
+// DeniesAllAPIs is true for a policy without access rights that is read as giving no access, set
+// per policy with empty_access_rights or for every policy with policies.empty_access_rights.
+// Allowing is the default as older policies rely on it, but it means a policy saved with its
+// access rights left out by mistake opens up every API of the org.
+func (p Policy) DeniesAllAPIs() bool {
+	if len(p.AccessRights) > 0 {
+		return false
+	}
+
+	mode := p.EmptyAccessRights
+	if mode == "" {
+		mode = config.Policies.EmptyAccessRights
+	}
+	return mode == EmptyAccessRightsDeny
+}
+
+// AtVersion returns the policy as it was at version, sessions pinned to an older version keep
+// getting its values. Version 0 is the current version.
+func (p Policy) AtVersion(version int) (Policy, bool) {
+	if version == 0 || version == p.Version {
+		return p, true
+	}
+
+	for _, previous := range p.PreviousVersions {
+		if previous.Version == version {
+			// A policy can't move between orgs by being pinned
+			previous.ID = p.ID
+			previous.OrgID = p.OrgID
+			return previous, true
+		}
+	}
+
+	return Policy{}, false
+}
+
+// limitUnits are the periods that rate_limit and quota can be given in, in seconds
+var limitUnits = map[string]float64{
+	"second": 1,
+	"minute": 60,
+	"hour":   3600,
+	"day":    86400,
+	"week":   604800,
+}
+
+var limitSpecPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*/\s*(\d+)?\s*([a-z]+)$`)
+
+// ParseLimitSpec reads a limit written as "1000/day", "10/second" or "100/15 minutes" into the
+// amount and the period in seconds
+func ParseLimitSpec(spec string) (float64, float64, error) {
+	parts := limitSpecPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(spec)))
+	if parts == nil {
+		return 0, 0, errors.New("limit must look like 1000/day, got: " + spec)
+	}
+
+	unit, found := limitUnits[parts[3]]
+	if !found {
+		unit, found = limitUnits[strings.TrimSuffix(parts[3], "s")]
+	}
+	if !found {
+		return 0, 0, errors.New("unknown limit unit: " + parts[3])
+	}
+
+	amount, _ := strconv.ParseFloat(parts[1], 64)
+	per := unit
+	if parts[2] != "" {
+		count, _ := strconv.ParseFloat(parts[2], 64)
+		if count == 0 {
+			return 0, 0, errors.New("limit period can't be 0: " + spec)
+		}
+		per *= count
+	}
+
+	return amount, per, nil
+}
+
+// parseLimits sets the numeric rate and quota fields of the policy from rate_limit and quota, when
+// they are given they take precedence over the numeric fields
+func (p *Policy) parseLimits() error {
+	if p.RateLimit != "" {
+		rate, per, err := ParseLimitSpec(p.RateLimit)
+		if err != nil {
+			return errors.New("policy " + p.ID + " rate_limit: " + err.Error())
+		}
+		p.Rate = rate
+		p.Per = per
+	}
+
+	if p.Quota != "" {
+		quotaMax, renewalRate, err := ParseLimitSpec(p.Quota)
+		if err != nil {
+			return errors.New("policy " + p.ID + " quota: " + err.Error())
+		}
+		if quotaMax != math.Trunc(quotaMax) {
+			return errors.New("policy " + p.ID + " quota must be a whole number of requests: " + p.Quota)
+		}
+		p.QuotaMax = int64(quotaMax)
+		p.QuotaRenewalRate = int64(renewalRate)
+	}
+
+	for i := range p.PreviousVersions {
+		p.PreviousVersions[i].ID = p.ID
+		if err := p.PreviousVersions[i].parseLimits(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParsePolicyLimits parses the rate_limit and quota of all of the policies, a malformed limit is an
+// error so that the policies aren't used with limits other than the ones intended
+func ParsePolicyLimits(policies map[string]Policy) error {
+	for id, policy := range policies {
+		if policy.ID == "" {
+			policy.ID = id
+		}
+		if err := policy.parseLimits(); err != nil {
+			log.Error("Invalid policy limit: ", err)
+			return err
+		}
+		policies[id] = policy
+	}
+
+	return nil
+}
+
+// PolicyPerAPIIssue is a policy_per_api entry that was skipped because the policy it maps the API
+// to can't be used
+type PolicyPerAPIIssue struct {
+	PolicyID       string `json:"policy_id"`
+	APIID          string `json:"api_id"`
+	PerAPIPolicyID string `json:"per_api_policy_id"`
+	Reason         string `json:"reason"`
+}
+
+// PolicyPerAPIIssues are the entries skipped when the policies were last loaded
+var PolicyPerAPIIssues = []PolicyPerAPIIssue{}
+
+// perAPIPolicyProblem explains why a policy can't be used as a per-API policy in the organisation,
+// it is empty if it can
+func perAPIPolicyProblem(orgID, policyID string, lookup func(string) (Policy, bool)) string {
+	if policyID == "" {
+		return "per-API policy ID is empty"
+	}
+	policy, found := lookup(policyID)
+	if !found {
+		return "per-API policy " + policyID + " not found"
+	}
+	if policy.OrgID != orgID {
+		return "per-API policy " + policyID + " belongs to a different organisation"
+	}
+	return ""
+}
+
+// ValidatePolicyPerAPI reports the policy_per_api entries of the policies that map an API to an
+// unknown policy or a policy of another organisation, so that a mistyped policy ID shows up when
+// the policies are loaded. The policies are left as they are, these entries are skipped when the
+// per-API policy is applied.
+func ValidatePolicyPerAPI(policies map[string]Policy) []PolicyPerAPIIssue {
+	lookup := func(id string) (Policy, bool) {
+		policy, found := policies[id]
+		return policy, found
+	}
+
+	issues := []PolicyPerAPIIssue{}
+	for id, policy := range policies {
+		for apiID, perAPIPolicyID := range policy.PolicyPerAPI {
+			problem := perAPIPolicyProblem(policy.OrgID, perAPIPolicyID, lookup)
+			if problem == "" {
+				continue
+			}
+
+			log.WithFields(logrus.Fields{
+				"policy_id": id,
+				"api_id":    apiID,
+			}).Warning("Per-API policy will be skipped: ", problem)
+			issues = append(issues, PolicyPerAPIIssue{
+				PolicyID:       id,
+				APIID:          apiID,
+				PerAPIPolicyID: perAPIPolicyID,
+				Reason:         problem,
+			})
+		}
+	}
+
+	return issues
+}
+
+// LoadPoliciesFromFile reads policies from a JSON file, the error is set if the file can't be read
+// or parsed so that the caller can keep the policies it already has
+func LoadPoliciesFromFile(filePath string) (map[string]Policy, error) {
 	policies := make(map[string]Policy)
 
 	policyConfig, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		log.Error("Couldn't load policy file: ", err)
-		return policies
+		return nil, err
 	}
 
 	mErr := json.Unmarshal(policyConfig, &policies)
 	if mErr != nil {
 		log.Error("Couldn't unmarshal policies: ", mErr)
+		return nil, mErr
 	}
 
-	return policies
+	return policies, nil
 }
 
 // LoadPoliciesFromMongo will connect and download POlicies from a Mongo DB instance.
-func LoadPoliciesFromMongo(collectionName string) map[string]Policy {
+func LoadPoliciesFromMongo(collectionName string) (map[string]Policy, error) {
 	dbPolicyList := make([]Policy, 0)
 	policies := make(map[string]Policy)
 
-	dbSession, dErr := mgo.Dial(config.AnalyticsConfig.MongoURL)
+	dbSession, dErr := getPolicyDBSession()
 	if dErr != nil {
 		log.Error("Mongo connection failed:", dErr)
 		time.Sleep(5)
 		return LoadPoliciesFromMongo(collectionName)
 	}
+	defer dbSession.Close()
 
 	log.Debug("Searching in collection: ", collectionName)
 	policyCollection := dbSession.DB("").C(collectionName)
@@ -64,7 +286,7 @@ func LoadPoliciesFromMongo(collectionName string) map[string]Policy {
 
 	if mongoErr != nil {
 		log.Error("Could not find any policy configs! ", mongoErr)
-		return policies
+		return nil, mongoErr
 	}
 
 	log.Printf("Loaded %v policies ", len(dbPolicyList))
@@ -74,25 +296,38 @@ func LoadPoliciesFromMongo(collectionName string) map[string]Policy {
 		log.Info("--> Processing policy ID: ", p.ID)
 	}
 
-	return policies
+	return policies, nil
 }
 
-func LoadPoliciesFromRPC(orgId string) map[string]Policy {
-	dbPolicyList := make([]Policy, 0)
-	policies := make(map[string]Policy)
+// GetPoliciesFromRPC fetches the raw policy list of an org, it is swappable so RPC can be stubbed
+var GetPoliciesFromRPC = getPoliciesFromRPCStore
 
+func getPoliciesFromRPCStore(orgId string) string {
 	store := &RPCStorageHandler{UserKey: config.SlaveOptions.APIKey, Address: config.SlaveOptions.ConnectionString}
 	store.Connect()
+	defer store.Disconnect()
 
-	rpcPolicies := store.GetPolicies(orgId)
+	return store.GetPolicies(orgId)
+}
 
-	store.Disconnect()
+// checkRPCPolicyCacheOwner refuses cache files another user could have written, since the gateway
+// would otherwise load whatever policies they put there
+func checkRPCPolicyCacheOwner(info os.FileInfo) error {
+	if info.Mode().Perm()&0022 != 0 {
+		return errors.New("the cache file is writable by other users")
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return errors.New("the cache file is not owned by the gateway user")
+	}
+	return nil
+}
 
-	jErr1 := json.Unmarshal([]byte(rpcPolicies), &dbPolicyList)
+func decodeRPCPolicies(rpcPolicies string) (map[string]Policy, error) {
+	dbPolicyList := make([]Policy, 0)
+	policies := make(map[string]Policy)
 
-	if jErr1 != nil {
-		log.Error("Failed decode: ", jErr1)
-		return policies
+	if err := json.Unmarshal([]byte(rpcPolicies), &dbPolicyList); err != nil {
+		return nil, err
 	}
 
 	log.Info("Policies found: ", len(dbPolicyList))
@@ -102,5 +337,244 @@ func LoadPoliciesFromRPC(orgId string) map[string]Policy {
 		log.Info("--> Processing policy ID: ", p.ID)
 	}
 
-	return policies
+	return policies, nil
+}
+
+// saveRPCPolicyCache keeps the last policy list that RPC returned, it is written to a temporary
+// file next to the cache first so a crash can't leave a half written cache behind
+func saveRPCPolicyCache(cacheFile, rpcPolicies string) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cacheFile), filepath.Base(cacheFile))
+	if err != nil {
+		log.Warning("Failed to write the RPC policy cache: ", err)
+		return
+	}
+	_, err = tmpFile.WriteString(rpcPolicies)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), cacheFile)
+	}
+	if err != nil {
+		log.Warning("Failed to write the RPC policy cache: ", err)
+		os.Remove(tmpFile.Name())
+	}
+}
+
+func loadRPCPolicyCache(cacheFile string) (map[string]Policy, error) {
+	f, err := os.Open(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRPCPolicyCacheOwner(info); err != nil {
+		return nil, err
+	}
+
+	cachedPolicies, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRPCPolicies(string(cachedPolicies))
+}
+
+// LoadPoliciesFromRPC loads the policies of an org from the RPC store, if RPC fails and
+// slave_options.policy_cache_file is set the last policies it returned are loaded from that file
+// so slaves keep working while the master is unavailable
+func LoadPoliciesFromRPC(orgId string) (map[string]Policy, error) {
+	rpcPolicies := GetPoliciesFromRPC(orgId)
+	cacheFile := config.SlaveOptions.PolicyCacheFile
+
+	policies, err := decodeRPCPolicies(rpcPolicies)
+	if err == nil {
+		if cacheFile != "" {
+			saveRPCPolicyCache(cacheFile, rpcPolicies)
+		}
+		return policies, nil
+	}
+	log.Error("Failed decode: ", err)
+
+	if cacheFile == "" {
+		return nil, err
+	}
+
+	policies, cacheErr := loadRPCPolicyCache(cacheFile)
+	if cacheErr != nil {
+		log.Error("Failed to load the RPC policy cache: ", cacheErr)
+		return nil, err
+	}
+
+	log.Warning("RPC policy source is unavailable, running from the cached policies in ", cacheFile)
+	return policies, nil
+}
+
+const defaultLazyPolicyCacheTTL = 60
+
+// LazyPolicyCache holds policies fetched on demand when policies.lazy_load is set,
+// including a marker for IDs the source did not know about
+var LazyPolicyCache *cache.Cache = cache.New(defaultLazyPolicyCacheTTL*time.Second, 30*time.Second)
+
+// policyNotFound is cached for IDs that the policy source doesn't have
+type policyNotFound struct{}
+
+// LoadPolicyFromSource fetches a single policy, it is swappable so the source can be stubbed
+var LoadPolicyFromSource = loadPolicyFromConfiguredSource
+
+func lazyPolicyCacheTTL() time.Duration {
+	ttl := config.Policies.LazyCacheTTL
+	if ttl <= 0 {
+		ttl = defaultLazyPolicyCacheTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func resetLazyPolicyCache() {
+	LazyPolicyCache = cache.New(lazyPolicyCacheTTL(), 30*time.Second)
+
+	lazyPolicyListMu.Lock()
+	lazyPolicyList = nil
+	lazyPolicyListMu.Unlock()
+}
+
+// lazyPolicyList is the last listing of a policy source that can't fetch a single policy (rpc and
+// file), misses for other IDs are answered from it until the lazy cache TTL is up. The lock is
+// held while the source is listed so that misses arriving together share one listing.
+var lazyPolicyList map[string]Policy
+var lazyPolicyListAt time.Time
+var lazyPolicyListMu sync.Mutex
+
+// listedPolicy picks a policy out of the listing of the source, list is only called once the
+// last listing has expired
+func listedPolicy(id string, list func() (map[string]Policy, error)) (Policy, bool, error) {
+	lazyPolicyListMu.Lock()
+	defer lazyPolicyListMu.Unlock()
+
+	if lazyPolicyList == nil || time.Since(lazyPolicyListAt) >= lazyPolicyCacheTTL() {
+		policies, err := list()
+		if err != nil {
+			return Policy{}, false, err
+		}
+		lazyPolicyList, lazyPolicyListAt = policies, time.Now()
+	}
+
+	policy, found := lazyPolicyList[id]
+	return policy, found, nil
+}
+
+// GetPolicy returns a loaded policy, in lazy mode a policy that isn't cached yet is
+// fetched from the policy source and kept until the lazy cache TTL expires
+func GetPolicy(id string) (Policy, bool) {
+	policiesMu.RLock()
+	policy, ok := Policies[id]
+	policiesMu.RUnlock()
+	if ok {
+		return policy, true
+	}
+
+	if !config.Policies.LazyLoad || id == "" {
+		return Policy{}, false
+	}
+
+	if cached, found := LazyPolicyCache.Get(id); found {
+		policy, ok := cached.(Policy)
+		return policy, ok
+	}
+
+	policy, found, err := LoadPolicyFromSource(id)
+	if err != nil {
+		// Don't cache source failures, the next request should try again
+		log.Error("Failed to fetch policy ", id, ": ", err)
+		return Policy{}, false
+	}
+
+	if !found {
+		log.Warning("Policy not found in source: ", id)
+		LazyPolicyCache.Set(id, policyNotFound{}, cache.DefaultExpiration)
+		return Policy{}, false
+	}
+
+	if policy.ID == "" {
+		policy.ID = id
+	}
+	if err := policy.parseLimits(); err != nil {
+		log.Error("Invalid policy limit: ", err)
+		return Policy{}, false
+	}
+
+	LazyPolicyCache.Set(id, policy, cache.DefaultExpiration)
+	return policy, true
+}
+
+func loadPolicyFromConfiguredSource(id string) (Policy, bool, error) {
+	switch config.Policies.PolicySource {
+	case "mongo":
+		return LoadPolicyFromMongo(config.Policies.PolicyRecordName, id)
+	case "rpc":
+		// The RPC layer can only list an org's policies, so pick the one we need out of the list.
+		// Unlike LoadPoliciesFromRPC this leaves the policy cache file alone, it is written when
+		// the policies are loaded.
+		return listedPolicy(id, func() (map[string]Policy, error) {
+			return decodeRPCPolicies(GetPoliciesFromRPC(config.SlaveOptions.RPCKey))
+		})
+	default:
+		return listedPolicy(id, func() (map[string]Policy, error) {
+			return LoadPoliciesFromFile(config.Policies.PolicyRecordName)
+		})
+	}
+}
+
+var policyDBSession *mgo.Session
+var policyDBSessionMu sync.Mutex
+
+// getPolicyDBSession returns a copy of the connection to the Mongo policy source, policies loaded
+// together and policies loaded lazily share it
+func getPolicyDBSession() (*mgo.Session, error) {
+	policyDBSessionMu.Lock()
+	defer policyDBSessionMu.Unlock()
+
+	if policyDBSession == nil {
+		dbSession, err := mgo.DialWithTimeout(config.AnalyticsConfig.MongoURL, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		policyDBSession = dbSession
+	}
+
+	return policyDBSession.Copy(), nil
+}
+
+// LoadPolicyFromMongo fetches a single active policy by ID, unlike LoadPoliciesFromMongo it
+// does not retry the connection as it is called while serving a request
+func LoadPolicyFromMongo(collectionName, id string) (Policy, bool, error) {
+	if !bson.IsObjectIdHex(id) {
+		return Policy{}, false, nil
+	}
+
+	dbSession, err := getPolicyDBSession()
+	if err != nil {
+		return Policy{}, false, err
+	}
+	defer dbSession.Close()
+
+	search := bson.M{
+		"_id":    bson.ObjectIdHex(id),
+		"active": true,
+	}
+
+	var policy Policy
+	err = dbSession.DB("").C(collectionName).Find(search).One(&policy)
+	if err == mgo.ErrNotFound {
+		return Policy{}, false, nil
+	}
+	if err != nil {
+		return Policy{}, false, err
+	}
+
+	policy.ID = policy.MID.Hex()
+	return policy, true, nil
 }
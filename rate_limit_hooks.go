@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// RateLimitDecision is returned by a RateLimitHook to let the limiter run or to short-circuit it
+type RateLimitDecision int
+
+const (
+	// RateLimitContinue lets the next hook (and then the limiter) decide
+	RateLimitContinue RateLimitDecision = iota
+	// RateLimitAllow lets the request through without it counting against the limiter
+	RateLimitAllow
+	// RateLimitBlock rejects the request as rate limited without consulting the limiter
+	RateLimitBlock
+)
+
+// RateLimitHook lets custom Go code take part in the rate limiting decision. Hooks are run in
+// the order they were registered:
+//
+// 1. BeforeRateLimit is called on each hook with the cost so far (starting at 1), the returned
+// cost is passed to the next hook and finally to the limiter, which counts the request cost
+// times. A cost of 0 or less lets the request through without counting it. The first hook to
+// return RateLimitAllow or RateLimitBlock stops the chain and the limiter is not run.
+//
+// 2. AfterRateLimit is then called on each hook with the decision (forward and the reason code
+// used by SessionLimiter), whatever it returns is passed on to the next hook and is final.
+//
+// A hook that panics is logged and skipped, it does not fail the request.
+type RateLimitHook interface {
+	BeforeRateLimit(r *http.Request, thisSessionState *SessionState, key string, cost int) (int, RateLimitDecision)
+	AfterRateLimit(r *http.Request, thisSessionState *SessionState, key string, forward bool, reason int) (bool, int)
+}
+
+var rateLimitHooks []RateLimitHook
+
+// RegisterRateLimitHook adds a hook to run around the rate limiter of every API, this should be
+// called before the gateway starts serving requests
+func RegisterRateLimitHook(hook RateLimitHook) {
+	rateLimitHooks = append(rateLimitHooks, hook)
+}
+
+func logRateLimitHookPanic(r *http.Request, stage string, err interface{}) {
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": r.RemoteAddr,
+		"stage":  stage,
+	}).Error("Rate limit hook panicked, skipping it: ", err)
+}
+
+func callBeforeRateLimitHook(hook RateLimitHook, r *http.Request, thisSessionState *SessionState, key string, cost int) (newCost int, decision RateLimitDecision) {
+	defer func() {
+		if err := recover(); err != nil {
+			logRateLimitHookPanic(r, "before", err)
+			newCost, decision = cost, RateLimitContinue
+		}
+	}()
+
+	return hook.BeforeRateLimit(r, thisSessionState, key, cost)
+}
+
+func callAfterRateLimitHook(hook RateLimitHook, r *http.Request, thisSessionState *SessionState, key string, forward bool, reason int) (newForward bool, newReason int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logRateLimitHookPanic(r, "after", err)
+			newForward, newReason = forward, reason
+		}
+	}()
+
+	return hook.AfterRateLimit(r, thisSessionState, key, forward, reason)
+}
+
+// runBeforeRateLimitHooks returns the cost of the request and whether a hook short-circuited the limiter
+func runBeforeRateLimitHooks(r *http.Request, thisSessionState *SessionState, key string) (int, RateLimitDecision) {
+	cost := 1
+	for _, hook := range rateLimitHooks {
+		var decision RateLimitDecision
+		cost, decision = callBeforeRateLimitHook(hook, r, thisSessionState, key, cost)
+		if decision != RateLimitContinue {
+			return cost, decision
+		}
+	}
+
+	return cost, RateLimitContinue
+}
+
+// runAfterRateLimitHooks gives every hook the chance to override the limiter decision
+func runAfterRateLimitHooks(r *http.Request, thisSessionState *SessionState, key string, forward bool, reason int) (bool, int) {
+	for _, hook := range rateLimitHooks {
+		forward, reason = callAfterRateLimitHook(hook, r, thisSessionState, key, forward, reason)
+	}
+
+	return forward, reason
+}
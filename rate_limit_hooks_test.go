@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testRateLimitHook struct {
+	before func(r *http.Request, cost int) (int, RateLimitDecision)
+	after  func(forward bool, reason int) (bool, int)
+}
+
+func (h testRateLimitHook) BeforeRateLimit(r *http.Request, thisSessionState *SessionState, key string, cost int) (int, RateLimitDecision) {
+	if h.before == nil {
+		return cost, RateLimitContinue
+	}
+	return h.before(r, cost)
+}
+
+func (h testRateLimitHook) AfterRateLimit(r *http.Request, thisSessionState *SessionState, key string, forward bool, reason int) (bool, int) {
+	if h.after == nil {
+		return forward, reason
+	}
+	return h.after(forward, reason)
+}
+
+func doRateLimitHookRequests(t *testing.T, thisSession SessionState, count int) []int {
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, thisSession, 60)
+	chain := getChain(spec)
+
+	codes := []int{}
+	for i := 0; i < count; i++ {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+		codes = append(codes, recorder.Code)
+	}
+
+	return codes
+}
+
+func TestRateLimitHookShortCircuit(t *testing.T) {
+	defer func() { rateLimitHooks = nil }()
+	RegisterRateLimitHook(testRateLimitHook{before: func(r *http.Request, cost int) (int, RateLimitDecision) {
+		return cost, RateLimitBlock
+	}})
+
+	codes := doRateLimitHookRequests(t, createNonThrottledSession(), 1)
+	if codes[0] != 429 {
+		t.Error("Blocking hook should return 429, got: ", codes[0])
+	}
+}
+
+func TestRateLimitHookCost(t *testing.T) {
+	defer func() { rateLimitHooks = nil }()
+	RegisterRateLimitHook(testRateLimitHook{before: func(r *http.Request, cost int) (int, RateLimitDecision) {
+		return cost * 2, RateLimitContinue
+	}})
+
+	// Quota of 2, each request costs 2
+	codes := doRateLimitHookRequests(t, createQuotaSession(), 2)
+	if codes[0] != 200 {
+		t.Error("First request should go through, got: ", codes[0])
+	}
+	if codes[1] != 403 {
+		t.Error("Second request should exceed the quota, got: ", codes[1])
+	}
+}
+
+func TestRateLimitHookPanic(t *testing.T) {
+	defer func() { rateLimitHooks = nil }()
+	RegisterRateLimitHook(testRateLimitHook{
+		before: func(r *http.Request, cost int) (int, RateLimitDecision) {
+			panic("before hook failure")
+		},
+		after: func(forward bool, reason int) (bool, int) {
+			panic("after hook failure")
+		},
+	})
+
+	codes := doRateLimitHookRequests(t, createNonThrottledSession(), 1)
+	if codes[0] != 200 {
+		t.Error("Panicking hooks should be skipped, got: ", codes[0])
+	}
+}
+
+func TestRateLimitCostIsChargedOnceAndRolledBack(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	store := spec.SessionManager.GetStore()
+
+	for _, rolling := range []bool{false, true} {
+		thisSession := createQuotaSession()
+		thisSession.Rate, thisSession.Per = 10, 60
+		thisSession.QuotaMax, thisSession.QuotaRemaining = 5, 5
+		thisSession.QuotaRolling = rolling
+		keyId := randSeq(10)
+
+		for _, tc := range []struct {
+			cost      int
+			forward   bool
+			reason    int
+			rateCount int
+		}{
+			{3, true, 0, 3},
+			// Over the quota, nothing of it is kept
+			{3, false, 2, 3},
+			{2, true, 0, 5},
+			// Over the rate limit, nothing of it is kept
+			{6, false, 1, 5},
+		} {
+			forward, reason, rateCount, _ := sessionLimiter.ForwardMessageAndCount(&thisSession, keyId, store, tc.cost)
+			if forward != tc.forward || reason != tc.reason || rateCount != tc.rateCount {
+				t.Errorf("Rolling quota %v, cost %v: expected %v %v %v, got %v %v %v", rolling, tc.cost, tc.forward, tc.reason, tc.rateCount, forward, reason, rateCount)
+			}
+		}
+
+		if thisSession.QuotaRemaining != 0 {
+			t.Errorf("Rolling quota %v: expected the quota to be used up by the forwarded requests, %v left", rolling, thisSession.QuotaRemaining)
+		}
+		if !rolling {
+			if used, _ := store.GetRawKey(quotaKeyForSession(keyId, &thisSession)); used != "5" {
+				t.Error("Refused requests should not be left on the quota counter, got: ", used)
+			}
+		}
+	}
+}
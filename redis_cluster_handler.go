@@ -213,17 +213,35 @@ func (r *RedisClusterStorageManager) SetRawKey(keyName string, sessionState stri
 	return nil
 }
 
-// Decrement will decrement a key in redis
+// Decrement will decrement a raw key in redis, it is the counterpart of IncrememntWithExpire
 func (r *RedisClusterStorageManager) Decrement(keyName string) {
 
-	keyName = r.fixKey(keyName)
-	log.Debug("Decrementing key: ", keyName)
+	log.Debug("Decrementing raw key: ", keyName)
 	if r.db == nil {
 		log.Info("Connection dropped, connecting..")
 		r.Connect()
 		r.Decrement(keyName)
 	} else {
-		err := r.db.Send("DECR", keyName)
+		// This function uses a raw key, so we shouldn't call fixKey
+		_, err := r.db.Do("DECR", keyName)
+
+		if err != nil {
+			log.Error("Error trying to decrement value:", err)
+		}
+	}
+}
+
+// DecrementBy will decrease a raw key in redis by a number, it is the counterpart of IncrementByWithExpire
+func (r *RedisClusterStorageManager) DecrementBy(keyName string, by int64) {
+
+	log.Debug("Decrementing raw key: ", keyName, " by ", by)
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		r.DecrementBy(keyName, by)
+	} else {
+		// This function uses a raw key, so we shouldn't call fixKey
+		_, err := r.db.Do("DECRBY", keyName, by)
 
 		if err != nil {
 			log.Error("Error trying to decrement value:", err)
@@ -231,6 +249,31 @@ func (r *RedisClusterStorageManager) Decrement(keyName string) {
 	}
 }
 
+// IncrementByWithExpire will increase a key in redis by a number in one command, the expiry is
+// set if the key was created by it
+func (r *RedisClusterStorageManager) IncrementByWithExpire(keyName string, by int64, expire int64) int64 {
+
+	log.Debug("Incrementing raw key: ", keyName, " by ", by)
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.IncrementByWithExpire(keyName, by, expire)
+	}
+
+	// This function uses a raw key, so we shouldn't call fixKey
+	val, err := redis.Int64(r.db.Do("INCRBY", keyName, by))
+	if err != nil {
+		log.Error("Error trying to increment value:", err)
+		return 0
+	}
+	log.Debug("Incremented key: ", keyName, ", val is: ", val)
+	if val == by {
+		log.Debug("--> Setting Expire")
+		r.db.Do("EXPIRE", keyName, expire)
+	}
+	return val
+}
+
 // IncrementWithExpire will increment a key in redis
 func (r *RedisClusterStorageManager) IncrememntWithExpire(keyName string, expire int64) int64 {
 
@@ -525,23 +568,22 @@ func (r *RedisClusterStorageManager) GetAndDeleteSet(keyName string) []interface
 	return []interface{}{}
 }
 
-func (r *RedisClusterStorageManager) AppendToSet(keyName string, value string) {
+func (r *RedisClusterStorageManager) AppendToSet(keyName string, value string) error {
 	log.Debug("Pushing to raw key list: ", keyName)
 	log.Debug("Appending to fixed key list: ", r.fixKey(keyName))
 	if r.db == nil {
 		log.Warning("Connection dropped, connecting..")
 		r.Connect()
-		r.AppendToSet(keyName, value)
-	} else {
-		_, err := r.db.Do("RPUSH", r.fixKey(keyName), value)
-
-		if err != nil {
-			log.Error("Error trying to delete keys:")
-			log.Error(err)
-		}
+		return r.AppendToSet(keyName, value)
+	}
 
-		return
+	_, err := r.db.Do("RPUSH", r.fixKey(keyName), value)
+	if err != nil {
+		log.Error("Error trying to append to set:")
+		log.Error(err)
 	}
+
+	return err
 }
 
 func (r *RedisClusterStorageManager) GetSet(keyName string) (map[string]string, error) {
@@ -608,6 +650,70 @@ func (r *RedisClusterStorageManager) RemoveFromSet(keyName string, value string)
 	}
 }
 
+// RemoveFromRollingWindow takes entries added with SetRollingWindow or AddToRollingWindow out of
+// the window again
+func (r *RedisClusterStorageManager) RemoveFromRollingWindow(keyName string, values ...string) {
+	if r.db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		r.RemoveFromRollingWindow(keyName, values...)
+	} else {
+		args := []interface{}{keyName}
+		for _, value := range values {
+			args = append(args, value)
+		}
+		if _, err := r.db.Do("ZREM", args...); err != nil {
+			log.Error("Error trying to remove from rolling window: ", err)
+		}
+	}
+}
+
+// removesRollingWindowEntries is true, RemoveFromRollingWindow takes the entries out with ZREM
+func (r *RedisClusterStorageManager) removesRollingWindowEntries() bool {
+	return true
+}
+
+// AddToRollingWindow is SetRollingWindow for several entries, which are added in the same
+// transaction. The window is returned as it was before they were added.
+func (r *RedisClusterStorageManager) AddToRollingWindow(keyName string, per int64, values []string) (int, []interface{}) {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.AddToRollingWindow(keyName, per, values)
+	}
+
+	now := time.Now()
+	onePeriodAgo := now.Add(time.Duration(-1*per) * time.Second)
+
+	ZREMRANGEBYSCORE := rediscluster.ClusterTransaction{}
+	ZREMRANGEBYSCORE.Cmd = "ZREMRANGEBYSCORE"
+	ZREMRANGEBYSCORE.Args = []interface{}{keyName, "-inf", onePeriodAgo.UnixNano()}
+
+	ZRANGE := rediscluster.ClusterTransaction{}
+	ZRANGE.Cmd = "ZRANGE"
+	ZRANGE.Args = []interface{}{keyName, 0, -1}
+
+	ZADD := rediscluster.ClusterTransaction{}
+	ZADD.Cmd = "ZADD"
+	ZADD.Args = []interface{}{keyName}
+	for _, value := range values {
+		ZADD.Args = append(ZADD.Args, now.UnixNano(), value)
+	}
+
+	EXPIRE := rediscluster.ClusterTransaction{}
+	EXPIRE.Cmd = "EXPIRE"
+	EXPIRE.Args = []interface{}{keyName, per}
+
+	redVal, err := redis.Values(r.db.DoTransaction([]rediscluster.ClusterTransaction{ZREMRANGEBYSCORE, ZRANGE, ZADD, EXPIRE}))
+	if err != nil || len(redVal) < 2 {
+		log.Error("Multi command failed: ", err)
+		return 0, []interface{}{}
+	}
+
+	window := redVal[1].([]interface{})
+	return len(window), window
+}
+
 // SetRollingWindow will append to a sorted set in redis and extract a timed window of values
 func (r *RedisClusterStorageManager) SetRollingWindow(keyName string, per int64, value_override string) (int, []interface{}) {
 
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// RequestCounters are live totals of the requests an API has handled since the process started.
+// Total counts every request that got a response, Allowed and Rejected are the decisions of the
+// rate limiter and quota check.
+type RequestCounters struct {
+	Total    int64 `json:"total"`
+	Allowed  int64 `json:"allowed"`
+	Rejected int64 `json:"rejected"`
+}
+
+var requestCountersLock sync.RWMutex
+var requestCounters = make(map[string]*RequestCounters)
+
+// countersForAPI returns the counters of an API, creating them on its first request
+func countersForAPI(apiID string) *RequestCounters {
+	requestCountersLock.RLock()
+	counters, found := requestCounters[apiID]
+	requestCountersLock.RUnlock()
+	if found {
+		return counters
+	}
+
+	requestCountersLock.Lock()
+	defer requestCountersLock.Unlock()
+	if counters, found = requestCounters[apiID]; !found {
+		counters = &RequestCounters{}
+		requestCounters[apiID] = counters
+	}
+
+	return counters
+}
+
+// countRequest adds a request that got a response to the total of the API
+func countRequest(apiID string) {
+	atomic.AddInt64(&countersForAPI(apiID).Total, 1)
+}
+
+// countRateLimitDecision adds a request that the rate limiter let through or refused
+func countRateLimitDecision(apiID string, allowed bool) {
+	counters := countersForAPI(apiID)
+	if allowed {
+		atomic.AddInt64(&counters.Allowed, 1)
+	} else {
+		atomic.AddInt64(&counters.Rejected, 1)
+	}
+}
+
+// RequestCountersSnapshot copies the counters of every API that has had a request, keyed by API ID
+func RequestCountersSnapshot() map[string]RequestCounters {
+	requestCountersLock.RLock()
+	defer requestCountersLock.RUnlock()
+
+	snapshot := make(map[string]RequestCounters, len(requestCounters))
+	for apiID, counters := range requestCounters {
+		snapshot[apiID] = RequestCounters{
+			Total:    atomic.LoadInt64(&counters.Total),
+			Allowed:  atomic.LoadInt64(&counters.Allowed),
+			Rejected: atomic.LoadInt64(&counters.Rejected),
+		}
+	}
+
+	return snapshot
+}
+
+// requestCountersHandler returns the request counters of this node, they are kept in memory and
+// start again from zero when the process restarts. Pass api_id to get the counters of one API.
+func requestCountersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	snapshot := RequestCountersSnapshot()
+	var responseMessage []byte
+	var err error
+	if APIID := r.FormValue("api_id"); APIID != "" {
+		responseMessage, err = json.Marshal(snapshot[APIID])
+	} else {
+		responseMessage, err = json.Marshal(snapshot)
+	}
+	if err != nil {
+		DoJSONWrite(w, 500, createError("Failed to encode data"))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
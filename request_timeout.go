@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestTimeout limits how long a request can take end to end, including the gateway middleware,
+// to the API's request_timeout (in milliseconds). This is separate from the hard timeouts set for
+// upstream calls, a request that runs out of time gets a 504 while an upstream timeout is a 408.
+// Like http.TimeoutHandler the timeout only applies until the response has started, the response
+// is passed straight through so that streamed responses aren't held back.
+func RequestTimeout(tykMiddleware *TykMiddleware, handler http.Handler) http.Handler {
+	if tykMiddleware.Spec.Options.RequestTimeout <= 0 {
+		return handler
+	}
+
+	return &requestTimeoutHandler{
+		TykMiddleware: tykMiddleware,
+		handler:       handler,
+		timeout:       time.Duration(tykMiddleware.Spec.Options.RequestTimeout) * time.Millisecond,
+	}
+}
+
+type requestTimeoutHandler struct {
+	*TykMiddleware
+	handler http.Handler
+	timeout time.Duration
+}
+
+// timeoutErrorRequest copies what the error handler reads from a request, the chain keeps using
+// the request itself after a timeout so it can't be shared
+func timeoutErrorRequest(r *http.Request) *http.Request {
+	errReq := new(http.Request)
+	*errReq = *r
+	errURL := *r.URL
+	errReq.URL = &errURL
+	errReq.Header = make(http.Header, len(r.Header))
+	copyHeader(errReq.Header, r.Header)
+	errReq.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	return errReq
+}
+
+func (h *requestTimeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	errReq := timeoutErrorRequest(r)
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+
+	tw := &timeoutWriter{w: w, header: make(http.Header)}
+	done := make(chan struct{})
+	panicChan := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- p
+			}
+		}()
+		h.handler.ServeHTTP(tw, r)
+		close(done)
+	}()
+
+	select {
+	case p := <-panicChan:
+		panic(p)
+	case <-done:
+		tw.finish()
+	case <-timer.C:
+		tw.mu.Lock()
+		if tw.wroteHeader {
+			// The response has started, it can't be replaced with an error any more
+			tw.mu.Unlock()
+			select {
+			case p := <-panicChan:
+				panic(p)
+			case <-done:
+				tw.finish()
+			}
+			return
+		}
+		tw.timedOut = true
+		tw.mu.Unlock()
+
+		log.WithFields(logrus.Fields{
+			"path":    errReq.URL.Path,
+			"origin":  errReq.RemoteAddr,
+			"api_id":  h.Spec.APIID,
+			"timeout": "request",
+		}).Warning("Request timeout reached after ", h.timeout)
+
+		ErrorHandler{h.TykMiddleware}.HandleError(w, errReq, "Request timeout reached", 504)
+	}
+}
+
+// timeoutWriter passes the response of the chain through to the client until the request times
+// out, from then on the chain can't write anything. The chain gets a header map of its own that is
+// copied when the response starts, so a timeout never shares one with it.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	mu          sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	copyHeader(tw.w.Header(), tw.header)
+	tw.w.WriteHeader(code)
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(200)
+	}
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+// Flush sends what has been written so far, e.g. the events of a streamed response
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(200)
+	}
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the chain, e.g. for a websocket, the request can't time
+// out after that
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	hijacker, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	tw.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+func (tw *timeoutWriter) CloseNotify() <-chan bool {
+	if notifier, ok := tw.w.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// finish completes the response once the chain has returned, the values of trailers are set on
+// the header after the response has started so they are copied again
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(200)
+		return
+	}
+	for _, trailers := range tw.header["Trailer"] {
+		for _, trailer := range strings.Split(trailers, ",") {
+			key := http.CanonicalHeaderKey(strings.TrimSpace(trailer))
+			tw.w.Header()[key] = tw.header[key]
+		}
+	}
+}
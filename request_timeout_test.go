@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createRequestTimeoutSpec(requestTimeout int, upstreamTimeout int) APISpec {
+	def := strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "request_timeout": `+strconv.Itoa(requestTimeout)+`,`, 1)
+	if upstreamTimeout > 0 {
+		def = strings.Replace(def, `"expires": "3000-01-02 15:04",`, `"expires": "3000-01-02 15:04",
+					"use_extended_paths": true,
+					"extended_paths": {
+						"hard_timeouts": [{"path": "slow", "method": "GET", "timeout": `+strconv.Itoa(upstreamTimeout)+`}]
+					},`, 1)
+	}
+	spec := createDefinitionFromString(def)
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	return spec
+}
+
+func slowUpstream(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("done"))
+	}))
+}
+
+func TestRequestTimeoutSlowMiddleware(t *testing.T) {
+	spec := createRequestTimeoutSpec(50, 0)
+	tykMiddleware := &TykMiddleware{&spec, nil}
+
+	for _, tc := range []struct {
+		delay time.Duration
+		code  int
+	}{
+		{0, 201},
+		{200 * time.Millisecond, 504},
+	} {
+		handler := RequestTimeout(tykMiddleware, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(tc.delay)
+			w.Header().Set("X-Slow-Middleware", "done")
+			w.WriteHeader(201)
+		}))
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("Delay %v: expected %v, got %v", tc.delay, tc.code, recorder.Code)
+		}
+		if tc.code == 504 && recorder.HeaderMap.Get("X-Slow-Middleware") != "" {
+			t.Error("Headers of a timed out chain should not be sent")
+		}
+	}
+}
+
+func TestRequestTimeoutStreamedResponse(t *testing.T) {
+	spec := createRequestTimeoutSpec(50, 0)
+	handler := RequestTimeout(&TykMiddleware{&spec, nil}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		// The response has started, so running past the timeout doesn't cut it off
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("second"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 || recorder.Body.String() != "first second" {
+		t.Errorf("Expected the whole streamed response, got %v: %v", recorder.Code, recorder.Body.String())
+	}
+	if !recorder.Flushed {
+		t.Error("Flushes of the chain should reach the client")
+	}
+	if got := recorder.HeaderMap.Get("X-Checksum"); got != "abc" {
+		t.Error("Expected the trailer to be passed through, got: ", got)
+	}
+}
+
+func TestRequestTimeoutSlowUpstream(t *testing.T) {
+	upstream := slowUpstream(1500 * time.Millisecond)
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name            string
+		requestTimeout  int
+		upstreamTimeout int
+		code            int
+	}{
+		{"request timeout", 100, 0, 504},
+		{"upstream timeout", 3000, 1, 408},
+	} {
+		spec := createRequestTimeoutSpec(tc.requestTimeout, tc.upstreamTimeout)
+		spec.Proxy.TargetURL = upstream.URL
+		chain := getChain(spec)
+
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/slow", nil)
+		req.Header.Add("authorization", keyId)
+		RequestTimeout(&TykMiddleware{&spec, nil}, chain).ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.code {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.code, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	RESPONSE_HEADER_API_ID          string = "$tyk_api_id"
+	RESPONSE_HEADER_API_VERSION     string = "$tyk_api_version"
+	RESPONSE_HEADER_UPSTREAM_TARGET string = "$tyk_upstream_target"
+)
+
+// ResponseHeaderOptions is a header added to every successfully proxied response of an API, the
+// value may use $tyk_api_id, $tyk_api_version and $tyk_upstream_target
+type ResponseHeaderOptions struct {
+	Name  string `mapstructure:"name" bson:"name" json:"name"`
+	Value string `mapstructure:"value" bson:"value" json:"value"`
+	// Override replaces a header of the same name sent by the upstream, by default the upstream value is kept
+	Override bool `mapstructure:"override" bson:"override" json:"override"`
+}
+
+// injectResponseHeaders adds the response_headers of an API to an upstream response
+func injectResponseHeaders(spec *APISpec, req *http.Request, res *http.Response) {
+	if spec == nil || len(spec.Options.ResponseHeaders) == 0 {
+		return
+	}
+
+	version := spec.getVersionFromRequest(req)
+	if version == "" {
+		version = "Non Versioned"
+	}
+
+	target := spec.Proxy.TargetURL
+	if res.Request != nil && res.Request.URL != nil {
+		target = res.Request.URL.Scheme + "://" + res.Request.URL.Host
+	}
+
+	replacer := strings.NewReplacer(
+		RESPONSE_HEADER_API_ID, spec.APIID,
+		RESPONSE_HEADER_API_VERSION, version,
+		RESPONSE_HEADER_UPSTREAM_TARGET, target,
+	)
+
+	for _, header := range spec.Options.ResponseHeaders {
+		if !header.Override && res.Header.Get(header.Name) != "" {
+			continue
+		}
+		res.Header.Set(header.Name, replacer.Replace(header.Value))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseHeaderInjection(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "upstream")
+		w.Header().Set("X-Cache-Status", "upstream")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	responseHeaders := `"response_headers": [
+		{"name": "X-Served-By", "value": "tyk"},
+		{"name": "X-Cache-Status", "value": "MISS", "override": true},
+		{"name": "X-API", "value": "$tyk_api_id/$tyk_api_version"},
+		{"name": "X-Upstream", "value": "$tyk_upstream_target"}
+	],`
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", `+responseHeaders, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatal("Expected 200, got ", recorder.Code)
+	}
+
+	expected := map[string]string{
+		"X-Served-By":    "upstream",
+		"X-Cache-Status": "MISS",
+		"X-API":          "1/Non Versioned",
+		"X-Upstream":     upstream.URL,
+	}
+	for name, value := range expected {
+		if got := recorder.HeaderMap[http.CanonicalHeaderKey(name)]; len(got) != 1 || got[0] != value {
+			t.Errorf("%v: expected %v, got %v", name, value, got)
+		}
+	}
+
+	// Responses from the gateway itself don't get the headers
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", "not-a-key")
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.HeaderMap.Get("X-API") != "" {
+		t.Error("Error responses should not have response headers injected")
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -148,3 +151,54 @@ func TestRewriterWithMissingAgain(t *testing.T) {
 		t.Error("Transform failed, expected: %v, got: %v ", expected, val)
 	}
 }
+
+func TestUpstreamRewrites(t *testing.T) {
+	upstreamURIs := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamURIs <- r.URL.RequestURI()
+	}))
+	defer upstream.Close()
+
+	rewrites := `"upstream_rewrites": [
+		{"match_pattern": "^/v1/(users", "rewrite_to": "/broken"},
+		{"match_pattern": "^/v1/users/(\\d+)$", "rewrite_to": "/internal/user?id=$1"},
+		{"match_pattern": "^/v1/orders/(\\w+)/items/(\\d+)", "rewrite_to": "/orders/$1/$2"},
+		{"match_pattern": "^/v1/users/(\\w+)$", "rewrite_to": "/people/$1"}
+	],`
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", `+rewrites, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	chain := getChain(spec)
+
+	// The invalid pattern is dropped when the API is loaded
+	if len(spec.Options.UpstreamRewrites) != 3 {
+		t.Fatal("Expected the invalid rewrite to be skipped, got: ", spec.Options.UpstreamRewrites)
+	}
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{"/v1/users/42", "/internal/user?id=42"},
+		{"/v1/users/7?verbose=1", "/internal/user?id=7&verbose=1"},
+		{"/v1/orders/abc/items/3", "/orders/abc/3"},
+		{"/v1/users/bob", "/people/bob"},
+		{"/v1/health", "/v1/health"},
+		{"/v1/users/42/avatar", "/v1/users/42/avatar"},
+	} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 {
+			t.Errorf("%v: expected 200, got %v", tc.path, recorder.Code)
+			continue
+		}
+		if got := <-upstreamURIs; got != tc.expected {
+			t.Errorf("%v: expected upstream path %v, got %v", tc.path, tc.expected, got)
+		}
+	}
+}
@@ -235,9 +235,9 @@ func (r *RPCStorageHandler) SetRawKey(keyName string, sessionState string, timeo
 	return nil
 }
 
-// Decrement will decrement a key in redis
+// Decrement will decrement a raw key in redis, like IncrememntWithExpire the key is sent as it is
 func (r *RPCStorageHandler) Decrement(keyName string) {
-	log.Warning("Decrement called")
+	log.Debug("Decrementing raw key: ", keyName)
 	_, err := r.Client.Call("Decrement", keyName)
 	if r.IsAccessError(err) {
 		r.Login()
@@ -246,6 +246,24 @@ func (r *RPCStorageHandler) Decrement(keyName string) {
 	}
 }
 
+// DecrementBy decreases a raw key by a number, there is no RPC call for it so the key is
+// decremented that many times
+func (r *RPCStorageHandler) DecrementBy(keyName string, by int64) {
+	for i := int64(0); i < by; i++ {
+		r.Decrement(keyName)
+	}
+}
+
+// IncrementByWithExpire increases a key by a number, there is no RPC call for it so the key is
+// incremented that many times and the count is not taken in one step
+func (r *RPCStorageHandler) IncrementByWithExpire(keyName string, by int64, expire int64) int64 {
+	var val int64
+	for i := int64(0); i < by; i++ {
+		val = r.IncrememntWithExpire(keyName, expire)
+	}
+	return val
+}
+
 // IncrementWithExpire will increment a key in redis
 func (r *RPCStorageHandler) IncrememntWithExpire(keyName string, expire int64) int64 {
 
@@ -428,6 +446,24 @@ func (r *RPCStorageHandler) SetRollingWindow(keyName string, per int64, val stri
 
 }
 
+// AddToRollingWindow adds several requests to the rolling window, there is no RPC call for it so
+// they are added one at a time and the window before the first is returned
+func (r *RPCStorageHandler) AddToRollingWindow(keyName string, per int64, values []string) (int, []interface{}) {
+	var firstCount int
+	var firstWindow []interface{}
+	for i, value := range values {
+		count, window := r.SetRollingWindow(keyName, per, value)
+		if i == 0 {
+			firstCount, firstWindow = count, window
+		}
+	}
+	return firstCount, firstWindow
+}
+
+func (r RPCStorageHandler) RemoveFromRollingWindow(keyName string, values ...string) {
+	log.Error("Not implemented")
+}
+
 func (r RPCStorageHandler) GetSet(keyName string) (map[string]string, error) {
 	log.Error("Not implemented")
 	return map[string]string{}, nil
@@ -479,9 +515,11 @@ func (r *RPCStorageHandler) GetPolicies(orgId string) string {
 			r.Login()
 			return r.GetPolicies(orgId)
 		}
+		log.Error("Failed to fetch policies from RPC: ", err)
 	}
 
-	return defString.(string)
+	policies, _ := defString.(string)
+	return policies
 
 }
 
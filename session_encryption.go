@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+// encryptedSecretPrefix marks a JWT secret that is stored encrypted, secrets without it are
+// legacy plaintext values and are encrypted the next time the session is saved
+const encryptedSecretPrefix = "enc:"
+
+var errNoSecretEncryptionKey = errors.New("JWT secret is encrypted but no jwt_secret_encryption_key is set")
+
+// secretEncryptionCipher returns the AES-GCM cipher for jwt_secret_encryption_key, or nil if
+// encryption isn't enabled. The configured key is hashed to get a 256 bit AES key.
+func secretEncryptionCipher() (cipher.AEAD, error) {
+	if config.JWTSecretEncryptionKey == "" {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(config.JWTSecretEncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSessionSecrets encrypts the JWT secret of a session before it is stored
+func encryptSessionSecrets(session *SessionState) error {
+	secret := session.JWTData.Secret
+	if secret == "" || strings.HasPrefix(secret, encryptedSecretPrefix) {
+		return nil
+	}
+
+	gcm, err := secretEncryptionCipher()
+	if err != nil || gcm == nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	session.JWTData.Secret = encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// decryptSessionSecrets decrypts the JWT secret of a session read from the store, legacy
+// plaintext secrets are left as they are
+func decryptSessionSecrets(session *SessionState) error {
+	secret := session.JWTData.Secret
+	if !strings.HasPrefix(secret, encryptedSecretPrefix) {
+		return nil
+	}
+
+	gcm, err := secretEncryptionCipher()
+	if err != nil {
+		return err
+	}
+	if gcm == nil {
+		return errNoSecretEncryptionKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, encryptedSecretPrefix))
+	if err != nil {
+		return err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return errors.New("encrypted JWT secret is too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return errors.New("JWT secret could not be decrypted")
+	}
+
+	session.JWTData.Secret = string(plain)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestJWTSecretEncryptedAtRest(t *testing.T) {
+	config.JWTSecretEncryptionKey = "at-rest-test-key"
+	defer func() { config.JWTSecretEncryptionKey = "" }()
+
+	spec := createDefinitionFromString(jwtDef)
+	spec.JWTSigningMethod = "hmac"
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createJWTSession(), 60)
+
+	rawSession, _ := spec.SessionManager.GetStore().GetKey(keyId)
+	if strings.Contains(rawSession, JWTSECRET) || !strings.Contains(rawSession, encryptedSecretPrefix) {
+		t.Fatal("JWT secret should be stored encrypted, got: ", rawSession)
+	}
+
+	session, found := spec.SessionManager.GetSessionDetail(keyId)
+	if !found || session.JWTData.Secret != JWTSECRET {
+		t.Fatal("JWT secret should be decrypted when the session is read")
+	}
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Header["kid"] = keyId
+	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	tokenString, _ := token.SignedString([]byte(JWTSECRET))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/jwt_test/", nil)
+	req.Header.Add("authorization", tokenString)
+	getJWTChain(spec).ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Error("Token signed with the encrypted secret should be accepted, got ", recorder.Code)
+	}
+
+	// A different key can't decrypt the secret, the session is unusable rather than exposed
+	config.JWTSecretEncryptionKey = "another-key"
+	if _, found := spec.SessionManager.GetSessionDetail(keyId); found {
+		t.Error("Session should not load with the wrong encryption key")
+	}
+}
+
+func TestJWTSecretLegacyPlaintext(t *testing.T) {
+	config.JWTSecretEncryptionKey = "at-rest-test-key"
+	defer func() { config.JWTSecretEncryptionKey = "" }()
+
+	spec := createDefinitionFromString(jwtDef)
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+
+	// Written before encryption was turned on
+	keyId := randSeq(10)
+	legacy, _ := json.Marshal(createJWTSession())
+	spec.SessionManager.GetStore().SetKey(keyId, string(legacy), 60)
+
+	session, found := spec.SessionManager.GetSessionDetail(keyId)
+	if !found || session.JWTData.Secret != JWTSECRET {
+		t.Fatal("Legacy plaintext secrets should still be readable")
+	}
+
+	// Saving the session migrates it
+	spec.SessionManager.UpdateSession(keyId, session, 60)
+	rawSession, _ := spec.SessionManager.GetStore().GetKey(keyId)
+	if strings.Contains(rawSession, JWTSECRET) {
+		t.Error("Secret should be encrypted once the session is saved again")
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/nu7hatch/gouuid"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,7 +42,9 @@ type SessionState struct {
 	QuotaMax         int64                       `json:"quota_max"`
 	QuotaRenews      int64                       `json:"quota_renews"`
 	QuotaRemaining   int64                       `json:"quota_remaining"`
+	QuotaUsed        int64                       `json:"quota_used"`
 	QuotaRenewalRate int64                       `json:"quota_renewal_rate"`
+	QuotaRolling     bool                        `json:"quota_rolling"`
 	AccessRights     map[string]AccessDefinition `json:"access_rights"`
 	OrgID            string                      `json:"org_id"`
 	OauthClientID    string                      `json:"oauth_client_id"`
@@ -44,19 +53,29 @@ type SessionState struct {
 		Password string   `json:"password"`
 		Hash     HashType `json:"hash_type"`
 	} `json:"basic_auth_data"`
+	Alias   string `json:"alias"`
 	JWTData struct {
-		Secret string `json:"secret"`
+		Secret  string `json:"secret"`
+		Virtual bool   `json:"virtual"`
 	} `json:"jwt_data"`
-	HMACEnabled   bool   `json:"hmac_enabled"`
-	HmacSecret    string `json:"hmac_string"`
-	IsInactive    bool   `json:"is_inactive"`
-	ApplyPolicyID string `json:"apply_policy_id"`
-	DataExpires   int64  `json:"data_expires"`
-	Monitor       struct {
+	HMACEnabled        bool     `json:"hmac_enabled"`
+	HmacSecret         string   `json:"hmac_string"`
+	IsInactive         bool     `json:"is_inactive"`
+	ApplyPolicyID      string   `json:"apply_policy_id"`
+	ApplyPolicyIDs     []string `json:"apply_policy_ids"`
+	ApplyPolicyVersion int      `json:"apply_policy_version"`
+	DataExpires        int64    `json:"data_expires"`
+	Monitor            struct {
 		TriggerLimits []float64 `json:"trigger_limits"`
 	} `json:"monitor"`
-	MetaData interface{} `json:"meta_data"`
-	Tags     []string    `json:"tags"`
+	MetaData              interface{}       `json:"meta_data"`
+	Tags                  []string          `json:"tags"`
+	SharedQuotaGroup      string            `json:"shared_quota_group"`
+	QuotaGrace            int64             `json:"quota_grace"`
+	QuotaGracePercent     float64           `json:"quota_grace_percent"`
+	PolicyPerAPI          map[string]string `json:"policy_per_api"`
+	MaxConcurrentRequests int64             `json:"max_concurrent_requests"`
+	DateCreated           int64             `json:"date_created"`
 }
 
 type PublicSessionState struct {
@@ -72,15 +91,28 @@ type PublicSessionState struct {
 }
 
 const (
-	QuotaKeyPrefix     string = "quota-"
-	RateLimitKeyPrefix string = "rate-limit-"
+	QuotaKeyPrefix      string = "quota-"
+	QuotaGroupKeyPrefix string = "quota-group-"
+	QuotaRollingPrefix  string = "rolling-"
+	RateLimitKeyPrefix  string = "rate-limit-"
+	InFlightKeyPrefix   string = "in-flight-"
 )
 
+// quotaKeyForSession returns the quota counter a key draws from, keys in a shared quota group
+// (scoped to their organisation) all use the same counter
+func quotaKeyForSession(key string, currentSession *SessionState) string {
+	if currentSession.SharedQuotaGroup != "" {
+		return QuotaGroupKeyPrefix + currentSession.OrgID + "-" + currentSession.SharedQuotaGroup
+	}
+
+	return QuotaKeyPrefix + publicHash(key)
+}
+
 // SessionLimiter is the rate limiter for the API, use ForwardMessage() to
 // check if a message should pass through or not
 type SessionLimiter struct{}
 
-func (l SessionLimiter) doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey string, currentSession *SessionState, store StorageHandler) {
+func (l SessionLimiter) doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey string, currentSession *SessionState, store StorageHandler) int {
 	log.Debug("[RATELIMIT] Inbound raw key is: ", key)
 	log.Debug("[RATELIMIT] Rate limiter key is: ", rateLimiterKey)
 	ratePerPeriodNow, _ := store.SetRollingWindow(rateLimiterKey, int64(currentSession.Per), "-1")
@@ -92,31 +124,212 @@ func (l SessionLimiter) doRollingWindowWrite(key, rateLimiterKey, rateLimiterSen
 		// Set a sentinel value with expire
 		store.SetRawKey(rateLimiterSentinelKey, "1", int64(currentSession.Per))
 	}
+
+	return ratePerPeriodNow
 }
 
 // ForwardMessage will enforce rate limiting, returning false if session limits have been exceeded.
-// Key values to manage rate are Rate and Per, e.g. Rate of 10 messages Per 10 seconds
+// Key values to manage rate are Rate and Per, e.g. Rate of 10 messages Per 10 seconds. The reason
+// is 1 for a rate limit and 2 for a quota, a forwarded message that used up quota grace returns 3.
 func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key string, store StorageHandler) (bool, int) {
 	rateLimiterKey := RateLimitKeyPrefix + publicHash(key)
 	rateLimiterSentinelKey := RateLimitKeyPrefix + publicHash(key) + ".BLOCKED"
 
+	// Check sentinel before this request is added to the window
+	_, sentinelActive := store.GetRawKey(rateLimiterSentinelKey)
+
 	// Set rolling window (off thread)
 	go l.doRollingWindowWrite(key, rateLimiterKey, rateLimiterSentinelKey, currentSession, store)
 
-	// Check sentinel
-	_, sentinelActive := store.GetRawKey(rateLimiterSentinelKey)
 	if sentinelActive == nil {
 		// Sentinel is set, fail
 		return false, 1
 	}
 
 	currentSession.Allowance--
-	if !l.IsRedisQuotaExceeded(currentSession, key, store) {
-		return true, 0
+	exceeded, graceUsed := l.IsRedisQuotaExceeded(currentSession, key, store)
+	if exceeded {
+		l.refundQuota(currentSession, key, store, 1)
+		return false, 2
+	}
+	if graceUsed {
+		return true, 3
+	}
+
+	return true, 0
+
+}
+
+// ForwardMessageAndCount is the same as ForwardMessage for a request that counts cost times, it
+// writes the rolling window on the request thread and also returns the number of requests in the
+// current rate window, including this one if it is forwarded, and when the window resets. The whole
+// cost is added to the rate window and the quota in one write each, and taken out again if the
+// request is refused, so a refused request uses up nothing.
+func (l SessionLimiter) ForwardMessageAndCount(currentSession *SessionState, key string, store StorageHandler, cost int) (bool, int, int, int64) {
+	rateLimiterKey := RateLimitKeyPrefix + publicHash(key)
+	rateLimiterSentinelKey := RateLimitKeyPrefix + publicHash(key) + ".BLOCKED"
+
+	// Check sentinel before this request is added to the window
+	_, sentinelActive := store.GetRawKey(rateLimiterSentinelKey)
+
+	entries := make([]string, cost)
+	for i := range entries {
+		entries[i] = rollingWindowEntry()
+	}
+	// The window holds the requests before this one
+	ratePerPeriodNow, window := store.AddToRollingWindow(rateLimiterKey, int64(currentSession.Per), entries)
+	resets := rateWindowResets(window, currentSession.Per)
+
+	// A request that costs more than one is refused if it doesn't fit in the window, like it would
+	// be if it was counted one request at a time
+	if sentinelActive == nil || cost > 1 && ratePerPeriodNow+cost > int(currentSession.Rate) {
+		removeFromRollingWindow(store, rateLimiterKey, entries...)
+		return false, 1, ratePerPeriodNow, resets
+	}
+
+	// Subtract by 1 because of the delayed add in the window, and another subtraction because of the preemptive limit
+	if ratePerPeriodNow+cost-1 > (int(currentSession.Rate) - 2) {
+		store.SetRawKey(rateLimiterSentinelKey, "1", int64(currentSession.Per))
+	}
+
+	currentSession.Allowance -= float64(cost)
+	exceeded, graceUsed := l.chargeQuota(currentSession, key, store, int64(cost))
+	if exceeded {
+		removeFromRollingWindow(store, rateLimiterKey, entries...)
+		l.refundQuota(currentSession, key, store, int64(cost))
+		return false, 2, ratePerPeriodNow, resets
+	}
+	if graceUsed {
+		return true, 3, ratePerPeriodNow + cost, resets
+	}
+
+	return true, 0, ratePerPeriodNow + cost, resets
+}
+
+// refundQuota takes the cost of a request refused by the quota off the quota counter again, so a
+// refused request uses up nothing
+func (l SessionLimiter) refundQuota(currentSession *SessionState, key string, store StorageHandler, cost int64) {
+	if currentSession.QuotaMax != -1 && !currentSession.QuotaRolling {
+		// A rolling quota has already taken the request out of its window
+		store.DecrementBy(quotaKeyForSession(key, currentSession), cost)
+	}
+}
+
+// rateWindowResets is when the oldest request in the rate window leaves it as a Unix time, rounded
+// up to the second. If the window is empty the request being counted is the oldest.
+func rateWindowResets(window []interface{}, per float64) int64 {
+	oldest, found := oldestWindowEntry(window)
+	if !found {
+		oldest = time.Now()
+	}
+
+	resets := oldest.Add(time.Duration(per * float64(time.Second)))
+	if resets.Nanosecond() > 0 {
+		return resets.Unix() + 1
+	}
+	return resets.Unix()
+}
+
+// oldestWindowEntry returns when the oldest entry of a rolling window was added
+func oldestWindowEntry(window []interface{}) (time.Time, bool) {
+	if len(window) == 0 {
+		return time.Time{}, false
+	}
+
+	// Entries start with the time they were added in nanoseconds
+	oldestEntry := strings.SplitN(fmt.Sprintf("%s", window[0]), "-", 2)[0]
+	oldest, err := strconv.ParseInt(oldestEntry, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, oldest), true
+}
+
+// inFlightTTL bounds how long a request is counted as in flight, so requests counted by a node
+// that stopped before it could release them don't hold the key's slots forever
+const inFlightTTL int64 = 3600
+
+// rollingWindowEntry returns a unique entry for a rolling window, it starts with the time in
+// nanoseconds so the window can still be read as a list of times
+func rollingWindowEntry() string {
+	entryID, _ := uuid.NewV4()
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + entryID.String()
+}
+
+// rollingWindowEntryRemover is implemented by the stores whose RemoveFromRollingWindow takes single
+// entries out of a rolling window again. The RPC store can't, the entries it adds are the times
+// set by the master.
+type rollingWindowEntryRemover interface {
+	removesRollingWindowEntries() bool
+}
+
+// canRemoveFromRollingWindow is true if the entries of a refused or finished request can be taken
+// out of the rolling windows of the store
+func canRemoveFromRollingWindow(store StorageHandler) bool {
+	remover, ok := store.(rollingWindowEntryRemover)
+	return ok && remover.removesRollingWindowEntries()
+}
+
+// rollingWindowRemovalWarning makes sure stores that can't remove rolling window entries are only
+// warned about once
+var rollingWindowRemovalWarning sync.Once
+
+// removeFromRollingWindow takes the entries of a refused request out of a rolling window. With a
+// store that can't remove them they count against the rate limit or rolling quota until they leave
+// the window.
+func removeFromRollingWindow(store StorageHandler, keyName string, entries ...string) {
+	if !canRemoveFromRollingWindow(store) {
+		rollingWindowRemovalWarning.Do(func() {
+			log.Warning("The storage engine can't take refused requests out of rolling windows, they count against the rate limit and rolling quota until they leave the window")
+		})
+		return
+	}
+	store.RemoveFromRollingWindow(keyName, entries...)
+}
+
+// AcquireInFlight counts a request that is starting against the MaxConcurrentRequests of the
+// session, it returns false and leaves the count unchanged if the key already has as many requests
+// in flight. Each request is an entry of a rolling window of inFlightTTL seconds, so the count can't
+// drop below zero and an entry that is never released only counts until it leaves the window.
+// Stores that can't remove rolling window entries count with a counter that expires inFlightTTL
+// seconds after the first request instead. Every acquired entry must be given back with
+// ReleaseInFlight.
+func (l SessionLimiter) AcquireInFlight(currentSession *SessionState, key string, store StorageHandler) (string, bool) {
+	rawKey := InFlightKeyPrefix + publicHash(key)
+	if !canRemoveFromRollingWindow(store) {
+		inFlight := store.IncrememntWithExpire(inFlightCounterKey(rawKey), inFlightTTL)
+		if inFlight > currentSession.MaxConcurrentRequests {
+			store.Decrement(inFlightCounterKey(rawKey))
+			return "", false
+		}
+		return "", true
 	}
 
-	return false, 2
+	entry := rollingWindowEntry()
 
+	// The window holds the requests before this one
+	inFlight, _ := store.SetRollingWindow(rawKey, inFlightTTL, entry)
+	if int64(inFlight) >= currentSession.MaxConcurrentRequests {
+		store.RemoveFromRollingWindow(rawKey, entry)
+		return "", false
+	}
+	return entry, true
+}
+
+// ReleaseInFlight gives back the entry of a request that AcquireInFlight let through
+func (l SessionLimiter) ReleaseInFlight(key, entry string, store StorageHandler) {
+	rawKey := InFlightKeyPrefix + publicHash(key)
+	if !canRemoveFromRollingWindow(store) {
+		store.Decrement(inFlightCounterKey(rawKey))
+		return
+	}
+	store.RemoveFromRollingWindow(rawKey, entry)
+}
+
+// inFlightCounterKey is the counter used in place of the in flight window, it has a key of its own
+// so the two never clash in a Redis that several kinds of gateway share
+func inFlightCounterKey(rawKey string) string {
+	return rawKey + ".count"
 }
 
 // ForwardMessageNaiveKey is the old redis-key ttl-based Rate limit, it could be gamed.
@@ -132,11 +345,15 @@ func (l SessionLimiter) ForwardMessageNaiveKey(currentSession *SessionState, key
 	}
 
 	currentSession.Allowance--
-	if !l.IsRedisQuotaExceeded(currentSession, key, store) {
-		return true, 0
+	exceeded, graceUsed := l.IsRedisQuotaExceeded(currentSession, key, store)
+	if exceeded {
+		return false, 2
+	}
+	if graceUsed {
+		return true, 3
 	}
 
-	return false, 2
+	return true, 0
 
 }
 
@@ -169,21 +386,49 @@ func (l SessionLimiter) IsQuotaExceeded(currentSession *SessionState) bool {
 
 }
 
-func (l SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key string, store StorageHandler) bool {
+// quotaGrace is how many requests over QuotaMax a session may make before it is refused, an
+// absolute QuotaGrace takes precedence over QuotaGracePercent
+func quotaGrace(currentSession *SessionState) int64 {
+	if currentSession.QuotaGrace > 0 {
+		return currentSession.QuotaGrace
+	}
+
+	if currentSession.QuotaGracePercent > 0 {
+		return int64(math.Ceil(float64(currentSession.QuotaMax) * currentSession.QuotaGracePercent / 100))
+	}
+
+	return 0
+}
+
+// IsRedisQuotaExceeded checks the quota counter for the session, graceUsed is true when the quota
+// has been used up but the request is still within the session's quota grace
+func (l SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key string, store StorageHandler) (exceeded bool, graceUsed bool) {
+	return l.chargeQuota(currentSession, key, store, 1)
+}
+
+// chargeQuota is IsRedisQuotaExceeded for a request that counts cost times against the quota, the
+// counter is increased by the whole cost at once
+func (l SessionLimiter) chargeQuota(currentSession *SessionState, key string, store StorageHandler, cost int64) (exceeded bool, graceUsed bool) {
 
 	// Are they unlimited?
 	if currentSession.QuotaMax == -1 {
 		// No quota set
-		return false
+		return false, false
+	}
+
+	if currentSession.QuotaRolling {
+		return l.isRollingQuotaExceeded(currentSession, key, store, cost)
 	}
 
 	// Create the key
 	log.Debug("[QUOTA] Inbound raw key is: ", key)
-	rawKey := QuotaKeyPrefix + publicHash(key)
+	rawKey := quotaKeyForSession(key, currentSession)
 	log.Debug("[QUOTA] Quota limiter key is: ", rawKey)
 	log.Debug("Renewing with TTL: ", currentSession.QuotaRenewalRate)
-	// INCR the key (If it equals 1 - set EXPIRE)
-	qInt := store.IncrememntWithExpire(rawKey, currentSession.QuotaRenewalRate)
+	// INCRBY the key (If it equals the cost - set EXPIRE)
+	qInt := store.IncrementByWithExpire(rawKey, cost, currentSession.QuotaRenewalRate)
+	qInt = l.reconcileQuotaCounter(currentSession, rawKey, qInt, cost, store)
+	currentSession.QuotaUsed = qInt
 
 	// if the returned val is >= quota: block
 	if (int64(qInt) - 1) >= currentSession.QuotaMax {
@@ -195,16 +440,18 @@ func (l SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key s
 			// Also, this fixes legacy issues where there is no TTL on quota buckets
 			log.Warning("Incorrect key expiry setting detected, correcting.")
 			go store.DeleteRawKey(rawKey)
-			qInt = 1
+			qInt = cost
+		} else if (int64(qInt) - 1) >= currentSession.QuotaMax+quotaGrace(currentSession) {
+			// Renewal date is in the future and the quota (and any grace) is exceeded
+			return true, false
 		} else {
-			// Renewal date is in the future and the quota is exceeded
-			return true
+			graceUsed = true
 		}
 
 	}
 
 	// If this is a new Quota period, ensure we let the end user know
-	if int64(qInt) == 1 {
+	if qInt == cost {
 		current := time.Now().Unix()
 		currentSession.QuotaRenews = current + currentSession.QuotaRenewalRate
 	}
@@ -217,7 +464,103 @@ func (l SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key s
 	} else {
 		currentSession.QuotaRemaining = remaining
 	}
-	return false
+	return false, graceUsed
+}
+
+const (
+	// QuotaReconcileRead reads the quota counter again when it is behind the session
+	QuotaReconcileRead = "read"
+	// QuotaReconcileStrict also counts on from the session if the counter is still behind
+	QuotaReconcileStrict = "strict"
+)
+
+// reconcileQuotaCounter compares the quota counter the store returned with the count the session
+// saw last in the same quota period. The counter only goes up within a period, so a lower value
+// means the store has lost writes, e.g. a replica promoted after a failover. How this is handled
+// is set with quota_reconciliation: by default the store is trusted, "read" reads the counter once
+// more in case the store has caught up, and "strict" then counts on from the session and writes
+// that back to the store, so a key can't get quota back from the failover.
+func (l SessionLimiter) reconcileQuotaCounter(currentSession *SessionState, rawKey string, qInt, cost int64, store StorageHandler) int64 {
+	mode := config.QuotaReconciliation
+	if mode != QuotaReconcileRead && mode != QuotaReconcileStrict {
+		return qInt
+	}
+
+	// Resetting a shared quota group can't clear the count on the sessions of every key in it
+	if currentSession.SharedQuotaGroup != "" {
+		return qInt
+	}
+
+	// The counter of the previous period may have expired a moment before the session renews
+	now := time.Now().Unix()
+	if qInt-cost >= currentSession.QuotaUsed || now >= currentSession.QuotaRenews-1 {
+		return qInt
+	}
+
+	fields := logrus.Fields{
+		"key":           rawKey,
+		"store_count":   qInt,
+		"session_count": currentSession.QuotaUsed,
+	}
+	if value, err := store.GetRawKey(rawKey); err == nil {
+		if current, convErr := strconv.ParseInt(value, 10, 64); convErr == nil && current > qInt {
+			qInt = current
+		}
+	}
+	if qInt-cost >= currentSession.QuotaUsed {
+		log.WithFields(fields).Info("Quota counter caught up after a second read")
+		return qInt
+	}
+
+	if mode != QuotaReconcileStrict {
+		log.WithFields(fields).Warning("Quota counter is behind the session, using the store count")
+		return qInt
+	}
+
+	log.WithFields(fields).Warning("Quota counter is behind the session, counting on from the session")
+	qInt = currentSession.QuotaUsed + cost
+	store.SetRawKey(rawKey, strconv.FormatInt(qInt, 10), currentSession.QuotaRenews-now)
+	return qInt
+}
+
+// isRollingQuotaExceeded counts the requests made in the QuotaRenewalRate seconds before this one,
+// rather than in a period that starts with the first request. Every request is kept as an entry
+// of a sorted set until it leaves the window, so this costs a lot more storage than a counter
+// for large quotas. Requests that are refused are taken out of the window again, so they don't use
+// up quota. A request that costs more than one adds that many entries.
+func (l SessionLimiter) isRollingQuotaExceeded(currentSession *SessionState, key string, store StorageHandler, cost int64) (exceeded bool, graceUsed bool) {
+	rawKey := QuotaRollingPrefix + quotaKeyForSession(key, currentSession)
+	log.Debug("[QUOTA] Rolling quota key is: ", rawKey)
+
+	// The window holds the requests before this one, the entries of this request have to be unique
+	// so that they can be removed again
+	entries := make([]string, cost)
+	for i := range entries {
+		entries[i] = rollingWindowEntry()
+	}
+	used, window := store.AddToRollingWindow(rawKey, currentSession.QuotaRenewalRate, entries)
+	used += int(cost)
+
+	if int64(used) > currentSession.QuotaMax {
+		if int64(used) > currentSession.QuotaMax+quotaGrace(currentSession) {
+			removeFromRollingWindow(store, rawKey, entries...)
+			return true, false
+		}
+		graceUsed = true
+	}
+
+	// The next request is freed when the oldest one in the window leaves it
+	currentSession.QuotaRenews = time.Now().Unix() + currentSession.QuotaRenewalRate
+	if oldest, found := oldestWindowEntry(window); found {
+		currentSession.QuotaRenews = oldest.Unix() + currentSession.QuotaRenewalRate
+	}
+
+	remaining := currentSession.QuotaMax - int64(used)
+	if remaining < 0 {
+		remaining = 0
+	}
+	currentSession.QuotaRemaining = remaining
+	return false, graceUsed
 }
 
 // createSampleSession is a debug function to create a mock session value
@@ -40,8 +40,12 @@ type StorageHandler interface {
 	GetKeysAndValuesWithFilter(string) map[string]string
 	DeleteKeys([]string) bool
 	Decrement(string)
+	DecrementBy(string, int64)
 	IncrememntWithExpire(string, int64) int64
+	IncrementByWithExpire(string, int64, int64) int64
 	SetRollingWindow(string, int64, string) (int, []interface{})
+	AddToRollingWindow(string, int64, []string) (int, []interface{})
+	RemoveFromRollingWindow(string, ...string)
 	GetSet(string) (map[string]string, error)
 	AddToSet(string, string)
 	RemoveFromSet(string, string)
@@ -59,16 +63,35 @@ func (s *InMemoryStorageManager) Decrement(n string) {
 	log.Warning("Not implemented!")
 }
 
+// DecrementBy is a dummy function
+func (s *InMemoryStorageManager) DecrementBy(n string, by int64) {
+	log.Warning("Not implemented!")
+}
+
 func (s *InMemoryStorageManager) SetRollingWindow(keyName string, per int64, val string) (int, []interface{}) {
 	log.Warning("Not Implemented!")
 	return 0, []interface{}{}
 }
 
+func (s *InMemoryStorageManager) AddToRollingWindow(keyName string, per int64, values []string) (int, []interface{}) {
+	log.Warning("Not Implemented!")
+	return 0, []interface{}{}
+}
+
+func (s *InMemoryStorageManager) RemoveFromRollingWindow(keyName string, values ...string) {
+	log.Warning("Not Implemented!")
+}
+
 func (s *InMemoryStorageManager) IncrememntWithExpire(n string, i int64) int64 {
 	log.Warning("Not implemented!")
 	return 0
 }
 
+func (s *InMemoryStorageManager) IncrementByWithExpire(n string, by int64, i int64) int64 {
+	log.Warning("Not implemented!")
+	return 0
+}
+
 func (s *InMemoryStorageManager) Connect() bool {
 	return true
 }
@@ -393,19 +416,19 @@ func (r *RedisStorageManager) SetRawKey(keyName string, sessionState string, tim
 	return nil
 }
 
-// Decrement will decrement a key in redis
+// Decrement will decrement a raw key in redis, it is the counterpart of IncrememntWithExpire
 func (r *RedisStorageManager) Decrement(keyName string) {
 	db := r.pool.Get()
 	defer db.Close()
 
-	keyName = r.fixKey(keyName)
-	log.Debug("Decrementing key: ", keyName)
+	log.Debug("Decrementing raw key: ", keyName)
 	if db == nil {
 		log.Info("Connection dropped, connecting..")
 		r.Connect()
 		r.Decrement(keyName)
 	} else {
-		err := db.Send("DECR", keyName)
+		// This function uses a raw key, so we shouldn't call fixKey
+		_, err := db.Do("DECR", keyName)
 
 		if err != nil {
 			log.Error("Error trying to decrement value:", err)
@@ -413,6 +436,53 @@ func (r *RedisStorageManager) Decrement(keyName string) {
 	}
 }
 
+// DecrementBy will decrease a raw key in redis by a number, it is the counterpart of IncrementByWithExpire
+func (r *RedisStorageManager) DecrementBy(keyName string, by int64) {
+	db := r.pool.Get()
+	defer db.Close()
+
+	log.Debug("Decrementing raw key: ", keyName, " by ", by)
+	if db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		r.DecrementBy(keyName, by)
+	} else {
+		// This function uses a raw key, so we shouldn't call fixKey
+		_, err := db.Do("DECRBY", keyName, by)
+
+		if err != nil {
+			log.Error("Error trying to decrement value:", err)
+		}
+	}
+}
+
+// IncrementByWithExpire will increase a key in redis by a number in one command, the expiry is
+// set if the key was created by it
+func (r *RedisStorageManager) IncrementByWithExpire(keyName string, by int64, expire int64) int64 {
+	db := r.pool.Get()
+	defer db.Close()
+
+	log.Debug("Incrementing raw key: ", keyName, " by ", by)
+	if db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.IncrementByWithExpire(keyName, by, expire)
+	}
+
+	// This function uses a raw key, so we shouldn't call fixKey
+	val, err := redis.Int64(db.Do("INCRBY", keyName, by))
+	if err != nil {
+		log.Error("Error trying to increment value:", err)
+		return 0
+	}
+	log.Debug("Incremented key: ", keyName, ", val is: ", val)
+	if val == by {
+		log.Debug("--> Setting Expire")
+		db.Do("EXPIRE", keyName, expire)
+	}
+	return val
+}
+
 // IncrementWithExpire will increment a key in redis
 func (r *RedisStorageManager) IncrememntWithExpire(keyName string, expire int64) int64 {
 	db := r.pool.Get()
@@ -730,7 +800,7 @@ func (r *RedisStorageManager) AppendToSet(keyName string, value string) {
 }
 
 // IncrementWithExpire will increment a key in redis
-func (r *RedisStorageManager) SetRollingWindow(keyName string, per int64, expire string) (int, []interface{}) {
+func (r *RedisStorageManager) SetRollingWindow(keyName string, per int64, value_override string) (int, []interface{}) {
 	db := r.pool.Get()
 	defer db.Close()
 
@@ -738,7 +808,7 @@ func (r *RedisStorageManager) SetRollingWindow(keyName string, per int64, expire
 	if db == nil {
 		log.Info("Connection dropped, connecting..")
 		r.Connect()
-		r.SetRollingWindow(keyName, per, expire)
+		r.SetRollingWindow(keyName, per, value_override)
 	} else {
 		log.Debug("keyName is: ", keyName)
 		now := time.Now()
@@ -752,7 +822,11 @@ func (r *RedisStorageManager) SetRollingWindow(keyName string, per int64, expire
 		// Get the set
 		db.Send("ZRANGE", keyName, 0, -1)
 		// Add this request to the pile
-		db.Send("ZADD", keyName, now.UnixNano(), strconv.Itoa(int(now.UnixNano())))
+		if value_override != "-1" {
+			db.Send("ZADD", keyName, now.UnixNano(), value_override)
+		} else {
+			db.Send("ZADD", keyName, now.UnixNano(), strconv.Itoa(int(now.UnixNano())))
+		}
 		// REset the TTL so the key lives as long as the requests pile in
 		db.Send("EXPIRE", keyName, per)
 		r, err := redis.Values(db.Do("EXEC"))
@@ -770,6 +844,66 @@ func (r *RedisStorageManager) SetRollingWindow(keyName string, per int64, expire
 	return 0, []interface{}{}
 }
 
+// AddToRollingWindow is SetRollingWindow for several entries, which are added in the same
+// transaction. The window is returned as it was before they were added.
+func (r *RedisStorageManager) AddToRollingWindow(keyName string, per int64, values []string) (int, []interface{}) {
+	db := r.pool.Get()
+	defer db.Close()
+
+	if db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.AddToRollingWindow(keyName, per, values)
+	}
+
+	now := time.Now()
+	onePeriodAgo := now.Add(time.Duration(-1*per) * time.Second)
+	zaddArgs := []interface{}{keyName}
+	for _, value := range values {
+		zaddArgs = append(zaddArgs, now.UnixNano(), value)
+	}
+
+	db.Send("MULTI")
+	db.Send("ZREMRANGEBYSCORE", keyName, "-inf", onePeriodAgo.UnixNano())
+	db.Send("ZRANGE", keyName, 0, -1)
+	db.Send("ZADD", zaddArgs...)
+	db.Send("EXPIRE", keyName, per)
+	redVal, err := redis.Values(db.Do("EXEC"))
+	if err != nil || len(redVal) < 2 {
+		log.Error("Multi command failed: ", err)
+		return 0, []interface{}{}
+	}
+
+	window := redVal[1].([]interface{})
+	return len(window), window
+}
+
+// removesRollingWindowEntries is true, RemoveFromRollingWindow takes the entries out with ZREM
+func (r *RedisStorageManager) removesRollingWindowEntries() bool {
+	return true
+}
+
+// RemoveFromRollingWindow takes entries added with SetRollingWindow or AddToRollingWindow out of
+// the window again
+func (r *RedisStorageManager) RemoveFromRollingWindow(keyName string, values ...string) {
+	db := r.pool.Get()
+	defer db.Close()
+
+	if db == nil {
+		log.Warning("Connection dropped, connecting..")
+		r.Connect()
+		r.RemoveFromRollingWindow(keyName, values...)
+	} else {
+		args := []interface{}{keyName}
+		for _, value := range values {
+			args = append(args, value)
+		}
+		if _, err := db.Do("ZREM", args...); err != nil {
+			log.Error("Error trying to remove from rolling window: ", err)
+		}
+	}
+}
+
 func (r *RedisStorageManager) GetSet(keyName string) (map[string]string, error) {
 	log.Debug("Getting from key set: ", keyName)
 	log.Info("Getting from fixed key set: ", r.fixKey(keyName))
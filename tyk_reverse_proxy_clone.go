@@ -8,6 +8,7 @@ package main
 
 import (
 	"bytes"
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
 	"github.com/pmylund/go-cache"
 	"io"
@@ -198,7 +199,7 @@ var TykDefaultTransport http.RoundTripper = &http.Transport{
 	TLSHandshakeTimeout: 10 * time.Second,
 }
 
-func GetTransport(timeOut int) http.RoundTripper {
+func GetTransport(timeOut int, spec *APISpec) http.RoundTripper {
 	if timeOut > 0 {
 		log.Debug("Setting timeout for outbound request to: ", timeOut)
 		var ModifiedTransport http.RoundTripper = &http.Transport{
@@ -209,12 +210,17 @@ func GetTransport(timeOut int) http.RoundTripper {
 			}).Dial,
 			ResponseHeaderTimeout: time.Duration(timeOut) * time.Second,
 			TLSHandshakeTimeout:   10 * time.Second,
+			TLSClientConfig:       spec.UpstreamTLSConfig,
 		}
 
 		return ModifiedTransport
 
 	}
 
+	if spec.UpstreamTransport != nil {
+		return spec.UpstreamTransport
+	}
+
 	return TykDefaultTransport
 }
 
@@ -290,7 +296,7 @@ func (p *ReverseProxy) New(c interface{}, spec *APISpec) (TykResponseHandler, er
 }
 
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) *http.Response {
-	return p.WrappedServeHTTP(rw, req, config.AnalyticsConfig.EnableDetailedRecording)
+	return p.WrappedServeHTTP(rw, req, false)
 	// return nil
 }
 
@@ -339,11 +345,27 @@ func (p *ReverseProxy) CheckCircuitBreakerEnforced(spec *APISpec, req *http.Requ
 }
 
 func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Request, withCache bool) *http.Response {
+	if p.TykAPISpec.UpstreamTLSError != nil {
+		p.ErrorHandler.HandleError(rw, req, "Upstream TLS settings could not be loaded", 500)
+		return nil
+	}
+
+	// Protect the upstream from too many concurrent requests
+	acquired, waited := p.TykAPISpec.UpstreamLimiter.Acquire()
+	context.Set(req, QueueTimeData, waited)
+	if !acquired {
+		log.Warning("Upstream connection limit reached for API: ", p.TykAPISpec.APIID)
+		p.ErrorHandler.HandleError(rw, req, "Upstream connection limit reached, please retry", 503)
+		return nil
+	}
+	defer p.TykAPISpec.UpstreamLimiter.Release()
+
 	transport := p.Transport
+	var timeout int
 	if transport == nil {
 		// 1. Check if timeouts are set for this endpoint
-		_, timeout := p.CheckHardTimeoutEnforced(p.TykAPISpec, req)
-		transport = GetTransport(timeout)
+		_, timeout = p.CheckHardTimeoutEnforced(p.TykAPISpec, req)
+		transport = GetTransport(timeout, p.TykAPISpec)
 	}
 
 	// Do this before we make a shallow copy
@@ -362,6 +384,10 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	outreq.ProtoMinor = 1
 	outreq.Close = false
 
+	if p.Transport == nil && p.TykAPISpec.Options.UpstreamHTTP2 {
+		transport = GetHTTP2Transport(outreq.URL.Scheme, timeout, p.TykAPISpec)
+	}
+
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
 	// connection, regardless of what the client sent to us.  This
@@ -382,6 +408,11 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 		}
 	}
 
+	// gRPC upstreams refuse calls that don't say they accept trailers
+	if IsGRPCRequest(req) && req.Header.Get("Te") == "trailers" {
+		outreq.Header.Set("Te", "trailers")
+	}
+
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		// If we aren't the first proxy retain prior
 		// X-Forwarded-For information as a comma+space
@@ -407,7 +438,7 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 			res, err = transport.RoundTrip(outreq)
 			if err != nil {
 				breakerConf.CB.Fail()
-			} else if res.StatusCode == 500 {
+			} else if IsBreakerFailureCode(res.StatusCode) {
 				breakerConf.CB.Fail()
 			} else {
 				breakerConf.CB.Success()
@@ -423,6 +454,11 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	if err != nil {
 		log.Error("http: proxy error: ", err)
 		if strings.Contains(err.Error(), "timeout awaiting response headers") {
+			log.WithFields(logrus.Fields{
+				"path":    req.URL.Path,
+				"api_id":  p.TykAPISpec.APIID,
+				"timeout": "upstream",
+			}).Warning("Upstream hard timeout reached")
 			p.ErrorHandler.HandleError(rw, logreq, "Upstream service reached hard timeout.", 408)
 
 			if p.TykAPISpec.Proxy.ServiceDiscovery.UseDiscoveryService {
@@ -472,10 +508,28 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 		log.Error("Response chain failed! ", chainErr)
 	}
 
+	// Detailed recording keeps a bounded copy of the body as it is streamed to the client, the
+	// upstream may not have said how long it is so it can't be buffered up front
+	var captured *recordingBody
+	if !withCache && DetailedRecording(req) && !IsGRPCRequest(req) {
+		*inres = *res
+		captured = newRecordingBody(res.Body, MaxRecordedBodySize())
+		res.Body = captured
+	}
+
 	// We should at least copy the status code in
 	inres.StatusCode = res.StatusCode
 	inres.ContentLength = res.ContentLength
 	p.HandleResponse(rw, res, req, &ses)
+
+	if captured != nil {
+		if captured.truncated {
+			log.Debug("Response body is larger than the recording limit, recording was truncated")
+		}
+		inres.Body = ioutil.NopCloser(&captured.buf)
+		inres.ContentLength = int64(captured.buf.Len())
+		inres.TransferEncoding = nil
+	}
 	return inres
 }
 
@@ -491,18 +545,42 @@ func (p *ReverseProxy) HandleResponse(rw http.ResponseWriter, res *http.Response
 		res.Header.Set("Connection", "close")
 	}
 
-	// Add resource headers
-	if ses != nil {
+	// Add resource headers, unless the rate limiter has already reported on the session it evaluated
+	if ses != nil && rw.Header().Get("X-RateLimit-Limit") == "" {
 		// We have found a session, lets report back
 		res.Header.Add("X-RateLimit-Limit", strconv.Itoa(int(ses.QuotaMax)))
 		res.Header.Add("X-RateLimit-Remaining", strconv.Itoa(int(ses.QuotaRemaining)))
 		res.Header.Add("X-RateLimit-Reset", strconv.Itoa(int(ses.QuotaRenews)))
 	}
 
+	// The gateway already set the request ID, don't repeat it if the upstream echoes it
+	if rw.Header().Get(RequestIDHeaderName()) != "" {
+		res.Header.Del(RequestIDHeaderName())
+	}
+
+	injectResponseHeaders(p.TykAPISpec, req, res)
+
 	copyHeader(rw.Header(), res.Header)
 
+	// Trailers have to be announced before the headers are written
+	for k := range res.Trailer {
+		rw.Header().Add("Trailer", k)
+	}
+
 	rw.WriteHeader(res.StatusCode)
-	p.copyResponse(rw, res.Body)
+	if IsGRPCRequest(req) {
+		copyStreamingResponse(rw, res.Body)
+		context.Set(req, GRPCStatusData, GRPCStatus(res))
+	} else if IsEventStream(res) {
+		copyStreamingResponse(rw, res.Body)
+	} else {
+		p.copyResponse(rw, res.Body)
+	}
+
+	// The trailer values are only known once the body has been read
+	for k, vv := range res.Trailer {
+		rw.Header()[k] = vv
+	}
 	return nil
 }
 
@@ -561,3 +639,37 @@ func (m *maxLatencyWriter) flushLoop() {
 }
 
 func (m *maxLatencyWriter) stop() { m.done <- true }
+
+// recordingBody keeps a copy of the first bytes of a body as it is read
+type recordingBody struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func newRecordingBody(body io.ReadCloser, limit int) *recordingBody {
+	return &recordingBody{ReadCloser: body, limit: limit}
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		remaining := b.limit - b.buf.Len()
+		if n > remaining {
+			b.truncated = true
+			if remaining > 0 {
+				b.buf.Write(p[:remaining])
+			}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// IsEventStream returns true for server-sent event responses, these are flushed to the client
+// as they arrive rather than when the flush interval ticks
+func IsEventStream(res *http.Response) bool {
+	return strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	b64 "encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createRecordedSpec(sinkName string, target string) (APISpec, recordingAnalyticsSink) {
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink(sinkName, sink)
+
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "analytics_sink": "`+sinkName+`",`, 1))
+	spec.Proxy.TargetURL = target
+	return spec, sink
+}
+
+func TestChunkedResponseRecording(t *testing.T) {
+	body := strings.Repeat("chunk-", 100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(body); i += 60 {
+			w.Write([]byte(body[i : i+60]))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	enableAnalytics, detailed := config.EnableAnalytics, config.AnalyticsConfig.EnableDetailedRecording
+	defer func() {
+		config.EnableAnalytics = enableAnalytics
+		config.AnalyticsConfig.EnableDetailedRecording = detailed
+		config.AnalyticsConfig.MaxRecordedBodySize = 0
+	}()
+	config.EnableAnalytics = true
+	config.AnalyticsConfig.MaxRecordedBodySize = 100
+
+	spec, sink := createRecordedSpec("chunked", upstream.URL)
+	defer delete(AnalyticsSinks, "chunked")
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for _, recordDetail := range []bool{false, true} {
+		config.AnalyticsConfig.EnableDetailedRecording = recordDetail
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != 200 || recorder.Body.String() != body {
+			t.Fatalf("Detailed recording %v: client should get the whole body, got %v with %v bytes", recordDetail, recorder.Code, recorder.Body.Len())
+		}
+
+		select {
+		case thisRecord := <-sink.records:
+			if !recordDetail {
+				if thisRecord.RawResponse != "" {
+					t.Error("Response should not be recorded without detailed recording")
+				}
+				continue
+			}
+			raw, _ := b64.StdEncoding.DecodeString(thisRecord.RawResponse)
+			res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			if err != nil {
+				t.Fatal("Recorded response is not valid: ", err)
+			}
+			recordedBody, _ := ioutil.ReadAll(res.Body)
+			if string(recordedBody) != body[:100] {
+				t.Errorf("Recorded body should be truncated to 100 bytes, got %v", len(recordedBody))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No analytics record")
+		}
+	}
+}
+
+func TestEventStreamIsNotBuffered(t *testing.T) {
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: last\n\n"))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	detailed := config.AnalyticsConfig.EnableDetailedRecording
+	defer func() { config.AnalyticsConfig.EnableDetailedRecording = detailed }()
+
+	spec, _ := createRecordedSpec("event-stream", upstream.URL)
+	defer delete(AnalyticsSinks, "event-stream")
+	gateway := httptest.NewServer(getChain(spec))
+	defer gateway.Close()
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	for _, recordDetail := range []bool{false, true} {
+		config.AnalyticsConfig.EnableDetailedRecording = recordDetail
+
+		req, _ := http.NewRequest("GET", gateway.URL+"/", nil)
+		req.Header.Add("authorization", keyId)
+
+		// A buffered response doesn't send its headers either, so the whole request runs aside
+		events := make(chan string, 1)
+		go func() {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				events <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			events <- line
+		}()
+
+		select {
+		case line := <-events:
+			if line != "data: first\n" {
+				t.Errorf("Detailed recording %v: unexpected event %q", recordDetail, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Detailed recording %v: event was buffered instead of streamed", recordDetail)
+		}
+
+		release <- true
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamLimiter caps the number of requests an API has in flight to its upstream at once, set
+// with max_upstream_connections. Requests over the cap wait up to upstream_queue_timeout
+// milliseconds for a slot, without a timeout they are rejected straight away.
+type UpstreamLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	inFlight     int64
+}
+
+// NewUpstreamLimiter creates a limiter, with a max of 0 or less it only counts requests in flight
+func NewUpstreamLimiter(max int, queueTimeoutMs int) *UpstreamLimiter {
+	limiter := &UpstreamLimiter{
+		queueTimeout: time.Duration(queueTimeoutMs) * time.Millisecond,
+	}
+	if max > 0 {
+		limiter.slots = make(chan struct{}, max)
+	}
+
+	return limiter
+}
+
+// Acquire takes a slot for an upstream request, it returns false if none was free in time and how
+// long the request waited in the queue either way. Every successful Acquire must be followed by a
+// Release.
+func (u *UpstreamLimiter) Acquire() (bool, time.Duration) {
+	if u == nil {
+		return true, 0
+	}
+
+	var waited time.Duration
+	if u.slots != nil {
+		select {
+		case u.slots <- struct{}{}:
+		default:
+			if u.queueTimeout <= 0 {
+				return false, 0
+			}
+
+			queued := time.Now()
+			timer := time.NewTimer(u.queueTimeout)
+			defer timer.Stop()
+			select {
+			case u.slots <- struct{}{}:
+				waited = time.Since(queued)
+			case <-timer.C:
+				return false, time.Since(queued)
+			}
+		}
+	}
+
+	atomic.AddInt64(&u.inFlight, 1)
+	return true, waited
+}
+
+// Release frees the slot taken by Acquire
+func (u *UpstreamLimiter) Release() {
+	if u == nil {
+		return
+	}
+
+	atomic.AddInt64(&u.inFlight, -1)
+	if u.slots != nil {
+		<-u.slots
+	}
+}
+
+// InFlight is the number of upstream requests currently in flight
+func (u *UpstreamLimiter) InFlight() int64 {
+	if u == nil {
+		return 0
+	}
+
+	return atomic.LoadInt64(&u.inFlight)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getUpstreamLimitedChain(t *testing.T, options string, upstreamURL string) (http.Handler, APISpec, string) {
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", `+options, 1))
+	spec.Proxy.TargetURL = upstreamURL
+	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisClusterStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	return getChain(spec), spec, keyId
+}
+
+func doUpstreamLimitedRequest(chain http.Handler, keyId string) int {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	return recorder.Code
+}
+
+func newBlockingUpstream() (*httptest.Server, chan bool, chan bool) {
+	started := make(chan bool, 10)
+	unblock := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-unblock
+	}))
+
+	return upstream, started, unblock
+}
+
+func TestUpstreamLimitReject(t *testing.T) {
+	upstream, started, unblock := newBlockingUpstream()
+	defer upstream.Close()
+	chain, spec, keyId := getUpstreamLimitedChain(t, `"max_upstream_connections": 1,`, upstream.URL)
+
+	firstCode := make(chan int)
+	go func() { firstCode <- doUpstreamLimitedRequest(chain, keyId) }()
+	<-started
+
+	if inFlight := spec.UpstreamLimiter.InFlight(); inFlight != 1 {
+		t.Error("Expected 1 upstream request in flight, got: ", inFlight)
+	}
+
+	if code := doUpstreamLimitedRequest(chain, keyId); code != 503 {
+		t.Error("Request over the upstream limit should be rejected, got: ", code)
+	}
+
+	close(unblock)
+	if code := <-firstCode; code != 200 {
+		t.Error("First request should go through, got: ", code)
+	}
+	if inFlight := spec.UpstreamLimiter.InFlight(); inFlight != 0 {
+		t.Error("Expected no upstream requests in flight, got: ", inFlight)
+	}
+}
+
+func TestUpstreamLimitQueue(t *testing.T) {
+	upstream, started, unblock := newBlockingUpstream()
+	defer upstream.Close()
+	chain, _, keyId := getUpstreamLimitedChain(t, `"max_upstream_connections": 1, "upstream_queue_timeout": 2000,`, upstream.URL)
+
+	firstCode := make(chan int)
+	go func() { firstCode <- doUpstreamLimitedRequest(chain, keyId) }()
+	<-started
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(unblock)
+	}()
+
+	// Waits for the first request to finish
+	if code := doUpstreamLimitedRequest(chain, keyId); code != 200 {
+		t.Error("Queued request should go through once a slot is free, got: ", code)
+	}
+	if code := <-firstCode; code != 200 {
+		t.Error("First request should go through, got: ", code)
+	}
+}
+
+func TestUpstreamLimitQueueTime(t *testing.T) {
+	enableAnalytics := config.EnableAnalytics
+	defer func() { config.EnableAnalytics = enableAnalytics }()
+	config.EnableAnalytics = true
+
+	sink := recordingAnalyticsSink{make(chan AnalyticsRecord, 10)}
+	RegisterAnalyticsSink("queued", sink)
+	defer delete(AnalyticsSinks, "queued")
+
+	nextRecord := func() AnalyticsRecord {
+		select {
+		case thisRecord := <-sink.records:
+			return thisRecord
+		case <-time.After(time.Second):
+			t.Fatal("No analytics record")
+		}
+		return AnalyticsRecord{}
+	}
+
+	upstream, started, unblock := newBlockingUpstream()
+	defer upstream.Close()
+	chain, _, keyId := getUpstreamLimitedChain(t, `"analytics_sink": "queued", "max_upstream_connections": 1, "upstream_queue_timeout": 2000,`, upstream.URL)
+
+	firstCode := make(chan int)
+	go func() { firstCode <- doUpstreamLimitedRequest(chain, keyId) }()
+	<-started
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(unblock)
+	}()
+
+	// Queues behind the first request until it finishes
+	if code := doUpstreamLimitedRequest(chain, keyId); code != 200 {
+		t.Error("Queued request should go through once a slot is free, got: ", code)
+	}
+	<-firstCode
+
+	first, second := nextRecord(), nextRecord()
+	if first.QueueTime > second.QueueTime {
+		first, second = second, first
+	}
+	if first.QueueTime != 0 {
+		t.Error("The request that got a slot straight away shouldn't have waited, got: ", first.QueueTime)
+	}
+	if second.QueueTime < 50 {
+		t.Error("Expected the queued request to have waited for the slot, got: ", second.QueueTime)
+	}
+
+	// A request that times out in the queue records how long it waited before it was rejected
+	blocked, blockedStarted, release := newBlockingUpstream()
+	defer blocked.Close()
+	chain, _, keyId = getUpstreamLimitedChain(t, `"analytics_sink": "queued", "max_upstream_connections": 1, "upstream_queue_timeout": 50,`, blocked.URL)
+
+	go func() { firstCode <- doUpstreamLimitedRequest(chain, keyId) }()
+	<-blockedStarted
+
+	if code := doUpstreamLimitedRequest(chain, keyId); code != 503 {
+		t.Error("Request should be rejected once its queue timeout is up, got: ", code)
+	}
+	if rejected := nextRecord(); rejected.ResponseCode != 503 || rejected.QueueTime < 50 {
+		t.Error("Expected the rejected request to record its time in the queue, got: ", rejected.ResponseCode, rejected.QueueTime)
+	}
+
+	close(release)
+	<-firstCode
+	nextRecord()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// UpstreamTLSOptions configure how the gateway verifies and authenticates to an API's upstream over TLS
+type UpstreamTLSOptions struct {
+	CAFile             string `mapstructure:"ca_file" bson:"ca_file" json:"ca_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" bson:"insecure_skip_verify" json:"insecure_skip_verify"`
+	CertFile           string `mapstructure:"cert_file" bson:"cert_file" json:"cert_file"`
+	KeyFile            string `mapstructure:"key_file" bson:"key_file" json:"key_file"`
+}
+
+// NewUpstreamTLSConfig builds the TLS config for an upstream, it returns nil if the API
+// doesn't change any of the defaults
+func NewUpstreamTLSConfig(options UpstreamTLSOptions) (*tls.Config, error) {
+	if options.CAFile == "" && !options.InsecureSkipVerify && options.CertFile == "" && options.KeyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+
+	if options.CAFile != "" {
+		caData, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found in CA file " + options.CAFile)
+		}
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewUpstreamTransport is the default transport with the TLS settings of an API
+func NewUpstreamTransport(tlsConfig *tls.Config) http.RoundTripper {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func createTestCertificate(t *testing.T, name string, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upstream-tls")
+	defer os.RemoveAll(dir)
+
+	ca := createTestCertificate(t, "Test CA", nil, true)
+	serverCert := createTestCertificate(t, "upstream", ca, false)
+	clientCert := createTestCertificate(t, "gateway", ca, false)
+
+	caFile := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	certFile := writeTestFile(t, dir, "client.pem", clientCert.certPEM)
+	keyFile := writeTestFile(t, dir, "client.key", clientCert.keyPEM)
+
+	serverKeyPair, _ := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		upstreamTLS string
+		expected    int
+	}{
+		{"CA and client certificate", `{"ca_file": "` + caFile + `", "cert_file": "` + certFile + `", "key_file": "` + keyFile + `"}`, 200},
+		{"Skip verify with client certificate", `{"insecure_skip_verify": true, "cert_file": "` + certFile + `", "key_file": "` + keyFile + `"}`, 200},
+		{"No client certificate", `{"ca_file": "` + caFile + `"}`, 500},
+		{"Unknown CA", `{"cert_file": "` + certFile + `", "key_file": "` + keyFile + `"}`, 500},
+	}
+
+	for _, test := range tests {
+		spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "upstream_tls": `+test.upstreamTLS+`,`, 1))
+		spec.Proxy.TargetURL = upstream.URL
+		chain := getChain(spec)
+
+		keyId := randSeq(10)
+		spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("authorization", keyId)
+		chain.ServeHTTP(recorder, req)
+
+		if recorder.Code != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, recorder.Code)
+		}
+	}
+}
+
+func TestUpstreamTLSLoadFailureRefusesRequests(t *testing.T) {
+	var upstreamHits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+	}))
+	defer upstream.Close()
+
+	spec := createDefinitionFromString(strings.Replace(nonExpiringDefNoWhiteList, `"org_id": "default",`, `"org_id": "default", "upstream_tls": {"cert_file": "/does/not/exist.pem", "key_file": "/does/not/exist.key"},`, 1))
+	spec.Proxy.TargetURL = upstream.URL
+	if spec.UpstreamTLSError == nil {
+		t.Fatal("Expected the TLS load error to be kept on the spec")
+	}
+	chain := getChain(spec)
+
+	keyId := randSeq(10)
+	spec.SessionManager.UpdateSession(keyId, createNonThrottledSession(), 60)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("authorization", keyId)
+	chain.ServeHTTP(recorder, req)
+
+	if recorder.Code != 500 {
+		t.Error("Expected requests to be refused when the upstream TLS settings can't be loaded, got: ", recorder.Code)
+	}
+	if atomic.LoadInt32(&upstreamHits) != 0 {
+		t.Error("The upstream should not be called without its TLS settings")
+	}
+}
+
+func TestUpstreamTLSConfigInvalidFiles(t *testing.T) {
+	if _, err := NewUpstreamTLSConfig(UpstreamTLSOptions{CAFile: "/does/not/exist.pem"}); err == nil {
+		t.Error("Missing CA file should be an error")
+	}
+	if _, err := NewUpstreamTLSConfig(UpstreamTLSOptions{CertFile: "/does/not/exist.pem", KeyFile: "/does/not/exist.key"}); err == nil {
+		t.Error("Missing client certificate should be an error")
+	}
+	if tlsConfig, err := NewUpstreamTLSConfig(UpstreamTLSOptions{}); tlsConfig != nil || err != nil {
+		t.Error("No options should keep the default transport")
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 func CopyHttpRequest(r *http.Request) *http.Request {
@@ -12,18 +16,7 @@ func CopyHttpRequest(r *http.Request) *http.Request {
 	*reqCopy = *r
 
 	if r.Body != nil {
-		defer r.Body.Close()
-
-		// Buffer body data
-		var bodyBuffer bytes.Buffer
-		bodyBuffer2 := new(bytes.Buffer)
-
-		io.Copy(&bodyBuffer, r.Body)
-		*bodyBuffer2 = bodyBuffer
-
-		// Create new ReadClosers so we can split output
-		r.Body = ioutil.NopCloser(&bodyBuffer)
-		reqCopy.Body = ioutil.NopCloser(bodyBuffer2)
+		r.Body, reqCopy.Body = copyBody(r.Body)
 	}
 
 	return reqCopy
@@ -35,19 +28,173 @@ func CopyHttpResponse(r *http.Response) *http.Response {
 	*resCopy = *r
 
 	if r.Body != nil {
-		defer r.Body.Close()
+		r.Body, resCopy.Body = copyBody(r.Body)
+	}
 
-		// Buffer body data
-		var bodyBuffer bytes.Buffer
-		bodyBuffer2 := new(bytes.Buffer)
+	return resCopy
+}
 
-		io.Copy(&bodyBuffer, r.Body)
-		*bodyBuffer2 = bodyBuffer
+// failedRead is returned by a body copy once the data read before the failure is used up
+type failedRead struct {
+	err error
+}
 
-		// Create new ReadClosers so we can split output
-		r.Body = ioutil.NopCloser(&bodyBuffer)
-		resCopy.Body = ioutil.NopCloser(bodyBuffer2)
+func (f failedRead) Read(p []byte) (int, error) {
+	return 0, f.err
+}
+
+// copyBody buffers body so it can be read twice. If reading it fails the copy keeps the error and
+// returns it after the buffered data, so that anything recording the copy knows it is incomplete
+func copyBody(body io.ReadCloser) (io.ReadCloser, io.ReadCloser) {
+	defer body.Close()
+
+	// Buffer body data
+	var bodyBuffer bytes.Buffer
+	bodyBuffer2 := new(bytes.Buffer)
+
+	_, err := io.Copy(&bodyBuffer, body)
+	*bodyBuffer2 = bodyBuffer
+
+	// Create new ReadClosers so we can split output
+	if err != nil {
+		return ioutil.NopCloser(&bodyBuffer), ioutil.NopCloser(io.MultiReader(bodyBuffer2, failedRead{err}))
 	}
+	return ioutil.NopCloser(&bodyBuffer), ioutil.NopCloser(bodyBuffer2)
+}
 
-	return resCopy
+// maxFormBodySize is the most of a form-encoded body GetFormValueFromBody will buffer
+const maxFormBodySize = 1 << 20
+
+// GetFormValueFromBody reads a field from a form-encoded request body, the body is restored
+// afterwards so that it reaches the upstream unchanged. Bodies larger than maxFormBodySize are
+// passed on without being parsed.
+func GetFormValueFromBody(r *http.Request, field string) string {
+	if r.Body == nil {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormBodySize+1))
+	if err != nil {
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		log.Error("Failed to read request body: ", err)
+		return ""
+	}
+	if len(body) > maxFormBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		log.Debug("Form body is too large to read a value from")
+		return ""
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ""
+	}
+
+	return values.Get(field)
+}
+
+// ParseIPNets turns a list of IPs and CIDR ranges into networks, single IPs become a network
+// of one address. Entries that can't be parsed are logged and skipped.
+func ParseIPNets(list []string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipNet)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			log.Error("Invalid IP or CIDR range, skipping: ", entry)
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return nets
+}
+
+// IPInNets returns true if the IP is part of any of the networks
+func IPInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetClientIP resolves the IP of the client that made the request. X-Forwarded-For is only used
+// when the request comes from one of the trusted_proxies, it is then read right to left and the
+// first address that isn't a trusted proxy is the client. A header sent on several lines is read
+// as one list.
+func GetClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	clientIP := net.ParseIP(host)
+	trustedProxies := config.trustedProxyNets
+	if clientIP == nil || len(trustedProxies) == 0 {
+		return host
+	}
+
+	if !IPInNets(clientIP, trustedProxies) {
+		return host
+	}
+
+	forwardedFor := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIP == nil {
+			break
+		}
+		clientIP = forwardedIP
+		if !IPInNets(clientIP, trustedProxies) {
+			break
+		}
+	}
+
+	return clientIP.String()
+}
+
+// IsSecureRequest is true if the client connected over TLS, either to us or to one of the
+// trusted_proxies that sent the request on with an X-Forwarded-Proto of https. Only the last value
+// is used, it is the one the nearest proxy set, the ones before it could come from the client.
+func IsSecureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxyIP := net.ParseIP(host)
+	if proxyIP == nil || !IPInNets(proxyIP, config.trustedProxyNets) {
+		return false
+	}
+
+	forwardedProto := strings.Split(strings.Join(r.Header["X-Forwarded-Proto"], ","), ",")
+	proto := forwardedProto[len(forwardedProto)-1]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
 }